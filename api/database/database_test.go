@@ -0,0 +1,18 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewDatabase_UnknownStoreType(t *testing.T) {
+	_, err := NewDatabase("sqlite", t.TempDir(), nil)
+	require.ErrorIs(t, err, ErrUnknownStoreType)
+	assert.Contains(t, err.Error(), "sqlite")
+
+	assert.NotContains(t, SupportedStoreTypes, "sqlite")
+	assert.Contains(t, SupportedStoreTypes, "boltdb")
+	assert.Contains(t, SupportedStoreTypes, "postgres")
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsStatusSuccess = "success"
+	metricsStatusError   = "error"
+)
+
+// MetricsMiddleware wraps a portainer.Connection and records the duration of the object
+// operations and of the transactions, labeled by outcome
+type MetricsMiddleware struct {
+	portainer.Connection
+
+	operations   *prometheus.HistogramVec
+	transactions *prometheus.HistogramVec
+}
+
+// metricsTransaction records the object operations made inside a transaction
+type metricsTransaction struct {
+	portainer.Transaction
+
+	operations *prometheus.HistogramVec
+}
+
+// NewMetricsMiddleware wraps conn so that its operations are recorded in histograms registered
+// with reg, prometheus.DefaultRegisterer is used when reg is nil. Wrapping several connections
+// with the same registerer shares the histograms.
+func NewMetricsMiddleware(conn portainer.Connection, reg prometheus.Registerer) portainer.Connection {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	operations := registerHistogram(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "portainer",
+		Subsystem: "database",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of the database object operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"table", "operation", "status"}))
+
+	transactions := registerHistogram(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "portainer",
+		Subsystem: "database",
+		Name:      "transaction_duration_seconds",
+		Help:      "Duration of the database transactions.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "status"}))
+
+	return &MetricsMiddleware{
+		Connection:   conn,
+		operations:   operations,
+		transactions: transactions,
+	}
+}
+
+// registerHistogram registers h, or returns the histogram already registered under the same name
+func registerHistogram(reg prometheus.Registerer, h *prometheus.HistogramVec) *prometheus.HistogramVec {
+	if err := reg.Register(h); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(*prometheus.HistogramVec); ok {
+				return existing
+			}
+		}
+
+		panic(err)
+	}
+
+	return h
+}
+
+// observe records the duration of an operation since start
+func observe(h *prometheus.HistogramVec, start time.Time, err error, labels ...string) {
+	status := metricsStatusSuccess
+	if err != nil {
+		status = metricsStatusError
+	}
+
+	h.WithLabelValues(append(labels, status)...).Observe(time.Since(start).Seconds())
+}
+
+func (m *MetricsMiddleware) UpdateTx(fn func(portainer.Transaction) error) (err error) {
+	defer func(start time.Time) { observe(m.transactions, start, err, "UpdateTx") }(time.Now())
+
+	return m.Connection.UpdateTx(func(tx portainer.Transaction) error {
+		return fn(&metricsTransaction{Transaction: tx, operations: m.operations})
+	})
+}
+
+func (m *MetricsMiddleware) ViewTx(fn func(portainer.Transaction) error) (err error) {
+	defer func(start time.Time) { observe(m.transactions, start, err, "ViewTx") }(time.Now())
+
+	return m.Connection.ViewTx(func(tx portainer.Transaction) error {
+		return fn(&metricsTransaction{Transaction: tx, operations: m.operations})
+	})
+}
+
+func (m *MetricsMiddleware) GetObject(bucketName string, key []byte, object any) (err error) {
+	defer func(start time.Time) { observe(m.operations, start, err, bucketName, "GetObject") }(time.Now())
+
+	return m.Connection.GetObject(bucketName, key, object)
+}
+
+func (m *MetricsMiddleware) UpdateObject(bucketName string, key []byte, object any) (err error) {
+	defer func(start time.Time) { observe(m.operations, start, err, bucketName, "UpdateObject") }(time.Now())
+
+	return m.Connection.UpdateObject(bucketName, key, object)
+}
+
+func (m *MetricsMiddleware) DeleteObject(bucketName string, key []byte) (err error) {
+	defer func(start time.Time) { observe(m.operations, start, err, bucketName, "DeleteObject") }(time.Now())
+
+	return m.Connection.DeleteObject(bucketName, key)
+}
+
+func (m *MetricsMiddleware) CreateObject(bucketName string, fn func(uint64) (int, any)) (err error) {
+	defer func(start time.Time) { observe(m.operations, start, err, bucketName, "CreateObject") }(time.Now())
+
+	return m.Connection.CreateObject(bucketName, fn)
+}
+
+func (m *MetricsMiddleware) CreateObjectWithId(bucketName string, id int, obj any) (err error) {
+	defer func(start time.Time) { observe(m.operations, start, err, bucketName, "CreateObjectWithId") }(time.Now())
+
+	return m.Connection.CreateObjectWithId(bucketName, id, obj)
+}
+
+func (m *MetricsMiddleware) CreateObjectWithStringId(bucketName string, id []byte, obj any) (err error) {
+	defer func(start time.Time) { observe(m.operations, start, err, bucketName, "CreateObjectWithStringId") }(time.Now())
+
+	return m.Connection.CreateObjectWithStringId(bucketName, id, obj)
+}
+
+func (m *MetricsMiddleware) GetAll(bucketName string, obj any, appendFn func(o any) (any, error)) (err error) {
+	defer func(start time.Time) { observe(m.operations, start, err, bucketName, "GetAll") }(time.Now())
+
+	return m.Connection.GetAll(bucketName, obj, appendFn)
+}
+
+func (tx *metricsTransaction) GetObject(bucketName string, key []byte, object any) (err error) {
+	defer func(start time.Time) { observe(tx.operations, start, err, bucketName, "GetObject") }(time.Now())
+
+	return tx.Transaction.GetObject(bucketName, key, object)
+}
+
+func (tx *metricsTransaction) UpdateObject(bucketName string, key []byte, object any) (err error) {
+	defer func(start time.Time) { observe(tx.operations, start, err, bucketName, "UpdateObject") }(time.Now())
+
+	return tx.Transaction.UpdateObject(bucketName, key, object)
+}
+
+func (tx *metricsTransaction) DeleteObject(bucketName string, key []byte) (err error) {
+	defer func(start time.Time) { observe(tx.operations, start, err, bucketName, "DeleteObject") }(time.Now())
+
+	return tx.Transaction.DeleteObject(bucketName, key)
+}
+
+func (tx *metricsTransaction) CreateObject(bucketName string, fn func(uint64) (int, any)) (err error) {
+	defer func(start time.Time) { observe(tx.operations, start, err, bucketName, "CreateObject") }(time.Now())
+
+	return tx.Transaction.CreateObject(bucketName, fn)
+}
+
+func (tx *metricsTransaction) CreateObjectWithId(bucketName string, id int, obj any) (err error) {
+	defer func(start time.Time) { observe(tx.operations, start, err, bucketName, "CreateObjectWithId") }(time.Now())
+
+	return tx.Transaction.CreateObjectWithId(bucketName, id, obj)
+}
+
+func (tx *metricsTransaction) CreateObjectWithStringId(bucketName string, id []byte, obj any) (err error) {
+	defer func(start time.Time) { observe(tx.operations, start, err, bucketName, "CreateObjectWithStringId") }(time.Now())
+
+	return tx.Transaction.CreateObjectWithStringId(bucketName, id, obj)
+}
+
+func (tx *metricsTransaction) GetAll(bucketName string, obj any, appendFn func(o any) (any, error)) (err error) {
+	defer func(start time.Time) { observe(tx.operations, start, err, bucketName, "GetAll") }(time.Now())
+
+	return tx.Transaction.GetAll(bucketName, obj, appendFn)
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errFake = errors.New("fake error")
+
+// fakeConnection fails the operations on the "broken" bucket
+type fakeConnection struct {
+	portainer.Connection
+}
+
+func (c *fakeConnection) GetObject(bucketName string, key []byte, object any) error {
+	if bucketName == "broken" {
+		return errFake
+	}
+
+	return nil
+}
+
+func (c *fakeConnection) UpdateObject(bucketName string, key []byte, object any) error {
+	return nil
+}
+
+func (c *fakeConnection) UpdateTx(fn func(portainer.Transaction) error) error {
+	return fn(&fakeTransaction{})
+}
+
+type fakeTransaction struct {
+	portainer.Transaction
+}
+
+func (tx *fakeTransaction) DeleteObject(bucketName string, key []byte) error {
+	return errFake
+}
+
+// observations returns the number of observations of the histogram series matching the labels
+func observations(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) uint64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+
+	return 0
+}
+
+func Test_MetricsMiddleware(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	conn := NewMetricsMiddleware(&fakeConnection{}, reg)
+
+	require.NoError(t, conn.GetObject("endpoints", []byte("1"), nil))
+	require.NoError(t, conn.GetObject("endpoints", []byte("2"), nil))
+	require.ErrorIs(t, conn.GetObject("broken", []byte("1"), nil), errFake)
+	require.NoError(t, conn.UpdateObject("settings", []byte("1"), nil))
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.DeleteObject("users", []byte("1"))
+	})
+	require.ErrorIs(t, err, errFake)
+
+	const operations = "portainer_database_operation_duration_seconds"
+	const transactions = "portainer_database_transaction_duration_seconds"
+
+	assert.Equal(t, 4, testutil.CollectAndCount(reg, operations))
+	assert.Equal(t, uint64(2), observations(t, reg, operations, map[string]string{"table": "endpoints", "operation": "GetObject", "status": "success"}))
+	assert.Equal(t, uint64(1), observations(t, reg, operations, map[string]string{"table": "broken", "operation": "GetObject", "status": "error"}))
+	assert.Equal(t, uint64(1), observations(t, reg, operations, map[string]string{"table": "settings", "operation": "UpdateObject", "status": "success"}))
+	assert.Equal(t, uint64(1), observations(t, reg, operations, map[string]string{"table": "users", "operation": "DeleteObject", "status": "error"}))
+
+	assert.Equal(t, 1, testutil.CollectAndCount(reg, transactions))
+	assert.Equal(t, uint64(1), observations(t, reg, transactions, map[string]string{"operation": "UpdateTx", "status": "error"}))
+}
+
+func Test_NewMetricsMiddleware_SharesHistograms(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	first := NewMetricsMiddleware(&fakeConnection{}, reg)
+	second := NewMetricsMiddleware(&fakeConnection{}, reg)
+
+	require.NoError(t, first.GetObject("endpoints", nil, nil))
+	require.NoError(t, second.GetObject("endpoints", nil, nil))
+
+	assert.Equal(t, uint64(2), observations(t, reg, "portainer_database_operation_duration_seconds", map[string]string{"table": "endpoints", "operation": "GetObject", "status": "success"}))
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/portainer/portainer/api/database/postgres"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MigrationProgress is called after each migrated bucket with the number of keys
+// migrated and skipped so far and the total number of keys of the BoltDB file
+type MigrationProgress func(bucket string, migrated, skipped, total int)
+
+// MigrationOption configures MigrateFromBoltDB
+type MigrationOption func(*boltMigration)
+
+type boltMigration struct {
+	progress MigrationProgress
+	dryRun   bool
+}
+
+// WithMigrationProgress reports the progress of the migration to fn
+func WithMigrationProgress(fn MigrationProgress) MigrationOption {
+	return func(m *boltMigration) {
+		m.progress = fn
+	}
+}
+
+// WithDryRun reads and decodes the whole BoltDB file without writing anything to PostgreSQL
+func WithDryRun() MigrationOption {
+	return func(m *boltMigration) {
+		m.dryRun = true
+	}
+}
+
+// MigrateFromBoltDB copies every bucket of a BoltDB file into the matching PostgreSQL table.
+// The values are decrypted with encryptionKey when it is set and are written through pgConn,
+// which encodes them with its own key. Keys that are not integers cannot be stored in the
+// integer id column and are skipped with a warning.
+func MigrateFromBoltDB(ctx context.Context, boltPath string, pgConn *postgres.DbConnection, encryptionKey []byte, opts ...MigrationOption) error {
+	m := &boltMigration{}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if pgConn == nil && !m.dryRun {
+		return postgres.ErrNoConnection
+	}
+
+	db, err := bolt.Open(boltPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open BoltDB file %s: %w", boltPath, err)
+	}
+	defer db.Close()
+
+	// The BoltDB values use the same encoding as the postgres store
+	decoder := &postgres.DbConnection{EncryptionKey: encryptionKey}
+	decoder.SetEncrypted(encryptionKey != nil)
+
+	return db.View(func(boltTx *bolt.Tx) error {
+		total := 0
+		if err := boltTx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			total += b.Stats().KeyN
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		migrated, skipped := 0, 0
+
+		return boltTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bucket := string(name)
+
+			objects := make(map[int]any)
+			if err := b.ForEach(func(k, v []byte) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				// Nested buckets are not used by Portainer
+				if v == nil {
+					return nil
+				}
+
+				id, ok := boltKeyToID(k)
+				if !ok {
+					log.Warn().Str("bucket", bucket).Str("key", string(k)).Msg("skipping a key that is not an integer")
+					skipped++
+					return nil
+				}
+
+				object, err := decodeBoltValue(decoder, v)
+				if err != nil {
+					return fmt.Errorf("failed to decode key %d of bucket %s: %w", id, bucket, err)
+				}
+
+				objects[id] = object
+
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if !m.dryRun && len(objects) > 0 {
+				if err := pgConn.EnsureTableExists(ctx, bucket, nil); err != nil {
+					return err
+				}
+
+				if err := pgConn.UpdateTx(func(tx portainer.Transaction) error {
+					for id, object := range objects {
+						if err := tx.CreateObjectWithId(bucket, id, object); err != nil {
+							return fmt.Errorf("failed to migrate key %d of bucket %s: %w", id, bucket, err)
+						}
+					}
+
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+
+			migrated += len(objects)
+
+			log.Info().Str("bucket", bucket).Int("keys", len(objects)).Bool("dry_run", m.dryRun).Msg("bucket migrated")
+
+			if m.progress != nil {
+				m.progress(bucket, migrated, skipped, total)
+			}
+
+			return nil
+		})
+	})
+}
+
+// boltKeyToID converts a BoltDB key, either the encoding of ConvertToKey or a decimal string, to an id
+func boltKeyToID(key []byte) (int, bool) {
+	if len(key) > 0 && bytes.IndexFunc(key, func(r rune) bool { return r < '0' || r > '9' }) == -1 {
+		id, err := strconv.Atoi(string(key))
+		return id, err == nil
+	}
+
+	if len(key) == 8 {
+		return int(binary.BigEndian.Uint64(key)), true
+	}
+
+	return 0, false
+}
+
+// decodeBoltValue decrypts a value and returns it as JSON, values that are not JSON documents
+// such as the version strings are returned as strings
+func decodeBoltValue(decoder *postgres.DbConnection, value []byte) (any, error) {
+	var object json.RawMessage
+	if err := decoder.UnmarshalObject(value, &object); err == nil && json.Valid(object) {
+		return object, nil
+	}
+
+	var s string
+	if err := decoder.UnmarshalObject(value, &s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/portainer/portainer/api/database/postgres"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// createBoltFixture writes a BoltDB file with the given buckets, the values are encoded
+// like the Portainer store does, with encryptionKey when it is set
+func createBoltFixture(t *testing.T, encryptionKey []byte, buckets map[string]map[string]any) string {
+	t.Helper()
+
+	encoder := &postgres.DbConnection{EncryptionKey: encryptionKey}
+	encoder.SetEncrypted(encryptionKey != nil)
+
+	path := filepath.Join(t.TempDir(), "portainer.db")
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for name, values := range buckets {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			for key, value := range values {
+				data, err := encoder.MarshalObject(value)
+				if err != nil {
+					return err
+				}
+
+				if err := b.Put([]byte(key), data); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return path
+}
+
+func boltKey(id int) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return string(b)
+}
+
+func Test_MigrateFromBoltDB_DryRun(t *testing.T) {
+	hash := sha256.Sum256([]byte("secret"))
+	key := hash[:]
+
+	path := createBoltFixture(t, key, map[string]map[string]any{
+		"endpoints": {
+			boltKey(1): map[string]any{"Name": "local"},
+			boltKey(2): map[string]any{"Name": "remote"},
+		},
+		"version": {
+			"VERSION": map[string]any{"SchemaVersion": "2.21.0"},
+		},
+	})
+
+	type progress struct {
+		migrated, skipped, total int
+	}
+	reported := map[string]progress{}
+
+	err := MigrateFromBoltDB(context.Background(), path, nil, key,
+		WithDryRun(),
+		WithMigrationProgress(func(bucket string, migrated, skipped, total int) {
+			reported[bucket] = progress{migrated, skipped, total}
+		}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]progress{
+		"endpoints": {2, 0, 3},
+		"version":   {2, 1, 3},
+	}, reported)
+}
+
+func Test_MigrateFromBoltDB_WrongKey(t *testing.T) {
+	hash := sha256.Sum256([]byte("secret"))
+	path := createBoltFixture(t, hash[:], map[string]map[string]any{
+		"endpoints": {boltKey(1): map[string]any{"Name": "local"}},
+	})
+
+	wrong := sha256.Sum256([]byte("wrong"))
+	err := MigrateFromBoltDB(context.Background(), path, nil, wrong[:], WithDryRun())
+	assert.Error(t, err)
+}
+
+func Test_MigrateFromBoltDB(t *testing.T) {
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	conn, err := postgres.NewConnection(connStr, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	t.Cleanup(func() {
+		for _, table := range []string{"bolt_endpoints", "bolt_users"} {
+			conn.Exec("DROP TABLE IF EXISTS " + table)
+		}
+	})
+
+	path := createBoltFixture(t, nil, map[string]map[string]any{
+		"bolt_endpoints": {
+			boltKey(1): map[string]any{"Name": "local"},
+			boltKey(2): map[string]any{"Name": "remote"},
+		},
+		"bolt_users": {
+			"3": map[string]any{"Username": "admin"},
+		},
+	})
+
+	require.NoError(t, MigrateFromBoltDB(context.Background(), path, conn, nil))
+
+	var endpoint map[string]any
+	require.NoError(t, conn.GetObject("bolt_endpoints", conn.ConvertToKey(2), &endpoint))
+	assert.Equal(t, "remote", endpoint["Name"])
+
+	var user map[string]any
+	require.NoError(t, conn.GetObject("bolt_users", []byte("3"), &user))
+	assert.Equal(t, "admin", user["Username"])
+
+	var count int
+	require.NoError(t, conn.Get(&count, "SELECT COUNT(*) FROM bolt_endpoints"))
+	assert.Equal(t, 2, count)
+}
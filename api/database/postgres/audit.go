@@ -0,0 +1,318 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// AuditTable records the objects created, updated and deleted when the audit log is enabled
+// by WithAuditLog. The entries are written by the statements of the connection, PostgresStore
+// included, and tell who changed which object, without its content.
+const AuditTable = "portainer_audit"
+
+// AuditLogTable records the content of the objects before and after every change once
+// EnableAuditLog is called. The entries are written by triggers, so that the changes made by raw
+// SQL are recorded as well. The two logs are enabled separately and complement each other, the
+// changes made through the connection are attributed to the same actor in both, see
+// DbTransaction.WithActor.
+const AuditLogTable = "audit_log"
+
+const (
+	auditTriggerName  = "portainer_audit_log"
+	auditFunctionName = "portainer_log_audit"
+)
+
+// auditSweepInterval is the interval between the deletions of the audit entries past their retention
+const auditSweepInterval = time.Hour
+
+// The operations recorded in AuditTable
+const (
+	AuditOperationCreate = "create"
+	AuditOperationUpdate = "update"
+	AuditOperationDelete = "delete"
+)
+
+// AuditEntry records a change of an object, without its content
+type AuditEntry struct {
+	ID        int64     `db:"id"`
+	Bucket    string    `db:"bucket"`
+	Key       string    `db:"object_key"`
+	Operation string    `db:"operation"`
+	Actor     string    `db:"actor"`
+	ChangedAt time.Time `db:"changed_at"`
+}
+
+type auditActorKey struct{}
+
+// WithAuditLog makes the transactions record the objects they create, update and delete in
+// AuditTable, along with the actor set by WithActor or WithAuditActor. The entries are written by the
+// transaction making the change, so that they are rolled back with it. The entries older than
+// retention are deleted in the background, they are kept forever when retention is 0.
+func WithAuditLog(retention time.Duration) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.auditLog = true
+		connection.auditRetention = retention
+	}
+}
+
+// WithAuditActor returns a copy of ctx whose transactions record actor as the author of their
+// changes in the audit log
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// auditActor returns the actor carried by ctx, it is NULL when there is none
+func auditActor(ctx context.Context) sql.NullString {
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+
+	return sql.NullString{String: actor, Valid: actor != ""}
+}
+
+// ensureAuditTable creates AuditTable unless it exists
+func (connection *DbConnection) ensureAuditTable(ctx context.Context, db sqlx.ExecerContext) error {
+	table := connection.table(AuditTable)
+
+	query := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id BIGSERIAL PRIMARY KEY,
+			bucket TEXT NOT NULL,
+			object_key TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			actor TEXT,
+			changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS %[1]s_changed_at_idx ON %[1]s (changed_at)`, table)
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// audit records the change of an object in AuditTable when the audit log is enabled
+func (tx *DbTransaction) audit(ctx context.Context, bucketName, key, operation string) error {
+	if !tx.conn.auditLog {
+		return nil
+	}
+
+	actor := tx.actor()
+
+	query := fmt.Sprintf("INSERT INTO %s (bucket, object_key, operation, actor) VALUES ($1, $2, $3, $4)", tx.conn.table(AuditTable))
+	if _, err := tx.tx.ExecContext(ctx, query, bucketName, key, operation, sql.NullString{String: actor, Valid: actor != ""}); err != nil {
+		return fmt.Errorf("failed to record the %s of %s/%s in the audit log: %w", operation, bucketName, key, err)
+	}
+
+	return nil
+}
+
+// GetAuditEntries returns the audit entries of a bucket, or of every bucket when it is empty,
+// recorded since the given time in the order of the changes. At most limit entries are returned
+// unless it is 0.
+func (connection *DbConnection) GetAuditEntries(bucketName string, since time.Time, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+
+	err := connection.tracedViewTx("GetAuditEntries", AuditTable, func(tx *DbTransaction) error {
+		query := fmt.Sprintf(`
+			SELECT id, bucket, object_key, operation, COALESCE(actor, '') AS actor, changed_at
+			FROM %s
+			WHERE ($1 = '' OR bucket = $1) AND changed_at >= $2
+			ORDER BY id`, connection.table(AuditTable))
+		args := []any{bucketName, since}
+
+		if limit > 0 {
+			query += " LIMIT $3"
+			args = append(args, limit)
+		}
+
+		return tx.tx.SelectContext(tx.context(), &entries, query, args...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// PruneAuditLog deletes the audit entries older than the retention of the audit log and
+// returns how many were deleted
+func (connection *DbConnection) PruneAuditLog(ctx context.Context) (int64, error) {
+	if !connection.auditLog || connection.auditRetention <= 0 {
+		return 0, nil
+	}
+
+	if connection.DB == nil {
+		return 0, ErrNoConnection
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE changed_at < now() - make_interval(secs => $1)", connection.table(AuditTable))
+	result, err := connection.DB.ExecContext(ctx, query, connection.auditRetention.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune the audit log: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// sweepAuditLog prunes the audit log every auditSweepInterval until ctx is done
+func (connection *DbConnection) sweepAuditLog(ctx context.Context) {
+	ticker := time.NewTicker(auditSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := connection.PruneAuditLog(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Warn().Str("component", "postgres").Err(err).Msg("failed to prune the audit log")
+			} else if deleted > 0 {
+				log.Debug().Str("component", "postgres").Int64("deleted", deleted).Msg("pruned the audit log")
+			}
+		}
+	}
+}
+
+// EnableAuditLog creates AuditLogTable and installs a trigger on every managed table recording
+// the inserted, updated and deleted rows along with their data before and after the change.
+// Unlike WithAuditLog, the changes made by raw SQL are recorded as well. The encrypted objects
+// are recorded as their ciphertext. Tables created afterwards through the connection are
+// audited as well.
+//
+// The author of the changes is the ChangedBy of the transaction, set by WithActor, or else the
+// actor set by WithAuditActor. It is written by a BeforeCommit hook of every transaction.
+func (connection *DbConnection) EnableAuditLog(ctx context.Context) (err error) {
+	ctx, end := connection.startSpan(ctx, "EnableAuditLog", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	_, err = connection.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id BIGSERIAL PRIMARY KEY,
+			table_name TEXT NOT NULL,
+			row_id TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			old_data JSONB,
+			new_data JSONB,
+			changed_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp(),
+			changed_by TEXT,
+			transaction_id BIGINT NOT NULL DEFAULT txid_current()
+		);
+		CREATE INDEX IF NOT EXISTS %[1]s_changed_at_idx ON %[1]s (changed_at);
+		CREATE INDEX IF NOT EXISTS %[1]s_transaction_id_idx ON %[1]s (transaction_id);
+	`, connection.table(AuditLogTable)))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", connection.table(AuditLogTable), err)
+	}
+
+	_, err = connection.ExecContext(ctx, fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				INSERT INTO %[2]s (table_name, row_id, operation, old_data)
+				VALUES (TG_TABLE_NAME, OLD.id::text, TG_OP, to_jsonb(OLD) -> 'data');
+				RETURN OLD;
+			END IF;
+
+			IF TG_OP = 'UPDATE' THEN
+				INSERT INTO %[2]s (table_name, row_id, operation, old_data, new_data)
+				VALUES (TG_TABLE_NAME, NEW.id::text, TG_OP, to_jsonb(OLD) -> 'data', to_jsonb(NEW) -> 'data');
+				RETURN NEW;
+			END IF;
+
+			INSERT INTO %[2]s (table_name, row_id, operation, new_data)
+			VALUES (TG_TABLE_NAME, NEW.id::text, TG_OP, to_jsonb(NEW) -> 'data');
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql
+	`, connection.table(auditFunctionName), connection.table(AuditLogTable)))
+	if err != nil {
+		return fmt.Errorf("failed to create the audit log function: %w", err)
+	}
+
+	tables, err := connection.managedTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if err := connection.installAuditTrigger(ctx, connection.DB, table); err != nil {
+			return err
+		}
+	}
+
+	connection.auditTriggers = true
+
+	log.Info().Str("component", "postgres").Int("tables", len(tables)).Msg("audit log enabled")
+
+	return nil
+}
+
+// installAuditTrigger adds the audit log trigger to the table of a bucket unless it is already present
+func (connection *DbConnection) installAuditTrigger(ctx context.Context, execer sqlx.ExecerContext, bucketName string) error {
+	table := connection.table(bucketName)
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	_, err := execer.ExecContext(ctx, fmt.Sprintf(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = '%[1]s' AND tgrelid = '%[2]s'::regclass) THEN
+				CREATE TRIGGER %[1]s AFTER INSERT OR UPDATE OR DELETE ON %[2]s
+				FOR EACH ROW EXECUTE FUNCTION %[3]s();
+			END IF;
+		END
+		$$
+	`, auditTriggerName, table, connection.table(auditFunctionName)))
+	if err != nil {
+		return fmt.Errorf("failed to install the audit log trigger on %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// WithActor sets the author of the changes of the transaction recorded in AuditTable and
+// AuditLogTable, it takes precedence over the actor set by WithAuditActor
+func (tx *DbTransaction) WithActor(actor string) *DbTransaction {
+	tx.ChangedBy = actor
+
+	return tx
+}
+
+// actor returns the author of the changes of the transaction, the ChangedBy set by WithActor or
+// else the actor set by WithAuditActor. It is empty when there is none.
+func (tx *DbTransaction) actor() string {
+	if tx.ChangedBy != "" {
+		return tx.ChangedBy
+	}
+
+	return auditActor(tx.context()).String
+}
+
+// recordAuditLogActor sets the author of the changes recorded in AuditLogTable by the
+// transaction, it is registered by beginTx as a BeforeCommit hook once EnableAuditLog is called
+func (tx *DbTransaction) recordAuditLogActor() error {
+	actor := tx.actor()
+	if actor == "" || tx.readOnly {
+		return nil
+	}
+
+	// txid_current_if_assigned is NULL for the transactions that changed nothing
+	query := fmt.Sprintf(`
+		UPDATE %s SET changed_by = $1
+		WHERE transaction_id = txid_current_if_assigned() AND changed_by IS NULL`, tx.conn.table(AuditLogTable))
+	if _, err := tx.tx.ExecContext(tx.context(), query, actor); err != nil {
+		return fmt.Errorf("failed to record the author of the changes in the audit log: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,339 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func expectAudit(mock sqlmock.Sqlmock, bucket, key, operation string, actor any) {
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO portainer_audit (bucket, object_key, operation, actor) VALUES ($1, $2, $3, $4)")).
+		WithArgs(bucket, key, operation, actor).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func Test_AuditLog(t *testing.T) {
+	t.Run("entries written within the transaction", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		WithAuditLog(0)(conn)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (id, data) VALUES ($1, $2)")).WithArgs(1, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, "users", "1", AuditOperationCreate, "admin")
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs(sqlmock.AnyArg(), 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, "users", "1", AuditOperationUpdate, "admin")
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, "users", "1", AuditOperationDelete, "admin")
+		mock.ExpectCommit()
+
+		ctx := WithAuditActor(context.Background(), "admin")
+		err := conn.UpdateTxCtx(ctx, func(ctx context.Context, tx portainer.Transaction) error {
+			if err := tx.CreateObjectWithId("users", 1, map[string]string{"Username": "admin"}); err != nil {
+				return err
+			}
+
+			if err := tx.UpdateObject("users", conn.ConvertToKey(1), map[string]string{"Username": "root"}); err != nil {
+				return err
+			}
+
+			return tx.DeleteObject("users", conn.ConvertToKey(1))
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rolled back with the transaction", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		WithAuditLog(0)(conn)
+		errAbort := errors.New("abort")
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, "users", "1", AuditOperationDelete, nil)
+		mock.ExpectRollback()
+
+		err := conn.UpdateTx(func(tx portainer.Transaction) error {
+			if err := tx.DeleteObject("users", conn.ConvertToKey(1)); err != nil {
+				return err
+			}
+
+			return errAbort
+		})
+		require.ErrorIs(t, err, errAbort)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("entries written by the store", func(t *testing.T) {
+		store, mock := newMockStore(t)
+		conn := store.conn
+		WithAuditLog(0)(conn)
+		conn.trackDeletions = true
+
+		mock.ExpectBegin()
+		expectBucketExists(mock, "endpoints", true)
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO endpoints (id, data)")).WithArgs(1, []byte(`{"Id":1}`)).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+		expectAudit(mock, "endpoints", "1", AuditOperationCreate, "admin")
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO endpoints (id, data)")).WithArgs(1, []byte(`{"Id":2}`)).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(false))
+		expectAudit(mock, "endpoints", "1", AuditOperationUpdate, "admin")
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM endpoints WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO deletions (bucket, object_key)")).WithArgs("endpoints", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, "endpoints", "1", AuditOperationDelete, "admin")
+		mock.ExpectCommit()
+
+		err := store.Update(func(tx *PostgresTx) error {
+			tx.tx.WithActor("admin")
+			b := tx.Bucket([]byte("endpoints"))
+
+			if err := b.Put(conn.ConvertToKey(1), []byte(`{"Id":1}`)); err != nil {
+				return err
+			}
+
+			if err := b.Put(conn.ConvertToKey(1), []byte(`{"Id":2}`)); err != nil {
+				return err
+			}
+
+			return b.Delete(conn.ConvertToKey(1))
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("actor set by WithActor", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		WithAuditLog(0)(conn)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectAudit(mock, "users", "1", AuditOperationDelete, "root")
+		mock.ExpectCommit()
+
+		ctx := WithAuditActor(context.Background(), "admin")
+		err := conn.UpdateTxCtx(ctx, func(ctx context.Context, tx portainer.Transaction) error {
+			return tx.(*DbTransaction).WithActor("root").DeleteObject("users", conn.ConvertToKey(1))
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.DeleteObject("users", conn.ConvertToKey(1)))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_PruneAuditLog(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	deleted, err := conn.PruneAuditLog(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	WithAuditLog(24 * time.Hour)(conn)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM portainer_audit WHERE changed_at < now() - make_interval(secs => $1)")).
+		WithArgs(float64(24 * 60 * 60)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	deleted, err = conn.PruneAuditLog(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, deleted)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_AuditLog_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t, WithAuditLog(time.Hour))
+	dropTestTables(t, conn, "audit_test", AuditTable)
+
+	start := time.Now().Add(-time.Second)
+	ctx := WithAuditActor(context.Background(), "admin")
+
+	err := conn.UpdateTxCtx(ctx, func(ctx context.Context, tx portainer.Transaction) error {
+		if err := tx.SetServiceName("audit_test"); err != nil {
+			return err
+		}
+
+		if err := tx.CreateObjectWithId("audit_test", 1, map[string]string{"Password": "secret"}); err != nil {
+			return err
+		}
+
+		return tx.UpdateObject("audit_test", conn.ConvertToKey(1), map[string]string{"Password": "changed"})
+	})
+	require.NoError(t, err)
+
+	err = conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.DeleteObject("audit_test", conn.ConvertToKey(1)); err != nil {
+			return err
+		}
+
+		return errors.New("abort")
+	})
+	require.Error(t, err)
+
+	entries, err := conn.GetAuditEntries("audit_test", start, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, AuditOperationCreate, entries[0].Operation)
+	assert.Equal(t, AuditOperationUpdate, entries[1].Operation)
+	for _, entry := range entries {
+		assert.Equal(t, "1", entry.Key)
+		assert.Equal(t, "admin", entry.Actor)
+	}
+
+	entries, err = conn.GetAuditEntries("", start, 1)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = conn.Exec("UPDATE " + AuditTable + " SET changed_at = now() - interval '2 hours'")
+	require.NoError(t, err)
+
+	deleted, err := conn.PruneAuditLog(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, deleted)
+}
+
+func Test_EnableAuditLog(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS audit_log")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE OR REPLACE FUNCTION portainer_log_audit()")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT table_name").WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("users"))
+	mock.ExpectExec("CREATE TRIGGER portainer_audit_log AFTER INSERT OR UPDATE OR DELETE ON users").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	require.NoError(t, conn.EnableAuditLog(context.Background()))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	const recordActor = "UPDATE audit_log SET changed_by = $1"
+
+	t.Run("actor of the transaction", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(recordActor)).WithArgs("admin").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		ctx := WithAuditActor(context.Background(), "ignored")
+		err := conn.UpdateTxCtx(ctx, func(ctx context.Context, tx portainer.Transaction) error {
+			return tx.(*DbTransaction).WithActor("admin").DeleteObject("users", conn.ConvertToKey(1))
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("actor of the context", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(recordActor)).WithArgs("operator").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		ctx := WithAuditActor(context.Background(), "operator")
+		err := conn.UpdateTxCtx(ctx, func(ctx context.Context, tx portainer.Transaction) error {
+			return tx.DeleteObject("users", conn.ConvertToKey(1))
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no actor", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.DeleteObject("users", conn.ConvertToKey(1)))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_EnableAuditLog_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "audit_log_test")
+	t.Cleanup(func() {
+		// the function is dropped first along with the triggers using it
+		if _, err := conn.Exec("DROP FUNCTION IF EXISTS " + auditFunctionName + "() CASCADE; DROP TABLE IF EXISTS " + AuditLogTable); err != nil {
+			t.Errorf("failed to drop the audit log: %v", err)
+		}
+	})
+
+	require.NoError(t, conn.SetServiceName("audit_log_test"))
+	require.NoError(t, conn.EnableAuditLog(context.Background()))
+
+	type entry struct {
+		Operation string         `db:"operation"`
+		RowID     string         `db:"row_id"`
+		OldData   sql.NullString `db:"old_data"`
+		NewData   sql.NullString `db:"new_data"`
+		ChangedBy sql.NullString `db:"changed_by"`
+	}
+
+	entries := func() []entry {
+		var entries []entry
+		require.NoError(t, conn.Select(&entries, "SELECT operation, row_id, old_data, new_data, changed_by FROM "+AuditLogTable+
+			" WHERE table_name = 'audit_log_test' ORDER BY id"))
+
+		return entries
+	}
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		pgTx := tx.(*DbTransaction).WithActor("admin")
+
+		if err := pgTx.CreateObjectWithId("audit_log_test", 1, map[string]string{"Name": "first"}); err != nil {
+			return err
+		}
+
+		if err := pgTx.UpdateObject("audit_log_test", conn.ConvertToKey(1), map[string]string{"Name": "second"}); err != nil {
+			return err
+		}
+
+		return pgTx.DeleteObject("audit_log_test", conn.ConvertToKey(1))
+	})
+	require.NoError(t, err)
+
+	valid := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	admin := valid("admin")
+	assert.Equal(t, []entry{
+		{Operation: "INSERT", RowID: "1", NewData: valid(`{"Name": "first"}`), ChangedBy: admin},
+		{Operation: "UPDATE", RowID: "1", OldData: valid(`{"Name": "first"}`), NewData: valid(`{"Name": "second"}`), ChangedBy: admin},
+		{Operation: "DELETE", RowID: "1", OldData: valid(`{"Name": "second"}`), ChangedBy: admin},
+	}, entries())
+
+	// the entry of a nested transaction is rolled back with the outer transaction
+	errAbort := errors.New("abort")
+	err = conn.UpdateTxCtx(context.Background(), func(ctx context.Context, tx portainer.Transaction) error {
+		err := conn.UpdateTxCtx(ctx, func(ctx context.Context, tx portainer.Transaction) error {
+			return tx.CreateObjectWithId("audit_log_test", 2, map[string]string{"Name": "third"})
+		})
+		if err != nil {
+			return err
+		}
+
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	assert.Len(t, entries(), 3)
+}
@@ -0,0 +1,463 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ChangeLogTable records the rows modified in the managed tables once change tracking is enabled
+	ChangeLogTable = "change_log"
+
+	changeTriggerName  = "portainer_change_log"
+	changeFunctionName = "portainer_log_change"
+
+	backupOperationDelete = "delete"
+
+	backupChecksumAlgorithm = "sha256"
+)
+
+var ErrBackupCorrupted = errors.New("the backup is corrupted")
+
+// backupRecord is a single line of a backup stream, it either holds the manifest of the
+// backup, describes the columns of a table or holds the content of one of its rows
+type backupRecord struct {
+	Manifest  *Manifest       `json:"manifest,omitempty"`
+	Table     string          `json:"table,omitempty"`
+	Columns   []string        `json:"columns,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Operation string          `json:"op,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// isRow returns whether the record holds a row or its deletion
+func (record backupRecord) isRow() bool {
+	return record.Manifest == nil && record.Columns == nil
+}
+
+// backupFooter is the last line of a backup stream, the checksum covers every byte written before it
+type backupFooter struct {
+	Checksum  string `json:"checksum"`
+	Algorithm string `json:"algorithm"`
+	RowCount  int    `json:"row_count"`
+}
+
+// backupWriter encodes the backup records while hashing the written bytes
+type backupWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	enc  *json.Encoder
+	rows int
+}
+
+func newBackupWriter(w io.Writer) *backupWriter {
+	h := sha256.New()
+
+	return &backupWriter{
+		w:    w,
+		hash: h,
+		enc:  json.NewEncoder(io.MultiWriter(w, h)),
+	}
+}
+
+func (bw *backupWriter) write(record backupRecord) error {
+	if record.isRow() {
+		bw.rows++
+	}
+
+	return bw.enc.Encode(record)
+}
+
+// checksum returns the hex encoded checksum of the bytes written so far
+func (bw *backupWriter) checksum() string {
+	return hex.EncodeToString(bw.hash.Sum(nil))
+}
+
+// close appends the checksum footer
+func (bw *backupWriter) close() error {
+	return json.NewEncoder(bw.w).Encode(backupFooter{
+		Checksum:  bw.checksum(),
+		Algorithm: backupChecksumAlgorithm,
+		RowCount:  bw.rows,
+	})
+}
+
+// VerifyBackup checks a backup written by BackupTo or BackupIncremental against its
+// checksum footer, it returns ErrBackupCorrupted when they do not match
+func (connection *DbConnection) VerifyBackup(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	h := sha256.New()
+	rows := 0
+
+	var previous []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if previous != nil {
+				h.Write(previous)
+
+				var record backupRecord
+				if err := json.Unmarshal(previous, &record); err != nil {
+					return fmt.Errorf("%w: invalid record: %w", ErrBackupCorrupted, err)
+				}
+
+				if record.isRow() {
+					rows++
+				}
+			}
+
+			previous = line
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+	}
+
+	var footer backupFooter
+	if previous == nil || json.Unmarshal(bytes.TrimSpace(previous), &footer) != nil || footer.Checksum == "" {
+		return fmt.Errorf("%w: missing checksum footer", ErrBackupCorrupted)
+	}
+
+	if footer.Algorithm != backupChecksumAlgorithm {
+		return fmt.Errorf("unsupported backup checksum algorithm %q", footer.Algorithm)
+	}
+
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != footer.Checksum {
+		return fmt.Errorf("%w: checksum mismatch (expected %s, computed %s)", ErrBackupCorrupted, footer.Checksum, checksum)
+	}
+
+	if rows != footer.RowCount {
+		return fmt.Errorf("%w: expected %d rows, found %d", ErrBackupCorrupted, footer.RowCount, rows)
+	}
+
+	return nil
+}
+
+// managedTables lists the buckets, that is the tables of the prefix having both an id and a data column
+func (connection *DbConnection) managedTables(ctx context.Context) ([]string, error) {
+	return connection.listBuckets(ctx, connection.DB)
+}
+
+// tableColumns returns the tables of the prefix by bucket name, along with their columns
+// described as "name data_type"
+func (connection *DbConnection) tableColumns(ctx context.Context, q sqlx.QueryerContext) ([]string, map[string][]string, error) {
+	rows, err := q.QueryxContext(ctx, `
+		SELECT 
+			table_schema,
+			table_name,
+			column_name,
+			data_type
+		FROM 
+			information_schema.columns
+		WHERE 
+			table_schema = current_schema()
+		ORDER BY 
+			table_name, ordinal_position
+	`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query schema: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	schemas := make(map[string][]string)
+	for rows.Next() {
+		var schema, table, column, dataType string
+		if err := rows.Scan(&schema, &table, &column, &dataType); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan schema row: %w", err)
+		}
+
+		table, ok := connection.bucketOf(table)
+		if !ok {
+			continue
+		}
+
+		if _, ok := schemas[table]; !ok {
+			tables = append(tables, table)
+		}
+		schemas[table] = append(schemas[table], fmt.Sprintf("%s %s", column, dataType))
+	}
+
+	return tables, schemas, rows.Err()
+}
+
+// newSnapshotManifest returns the manifest of a backup made in the snapshot of tx. It is
+// created at the start time of the transaction on the clock of the server, which is the
+// time to give to BackupSince for the changes made after the backup.
+func (connection *DbConnection) newSnapshotManifest(ctx context.Context, tx *sqlx.Tx, buckets []string) (*Manifest, error) {
+	manifest, err := connection.newManifest(ctx, tx, buckets)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.GetContext(ctx, &manifest.CreatedAt, "SELECT now()"); err != nil {
+		return nil, fmt.Errorf("failed to read the time of the backup: %w", err)
+	}
+	manifest.CreatedAt = manifest.CreatedAt.UTC()
+
+	return manifest, nil
+}
+
+// EnableChangeTracking creates the change_log table and installs a trigger on every
+// managed table recording the inserted, updated and deleted rows. Tables created
+// afterwards through the connection are tracked as well.
+func (connection *DbConnection) EnableChangeTracking(ctx context.Context) (err error) {
+	ctx, end := connection.startSpan(ctx, "EnableChangeTracking", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	_, err = connection.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			table_name TEXT NOT NULL,
+			row_id TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			changed_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp()
+		);
+		CREATE INDEX IF NOT EXISTS %[1]s_changed_at_idx ON %[1]s (changed_at);
+	`, connection.table(ChangeLogTable)))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", connection.table(ChangeLogTable), err)
+	}
+
+	// clock_timestamp() is used so that changes made in the same transaction can still be ordered
+	_, err = connection.ExecContext(ctx, fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				INSERT INTO %[2]s (table_name, row_id, operation) VALUES (TG_TABLE_NAME, OLD.id::text, TG_OP);
+				RETURN OLD;
+			END IF;
+
+			INSERT INTO %[2]s (table_name, row_id, operation) VALUES (TG_TABLE_NAME, NEW.id::text, TG_OP);
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql
+	`, connection.table(changeFunctionName), connection.table(ChangeLogTable)))
+	if err != nil {
+		return fmt.Errorf("failed to create the change tracking function: %w", err)
+	}
+
+	tables, err := connection.managedTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if err := connection.installChangeTrigger(ctx, connection.DB, table); err != nil {
+			return err
+		}
+	}
+
+	connection.changeTracking = true
+
+	log.Info().Str("component", "postgres").Int("tables", len(tables)).Msg("change tracking enabled")
+
+	return nil
+}
+
+// installChangeTrigger adds the change tracking trigger to the table of a bucket unless it is already present
+func (connection *DbConnection) installChangeTrigger(ctx context.Context, execer sqlx.ExecerContext, bucketName string) error {
+	table := connection.table(bucketName)
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	_, err := execer.ExecContext(ctx, fmt.Sprintf(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = '%[1]s' AND tgrelid = '%[2]s'::regclass) THEN
+				CREATE TRIGGER %[1]s AFTER INSERT OR UPDATE OR DELETE ON %[2]s
+				FOR EACH ROW EXECUTE FUNCTION %[3]s();
+			END IF;
+		END
+		$$
+	`, changeTriggerName, table, connection.table(changeFunctionName)))
+	if err != nil {
+		return fmt.Errorf("failed to install the change tracking trigger on %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// BackupIncremental writes the rows of the managed tables that changed after since.
+// Rows deleted in the meantime are written as delete records. Change tracking must be
+// enabled for the changes to be recorded. The triggers also record the changes made outside
+// of the connection, BackupSince is the authoritative incremental backup otherwise.
+func (connection *DbConnection) BackupIncremental(ctx context.Context, since time.Time, w io.Writer) (err error) {
+	ctx, end := connection.startSpan(ctx, "BackupIncremental", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	tx, err := connection.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Only the latest change of each row matters
+	rows, err := tx.QueryxContext(ctx, fmt.Sprintf(`
+		SELECT DISTINCT ON (table_name, row_id) table_name, row_id, operation
+		FROM %s
+		WHERE changed_at > $1
+		ORDER BY table_name, row_id, changed_at DESC
+	`, connection.table(ChangeLogTable)), since)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %w", connection.table(ChangeLogTable), err)
+	}
+
+	updated := make(map[string][]string)
+	deleted := make(map[string][]string)
+	for rows.Next() {
+		var table, id, operation string
+		if err := rows.Scan(&table, &id, &operation); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan %s row: %w", ChangeLogTable, err)
+		}
+
+		// the change log records the name of the table, the backup holds the name of the bucket
+		table, ok := connection.bucketOf(table)
+		if !ok {
+			continue
+		}
+
+		if operation == "DELETE" {
+			deleted[table] = append(deleted[table], id)
+		} else {
+			updated[table] = append(updated[table], id)
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tables := make([]string, 0, len(updated))
+	for table := range updated {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	bw := newBackupWriter(w)
+
+	for _, table := range tables {
+		if err := validateTableName(connection.table(table)); err != nil {
+			return err
+		}
+
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT to_regclass($1) IS NOT NULL", connection.table(table)); err != nil {
+			return fmt.Errorf("failed to look up table %s: %w", connection.table(table), err)
+		}
+
+		found := map[string]bool{}
+		if exists {
+			found, err = connection.writeTableRows(ctx, tx, bw, table, updated[table], time.Time{})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Rows that no longer exist, for example because their table was dropped, are reported as deleted
+		for _, id := range updated[table] {
+			if !found[id] {
+				deleted[table] = append(deleted[table], id)
+			}
+		}
+	}
+
+	tables = tables[:0]
+	for table := range deleted {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		ids := deleted[table]
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			if err := bw.write(backupRecord{Table: table, ID: id, Operation: backupOperationDelete}); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Debug().Str("component", "postgres").Time("since", since).Int("records", bw.rows).Msg("incremental backup written")
+
+	return bw.close()
+}
+
+// writeTableRows writes the rows of the table of a bucket as backup records. When ids is not
+// empty, only the matching rows are written, and when since is not zero only the rows updated
+// since then. It returns the ids of the rows written.
+func (connection *DbConnection) writeTableRows(ctx context.Context, q sqlx.QueryerContext, bw *backupWriter, table string, ids []string, since time.Time) (map[string]bool, error) {
+	if err := validateTableName(connection.table(table)); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT id::text, data FROM %s", connection.table(table))
+	args := []any{}
+	if len(ids) > 0 {
+		query += " WHERE id::text = ANY($1)"
+		args = append(args, pq.Array(ids))
+	} else if !since.IsZero() {
+		query += " WHERE updated_at >= $1"
+		args = append(args, since)
+	}
+	query += " ORDER BY id"
+
+	rows, err := q.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan row of table %s: %w", table, err)
+		}
+
+		// the objects of an encrypted store are not JSON documents, they are written as base64 strings
+		if connection.IsEncryptedStore() {
+			if data, err = json.Marshal(data); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := bw.write(backupRecord{Table: table, ID: id, Data: data}); err != nil {
+			return nil, err
+		}
+
+		found[id] = true
+	}
+
+	return found, rows.Err()
+}
@@ -0,0 +1,124 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeBackupRows returns the ids of the row records of a table found in a backup stream
+func decodeBackupRows(t *testing.T, data []byte, table string) []string {
+	t.Helper()
+
+	var ids []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var record backupRecord
+		require.NoError(t, dec.Decode(&record))
+
+		if record.Table == table && record.Columns == nil {
+			ids = append(ids, record.ID)
+		}
+	}
+
+	return ids
+}
+
+func Test_BackupIncremental(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "backup_test", ChangeLogTable)
+
+	ctx := context.Background()
+	require.NoError(t, conn.EnsureTableExists(ctx, "backup_test", nil))
+	require.NoError(t, conn.EnableChangeTracking(ctx))
+
+	require.NoError(t, conn.CreateObjectWithId("backup_test", 1, map[string]any{"Name": "first"}))
+	require.NoError(t, conn.CreateObjectWithId("backup_test", 2, map[string]any{"Name": "second"}))
+
+	var full bytes.Buffer
+	require.NoError(t, conn.BackupTo(&full))
+	assert.Equal(t, []string{"1", "2"}, decodeBackupRows(t, full.Bytes(), "backup_test"))
+
+	var since time.Time
+	require.NoError(t, conn.Get(&since, "SELECT clock_timestamp()"))
+
+	require.NoError(t, conn.CreateObjectWithId("backup_test", 3, map[string]any{"Name": "third"}))
+	require.NoError(t, conn.CreateObjectWithId("backup_test", 4, map[string]any{"Name": "fourth"}))
+
+	var incremental bytes.Buffer
+	require.NoError(t, conn.BackupIncremental(ctx, since, &incremental))
+	assert.Equal(t, []string{"3", "4"}, decodeBackupRows(t, incremental.Bytes(), "backup_test"))
+
+	// a deletion shows up as a delete record
+	require.NoError(t, conn.Get(&since, "SELECT clock_timestamp()"))
+	require.NoError(t, conn.DeleteObject("backup_test", []byte("1")))
+
+	incremental.Reset()
+	require.NoError(t, conn.BackupIncremental(ctx, since, &incremental))
+
+	var record backupRecord
+	require.NoError(t, json.NewDecoder(&incremental).Decode(&record))
+	assert.Equal(t, backupRecord{Table: "backup_test", ID: "1", Operation: backupOperationDelete}, record)
+}
+
+func Test_VerifyBackup(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	var backup bytes.Buffer
+	expectBackup(mock)
+	require.NoError(t, conn.BackupTo(&backup))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	lines := bytes.Split(bytes.TrimSpace(backup.Bytes()), []byte("\n"))
+	require.Len(t, lines, 5)
+
+	var footer backupFooter
+	require.NoError(t, json.Unmarshal(lines[4], &footer))
+	assert.Equal(t, backupChecksumAlgorithm, footer.Algorithm)
+	assert.Equal(t, 2, footer.RowCount)
+
+	require.NoError(t, conn.VerifyBackup(bytes.NewReader(backup.Bytes())))
+
+	t.Run("modified row", func(t *testing.T) {
+		corrupted := bytes.Replace(backup.Bytes(), []byte("second"), []byte("Second"), 1)
+		assert.ErrorIs(t, conn.VerifyBackup(bytes.NewReader(corrupted)), ErrBackupCorrupted)
+	})
+
+	t.Run("missing row", func(t *testing.T) {
+		truncated := bytes.Join([][]byte{lines[0], lines[1], lines[2], lines[4]}, []byte("\n"))
+		assert.ErrorIs(t, conn.VerifyBackup(bytes.NewReader(truncated)), ErrBackupCorrupted)
+	})
+
+	t.Run("missing footer", func(t *testing.T) {
+		truncated := bytes.Join(lines[:4], []byte("\n"))
+		assert.ErrorIs(t, conn.VerifyBackup(bytes.NewReader(truncated)), ErrBackupCorrupted)
+	})
+}
+
+// expectBackup expects the queries of BackupTo on a database holding two rows in the settings bucket
+func expectBackup(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM\\s+information_schema.columns").
+		WillReturnRows(sqlmock.NewRows([]string{"table_schema", "table_name", "column_name", "data_type"}).
+			AddRow("public", "settings", "id", "integer").
+			AddRow("public", "settings", "data", "jsonb"))
+	mock.ExpectQuery("SELECT table_name").
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("settings"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT now()")).
+		WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	for range 2 {
+		mock.ExpectQuery("SELECT id::text, data FROM settings").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+				AddRow("1", []byte(`{"Name":"first"}`)).
+				AddRow("2", []byte(`{"Name":"second"}`)))
+	}
+	mock.ExpectRollback()
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"bytes"
+	"fmt"
+
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+)
+
+// PostgresBatch accumulates the writes of PostgresStore.Batch, they are applied in order once
+// the batch is built
+type PostgresBatch struct {
+	ops []batchOp
+}
+
+// batchOp is a write of a batch
+type batchOp struct {
+	bucketName string
+	key        []byte
+	value      []byte
+	delete     bool
+}
+
+// Put adds the storage of a key/value pair to the batch, the value must be a JSON document
+func (b *PostgresBatch) Put(bucketName, key, value []byte) error {
+	return b.add(batchOp{bucketName: string(bucketName), key: key, value: value})
+}
+
+// Delete adds the removal of a key/value pair to the batch
+func (b *PostgresBatch) Delete(bucketName, key []byte) error {
+	return b.add(batchOp{bucketName: string(bucketName), key: key, delete: true})
+}
+
+// Len returns the number of writes in the batch
+func (b *PostgresBatch) Len() int {
+	return len(b.ops)
+}
+
+// add validates a write before adding it, so that an invalid write fails the call that
+// adds it rather than the whole batch
+func (b *PostgresBatch) add(op batchOp) error {
+	if err := validateTableName(op.bucketName); err != nil {
+		return err
+	}
+
+	if _, err := keyToID(op.key); err != nil {
+		return err
+	}
+
+	// the caller may reuse its slices once the write is added
+	op.key = bytes.Clone(op.key)
+	op.value = bytes.Clone(op.value)
+	b.ops = append(b.ops, op)
+
+	return nil
+}
+
+// Batch calls fn to build a batch of writes, then applies them in a single transaction once
+// fn returns. Nothing is written when fn returns an error or when one of the writes fails,
+// and the buckets of the writes must exist. Unlike Update, no transaction is open while fn runs.
+func (s *PostgresStore) Batch(fn func(*PostgresBatch) error) error {
+	batch := &PostgresBatch{}
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return s.Update(func(tx *PostgresTx) error {
+		buckets := make(map[string]*PostgresBucket)
+
+		for _, op := range batch.ops {
+			bucket, ok := buckets[op.bucketName]
+			if !ok {
+				bucket = tx.Bucket([]byte(op.bucketName))
+				if bucket == nil {
+					return fmt.Errorf("%w (bucket=%s)", dserrors.ErrObjectNotFound, op.bucketName)
+				}
+
+				buckets[op.bucketName] = bucket
+			}
+
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to apply the batch to bucket %s: %w", op.bucketName, err)
+			}
+		}
+
+		return nil
+	})
+}
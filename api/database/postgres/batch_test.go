@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PostgresStore_Batch(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	for id := 1; id <= 100; id++ {
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO endpoints")).WithArgs(id, []byte(fmt.Sprintf(`{"Id":%d}`, id))).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM endpoints WHERE id = $1")).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := store.Batch(func(b *PostgresBatch) error {
+		for id := 1; id <= 100; id++ {
+			if err := b.Put([]byte("endpoints"), conn.ConvertToKey(id), []byte(fmt.Sprintf(`{"Id":%d}`, id))); err != nil {
+				return err
+			}
+		}
+
+		return b.Delete([]byte("endpoints"), []byte("7"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_Batch_Rollback(t *testing.T) {
+	t.Run("fn fails", func(t *testing.T) {
+		store, mock := newMockStore(t)
+
+		failure := errors.New("invalid endpoint")
+		err := store.Batch(func(b *PostgresBatch) error {
+			require.NoError(t, b.Put([]byte("endpoints"), []byte("1"), []byte(`{}`)))
+			return failure
+		})
+		require.ErrorIs(t, err, failure)
+
+		// no transaction is even opened
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("write fails", func(t *testing.T) {
+		store, mock := newMockStore(t)
+
+		failure := errors.New("value too long")
+		mock.ExpectBegin()
+		expectBucketExists(mock, "endpoints", true)
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO endpoints")).WithArgs(1, []byte(`{}`)).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO endpoints")).WithArgs(2, []byte(`{}`)).
+			WillReturnError(failure)
+		mock.ExpectRollback()
+
+		err := store.Batch(func(b *PostgresBatch) error {
+			for id := 1; id <= 3; id++ {
+				if err := b.Put([]byte("endpoints"), []byte(fmt.Sprint(id)), []byte(`{}`)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		require.ErrorIs(t, err, failure)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("missing bucket", func(t *testing.T) {
+		store, mock := newMockStore(t)
+
+		mock.ExpectBegin()
+		expectBucketExists(mock, "stacks", false)
+		mock.ExpectRollback()
+
+		err := store.Batch(func(b *PostgresBatch) error {
+			return b.Delete([]byte("stacks"), []byte("1"))
+		})
+		require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid write", func(t *testing.T) {
+		store, mock := newMockStore(t)
+
+		err := store.Batch(func(b *PostgresBatch) error {
+			assert.ErrorIs(t, b.Put([]byte("end points"), []byte("1"), []byte(`{}`)), ErrInvalidTableName)
+			assert.Error(t, b.Delete([]byte("endpoints"), []byte("key")))
+			assert.Zero(t, b.Len())
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_PostgresStore_Batch_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "batch_test")
+	store := &PostgresStore{conn: conn}
+
+	require.NoError(t, store.Update(func(tx *PostgresTx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("batch_test"))
+		return err
+	}))
+
+	put := func(b *PostgresBatch) error {
+		for id := 1; id <= 100; id++ {
+			if err := b.Put([]byte("batch_test"), conn.ConvertToKey(id), []byte(fmt.Sprintf(`{"Id":%d}`, id))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	count := func() int {
+		var n int
+		require.NoError(t, store.ForEach([]byte("batch_test"), func(k, v []byte) error {
+			n++
+			return nil
+		}))
+
+		return n
+	}
+
+	// the last write fails, none of the 100 puts is kept
+	err := store.Batch(func(b *PostgresBatch) error {
+		if err := put(b); err != nil {
+			return err
+		}
+
+		return b.Put([]byte("batch_test"), []byte("101"), []byte(`not json`))
+	})
+	require.Error(t, err)
+	assert.Zero(t, count())
+
+	require.NoError(t, store.Batch(put))
+	assert.Equal(t, 100, count())
+}
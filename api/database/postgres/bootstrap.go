@@ -0,0 +1,150 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+// sqlStateDuplicateDatabase is the SQLSTATE of the creation of a database that already exists
+const sqlStateDuplicateDatabase = "42P04"
+
+// maintenanceDatabase is the database EnsureDatabase connects to when the admin connection
+// string names none
+const maintenanceDatabase = "postgres"
+
+// ErrInsufficientPrivileges is returned by VerifyPrivileges when the role cannot create the
+// tables of the buckets
+var ErrInsufficientPrivileges = errors.New("the PostgreSQL role has insufficient privileges")
+
+// WithBootstrap makes Open create the database of the connection string unless it exists,
+// connecting with adminDSN, see EnsureDatabase
+func WithBootstrap(adminDSN string) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.bootstrapDSN = adminDSN
+	}
+}
+
+// EnsureDatabase creates the database targetDB unless it exists. adminDSN is the connection
+// string of a role allowed to create databases, it connects to the postgres maintenance
+// database unless it names another one.
+func EnsureDatabase(adminDSN, targetDB string) error {
+	return ensureDatabase(context.Background(), adminDSN, targetDB)
+}
+
+func ensureDatabase(ctx context.Context, adminDSN, targetDB string) error {
+	if targetDB == "" {
+		return errors.New("the name of the database to create is empty")
+	}
+
+	if databaseName(adminDSN) == "" {
+		var err error
+		if adminDSN, err = withDSNParameter(adminDSN, "dbname", maintenanceDatabase); err != nil {
+			return err
+		}
+	}
+
+	connector, err := newHostConnector(adminDSN)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the maintenance database: %w", err)
+	}
+
+	db := sqlx.NewDb(sql.OpenDB(connector), DatabaseDriverName)
+	defer db.Close()
+
+	return createDatabase(ctx, db, targetDB)
+}
+
+// createDatabase creates the database targetDB with db unless it exists
+func createDatabase(ctx context.Context, db *sqlx.DB, targetDB string) error {
+	var exists bool
+	if err := db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", targetDB); err != nil {
+		return fmt.Errorf("failed to look up database %s: %w", targetDB, err)
+	}
+
+	if exists {
+		return nil
+	}
+
+	// another instance may create it concurrently
+	_, err := db.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(targetDB))
+	if isDuplicateDatabase(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to create database %s: %w", targetDB, err)
+	}
+
+	log.Info().Str("component", "postgres").Str("database", targetDB).Msg("created the PostgreSQL database")
+
+	return nil
+}
+
+// isDuplicateDatabase returns true when err is caused by the creation of a database that already exists
+func isDuplicateDatabase(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == sqlStateDuplicateDatabase
+}
+
+// schemaPrivileges are the privileges of the role on the schema of the tables
+type schemaPrivileges struct {
+	Schema sql.NullString `db:"schema"`
+	Role   string         `db:"role"`
+	Usage  bool           `db:"can_use"`
+	Create bool           `db:"can_create"`
+}
+
+// VerifyPrivileges makes sure the role of the connection can use the schema of the tables and
+// create tables in it. The error lists every privilege missing. It is run by Open.
+func (connection *DbConnection) VerifyPrivileges() (err error) {
+	ctx, end := connection.startSpan(connection.ctx, "VerifyPrivileges", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	return connection.verifyPrivileges(ctx, connection.DB)
+}
+
+func (connection *DbConnection) verifyPrivileges(ctx context.Context, q sqlx.QueryerContext) error {
+	// the schema of the connection is not in the search_path of the connections in pgBouncer mode
+	var privileges schemaPrivileges
+	err := sqlx.GetContext(ctx, q, &privileges, `
+		SELECT s.schema, current_user AS role,
+			COALESCE(has_schema_privilege(s.schema, 'USAGE'), false) AS can_use,
+			COALESCE(has_schema_privilege(s.schema, 'CREATE'), false) AS can_create
+		FROM (SELECT COALESCE(NULLIF($1::text, ''), current_schema()) AS schema) s
+		WHERE s.schema IS NULL OR EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = s.schema)
+	`, connection.schema)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: schema %s does not exist", ErrInsufficientPrivileges, connection.schema)
+	} else if err != nil {
+		return fmt.Errorf("failed to verify the privileges: %w", err)
+	}
+
+	if !privileges.Schema.Valid {
+		return fmt.Errorf("%w: no schema of the search_path of role %s exists", ErrInsufficientPrivileges, privileges.Role)
+	}
+
+	var missing []string
+	if !privileges.Usage {
+		missing = append(missing, "USAGE")
+	}
+	if !privileges.Create {
+		missing = append(missing, "CREATE")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: role %s lacks %s on schema %s", ErrInsufficientPrivileges,
+			privileges.Role, strings.Join(missing, " and "), privileges.Schema.String)
+	}
+
+	return nil
+}
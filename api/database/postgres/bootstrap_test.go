@@ -0,0 +1,112 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_createDatabase(t *testing.T) {
+	lookup := regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)")
+
+	t.Run("missing database", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		mock.ExpectQuery(lookup).WithArgs("portainer").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE "portainer"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		require.NoError(t, createDatabase(context.Background(), conn.DB, "portainer"))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("existing database", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		mock.ExpectQuery(lookup).WithArgs("portainer").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		require.NoError(t, createDatabase(context.Background(), conn.DB, "portainer"))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("database created concurrently", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		mock.ExpectQuery(lookup).WithArgs(`port"ainer`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE "port""ainer"`)).WillReturnError(&pq.Error{Code: sqlStateDuplicateDatabase})
+
+		require.NoError(t, createDatabase(context.Background(), conn.DB, `port"ainer`))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		mock.ExpectQuery(lookup).WithArgs("portainer").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE DATABASE "portainer"`)).WillReturnError(&pq.Error{Code: "42501", Message: "permission denied to create database"})
+
+		require.ErrorContains(t, createDatabase(context.Background(), conn.DB, "portainer"), "permission denied")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	require.Error(t, EnsureDatabase("host=localhost", ""))
+}
+
+func Test_VerifyPrivileges(t *testing.T) {
+	columns := []string{"schema", "role", "can_use", "can_create"}
+
+	tests := []struct {
+		name     string
+		schema   string
+		rows     *sqlmock.Rows
+		expected string
+	}{
+		{
+			name:   "privileged role",
+			schema: "portainer",
+			rows:   sqlmock.NewRows(columns).AddRow("portainer", "portainer", true, true),
+		},
+		{
+			name:     "role without CREATE",
+			rows:     sqlmock.NewRows(columns).AddRow("public", "reader", true, false),
+			expected: "role reader lacks CREATE on schema public",
+		},
+		{
+			name:     "role without privileges",
+			schema:   "portainer",
+			rows:     sqlmock.NewRows(columns).AddRow("portainer", "nobody", false, false),
+			expected: "role nobody lacks USAGE and CREATE on schema portainer",
+		},
+		{
+			name:     "no schema in the search_path",
+			rows:     sqlmock.NewRows(columns).AddRow(nil, "portainer", false, false),
+			expected: "no schema of the search_path of role portainer exists",
+		},
+		{
+			name:     "missing schema",
+			schema:   "portainer",
+			rows:     sqlmock.NewRows(columns),
+			expected: "schema portainer does not exist",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, mock := newMockConnection(t)
+			conn.schema = tc.schema
+
+			mock.ExpectQuery(regexp.QuoteMeta("has_schema_privilege(s.schema, 'CREATE')")).WithArgs(tc.schema).WillReturnRows(tc.rows)
+
+			err := conn.VerifyPrivileges()
+			require.NoError(t, mock.ExpectationsWereMet())
+
+			if tc.expected == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.ErrorIs(t, err, ErrInsufficientPrivileges)
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/portainer/portainer/api/database/postgres/migrations"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+)
+
+var (
+	// ErrTableNotEmpty is returned by DropTable for a table holding objects unless it is forced
+	ErrTableNotEmpty = errors.New("the table is not empty")
+	// ErrTableInUse is returned by DropTable for a table used by a transaction in progress
+	ErrTableInUse = errors.New("the table is used by a transaction in progress")
+)
+
+// metadataTables are the tables of the postgres layer itself, they are never listed as buckets
+var metadataTables = map[string]bool{
+	AuditTable:                       true,
+	AuditLogTable:                    true,
+	ChangeLogTable:                   true,
+	AppliedBackupsTable:              true,
+	BucketRegistryTable:              true,
+	DeletionsTable:                   true,
+	InstanceLockTable:                true,
+	LegacyBucketsTable:               true,
+	MigrationStateTable:              true,
+	migrations.SchemaMigrationsTable: true,
+}
+
+// bucketSequence returns the name of the sequence of the NextSequence values of a bucket
+func bucketSequence(bucketName string) string {
+	return "seq_" + bucketName
+}
+
+// idSequence returns the name of the sequence of the identifiers of a table, it is the name
+// PostgreSQL gave to the sequence of the SERIAL id column of the tables created before
+func idSequence(table string) string {
+	return table + "_id_seq"
+}
+
+// ListBuckets returns the name of every bucket table, sorted alphabetically
+func (connection *DbConnection) ListBuckets() (buckets []string, err error) {
+	ctx, end := connection.startSpan(connection.ctx, "ListBuckets", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return nil, ErrNoConnection
+	}
+
+	return connection.listBuckets(ctx, connection.DB)
+}
+
+// DropBucket drops the table of a bucket along with its sequences, it is a no-op when the
+// bucket does not exist
+func (connection *DbConnection) DropBucket(name string) error {
+	return connection.tracedTx("DropBucket", name, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.DropBucket(name)
+	})
+}
+
+// RenameBucket renames the table of a bucket along with its sequences, see DbTransaction.RenameBucket
+func (connection *DbConnection) RenameBucket(oldName, newName string) error {
+	return connection.tracedTx("RenameBucket", oldName, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.RenameBucket(oldName, newName)
+	})
+}
+
+// TruncateTable removes every object of a bucket and restarts its id sequence, so that the
+// next object created gets the identifier 1. It is meant for the teardown of the tests and for
+// maintenance, it returns ErrInvalidTableName when the bucket does not exist.
+func (connection *DbConnection) TruncateTable(ctx context.Context, tableName string) error {
+	return connection.tracedTxCtx(ctx, "TruncateTable", tableName, connection.txOptions, func(tx *DbTransaction) error {
+		buckets, err := tx.ListBuckets()
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(buckets, tableName) {
+			return fmt.Errorf("%w: unknown bucket %q", ErrInvalidTableName, tableName)
+		}
+
+		return tx.Truncate(tableName)
+	})
+}
+
+// TruncateAllTables removes every object of every bucket and restarts their id sequences, the
+// metadata tables are kept. The tables are truncated by a single statement, which is not
+// held back by the foreign keys between them whatever their order.
+func (connection *DbConnection) TruncateAllTables(ctx context.Context) error {
+	return connection.tracedTxCtx(ctx, "TruncateAllTables", "", connection.txOptions, func(tx *DbTransaction) error {
+		buckets, err := tx.ListBuckets()
+		if err != nil || len(buckets) == 0 {
+			return err
+		}
+
+		tables := make([]string, 0, len(buckets))
+		for _, bucket := range buckets {
+			tx.conn.counters(bucket).deletes.Add(1)
+			tx.invalidateCache(bucket, "")
+			tables = append(tables, connection.table(bucket))
+		}
+
+		_, err = tx.tx.ExecContext(tx.ctx, fmt.Sprintf("TRUNCATE TABLE %s RESTART IDENTITY", strings.Join(tables, ", ")))
+
+		return err
+	})
+}
+
+// DropTable drops the table of a bucket along with its sequences, for the tables created during
+// development or migration testing. It returns ErrInvalidTableName when the bucket does not
+// exist, ErrTableInUse when a transaction in progress uses the table and, unless force is set,
+// ErrTableNotEmpty when the table holds objects.
+func (connection *DbConnection) DropTable(ctx context.Context, tableName string, force bool) error {
+	return connection.tracedTxCtx(ctx, "DropTable", tableName, connection.txOptions, func(tx *DbTransaction) error {
+		buckets, err := tx.ListBuckets()
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(buckets, tableName) {
+			return fmt.Errorf("%w: unknown bucket %q", ErrInvalidTableName, tableName)
+		}
+
+		// the lock conflicts with the ones of every other statement on the table, NOWAIT fails
+		// rather than waiting for the transactions holding them
+		table := connection.table(tableName)
+		if _, err := tx.tx.ExecContext(tx.ctx, fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE NOWAIT", table)); isLockNotAvailable(err) {
+			// the error of the lock is left out, it would be reported as ErrQueryTimeout
+			return fmt.Errorf("%w (bucket=%s)", ErrTableInUse, tableName)
+		} else if err != nil {
+			return err
+		}
+
+		if !force {
+			var notEmpty bool
+			if err := tx.tx.GetContext(tx.ctx, &notEmpty, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s)", table)); err != nil {
+				return err
+			}
+
+			if notEmpty {
+				return fmt.Errorf("%w (bucket=%s)", ErrTableNotEmpty, tableName)
+			}
+		}
+
+		return tx.DropBucket(tableName)
+	})
+}
+
+// BucketsLockKey is the transaction-level advisory lock serializing the creation of the bucket tables
+const BucketsLockKey int64 = 0x706f7274626b74 // "portbkt"
+
+// SetServiceName creates the table of a bucket in a transaction of its own, so that the bucket
+// can be used by the connection-level operations right away. It is idempotent and safe for
+// concurrent use, see Init.
+func (connection *DbConnection) SetServiceName(bucketName string) error {
+	return connection.Init([]string{bucketName})
+}
+
+// Init creates the tables of the buckets that do not exist yet, it is meant to prepare the
+// buckets of the store when it is bootstrapped. The tables are created under BucketsLockKey,
+// because concurrent CREATE TABLE IF NOT EXISTS statements for the same table can fail.
+func (connection *DbConnection) Init(buckets []string) error {
+	return connection.tracedTx("Init", "", connection.txOptions, func(tx *DbTransaction) error {
+		if _, err := tx.tx.ExecContext(tx.ctx, "SELECT pg_advisory_xact_lock($1)", BucketsLockKey); err != nil {
+			return fmt.Errorf("failed to lock the bucket tables: %w", err)
+		}
+
+		for _, bucketName := range buckets {
+			if err := tx.SetServiceName(bucketName); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", bucketName, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// ListBuckets returns the name of every bucket table visible to the transaction, sorted alphabetically
+func (tx *DbTransaction) ListBuckets() (buckets []string, err error) {
+	ctx, end := tx.startSpan("ListBuckets", "")
+	defer func() { err = translateError(err); end(err) }()
+
+	return tx.conn.listBuckets(ctx, tx.tx)
+}
+
+// DropBucket drops the table of a bucket along with its sequences, it is a no-op when the
+// bucket does not exist
+func (tx *DbTransaction) DropBucket(name string) (err error) {
+	ctx, end := tx.startSpan("DropBucket", name)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+
+	table := tx.conn.table(name)
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	// the sequence of the id column is owned by the table and dropped along with it
+	if _, err := tx.tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+table); err != nil {
+		return err
+	}
+	tx.conn.sequences.Delete(idSequence(table))
+	tx.conn.timestamped.Delete(name)
+	tx.conn.invalidateStmts(name)
+	tx.invalidateCache(name, "")
+
+	if err := tx.unregisterBucket(ctx, name, ""); err != nil {
+		return err
+	}
+
+	return tx.dropBucketSequence(ctx, name)
+}
+
+// RenameBucket renames the table of a bucket along with the sequences of its id column and of
+// its NextSequence values. It is a no-op when the bucket does not exist and returns
+// ErrAlreadyExists when the new name is taken by another table.
+func (tx *DbTransaction) RenameBucket(oldName, newName string) (err error) {
+	ctx, end := tx.startSpan("RenameBucket", oldName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+
+	oldTable, newTable := tx.conn.table(oldName), tx.conn.table(newName)
+	if err := validateTableName(oldTable); err != nil {
+		return err
+	}
+
+	if err := validateTableName(newTable); err != nil {
+		return err
+	}
+
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE IF EXISTS %s RENAME TO %s", oldTable, newTable),
+		fmt.Sprintf("ALTER SEQUENCE IF EXISTS %s RENAME TO %s", idSequence(oldTable), idSequence(newTable)),
+		fmt.Sprintf("ALTER SEQUENCE IF EXISTS %s RENAME TO %s", tx.conn.table(bucketSequence(oldName)), tx.conn.table(bucketSequence(newName))),
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.tx.ExecContext(ctx, statement); isDuplicateTable(err) {
+			return fmt.Errorf("%w (bucket=%s): %w", dserrors.ErrAlreadyExists, newName, err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	tx.conn.sequences.Delete(idSequence(oldTable))
+	tx.conn.sequences.Delete(tx.conn.table(bucketSequence(oldName)))
+	tx.conn.timestamped.Delete(oldName)
+	tx.conn.invalidateStmts(oldName)
+	tx.conn.invalidateStmts(newName)
+
+	return tx.unregisterBucket(ctx, oldName, newName)
+}
+
+// unregisterBucket removes a bucket from the bucket registry, or renames it when newName is
+// not empty. The registry is only written when it is known to hold the bucket.
+func (tx *DbTransaction) unregisterBucket(ctx context.Context, name, newName string) error {
+	keyType, ok := tx.conn.keyTypes.Load(name)
+	if !ok {
+		return nil
+	}
+
+	registry := tx.conn.table(BucketRegistryTable)
+	query, args := "DELETE FROM "+registry+" WHERE bucket_name = $1", []any{name}
+	if newName != "" {
+		query, args = "UPDATE "+registry+" SET bucket_name = $2 WHERE bucket_name = $1", []any{name, newName}
+	}
+
+	if _, err := tx.tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to update %s: %w", registry, err)
+	}
+
+	tx.conn.keyTypes.Delete(name)
+	if newName != "" {
+		tx.conn.keyTypes.Store(newName, keyType)
+	}
+
+	return nil
+}
+
+// dropBucketSequence drops the sequence of the NextSequence values of a bucket
+func (tx *DbTransaction) dropBucketSequence(ctx context.Context, bucketName string) error {
+	sequence := tx.conn.table(bucketSequence(bucketName))
+	if _, err := tx.tx.ExecContext(ctx, "DROP SEQUENCE IF EXISTS "+sequence); err != nil {
+		return err
+	}
+
+	tx.conn.sequences.Delete(sequence)
+
+	return nil
+}
+
+// listBuckets lists the tables of the prefix having both an id and a data column, it returns
+// the names of their buckets
+func (connection *DbConnection) listBuckets(ctx context.Context, q sqlx.QueryerContext) ([]string, error) {
+	var tables []string
+	err := sqlx.SelectContext(ctx, q, &tables, `
+		SELECT table_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND column_name IN ('id', 'data')
+		GROUP BY table_name
+		HAVING COUNT(*) = 2
+		ORDER BY table_name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the buckets: %w", err)
+	}
+
+	buckets := make([]string, 0, len(tables))
+	for _, table := range tables {
+		if bucket, ok := connection.bucketOf(table); ok && !metadataTables[bucket] {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	return buckets, nil
+}
@@ -0,0 +1,378 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	portainer "github.com/portainer/portainer/api"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ListBuckets_SkipsMetadataTables(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT table_name")).
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).
+			AddRow("endpoints").AddRow("portainer_buckets").AddRow("schema_migrations").AddRow("stacks"))
+
+	buckets, err := conn.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"endpoints", "stacks"}, buckets)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_RenameBucket(t *testing.T) {
+	t.Run("renames the sequences", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		conn.sequences.Store("seq_edge_groups", struct{}{})
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE IF EXISTS edge_groups RENAME TO edgegroups")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("ALTER SEQUENCE IF EXISTS edge_groups_id_seq RENAME TO edgegroups_id_seq")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("ALTER SEQUENCE IF EXISTS seq_edge_groups RENAME TO seq_edgegroups")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.RenameBucket("edge_groups", "edgegroups"))
+
+		_, cached := conn.sequences.Load("seq_edge_groups")
+		assert.False(t, cached)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("new name taken", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE IF EXISTS edge_groups RENAME TO stacks")).
+			WillReturnError(&pq.Error{Code: "42P07", Message: `relation "stacks" already exists`})
+		mock.ExpectRollback()
+
+		err := conn.RenameBucket("edge_groups", "stacks")
+		require.ErrorIs(t, err, dserrors.ErrAlreadyExists)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("invalid names", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+
+		require.ErrorIs(t, conn.RenameBucket("edge_groups", "stacks; DROP TABLE users"), ErrInvalidTableName)
+		require.ErrorIs(t, conn.DropBucket("1stacks"), ErrInvalidTableName)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("read-only transaction", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+
+		err := conn.ViewTx(func(tx portainer.Transaction) error {
+			assert.ErrorIs(t, tx.(*DbTransaction).RenameBucket("edge_groups", "edgegroups"), ErrTxReadOnly)
+			assert.ErrorIs(t, tx.(*DbTransaction).DropBucket("edge_groups"), ErrTxReadOnly)
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_Init(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_xact_lock($1)")).WithArgs(BucketsLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS endpoints")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "endpoints")
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS stacks")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "stacks")
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.Init([]string{"endpoints", "stacks"}))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_SetServiceName_Connection_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "service_a", "service_b")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- conn.SetServiceName("service_a")
+			errs <- conn.Init([]string{"service_a", "service_b"})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, conn.SetServiceName("service_a"))
+	require.NoError(t, conn.SetServiceName("service_a"))
+
+	require.NoError(t, conn.CreateObjectWithId("service_a", 1, map[string]int{"Id": 1}))
+
+	var object map[string]int
+	require.NoError(t, conn.GetObject("service_a", conn.ConvertToKey(1), &object))
+	assert.Equal(t, 1, object["Id"])
+
+	require.NoError(t, conn.DeleteObject("service_a", conn.ConvertToKey(1)))
+	require.ErrorIs(t, conn.GetObject("service_a", conn.ConvertToKey(1), &object), dserrors.ErrObjectNotFound)
+}
+
+func Test_BucketCatalog_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "catalog_a", "catalog_b", "catalog_c", "catalog_renamed")
+
+	assertBuckets := func(expected ...string) {
+		t.Helper()
+
+		buckets, err := conn.ListBuckets()
+		require.NoError(t, err)
+
+		var catalog []string
+		for _, bucket := range buckets {
+			if len(bucket) > 8 && bucket[:8] == "catalog_" {
+				catalog = append(catalog, bucket)
+			}
+		}
+		assert.Equal(t, expected, catalog)
+	}
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		for _, bucket := range []string{"catalog_a", "catalog_b", "catalog_c"} {
+			if err := tx.SetServiceName(bucket); err != nil {
+				return err
+			}
+		}
+
+		return tx.CreateObject("catalog_b", func(id uint64) (int, any) {
+			return int(id), map[string]int{"Id": int(id)}
+		})
+	})
+	require.NoError(t, err)
+	assertBuckets("catalog_a", "catalog_b", "catalog_c")
+
+	require.NoError(t, conn.RenameBucket("catalog_b", "catalog_renamed"))
+	require.NoError(t, conn.RenameBucket("catalog_b", "catalog_renamed"), "renaming is idempotent")
+	assertBuckets("catalog_a", "catalog_c", "catalog_renamed")
+
+	var object map[string]int
+	require.NoError(t, conn.GetObject("catalog_renamed", []byte("1"), &object))
+	assert.Equal(t, 1, object["Id"])
+
+	var sequence string
+	require.NoError(t, conn.Get(&sequence, "SELECT pg_get_serial_sequence('catalog_renamed', 'id')"))
+	assert.Contains(t, sequence, "catalog_renamed_id_seq")
+
+	require.NoError(t, conn.DropBucket("catalog_a"))
+	require.NoError(t, conn.DropBucket("catalog_a"), "dropping is idempotent")
+	assertBuckets("catalog_c", "catalog_renamed")
+}
+
+// expectListBuckets expects the buckets to be listed from information_schema
+func expectListBuckets(mock sqlmock.Sqlmock, tables ...string) {
+	rows := sqlmock.NewRows([]string{"table_name"})
+	for _, table := range tables {
+		rows.AddRow(table)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT table_name")).WillReturnRows(rows)
+}
+
+func Test_TruncateTable(t *testing.T) {
+	t.Run("truncates the bucket", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectListBuckets(mock, "edge_jobs", "stacks")
+		mock.ExpectExec(regexp.QuoteMeta("TRUNCATE TABLE edge_jobs RESTART IDENTITY")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.TruncateTable(context.Background(), "edge_jobs"))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown bucket", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectListBuckets(mock, "edge_jobs", "portainer_buckets")
+		mock.ExpectRollback()
+
+		require.ErrorIs(t, conn.TruncateTable(context.Background(), "portainer_buckets"), ErrInvalidTableName)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_TruncateAllTables(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	expectListBuckets(mock, "edge_jobs", "schema_migrations", "stacks")
+	mock.ExpectExec(regexp.QuoteMeta("TRUNCATE TABLE edge_jobs, stacks RESTART IDENTITY")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.TruncateAllTables(context.Background()))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_TruncateTable_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "truncate_a", "truncate_b")
+
+	for _, bucket := range []string{"truncate_a", "truncate_b"} {
+		require.NoError(t, conn.SetServiceName(bucket))
+
+		for range 3 {
+			require.NoError(t, conn.CreateObject(bucket, func(id uint64) (int, any) {
+				return int(id), map[string]int{"Id": int(id)}
+			}))
+		}
+	}
+
+	count := func(bucket string) int {
+		var count int
+		require.NoError(t, conn.Get(&count, "SELECT COUNT(*) FROM "+bucket))
+
+		return count
+	}
+
+	require.NoError(t, conn.TruncateTable(context.Background(), "truncate_a"))
+	assert.Equal(t, 0, count("truncate_a"))
+	assert.Equal(t, 3, count("truncate_b"))
+	nextID, err := conn.GetNextIdentifierErr("truncate_a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, nextID)
+
+	require.ErrorIs(t, conn.TruncateTable(context.Background(), "truncate_missing"), ErrInvalidTableName)
+
+	require.NoError(t, conn.TruncateAllTables(context.Background()))
+	assert.Equal(t, 0, count("truncate_b"))
+	nextID, err = conn.GetNextIdentifierErr("truncate_b")
+	require.NoError(t, err)
+	assert.Equal(t, 1, nextID)
+}
+
+func Test_DropTable(t *testing.T) {
+	const lock = "LOCK TABLE edge_jobs IN ACCESS EXCLUSIVE MODE NOWAIT"
+
+	expectDrop := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(regexp.QuoteMeta("DROP TABLE IF EXISTS edge_jobs")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("DROP SEQUENCE IF EXISTS seq_edge_jobs")).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	t.Run("empty table", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectListBuckets(mock, "edge_jobs")
+		mock.ExpectExec(regexp.QuoteMeta(lock)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM edge_jobs)")).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		expectDrop(mock)
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.DropTable(context.Background(), "edge_jobs", false))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("non-empty table", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectListBuckets(mock, "edge_jobs")
+		mock.ExpectExec(regexp.QuoteMeta(lock)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM edge_jobs)")).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectRollback()
+
+		require.ErrorIs(t, conn.DropTable(context.Background(), "edge_jobs", false), ErrTableNotEmpty)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectListBuckets(mock, "edge_jobs")
+		mock.ExpectExec(regexp.QuoteMeta(lock)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectDrop(mock)
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.DropTable(context.Background(), "edge_jobs", true))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("table in use", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectListBuckets(mock, "edge_jobs")
+		mock.ExpectExec(regexp.QuoteMeta(lock)).
+			WillReturnError(&pq.Error{Code: "55P03", Message: `could not obtain lock on relation "edge_jobs"`})
+		mock.ExpectRollback()
+
+		err := conn.DropTable(context.Background(), "edge_jobs", true)
+		require.ErrorIs(t, err, ErrTableInUse)
+		assert.NotErrorIs(t, err, ErrQueryTimeout)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown table", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectListBuckets(mock, "edge_jobs")
+		mock.ExpectRollback()
+
+		require.ErrorIs(t, conn.DropTable(context.Background(), "stacks", true), ErrInvalidTableName)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_DropTable_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "drop_empty", "drop_full")
+
+	require.NoError(t, conn.Init([]string{"drop_empty", "drop_full"}))
+	require.NoError(t, conn.CreateObjectWithId("drop_full", 1, map[string]int{"Id": 1}))
+
+	require.NoError(t, conn.DropTable(context.Background(), "drop_empty", false))
+	require.ErrorIs(t, conn.DropTable(context.Background(), "drop_full", false), ErrTableNotEmpty)
+
+	// a transaction reading the table holds a lock on it until it ends
+	tx, _, rollback, err := conn.BeginTransaction(context.Background(), TxOptions{})
+	require.NoError(t, err)
+
+	var object map[string]int
+	require.NoError(t, tx.GetObject("drop_full", conn.ConvertToKey(1), &object))
+	require.ErrorIs(t, conn.DropTable(context.Background(), "drop_full", true), ErrTableInUse)
+	require.NoError(t, rollback())
+
+	require.NoError(t, conn.DropTable(context.Background(), "drop_full", true))
+
+	buckets, err := conn.ListBuckets()
+	require.NoError(t, err)
+	assert.NotContains(t, buckets, "drop_empty")
+	assert.NotContains(t, buckets, "drop_full")
+}
@@ -0,0 +1,226 @@
+package postgres
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+// DefaultCacheSize is the number of objects kept by the object cache
+const DefaultCacheSize = 1024
+
+// objectCache keeps the plaintext JSON of the objects of the buckets for which EnableCache was
+// called, the least recently used objects are evicted once it is full
+type objectCache struct {
+	entries *lru.Cache
+
+	// ttls holds the time to live of the objects of the cached buckets
+	ttls sync.Map
+
+	// generation is incremented by every invalidation, an object read before an invalidation
+	// is not cached as it may be stale
+	generation atomic.Uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// cacheEntry is an object of the cache, data is its plaintext JSON
+type cacheEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// cacheKey returns the key of an object in the cache, the keys encoded by ConvertToKey and their
+// decimal representation are cached alike
+func cacheKey(bucketName, key string) string {
+	return bucketName + "\x00" + key
+}
+
+// WithCacheSize sets the number of objects kept by the object cache, DefaultCacheSize by default
+func WithCacheSize(size int) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.cacheSize = size
+	}
+}
+
+// EnableCache makes GetObject serve the objects of a bucket from memory for ttl once they are
+// read. The cached objects are invalidated by the writes of the connection as soon as they are
+// made and again when their transaction commits, see InvalidateCacheOnChanges for the writes of
+// the other instances. The reads made inside a transaction always query the database.
+//
+// The cache holds the plaintext of the objects, decrypted on an encrypted store.
+func (connection *DbConnection) EnableCache(bucketName string, ttl time.Duration) {
+	connection.cacheOnce.Do(func() {
+		size := connection.cacheSize
+		if size <= 0 {
+			size = DefaultCacheSize
+		}
+
+		// lru.New only fails when the size is not positive
+		entries, _ := lru.New(size)
+		connection.cache.Store(&objectCache{entries: entries})
+	})
+
+	connection.cache.Load().ttls.Store(bucketName, ttl)
+}
+
+// CacheStats returns the number of hits and misses of the object cache
+func (connection *DbConnection) CacheStats() (hits, misses uint64) {
+	cache := connection.cache.Load()
+	if cache == nil {
+		return 0, 0
+	}
+
+	return cache.hits.Load(), cache.misses.Load()
+}
+
+// ttl returns the time to live of the objects of a bucket, ok is false when it is not cached
+func (cache *objectCache) ttl(bucketName string) (time.Duration, bool) {
+	if cache == nil {
+		return 0, false
+	}
+
+	ttl, ok := cache.ttls.Load(bucketName)
+	if !ok {
+		return 0, false
+	}
+
+	return ttl.(time.Duration), true
+}
+
+// get returns the plaintext of an object unless it is missing or expired
+func (cache *objectCache) get(bucketName, key string) ([]byte, bool) {
+	value, ok := cache.entries.Get(cacheKey(bucketName, key))
+	if ok {
+		entry := value.(cacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			cache.hits.Add(1)
+
+			return entry.data, true
+		}
+
+		cache.entries.Remove(cacheKey(bucketName, key))
+	}
+
+	cache.misses.Add(1)
+
+	return nil, false
+}
+
+// add caches the plaintext of an object read at generation, unless it was invalidated since
+func (cache *objectCache) add(bucketName, key string, data []byte, ttl time.Duration, generation uint64) {
+	if cache.generation.Load() != generation {
+		return
+	}
+
+	cache.entries.Add(cacheKey(bucketName, key), cacheEntry{data: data, expiresAt: time.Now().Add(ttl)})
+}
+
+// invalidate removes an object from the cache, or every object of the bucket when key is empty,
+// or every object when bucketName is empty
+func (cache *objectCache) invalidate(bucketName, key string) {
+	if cache == nil {
+		return
+	}
+
+	cache.generation.Add(1)
+
+	switch {
+	case bucketName == "":
+		cache.entries.Purge()
+	case key == "":
+		prefix := cacheKey(bucketName, "")
+		for _, k := range cache.entries.Keys() {
+			if strings.HasPrefix(k.(string), prefix) {
+				cache.entries.Remove(k)
+			}
+		}
+	default:
+		cache.entries.Remove(cacheKey(bucketName, key))
+	}
+}
+
+// invalidateCache removes an object from the cache, see objectCache.invalidate. It is removed
+// again once the transaction commits, in case a concurrent read cached the former value.
+func (tx *DbTransaction) invalidateCache(bucketName, key string) {
+	cache := tx.conn.cache.Load()
+	if cache == nil {
+		return
+	}
+
+	cache.invalidate(bucketName, key)
+	tx.invalidations = append(tx.invalidations, ChangeEvent{Bucket: bucketName, Key: key})
+}
+
+// invalidateCommitted removes the objects written by the transaction from the cache once it commits
+func (tx *DbTransaction) invalidateCommitted() {
+	for _, change := range tx.invalidations {
+		tx.conn.cache.Load().invalidate(change.Bucket, change.Key)
+	}
+}
+
+// getCachedObject decodes an object of a cached bucket from the cache, or reads it and caches it
+func (connection *DbConnection) getCachedObject(cache *objectCache, bucketName string, key []byte, object any, ttl time.Duration) error {
+	if data, ok := cache.get(bucketName, changeKey(key)); ok {
+		return json.Unmarshal(data, object)
+	}
+
+	generation := cache.generation.Load()
+
+	var data []byte
+	err := connection.tracedViewTx("GetObject", bucketName, func(tx *DbTransaction) error {
+		var err error
+		data, err = tx.getObjectData(bucketName, key)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := connection.plaintextObject(bucketName, key, data)
+	if err != nil {
+		// the raw strings of the version bucket are not JSON, they are decoded without the cache
+		return connection.decodeObject(bucketName, key, data, object)
+	}
+
+	cache.add(bucketName, changeKey(key), plaintext, ttl, generation)
+
+	return json.Unmarshal(plaintext, object)
+}
+
+// plaintextObject returns the JSON of an object stored as data, decrypted on an encrypted store
+func (connection *DbConnection) plaintextObject(bucketName string, key []byte, data []byte) ([]byte, error) {
+	var plaintext json.RawMessage
+	if err := connection.decodeObject(bucketName, key, data, &plaintext); err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// InvalidateCacheOnChanges invalidates the cached objects changed by the other instances, which
+// notify their changes when they are opened WithNotifyOnChange, until ctx is done
+func (connection *DbConnection) InvalidateCacheOnChanges(ctx context.Context) error {
+	events, err := connection.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for event := range events {
+			connection.cache.Load().invalidate(event.Bucket, event.Key)
+		}
+
+		log.Debug().Str("component", "postgres").Msg("stopped invalidating the object cache on changes")
+	}()
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type cachedSettings struct {
+	LogoURL string `json:"LogoURL"`
+}
+
+// expectObjectRead expects GetObject to read an object of a bucket in its own transaction
+func expectObjectRead(mock sqlmock.Sqlmock, table string, id int, data []byte) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM " + table + " WHERE id = $1")).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(data))
+	mock.ExpectCommit()
+}
+
+func Test_Cache_HitAndMiss(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EnableCache("settings", time.Minute)
+
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"logo.png"}`))
+
+	for range 3 {
+		var settings cachedSettings
+		require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+		assert.Equal(t, "logo.png", settings.LogoURL)
+	}
+
+	// the keys encoded by ConvertToKey and their decimal representation are cached alike
+	var settings cachedSettings
+	require.NoError(t, conn.GetObject("settings", []byte("1"), &settings))
+
+	hits, misses := conn.CacheStats()
+	assert.Equal(t, uint64(3), hits)
+	assert.Equal(t, uint64(1), misses)
+
+	// the buckets without cache always query the database
+	expectObjectRead(mock, "users", 1, []byte(`{}`))
+	expectObjectRead(mock, "users", 1, []byte(`{}`))
+
+	var user map[string]any
+	require.NoError(t, conn.GetObject("users", conn.ConvertToKey(1), &user))
+	require.NoError(t, conn.GetObject("users", conn.ConvertToKey(1), &user))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Cache_InvalidatedOnWrite(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EnableCache("settings", time.Minute)
+
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"logo.png"}`))
+
+	var settings cachedSettings
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE settings SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.UpdateObject("settings", conn.ConvertToKey(1), cachedSettings{LogoURL: "updated.png"}))
+
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"updated.png"}`))
+
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	assert.Equal(t, "updated.png", settings.LogoURL)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM settings WHERE id = $1")).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.DeleteObject("settings", conn.ConvertToKey(1)))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM settings WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	mock.ExpectRollback()
+
+	assert.Error(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Cache_TTLExpiry(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EnableCache("settings", 20*time.Millisecond)
+
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"logo.png"}`))
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"logo.png"}`))
+
+	var settings cachedSettings
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+
+	time.Sleep(30 * time.Millisecond)
+
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Cache_LRUEviction(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithCacheSize(1)(conn)
+	conn.EnableCache("settings", time.Minute)
+
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"one.png"}`))
+	expectObjectRead(mock, "settings", 2, []byte(`{"LogoURL":"two.png"}`))
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"one.png"}`))
+
+	var settings cachedSettings
+	for _, id := range []int{1, 2, 2, 1} {
+		require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(id), &settings))
+	}
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Cache_NotUsedInsideTransactions(t *testing.T) {
+	errRollback := errors.New("roll back")
+
+	conn, mock := newMockConnection(t)
+	conn.EnableCache("settings", time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE settings SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM settings WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"LogoURL":"uncommitted.png"}`)))
+	mock.ExpectExec(regexp.QuoteMeta("RELEASE SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := conn.UpdateTxCtx(context.Background(), func(ctx context.Context, tx portainer.Transaction) error {
+		if err := tx.UpdateObject("settings", conn.ConvertToKey(1), cachedSettings{LogoURL: "uncommitted.png"}); err != nil {
+			return err
+		}
+
+		var settings cachedSettings
+		if err := conn.WithContext(ctx).GetObject("settings", conn.ConvertToKey(1), &settings); err != nil {
+			return err
+		}
+
+		return errRollback
+	})
+	require.ErrorIs(t, err, errRollback)
+
+	hits, misses := conn.CacheStats()
+	assert.Zero(t, hits+misses)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Cache_EncryptedStore(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+	conn.EnableCache("settings", time.Minute)
+
+	data, err := conn.MarshalObjectForKey("settings", []byte("1"), cachedSettings{LogoURL: "logo.png"})
+	require.NoError(t, err)
+
+	expectObjectRead(mock, "settings", 1, data)
+
+	var settings cachedSettings
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	assert.Equal(t, "logo.png", settings.LogoURL)
+
+	cached, ok := conn.cache.Load().get("settings", "1")
+	require.True(t, ok)
+	assert.JSONEq(t, `{"LogoURL":"logo.png"}`, string(cached))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressionThreshold is the size in bytes above which MarshalObject compresses the
+// payloads once compression is enabled
+const DefaultCompressionThreshold = 16 * 1024
+
+// maxDecompressedSize bounds the memory used to decompress a payload, so that a corrupted or
+// hostile payload cannot exhaust it
+const maxDecompressedSize = 256 << 20
+
+// zstdEncoder and zstdDecoder are shared by every connection, they are safe for concurrent use
+// with EncodeAll and DecodeAll
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize), zstd.WithDecoderConcurrency(0))
+	})
+)
+
+// WithCompression makes MarshalObject compress with zstd the payloads larger than the
+// compression threshold, see WithCompressionThreshold. The payloads are compressed before they
+// are encrypted. The compressed objects are read whatever the option, their envelope tells
+// they are compressed.
+//
+// The large objects of an unencrypted store are stored in an envelope document instead of their
+// JSON document, so that UpdateObjectField, PatchObject and ExportTableCSV, which read the fields
+// of the objects in the database, return ErrCompressedStore once the option is enabled.
+func WithCompression(enabled bool) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.compression = enabled
+	}
+}
+
+// WithCompressionThreshold sets the size in bytes above which the payloads are compressed once
+// compression is enabled, DefaultCompressionThreshold by default
+func WithCompressionThreshold(threshold int) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.compressionThreshold = threshold
+	}
+}
+
+// shouldCompress returns whether MarshalObject compresses a payload of the given size
+func (connection *DbConnection) shouldCompress(size int) bool {
+	if !connection.compression {
+		return false
+	}
+
+	threshold := connection.compressionThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+
+	return size > threshold
+}
+
+// compress compresses a payload with zstd
+func compress(payload []byte) ([]byte, error) {
+	encoder, err := zstdEncoder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the zstd encoder: %w", err)
+	}
+
+	return encoder.EncodeAll(payload, make([]byte, 0, len(payload)/4)), nil
+}
+
+// decompress decompresses a payload compressed by compress
+func decompress(payload []byte) ([]byte, error) {
+	decoder, err := zstdDecoder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the zstd decoder: %w", err)
+	}
+
+	data, err := decoder.DecodeAll(payload, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress object: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,243 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSnapshotDocument returns a document shaped like the Docker snapshot of an endpoint
+// running the given number of containers
+func newSnapshotDocument(containers int) map[string]any {
+	list := make([]map[string]any, 0, containers)
+	for i := range containers {
+		list = append(list, map[string]any{
+			"Id":      fmt.Sprintf("%064x", i),
+			"Names":   []string{fmt.Sprintf("/stack_service_%d", i)},
+			"Image":   "portainer/agent:2.21.0",
+			"ImageID": fmt.Sprintf("sha256:%064x", i%7),
+			"Command": "./agent",
+			"Created": 1718000000 + i,
+			"State":   "running",
+			"Status":  "Up 3 days",
+			"Ports":   []map[string]any{{"IP": "0.0.0.0", "PrivatePort": 9001, "PublicPort": 9001 + i, "Type": "tcp"}},
+			"Labels": map[string]string{
+				"com.docker.compose.project": "stack",
+				"com.docker.compose.service": fmt.Sprintf("service_%d", i),
+				"com.docker.compose.version": "2.27.0",
+			},
+			"HostConfig": map[string]any{"NetworkMode": "stack_default"},
+			"Mounts": []map[string]any{{
+				"Type": "volume", "Name": fmt.Sprintf("stack_data_%d", i), "Destination": "/data", "Driver": "local", "RW": true,
+			}},
+		})
+	}
+
+	return map[string]any{
+		"Time":                  1718000000,
+		"DockerVersion":         "26.1.4",
+		"Swarm":                 false,
+		"TotalCPU":              8,
+		"TotalMemory":           33554432000,
+		"RunningContainerCount": containers,
+		"SnapshotRaw":           map[string]any{"Containers": list},
+	}
+}
+
+func Test_MarshalObject_Compression(t *testing.T) {
+	document := newSnapshotDocument(100)
+
+	for _, tc := range []struct {
+		compressed bool
+		encrypted  bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		t.Run(fmt.Sprintf("compressed=%t,encrypted=%t", tc.compressed, tc.encrypted), func(t *testing.T) {
+			conn := &DbConnection{compression: tc.compressed}
+			if tc.encrypted {
+				conn = encryptedConnection()
+				conn.compression = tc.compressed
+			}
+
+			data, err := conn.MarshalObjectForKey("snapshots", []byte("1"), document)
+			require.NoError(t, err)
+
+			flags, payload, ok := parseEnvelope(data)
+			require.True(t, ok)
+			assert.Equal(t, tc.compressed, flags&envelopeCompressed != 0)
+			assert.Equal(t, tc.encrypted, flags&envelopeEncrypted != 0)
+			assert.Equal(t, !tc.compressed && !tc.encrypted, json.Valid(payload))
+
+			// the compressed objects are read by a connection without compression
+			reader := &DbConnection{}
+			if tc.encrypted {
+				reader = encryptedConnection()
+			}
+
+			var got map[string]any
+			require.NoError(t, reader.UnmarshalObjectForKey("snapshots", []byte("1"), data, &got))
+
+			want, err := json.Marshal(document)
+			require.NoError(t, err)
+			gotJSON, err := json.Marshal(got)
+			require.NoError(t, err)
+			assert.JSONEq(t, string(want), string(gotJSON))
+		})
+	}
+}
+
+func Test_MarshalObject_CompressionThreshold(t *testing.T) {
+	conn := &DbConnection{}
+	WithCompression(true)(conn)
+	WithCompressionThreshold(1024)(conn)
+
+	small, err := conn.MarshalObject(map[string]string{"Name": "local"})
+	require.NoError(t, err)
+	flags, _, _ := parseEnvelope(small)
+	assert.Zero(t, flags&envelopeCompressed)
+
+	large, err := conn.MarshalObject(map[string]string{"Name": strings.Repeat("local", 1024)})
+	require.NoError(t, err)
+	flags, _, _ = parseEnvelope(large)
+	assert.NotZero(t, flags&envelopeCompressed)
+	assert.Less(t, len(large), 1024)
+}
+
+func Test_ExportTables_Compressed(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+	WithCompression(true)(conn)
+	WithCompressionThreshold(1)(conn)
+
+	data, err := conn.MarshalObjectForKey("users", conn.ConvertToKey(1), map[string]string{"Username": "admin"})
+	require.NoError(t, err)
+	flags, _, _ := parseEnvelope(data)
+	require.NotZero(t, flags&envelopeCompressed)
+
+	expectManagedTables(mock, "users")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow(1, data))
+
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTables(context.Background(), []string{"users"}, &buf, ExportFormatJSON))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	var export map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &export))
+
+	var users []map[string]any
+	require.NoError(t, json.Unmarshal(export["users"], &users))
+	assert.Equal(t, []map[string]any{{"id": float64(1), "data": map[string]any{"Username": "admin"}}}, users)
+}
+
+func Test_DbTransaction_Compression_UnencryptedStore(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithCompression(true)(conn)
+
+	document := newSnapshotDocument(100)
+
+	written := &capturedArg{}
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO snapshots (id, data) VALUES ($1, $2)")).WithArgs(1, written).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.CreateObjectWithId("snapshots", 1, document))
+
+	data, ok := written.value.([]byte)
+	require.True(t, ok)
+	require.True(t, json.Valid(data), "the JSONB column holds a JSON document")
+
+	want, err := json.Marshal(document)
+	require.NoError(t, err)
+	assert.Less(t, len(data), len(want)/2)
+
+	envelope, ok := unwrapEnvelope(data)
+	require.True(t, ok)
+	flags, _, _ := parseEnvelope(envelope)
+	assert.NotZero(t, flags&envelopeCompressed)
+	assert.Zero(t, flags&envelopeEncrypted)
+
+	// the object is read back by a connection without compression
+	reader, mock := newMockConnection(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM snapshots WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(data))
+	mock.ExpectCommit()
+
+	var got map[string]any
+	require.NoError(t, reader.GetObject("snapshots", reader.ConvertToKey(1), &got))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	gotJSON, err := json.Marshal(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(want), string(gotJSON))
+
+	// the small objects keep their JSON document
+	small := &capturedArg{}
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO snapshots (id, data) VALUES ($1, $2)")).WithArgs(2, small).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	WithCompression(true)(reader)
+	require.NoError(t, reader.CreateObjectWithId("snapshots", 2, map[string]string{"Name": "local"}))
+	assert.Equal(t, []byte(`{"Name":"local"}`), small.value)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateObjectField_CompressedStore(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithCompression(true)(conn)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	err := conn.UpdateObjectField("endpoints", []byte("1"), []string{"Status"}, 2)
+	assert.ErrorIs(t, err, ErrCompressedStore)
+
+	err = conn.PatchObject("endpoints", []byte("1"), map[string]any{"Status": 2})
+	assert.ErrorIs(t, err, ErrCompressedStore)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Benchmark_MarshalObject_Compression(b *testing.B) {
+	document := newSnapshotDocument(500)
+
+	plain, err := json.Marshal(document)
+	require.NoError(b, err)
+
+	for _, compressed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compressed=%t", compressed), func(b *testing.B) {
+			conn := encryptedConnection()
+			conn.compression = compressed
+
+			var size int
+			for range b.N {
+				data, err := conn.MarshalObject(document)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(data)
+			}
+
+			b.ReportMetric(float64(size), "stored-bytes")
+			b.ReportMetric(float64(size)/float64(len(plain)), "stored/json")
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package postgres
+
+import (
+	"testing"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/portainer/portainer/api/dataservices/conformance"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Conformance_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, conformance.ObjectsBucket, conformance.SequenceBucket, conformance.StringKeysBucket, versionBucket)
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.(*DbTransaction).SetServiceNameWithKeyType(conformance.StringKeysBucket, KeyTypeText)
+	})
+	require.NoError(t, err)
+
+	conformance.RunConnectionTests(t, conn)
+}
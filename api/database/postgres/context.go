@@ -0,0 +1,104 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	portainer "github.com/portainer/portainer/api"
+)
+
+// ErrTransactionCanceled is returned when the context of a transaction is canceled before it
+// completes, the transaction is rolled back and the statement running at that time is canceled
+var ErrTransactionCanceled = errors.New("the transaction was canceled")
+
+// canceledError wraps err into ErrTransactionCanceled when ctx was canceled. PostgreSQL reports
+// the cancellation of a statement as a query_canceled error, context.Canceled is then added to
+// the chain so that the callers can check either.
+func canceledError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrTransactionCanceled) || !errors.Is(ctx.Err(), context.Canceled) {
+		return err
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: %w", ErrTransactionCanceled, err)
+	}
+
+	return fmt.Errorf("%w: %w: %w", ErrTransactionCanceled, ctx.Err(), err)
+}
+
+// ViewTxCtx is ViewTx on behalf of ctx
+func (connection *DbConnection) ViewTxCtx(ctx context.Context, fn func(portainer.Transaction) error) error {
+	return connection.WithContext(ctx).ViewTx(fn)
+}
+
+// CreateObjectCtx is CreateObject on behalf of ctx
+func (connection *DbConnection) CreateObjectCtx(ctx context.Context, bucketName string, fn func(uint64) (int, any)) error {
+	return connection.WithContext(ctx).CreateObject(bucketName, fn)
+}
+
+// CreateObjectWithIdCtx is CreateObjectWithId on behalf of ctx
+func (connection *DbConnection) CreateObjectWithIdCtx(ctx context.Context, bucketName string, id int, obj any) error {
+	return connection.WithContext(ctx).CreateObjectWithId(bucketName, id, obj)
+}
+
+// CreateObjectWithStringIdCtx is CreateObjectWithStringId on behalf of ctx
+func (connection *DbConnection) CreateObjectWithStringIdCtx(ctx context.Context, bucketName string, id []byte, obj any) error {
+	return connection.WithContext(ctx).CreateObjectWithStringId(bucketName, id, obj)
+}
+
+// GetObjectCtx is GetObject on behalf of ctx
+func (connection *DbConnection) GetObjectCtx(ctx context.Context, bucketName string, key []byte, object any) error {
+	return connection.WithContext(ctx).GetObject(bucketName, key, object)
+}
+
+// UpdateObjectCtx is UpdateObject on behalf of ctx
+func (connection *DbConnection) UpdateObjectCtx(ctx context.Context, bucketName string, key []byte, object any) error {
+	return connection.WithContext(ctx).UpdateObject(bucketName, key, object)
+}
+
+// UpdateObjectFuncCtx is UpdateObjectFunc on behalf of ctx
+func (connection *DbConnection) UpdateObjectFuncCtx(ctx context.Context, bucketName string, key []byte, object any, updateFn func()) error {
+	return connection.WithContext(ctx).UpdateObjectFunc(bucketName, key, object, updateFn)
+}
+
+// UpdateObjectFieldCtx is UpdateObjectField on behalf of ctx
+func (connection *DbConnection) UpdateObjectFieldCtx(ctx context.Context, bucketName string, key []byte, path []string, value any) error {
+	return connection.WithContext(ctx).UpdateObjectField(bucketName, key, path, value)
+}
+
+// PatchObjectCtx is PatchObject on behalf of ctx
+func (connection *DbConnection) PatchObjectCtx(ctx context.Context, bucketName string, key []byte, patch map[string]any) error {
+	return connection.WithContext(ctx).PatchObject(bucketName, key, patch)
+}
+
+// DeleteObjectCtx is DeleteObject on behalf of ctx
+func (connection *DbConnection) DeleteObjectCtx(ctx context.Context, bucketName string, key []byte) error {
+	return connection.WithContext(ctx).DeleteObject(bucketName, key)
+}
+
+// DeleteAllObjectsCtx is DeleteAllObjects on behalf of ctx
+func (connection *DbConnection) DeleteAllObjectsCtx(ctx context.Context, bucketName string, obj any, matching func(o any) (id int, ok bool)) error {
+	return connection.WithContext(ctx).DeleteAllObjects(bucketName, obj, matching)
+}
+
+// GetAllCtx is GetAll on behalf of ctx
+func (connection *DbConnection) GetAllCtx(ctx context.Context, bucketName string, obj any, appendFn func(o any) (any, error)) error {
+	return connection.WithContext(ctx).GetAll(bucketName, obj, appendFn)
+}
+
+// GetAllModifiedSinceCtx is GetAllModifiedSince on behalf of ctx
+func (connection *DbConnection) GetAllModifiedSinceCtx(ctx context.Context, bucketName string, since time.Time, obj any, appendFn func(o any) (any, error)) error {
+	return connection.WithContext(ctx).GetAllModifiedSince(bucketName, since, obj, appendFn)
+}
+
+// GetAllWithKeyPrefixCtx is GetAllWithKeyPrefix on behalf of ctx
+func (connection *DbConnection) GetAllWithKeyPrefixCtx(ctx context.Context, bucketName string, keyPrefix []byte, obj any, appendFn func(o any) (any, error)) error {
+	return connection.WithContext(ctx).GetAllWithKeyPrefix(bucketName, keyPrefix, obj, appendFn)
+}
+
+// GetNextIdentifierCtx is GetNextIdentifierErr on behalf of ctx
+func (connection *DbConnection) GetNextIdentifierCtx(ctx context.Context, bucketName string) (int, error) {
+	return connection.WithContext(ctx).GetNextIdentifierErr(bucketName)
+}
@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_canceledError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	errQuery := errors.New("pq: canceling statement due to user request")
+
+	assert.NoError(t, canceledError(canceled, nil))
+	assert.Same(t, errQuery, canceledError(context.Background(), errQuery))
+
+	err := canceledError(canceled, errQuery)
+	require.ErrorIs(t, err, ErrTransactionCanceled)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, err, errQuery)
+
+	assert.Equal(t, err, canceledError(canceled, err))
+}
+
+func Test_GetObjectCtx_Canceled(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM slow_bucket WHERE id = $1")).WithArgs(1).
+		WillDelayFor(time.Minute).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{}`)))
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	var object map[string]any
+	err := conn.GetObjectCtx(ctx, "slow_bucket", conn.ConvertToKey(1), &object)
+	require.ErrorIs(t, err, ErrTransactionCanceled)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// database/sql rolls the transaction back in the background once its context is canceled
+	require.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_UpdateTxCtx_Canceled_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "canceled_test")
+
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.SetServiceName("canceled_test")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	err := conn.UpdateTxCtx(ctx, func(ctx context.Context, tx portainer.Transaction) error {
+		if err := tx.CreateObjectWithId("canceled_test", 1, map[string]any{"Id": 1}); err != nil {
+			return err
+		}
+
+		rawTx, err := tx.(*DbTransaction).RawTx()
+		if err != nil {
+			return err
+		}
+
+		_, err = rawTx.ExecContext(ctx, "SELECT pg_sleep(60)")
+
+		return err
+	})
+	require.ErrorIs(t, err, ErrTransactionCanceled)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	var object map[string]any
+	err = conn.GetObject("canceled_test", conn.ConvertToKey(1), &object)
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+}
@@ -0,0 +1,113 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// primaryPool is a pool of the primary, the transactions in progress on it are counted so that
+// it is closed once they are over when RotateCredentials replaces it
+type primaryPool struct {
+	db *sqlx.DB
+
+	mu       sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+// acquirePool returns the pool of the primary the transactions begin on, release must be
+// called once the transaction is over
+func (connection *DbConnection) acquirePool() (db *sqlx.DB, release func()) {
+	for {
+		pool := connection.primary.Load()
+		if pool == nil {
+			return connection.DB, func() {}
+		}
+
+		pool.mu.Lock()
+		if !pool.draining {
+			pool.inFlight.Add(1)
+			pool.mu.Unlock()
+
+			return pool.db, pool.inFlight.Done
+		}
+		pool.mu.Unlock()
+
+		// the pool was replaced in the meantime, the next load returns the new one
+	}
+}
+
+// RotateCredentials replaces the user and the password of the connection without a restart. A
+// pool connected as newUser is opened and checked, then it replaces the pool of the connection:
+// the transactions started from then on use the new credentials, while the ones in progress
+// complete on the former pool. The former pool is closed once they are over, RotateCredentials
+// waits for them until ctx is done and closes it in the background afterwards.
+//
+// The DB field of the connection is replaced as well, the copies made by WithContext beforehand
+// keep using the former pool for the queries made outside of a transaction.
+func (connection *DbConnection) RotateCredentials(ctx context.Context, newUser, newPassword string) (err error) {
+	ctx, end := connection.startSpan(ctx, "RotateCredentials", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	dsn, err := withDSNCredentials(connection.ConnectionString, newUser, newPassword)
+	if err != nil {
+		return err
+	}
+
+	db, _, err := connection.openPool(dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open the pool of user %s: %w", newUser, err)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to connect as user %s: %w", newUser, err)
+	}
+
+	connection.swapPool(ctx, db)
+	connection.ConnectionString = dsn
+
+	log.Info().Str("component", "postgres").Str("user", newUser).Msg("database credentials rotated")
+
+	return nil
+}
+
+// swapPool makes db the pool of the primary and closes the former one once its transactions
+// are over, or in the background when ctx is done first
+func (connection *DbConnection) swapPool(ctx context.Context, db *sqlx.DB) {
+	old := connection.primary.Swap(&primaryPool{db: db})
+	if old == nil {
+		old = &primaryPool{db: connection.DB}
+	}
+	connection.DB = db
+
+	old.mu.Lock()
+	old.draining = true
+	old.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		old.inFlight.Wait()
+		connection.invalidatePoolStmts(old.db)
+		if err := old.db.Close(); err != nil {
+			log.Warn().Str("component", "postgres").Err(err).Msg("failed to close the former connection pool")
+		}
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Warn().Str("component", "postgres").Err(ctx.Err()).
+			Msg("the former connection pool will be closed once the transactions in progress are over")
+	}
+}
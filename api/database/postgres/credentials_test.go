@@ -0,0 +1,138 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_swapPool_DrainsTransactionsInProgress(t *testing.T) {
+	conn, old := newMockConnection(t)
+	conn.primary.Store(&primaryPool{db: conn.DB})
+
+	db, current, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	newPool := sqlx.NewDb(db, DatabaseDriverName)
+
+	old.ExpectBegin()
+	old.ExpectQuery("SELECT data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"old"}`)))
+	old.ExpectCommit()
+	old.ExpectClose()
+
+	current.ExpectBegin()
+	current.ExpectQuery("SELECT data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"new"}`)))
+	current.ExpectCommit()
+
+	// a transaction is in progress on the former pool while the pool is swapped
+	started, resume := make(chan struct{}), make(chan struct{})
+	inFlight := make(chan error, 1)
+	go func() {
+		inFlight <- conn.UpdateTx(func(tx portainer.Transaction) error {
+			close(started)
+			<-resume
+
+			var endpoint map[string]any
+			if err := tx.GetObject("endpoints", []byte("1"), &endpoint); err != nil {
+				return err
+			}
+
+			if endpoint["Name"] != "old" {
+				return fmt.Errorf("unexpected endpoint %v", endpoint)
+			}
+
+			return nil
+		})
+	}()
+	<-started
+
+	swapped := make(chan struct{})
+	go func() {
+		conn.swapPool(context.Background(), newPool)
+		close(swapped)
+	}()
+
+	require.Eventually(t, func() bool { return conn.primary.Load().db == newPool }, time.Second, time.Millisecond)
+
+	var endpoint map[string]any
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.GetObject("endpoints", []byte("1"), &endpoint)
+	}))
+	assert.Equal(t, "new", endpoint["Name"])
+
+	// the former pool is closed once its transaction is over
+	select {
+	case <-swapped:
+		t.Fatal("the former pool was closed with a transaction in progress")
+	default:
+	}
+
+	close(resume)
+	require.NoError(t, <-inFlight)
+	<-swapped
+
+	require.NoError(t, old.ExpectationsWereMet())
+	require.NoError(t, current.ExpectationsWereMet())
+}
+
+func Test_swapPool_ContextDone(t *testing.T) {
+	conn, old := newMockConnection(t)
+	conn.primary.Store(&primaryPool{db: conn.DB})
+
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	old.ExpectClose()
+
+	// the transaction in progress is never over within the deadline
+	_, release := conn.acquirePool()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	conn.swapPool(ctx, sqlx.NewDb(db, DatabaseDriverName))
+
+	release()
+	require.Eventually(t, func() bool { return old.ExpectationsWereMet() == nil }, time.Second, time.Millisecond)
+}
+
+func Test_RotateCredentials_RealDatabase(t *testing.T) {
+	const role = "portainer_rotated_test"
+
+	admin := newTestConnection(t)
+	dropTestTables(t, admin, "rotated_test")
+
+	require.NoError(t, admin.SetServiceName("rotated_test"))
+	require.NoError(t, admin.CreateObjectWithId("rotated_test", 1, map[string]any{"Name": "first"}))
+
+	var user string
+	require.NoError(t, admin.Get(&user, "SELECT current_user"))
+
+	_, err := admin.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %[1]s; CREATE ROLE %[1]s LOGIN PASSWORD 'rotated'; GRANT %[2]s TO %[1]s", role, pq.QuoteIdentifier(user)))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		admin.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %s", role))
+	})
+
+	conn := newTestConnection(t)
+	require.Error(t, conn.RotateCredentials(context.Background(), role, "wrong"))
+
+	require.NoError(t, conn.RotateCredentials(context.Background(), role, "rotated"))
+	t.Cleanup(func() { conn.Close() })
+
+	require.NoError(t, conn.Get(&user, "SELECT current_user"))
+	assert.Equal(t, role, user)
+
+	var object map[string]any
+	require.NoError(t, conn.GetObject("rotated_test", conn.ConvertToKey(1), &object))
+	assert.Equal(t, "first", object["Name"])
+	require.NoError(t, conn.CreateObjectWithId("rotated_test", 2, map[string]any{"Name": "second"}))
+}
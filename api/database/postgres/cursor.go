@@ -0,0 +1,124 @@
+package postgres
+
+import (
+	"fmt"
+)
+
+// BucketCursor simulates bolt.Cursor on top of a server-side cursor over the rows of a bucket
+// ordered by key. The cursor is declared by the first navigation and closed with the transaction.
+// Like bolt.Cursor, the navigation methods return a nil key once there is no more pair, the
+// errors are logged.
+type BucketCursor struct {
+	bucket   *PostgresBucket
+	name     string
+	declared bool
+}
+
+// Cursor creates a cursor over the key/value pairs of the bucket
+func (b *PostgresBucket) Cursor() *BucketCursor {
+	b.tx.cursors++
+
+	return &BucketCursor{
+		bucket: b,
+		name:   fmt.Sprintf("%s_cursor_%d", b.bucketName, b.tx.cursors),
+	}
+}
+
+// First moves the cursor to the first pair of the bucket and returns it
+func (c *BucketCursor) First() (key, value []byte) {
+	return c.fetch("FIRST")
+}
+
+// Last moves the cursor to the last pair of the bucket and returns it
+func (c *BucketCursor) Last() (key, value []byte) {
+	return c.fetch("LAST")
+}
+
+// Next moves the cursor to the next pair and returns it, it returns nil, nil at the end of the bucket
+func (c *BucketCursor) Next() (key, value []byte) {
+	return c.fetch("NEXT")
+}
+
+// Seek moves the cursor to the first pair whose key is greater than or equal to seek and
+// returns it, it returns nil, nil when there is none
+func (c *BucketCursor) Seek(seek []byte) (key, value []byte) {
+	if len(seek) == 0 {
+		return c.First()
+	}
+
+	id, err := keyToID(seek)
+	if err != nil {
+		c.logError(err, "invalid cursor seek key")
+		return nil, nil
+	}
+
+	if err := c.declare(); err != nil {
+		return nil, nil
+	}
+
+	// the cursor is moved onto the last pair before seek, so that the next one is fetched
+	var position int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id < $1", c.bucket.table())
+	if err := c.bucket.tx.tx.tx.GetContext(c.bucket.tx.ctx, &position, query, id); err != nil {
+		c.logError(err, "failed to seek the cursor")
+		return nil, nil
+	}
+
+	if _, err := c.bucket.tx.tx.tx.ExecContext(c.bucket.tx.ctx, fmt.Sprintf("MOVE ABSOLUTE %d IN %s", position, c.name)); err != nil {
+		c.logError(err, "failed to seek the cursor")
+		return nil, nil
+	}
+
+	return c.fetch("NEXT")
+}
+
+// declare declares the server-side cursor on first use
+func (c *BucketCursor) declare() error {
+	if c.declared {
+		return nil
+	}
+
+	query := fmt.Sprintf("DECLARE %s SCROLL CURSOR FOR SELECT id, data FROM %s ORDER BY id", c.name, c.bucket.table())
+	if _, err := c.bucket.tx.tx.tx.ExecContext(c.bucket.tx.ctx, query); err != nil {
+		c.logError(err, "failed to declare the cursor")
+		return err
+	}
+
+	c.declared = true
+
+	return nil
+}
+
+// fetch fetches the pair found in direction, the keys are encoded as by ConvertToKey
+func (c *BucketCursor) fetch(direction string) (key, value []byte) {
+	if err := c.declare(); err != nil {
+		return nil, nil
+	}
+
+	rows, err := c.bucket.tx.tx.tx.QueryContext(c.bucket.tx.ctx, fmt.Sprintf("FETCH %s FROM %s", direction, c.name))
+	if err != nil {
+		c.logError(err, "failed to fetch from the cursor")
+		return nil, nil
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			c.logError(err, "failed to fetch from the cursor")
+		}
+
+		return nil, nil
+	}
+
+	var id int
+	if err := rows.Scan(&id, &value); err != nil {
+		c.logError(err, "failed to fetch from the cursor")
+		return nil, nil
+	}
+
+	return c.bucket.tx.tx.conn.ConvertToKey(id), value
+}
+
+func (c *BucketCursor) logError(err error, msg string) {
+	ctxLogger(c.bucket.tx.ctx).Error().Str("component", "postgres").Err(err).Str("bucket", c.bucket.bucketName).Msg(msg)
+}
@@ -0,0 +1,158 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func expectFetch(mock sqlmock.Sqlmock, direction string, ids ...int) {
+	rows := sqlmock.NewRows([]string{"id", "data"})
+	for _, id := range ids {
+		rows.AddRow(id, []byte(`{}`))
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FETCH " + direction + " FROM endpoints_cursor_1")).WillReturnRows(rows)
+}
+
+func Test_BucketCursor(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectExec(regexp.QuoteMeta("DECLARE endpoints_cursor_1 SCROLL CURSOR FOR SELECT id, data FROM endpoints ORDER BY id")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectFetch(mock, "FIRST", 1)
+	expectFetch(mock, "NEXT", 2)
+	expectFetch(mock, "NEXT", 3)
+	expectFetch(mock, "NEXT")
+	expectFetch(mock, "LAST", 3)
+	expectFetch(mock, "NEXT")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM endpoints WHERE id < $1")).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("MOVE ABSOLUTE 1 IN endpoints_cursor_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectFetch(mock, "NEXT", 2)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM endpoints WHERE id < $1")).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectExec(regexp.QuoteMeta("MOVE ABSOLUTE 3 IN endpoints_cursor_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectFetch(mock, "NEXT")
+	expectFetch(mock, "FIRST", 1)
+	mock.ExpectCommit()
+
+	err := store.View(func(tx *PostgresTx) error {
+		c := tx.Bucket([]byte("endpoints")).Cursor()
+
+		k, v := c.First()
+		assert.Equal(t, conn.ConvertToKey(1), k)
+		assert.Equal(t, []byte(`{}`), v)
+
+		k, _ = c.Next()
+		assert.Equal(t, conn.ConvertToKey(2), k)
+		k, _ = c.Next()
+		assert.Equal(t, conn.ConvertToKey(3), k)
+
+		// the end of the bucket
+		k, v = c.Next()
+		assert.Nil(t, k)
+		assert.Nil(t, v)
+
+		k, _ = c.Last()
+		assert.Equal(t, conn.ConvertToKey(3), k)
+		k, _ = c.Next()
+		assert.Nil(t, k)
+
+		k, _ = c.Seek(conn.ConvertToKey(2))
+		assert.Equal(t, conn.ConvertToKey(2), k)
+
+		// past the last key
+		k, _ = c.Seek([]byte("4"))
+		assert.Nil(t, k)
+
+		// an empty key seeks to the start of the bucket
+		k, _ = c.Seek(nil)
+		assert.Equal(t, conn.ConvertToKey(1), k)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_BucketCursor_EmptyBucket(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectExec(regexp.QuoteMeta("DECLARE endpoints_cursor_1 SCROLL CURSOR")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectFetch(mock, "FIRST")
+	expectFetch(mock, "LAST")
+	mock.ExpectCommit()
+
+	err := store.View(func(tx *PostgresTx) error {
+		c := tx.Bucket([]byte("endpoints")).Cursor()
+
+		k, v := c.First()
+		assert.Nil(t, k)
+		assert.Nil(t, v)
+
+		k, v = c.Last()
+		assert.Nil(t, k)
+		assert.Nil(t, v)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_BucketCursor_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "cursor_test")
+	store := &PostgresStore{conn: conn}
+
+	err := store.Update(func(tx *PostgresTx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("cursor_test"))
+		if err != nil {
+			return err
+		}
+
+		for _, id := range []int{2, 4, 6} {
+			if err := b.Put(conn.ConvertToKey(id), []byte(`{}`)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = store.View(func(tx *PostgresTx) error {
+		c := tx.Bucket([]byte("cursor_test")).Cursor()
+
+		k, _ := c.First()
+		assert.Equal(t, conn.ConvertToKey(2), k)
+		k, _ = c.Next()
+		assert.Equal(t, conn.ConvertToKey(4), k)
+
+		k, _ = c.Seek(conn.ConvertToKey(5))
+		assert.Equal(t, conn.ConvertToKey(6), k)
+		k, _ = c.Next()
+		assert.Nil(t, k)
+
+		k, _ = c.Seek(conn.ConvertToKey(1))
+		assert.Equal(t, conn.ConvertToKey(2), k)
+
+		k, _ = c.Seek(conn.ConvertToKey(7))
+		assert.Nil(t, k)
+
+		k, _ = c.Last()
+		assert.Equal(t, conn.ConvertToKey(6), k)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
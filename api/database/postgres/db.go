@@ -1,26 +1,40 @@
 package postgres
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	portainer "github.com/portainer/portainer/api"
+	"github.com/portainer/portainer/api/database/postgres/migrations"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	_ portainer.Connection  = (*DbConnection)(nil)
+	_ portainer.Transaction = (*DbTransaction)(nil)
 )
 
 const (
 	// Database configuration constants
 	DatabaseDriverName = "postgres"
-	DatabaseMaxOpen   = 25
-	DatabaseMaxIdle   = 25
-	DatabaseTimeout   = 5 * time.Minute
+	DatabaseMaxOpen    = 25
+	DatabaseMaxIdle    = 25
+	DatabaseTimeout    = 5 * time.Minute
 
 	// Metadata table names
 	EncryptedMetadataTable   = "encrypted_metadata"
@@ -30,44 +44,204 @@ const (
 var (
 	ErrHaveEncryptedAndUnencrypted = errors.New("portainer has detected both an encrypted and un-encrypted database and cannot start")
 	ErrHaveEncryptedWithNoKey      = errors.New("the portainer database is encrypted, but no secret was loaded")
-	ErrNoConnection               = errors.New("database connection is not initialized")
+	ErrNoConnection                = errors.New("database connection is not initialized")
+	ErrInvalidTableName            = errors.New("invalid table name")
+	ErrDuplicateKey                = errors.New("an object with the same key already exists")
+	ErrTableNotFound               = errors.New("table not found")
+	ErrEncryptedStore              = errors.New("the operation is not supported on an encrypted store")
+	ErrCompressedStore             = errors.New("the operation is not supported when compression is enabled")
 )
 
 // DbConnection represents a PostgreSQL database connection
 type DbConnection struct {
 	ConnectionString string
-	Path            string
-	EncryptionKey   []byte
-	isEncrypted     bool
-	ctx             context.Context
-	cancelFunc      context.CancelFunc
+	Path             string
+	EncryptionKey    []byte
+	isEncrypted      bool
+	changeTracking   bool
+	ctx              context.Context
+	cancelFunc       context.CancelFunc
+
+	instanceLockMode InstanceLockMode
+	pgBouncerMode    bool
+	cacheStatements  bool
+
+	maxTxRetries int
+	txOptions    TxOptions
+
+	statementTimeout   time.Duration
+	lockTimeout        time.Duration
+	slowQueryThreshold time.Duration
+
+	maxOpenConns int
+	maxIdleConns int
+
+	cacheSize int
+
+	// encryptionBatchSize is the number of objects per transaction of MigrateEncryption
+	encryptionBatchSize int
+
+	// compression makes MarshalObject compress the payloads larger than compressionThreshold
+	compression          bool
+	compressionThreshold int
+
+	// bootstrapDSN is the connection string Open creates the database with, see WithBootstrap
+	bootstrapDSN string
+
+	// tlsConfig encrypts the connections to the server, see SetTLSConfig
+	tlsConfig *tls.Config
+
+	replicaConfig ReplicaConfig
+	replica       *sqlx.DB
+
+	// reader is the pool of the read-only role, see WithReadOnlyRole
+	readerUser     string
+	readerPassword string
+	reader         *sqlx.DB
+
+	// embedded is the server started by Open and stopped by Close, see NewEmbeddedConnection
+	embedded *embeddedServer
+
+	notifyOnChange bool
+
+	// auditLog makes the transactions record their changes in AuditTable
+	auditLog       bool
+	auditRetention time.Duration
+
+	// auditTriggers is set by EnableAuditLog, the tables of the buckets record their changes in
+	// AuditLogTable
+	auditTriggers bool
+
+	// trackDeletions makes the transactions record the objects they delete in DeletionsTable
+	trackDeletions bool
+
+	// schema holds the tables instead of public and tablePrefix is prepended to their name,
+	// so that the tables can be hosted in a shared database
+	schema      string
+	tablePrefix string
 
+	tracer trace.Tracer
+
+	*connectionState
 	*sqlx.DB
 }
 
+// connectionState is the state of a connection shared with the copies made by WithContext
+type connectionState struct {
+	instanceLock *sqlx.Conn
+	// instanceTableLock replaces instanceLock in pgBouncer mode
+	instanceTableLock *tableLock
+	instanceLockMu    sync.Mutex
+
+	// shuttingDown is set by Shutdown, which waits for activeTxs
+	shuttingDown bool
+	shutdownMu   sync.RWMutex
+	activeTxs    sync.WaitGroup
+
+	txRetries atomic.Uint64
+
+	tableStats sync.Map
+
+	// sequences holds the names of the bucket sequences known to exist
+	sequences sync.Map
+
+	// keyTypes holds the key type of the buckets found in the bucket registry
+	keyTypes sync.Map
+
+	// timestamped holds the buckets whose table is known to have the timestamp columns
+	timestamped sync.Map
+
+	// replicaDegraded is set while the read replica is unreachable or lagging
+	replicaDegraded atomic.Bool
+
+	// cache is created by the first EnableCache call
+	cache     atomic.Pointer[objectCache]
+	cacheOnce sync.Once
+
+	// stmts holds the prepared statements of the hot CRUD paths by stmtKey
+	stmts sync.Map
+
+	txWarnThreshold     atomic.Int64
+	txCriticalThreshold atomic.Int64
+	txDurations         durationRing
+
+	// openTxs holds the transactions in progress watched by watchTransactions, by ID
+	openTxs         sync.Map
+	nextTxID        atomic.Uint64
+	txHardLimit     atomic.Int64
+	watchdogRunning atomic.Bool
+
+	// primary is the pool of the primary the transactions begin on, see RotateCredentials
+	primary atomic.Pointer[primaryPool]
+
+	// encryptionProgress is published by MigrateEncryption, see MigrationProgress
+	encryptionProgress atomic.Pointer[MigrationProgress]
+}
+
+// ConnectionOption configures a DbConnection before it is opened
+type ConnectionOption func(*DbConnection)
+
 // NewConnection creates a new database connection
-func NewConnection(connectionString string, encryptionKey []byte) (*DbConnection, error) {
+func NewConnection(connectionString string, encryptionKey []byte, opts ...ConnectionOption) (*DbConnection, error) {
 	ctx, cancel := context.WithCancel(context.Background())
-	
+
 	conn := &DbConnection{
 		ConnectionString: connectionString,
-		Path:            connectionString,
-		EncryptionKey:   encryptionKey,
-		ctx:             ctx,
-		cancelFunc:      cancel,
+		Path:             connectionString,
+		EncryptionKey:    encryptionKey,
+		ctx:              ctx,
+		cancelFunc:       cancel,
+		maxTxRetries:     DefaultMaxTxRetries,
+		statementTimeout: DefaultStatementTimeout,
+		lockTimeout:      DefaultLockTimeout,
+		maxOpenConns:     DatabaseMaxOpen,
+		maxIdleConns:     DatabaseMaxIdle,
+		cacheStatements:  true,
+		connectionState:  &connectionState{},
+	}
+
+	for _, opt := range opts {
+		opt(conn)
 	}
 
 	if err := conn.Open(); err != nil {
 		cancel()
-		return nil, err
+		return nil, fmt.Errorf("failed to open %s: %w", redactDSN(connectionString), err)
 	}
 
 	return conn, nil
 }
 
-// GetStorePath returns the connection string path
+// WithContext returns a shallow copy of the connection carrying ctx, so that the deadline, the
+// cancellation and the tracing span of a request apply to the operations made through it. The
+// copy shares the pool, the caches and the instance lock of the connection, closing either of
+// them closes both.
+func (connection *DbConnection) WithContext(ctx context.Context) *DbConnection {
+	copied := *connection
+	copied.ctx = ctx
+
+	return &copied
+}
+
+// GetDatabaseFileName returns the name of the database, PostgreSQL does not keep it in a file
+func (connection *DbConnection) GetDatabaseFileName() string {
+	return databaseName(connection.ConnectionString)
+}
+
+// GetDatabaseFilePath returns the redacted connection string, the database is not a file that
+// can be copied
+func (connection *DbConnection) GetDatabaseFilePath() string {
+	return redactDSN(connection.ConnectionString)
+}
+
+// GetStorePath returns the connection string with its password masked by MaskDSN, or the
+// data directory of an embedded server
 func (connection *DbConnection) GetStorePath() string {
-	return connection.Path
+	if connection.embedded != nil {
+		return connection.Path
+	}
+
+	return redactDSN(connection.Path)
 }
 
 func (connection *DbConnection) SetEncrypted(flag bool) {
@@ -78,40 +252,61 @@ func (connection *DbConnection) SetEncrypted(flag bool) {
 func (connection *DbConnection) IsEncryptedStore() bool {
 	return connection.getEncryptionKey() != nil
 }
+
+// ConvertToKey encodes an integer id as a bucket key, the 8 bytes of its two's complement in
+// big-endian order. 0 is a valid id, and a negative id keeps its sign through keyToID rather
+// than wrapping around to a large positive one, so that it matches no row instead of another.
 func (connection *DbConnection) ConvertToKey(key int) []byte {
 	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, uint64(key))
-    return b
+	binary.BigEndian.PutUint64(b, uint64(int64(key)))
+	return b
+}
+
+// keyToID converts a bucket key to the value of the integer id column. Keys are
+// either the decimal representation of the id or the encoding from ConvertToKey.
+func keyToID(key []byte) (int, error) {
+	if len(key) > 0 && bytes.IndexFunc(key, func(r rune) bool { return r < '0' || r > '9' }) == -1 {
+		return strconv.Atoi(string(key))
+	}
+
+	if len(key) == 8 {
+		return int(int64(binary.BigEndian.Uint64(key))), nil
+	}
+
+	return 0, fmt.Errorf("unsupported key %q", key)
 }
+
 // NeedsEncryptionMigration checks if database needs encryption migration
-func (connection *DbConnection) NeedsEncryptionMigration() (bool, error) {
+func (connection *DbConnection) NeedsEncryptionMigration() (needed bool, err error) {
+	ctx, end := connection.startSpan(connection.ctx, "NeedsEncryptionMigration", "")
+	defer func() { end(err) }()
+
 	if connection.DB == nil {
 		return false, ErrNoConnection
 	}
 
-	checkTableExists := func(tableName string) (bool, error) {
-		var exists bool
-		query := `
-			SELECT EXISTS (
-				SELECT FROM information_schema.tables 
-				WHERE table_schema = 'public' 
-				AND table_name = $1
-			);`
-		err := connection.QueryRowx(query, tableName).Scan(&exists)
-		return exists, err
-	}
-
-	haveUnencrypted, err := checkTableExists(UnencryptedMetadataTable)
+	haveUnencrypted, err := connection.tableExists(ctx, connection.DB, UnencryptedMetadataTable)
 	if err != nil {
 		return false, fmt.Errorf("failed to check unencrypted table: %w", err)
 	}
 
-	haveEncrypted, err := checkTableExists(EncryptedMetadataTable)
+	haveEncrypted, err := connection.tableExists(ctx, connection.DB, EncryptedMetadataTable)
 	if err != nil {
 		return false, fmt.Errorf("failed to check encrypted table: %w", err)
 	}
 
+	// a migration interrupted by a restart left some buckets encrypted, MigrateEncryption resumes
+	// it. The store is still encrypted while RemoveEncryption is interrupted.
+	pending, err := connection.pendingMigration(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s table: %w", MigrationStateTable, err)
+	}
+
 	switch {
+	case pending != "" && connection.EncryptionKey == nil:
+		return false, ErrHaveEncryptedWithNoKey
+	case pending == migrationEncrypt:
+		return true, nil
 	case haveUnencrypted && haveEncrypted:
 		return false, ErrHaveEncryptedAndUnencrypted
 	case haveUnencrypted && connection.EncryptionKey != nil:
@@ -124,138 +319,497 @@ func (connection *DbConnection) NeedsEncryptionMigration() (bool, error) {
 }
 
 // Open opens and initializes the PostgreSQL database connection
-func (connection *DbConnection) Open() error {
-	log.Info().Str("connection", connection.ConnectionString).Msg("connecting to PostgreSQL database")
+func (connection *DbConnection) Open() (err error) {
+	_, end := connection.startSpan(connection.ctx, "Open", "")
+	defer func() { end(err) }()
+
+	log.Info().Str("component", "postgres").Str("connection", redactDSN(connection.ConnectionString)).Msg("connecting to PostgreSQL database")
+
+	if err := connection.validateNamespace(); err != nil {
+		return err
+	}
 
-	db, err := sqlx.Connect(DatabaseDriverName, connection.ConnectionString)
+	if connection.embedded != nil {
+		if err := connection.embedded.start(); err != nil {
+			return err
+		}
+
+		defer func() {
+			if err != nil {
+				connection.embedded.stop()
+			}
+		}()
+	}
+
+	if connection.bootstrapDSN != "" {
+		if err := ensureDatabase(connection.ctx, connection.bootstrapDSN, databaseName(connection.ConnectionString)); err != nil {
+			return err
+		}
+	}
+
+	db, connector, err := connection.openPool(connection.ConnectionString)
 	if err != nil {
 		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	// Configure connection pool
-	db.SetMaxOpenConns(DatabaseMaxOpen)
-	db.SetMaxIdleConns(DatabaseMaxIdle)
-	db.SetConnMaxLifetime(DatabaseTimeout)
-
 	// Verify connection
 	if err := db.PingContext(connection.ctx); err != nil {
+		db.Close()
 		return fmt.Errorf("failed to verify database connection: %w", err)
 	}
 
+	log.Info().Str("component", "postgres").Str("host", connector.Host()).Msg("connected to PostgreSQL database")
+
+	// the connections of the pool already use the schema as search_path
+	if connection.schema != "" {
+		if _, err := db.ExecContext(connection.ctx, "CREATE SCHEMA IF NOT EXISTS "+connection.schema); err != nil {
+			db.Close()
+			return fmt.Errorf("failed to create schema %s: %w", connection.schema, err)
+		}
+	}
+
+	// the missing privileges would otherwise surface as failures of the migrations
+	if err := connection.verifyPrivileges(connection.ctx, db); err != nil {
+		db.Close()
+		return err
+	}
+
+	// Only one instance at a time may run the migrations and generate identifiers
+	if connection.instanceLockMode != InstanceLockDisabled {
+		locked, err := connection.lockInstance(connection.ctx, db, connection.instanceLockMode == InstanceLockWait)
+		if err != nil {
+			db.Close()
+			return err
+		}
+
+		if !locked {
+			db.Close()
+			return ErrInstanceLocked
+		}
+	}
+
+	if err := migrations.RunMigrations(connection.ctx, db, connection.tablePrefix, connection.newTransaction); err != nil {
+		connection.ReleaseInstanceLock()
+		db.Close()
+		return fmt.Errorf("failed to migrate database schema: %w", err)
+	}
+
+	// DeletionsTable is created by the schema migrations
+	connection.trackDeletions = true
+
+	if err := connection.loadKeyTypes(connection.ctx, db); err != nil {
+		connection.ReleaseInstanceLock()
+		db.Close()
+		return err
+	}
+
+	if connection.auditLog {
+		if err := connection.ensureAuditTable(connection.ctx, db); err != nil {
+			connection.ReleaseInstanceLock()
+			db.Close()
+			return err
+		}
+
+		go connection.sweepAuditLog(connection.ctx)
+	}
+
+	if connection.replicaConfig.ConnectionString != "" {
+		connection.openReadReplica()
+	}
+
+	if connection.readerUser != "" {
+		connection.openReaderPool()
+	}
+
 	connection.DB = db
+	connection.primary.Store(&primaryPool{db: db})
 	return nil
 }
 
+// openPool returns a connection pool to dsn, configured like the connection. The
+// connections are opened lazily.
+func (connection *DbConnection) openPool(dsn string) (*sqlx.DB, *hostConnector, error) {
+	if connection.pgBouncerMode {
+		// the session settings are set for each transaction by beginTx
+		dsn = pgBouncerConnectionString(dsn)
+	} else {
+		dsn = connection.searchPathConnectionString(connection.timeoutConnectionString(dsn))
+	}
+
+	// the connections are switched to TLS by the dialer rather than by lib/pq
+	if connection.tlsConfig != nil {
+		var err error
+		if dsn, err = withDSNParameter(dsn, "sslmode", "disable"); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	connector, err := newHostConnector(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if connection.tlsConfig != nil {
+		connector.setDialer(&tlsDialer{config: connection.tlsConfig})
+	}
+
+	db := sqlx.NewDb(sql.OpenDB(connection.wrapConnector(connector)), DatabaseDriverName)
+	connection.configurePool(db)
+
+	return db, connector, nil
+}
+
 // Close closes the PostgreSQL database connection
-func (connection *DbConnection) Close() error {
-	log.Info().Msg("closing PostgreSQL connection")
+func (connection *DbConnection) Close() (err error) {
+	_, end := connection.startSpan(connection.ctx, "Close", "")
+	defer func() { end(err) }()
+
+	log.Info().Str("component", "postgres").Msg("closing PostgreSQL connection")
 
 	if connection.cancelFunc != nil {
 		connection.cancelFunc()
 	}
 
+	if err := connection.ReleaseInstanceLock(); err != nil {
+		log.Warn().Str("component", "postgres").Err(err).Msg("failed to release the instance lock")
+	}
+
+	if connection.replica != nil {
+		if err := connection.replica.Close(); err != nil {
+			log.Warn().Str("component", "postgres").Err(err).Msg("failed to close the read replica connection")
+		}
+	}
+
+	if connection.reader != nil {
+		if err := connection.reader.Close(); err != nil {
+			log.Warn().Str("component", "postgres").Err(err).Msg("failed to close the pool of the read-only role")
+		}
+	}
+
+	connection.invalidateStmts("")
+
 	if connection.DB != nil {
-		return connection.DB.Close()
+		err = connection.DB.Close()
 	}
 
-	return nil
+	if connection.embedded != nil {
+		if stopErr := connection.embedded.stop(); stopErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to stop the embedded PostgreSQL server: %w", stopErr))
+		}
+	}
+
+	return err
 }
 
-// UpdateTx executes the given function within a transaction
+// UpdateTx executes the given function within a transaction. The transaction is retried
+// when it is aborted by a serialization failure or a deadlock, fn must therefore be safe to
+// run several times and must not have side effects outside of the transaction.
 func (connection *DbConnection) UpdateTx(fn func(portainer.Transaction) error) error {
-	if connection.DB == nil {
-		return ErrNoConnection
+	return connection.tracedTx("UpdateTx", "", connection.txOptions, func(tx *DbTransaction) error {
+		return fn(tx)
+	})
+}
+
+// ViewTx executes a read-only transaction, on the read replica or with the read-only role when
+// one is configured
+func (connection *DbConnection) ViewTx(fn func(portainer.Transaction) error) error {
+	return connection.tracedViewTx("ViewTx", "", func(tx *DbTransaction) error {
+		return fn(tx)
+	})
+}
+
+// UpdateTxWithOptions executes the given function within a transaction using the given
+// isolation level and access mode, it is retried like UpdateTx
+func (connection *DbConnection) UpdateTxWithOptions(opts TxOptions, fn func(portainer.Transaction) error) error {
+	return connection.tracedTx("UpdateTxWithOptions", "", opts, func(tx *DbTransaction) error {
+		return fn(tx)
+	})
+}
+
+// updateTx runs fn inside a new transaction using the default transaction options of the connection
+func (connection *DbConnection) updateTx(fn func(*DbTransaction) error) error {
+	return connection.updateTxWithOptions(connection.ctx, connection.txOptions, fn)
+}
+
+// tracedTx runs fn inside a new transaction within the span of operation, the operations
+// made by fn are traced as its children
+func (connection *DbConnection) tracedTx(operation, table string, opts TxOptions, fn func(*DbTransaction) error) error {
+	return connection.tracedTxCtx(connection.ctx, operation, table, opts, fn)
+}
+
+// tracedTxCtx is tracedTx on behalf of ctx, fn runs within a savepoint of the transaction
+// carried by ctx, if any, rather than inside a new transaction
+func (connection *DbConnection) tracedTxCtx(ctx context.Context, operation, table string, opts TxOptions, fn func(*DbTransaction) error) (err error) {
+	if tx, ok := TxFromContext(ctx); ok {
+		return tx.withSavepoint(operation, table, fn)
 	}
 
-	tx, err := connection.BeginTxx(connection.ctx, nil)
+	done, err := connection.trackTx()
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return err
+	}
+	defer done()
+
+	ctx, end := connection.startTx(ctx, operation, table)
+	defer func() { end(err) }()
+
+	return connection.updateTxWithOptions(ctx, opts, fn)
+}
+
+// tracedViewTx runs fn inside a new read transaction within the span of operation, or within
+// a savepoint of the transaction carried by the context of the connection
+func (connection *DbConnection) tracedViewTx(operation, table string, fn func(*DbTransaction) error) (err error) {
+	if tx, ok := TxFromContext(connection.ctx); ok {
+		return tx.withSavepoint(operation, table, readOnlyTx(fn))
+	}
+
+	done, err := connection.trackTx()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	ctx, end := connection.startTx(connection.ctx, operation, table)
+	defer func() { end(err) }()
+
+	return connection.viewTx(ctx, fn)
+}
+
+// readOnlyTx marks the transaction passed to fn as read-only
+func readOnlyTx(fn func(*DbTransaction) error) func(*DbTransaction) error {
+	return func(tx *DbTransaction) error {
+		tx.readOnly = true
+
+		return fn(tx)
+	}
+}
+
+// updateTxWithOptions runs fn inside a new transaction, retrying it on serialization failures and deadlocks
+func (connection *DbConnection) updateTxWithOptions(ctx context.Context, opts TxOptions, fn func(*DbTransaction) error) error {
+	setTx, err := opts.statement()
+	if err != nil {
+		return err
+	}
+
+	if opts.ReadOnly {
+		fn = readOnlyTx(fn)
+	}
+
+	for retry := 0; ; retry++ {
+		db, release := connection.acquirePool()
+		err := connection.runTx(ctx, db, setTx, fn)
+		release()
+		if err == nil || retry >= connection.maxTxRetries || !isRetryableTxError(err) {
+			return timeoutError(err)
+		}
+
+		connection.txRetries.Add(1)
+
+		delay := txRetryBackoff(retry)
+		ctxLogger(ctx).Debug().Str("component", "postgres").Err(err).Int("retry", retry+1).Dur("delay", delay).Msg("retrying transaction")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return canceledError(ctx, err)
+		}
+	}
+}
+
+// runTx runs fn inside a new transaction, committing on success and rolling back otherwise.
+// The SET TRANSACTION statement setTx is executed first unless it is empty.
+func (connection *DbConnection) runTx(ctx context.Context, db *sqlx.DB, setTx string, fn func(*DbTransaction) error) error {
+	pgTx, err := connection.beginTx(ctx, db, setTx)
+	if err != nil {
+		return canceledError(ctx, err)
 	}
 
 	defer func() {
 		if p := recover(); p != nil {
-			tx.Rollback()
+			pgTx.tx.Rollback()
+			pgTx.release()
 			panic(p)
 		}
 	}()
 
+	if err := fn(pgTx); err != nil {
+		pgTx.rollback()
+		return canceledError(ctx, abortedError(pgTx.ctx, err))
+	}
+
+	return canceledError(ctx, abortedError(pgTx.ctx, pgTx.commit()))
+}
+
+// beginTx begins a new transaction carried by its own context, the SET TRANSACTION statement
+// setTx is executed first unless it is empty. The transaction is watched until it is released,
+// canceling its context rolls it back.
+func (connection *DbConnection) beginTx(ctx context.Context, db *sqlx.DB, setTx string) (*DbTransaction, error) {
+	if db == nil {
+		return nil, ErrNoConnection
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		cancel(nil)
+		return nil, fmt.Errorf("%w: %w", errBeginTx, translateError(err))
+	}
+
+	// the statements of setTx come next so that the options of the transaction take precedence
+	if settings := connection.transactionSettings(); settings != "" {
+		if _, err := tx.ExecContext(ctx, settings); err != nil {
+			tx.Rollback()
+			cancel(nil)
+			return nil, fmt.Errorf("failed to apply the session settings: %w", err)
+		}
+	}
+
+	if setTx != "" {
+		if _, err := tx.ExecContext(ctx, setTx); err != nil {
+			tx.Rollback()
+			cancel(nil)
+			return nil, fmt.Errorf("failed to set transaction options: %w", err)
+		}
+	}
+
 	pgTx := &DbTransaction{
-		conn: connection,
-		tx:   tx,
+		conn:    connection,
+		tx:      tx,
+		db:      db,
+		watched: connection.registerTx(ctx, cancel),
 	}
+	pgTx.ctx = context.WithValue(ctx, txContextKey{}, pgTx)
 
-	if err := fn(pgTx); err != nil {
-		if rbErr := tx.Rollback(); rbErr != nil {
-			log.Error().Err(rbErr).Msg("failed to rollback transaction")
+	if connection.auditTriggers {
+		pgTx.BeforeCommit(pgTx.recordAuditLogActor)
+	}
+
+	return pgTx, nil
+}
+
+// commit notifies the changes of the transaction and commits it
+func (tx *DbTransaction) commit() error {
+	tx.closed.Store(true)
+	defer tx.release()
+
+	for _, fn := range tx.beforeCommit {
+		if err := fn(); err != nil {
+			tx.tx.Rollback()
+			return err
 		}
+	}
+
+	if err := tx.notifyChanges(); err != nil {
+		tx.tx.Rollback()
+		return err
+	}
+
+	if err := tx.tx.Commit(); err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	tx.invalidateCommitted()
+
+	return nil
 }
 
-// ViewTx executes a read-only transaction
-func (connection *DbConnection) ViewTx(fn func(portainer.Transaction) error) error {
-	return connection.UpdateTx(fn) // PostgreSQL doesn't require special handling for read-only transactions
+// rollback rolls the transaction back, a failure is only logged
+func (tx *DbTransaction) rollback() {
+	tx.closed.Store(true)
+	defer tx.release()
+
+	if err := tx.tx.Rollback(); err != nil {
+		ctxLogger(tx.ctx).Error().Str("component", "postgres").Err(err).Msg("failed to rollback transaction")
+	}
 }
 
-// GetNextIdentifier retrieves the next available ID for a table
+// GetNextIdentifier retrieves the next available ID for a table. It returns 0 when the
+// identifier cannot be obtained, the failure is only logged.
+//
+// Deprecated: 0 is not a valid identifier, use GetNextIdentifierErr, which reports the failure.
 func (connection *DbConnection) GetNextIdentifier(tableName string) int {
-	var nextID int
-	query := fmt.Sprintf("SELECT COALESCE(MAX(id), 0) + 1 FROM %s", tableName)
-	
-	err := connection.GetContext(connection.ctx, &nextID, query)
+	nextID, err := connection.GetNextIdentifierErr(tableName)
 	if err != nil {
-		log.Error().Err(err).Str("table", tableName).Msg("failed to get next identifier")
-		return 1 // Return 1 as fallback for first entry
+		ctxLogger(connection.ctx).Error().Str("component", "postgres").Err(err).Str("bucket", tableName).Msg("failed to get the next identifier")
+		return 0
 	}
-	
+
 	return nextID
 }
 
-// BackupTo exports the database to a writer
-func (connection *DbConnection) BackupTo(w io.Writer) error {
+// GetNextIdentifierErr retrieves the next available ID for a table
+func (connection *DbConnection) GetNextIdentifierErr(tableName string) (nextID int, err error) {
+	err = connection.tracedTx("GetNextIdentifier", tableName, connection.txOptions, func(tx *DbTransaction) error {
+		nextID, err = tx.GetNextIdentifierErr(tableName)
+		return err
+	})
+
+	return nextID, err
+}
+
+// BackupTo exports the database to a writer as a stream of JSON records, the
+// manifest comes first, then the columns of every table, followed by the rows
+// of the managed tables and a checksum footer
+func (connection *DbConnection) BackupTo(w io.Writer) (err error) {
+	ctx, end := connection.startSpan(connection.ctx, "BackupTo", "")
+	defer func() { end(err) }()
+
 	if connection.DB == nil {
 		return ErrNoConnection
 	}
 
-	rows, err := connection.QueryxContext(connection.ctx, `
-		SELECT 
-			table_schema,
-			table_name,
-			column_name,
-			data_type
-		FROM 
-			information_schema.columns
-		WHERE 
-			table_schema = 'public'
-		ORDER BY 
-			table_name, ordinal_position
-	`)
+	// the manifest and the rows must come from the same snapshot
+	tx, err := connection.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	tables, schemas, err := connection.tableColumns(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	managed, err := connection.listBuckets(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := connection.newSnapshotManifest(ctx, tx, managed)
 	if err != nil {
-		return fmt.Errorf("failed to query schema: %w", err)
+		return err
 	}
-	defer rows.Close()
 
-	schemas := make(map[string][]string)
-	for rows.Next() {
-		var schema, table, column, dataType string
-		if err := rows.Scan(&schema, &table, &column, &dataType); err != nil {
-			return fmt.Errorf("failed to scan schema row: %w", err)
+	// the rows are read twice, first to describe the buckets in the manifest
+	for _, table := range managed {
+		bucket := newBackupWriter(io.Discard)
+		if _, err := connection.writeTableRows(ctx, tx, bucket, table, nil, time.Time{}); err != nil {
+			return err
 		}
-		schemas[table] = append(schemas[table], fmt.Sprintf("%s %s", column, dataType))
+
+		manifest.Buckets[table] = BucketManifest{Rows: bucket.rows, Checksum: bucket.checksum()}
+	}
+
+	bw := newBackupWriter(w)
+	if err := bw.write(backupRecord{Manifest: manifest}); err != nil {
+		return err
 	}
 
 	// Write schema information
-	for table, columns := range schemas {
-		fmt.Fprintf(w, "Table: %s\nColumns:\n", table)
-		for _, col := range columns {
-			fmt.Fprintf(w, "  %s\n", col)
+	for _, table := range tables {
+		if err := bw.write(backupRecord{Table: table, Columns: schemas[table]}); err != nil {
+			return err
 		}
-		fmt.Fprintln(w, "---")
 	}
 
-	return nil
+	for _, table := range managed {
+		if _, err := connection.writeTableRows(ctx, tx, bw, table, nil, time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	return bw.close()
 }
 
 func (connection *DbConnection) getEncryptionKey() []byte {
@@ -267,115 +821,239 @@ func (connection *DbConnection) getEncryptionKey() []byte {
 
 // CreateObject creates a new object in the specified table
 func (connection *DbConnection) CreateObject(bucketName string, fn func(uint64) (int, interface{})) error {
-	return connection.UpdateTx(func(tx portainer.Transaction) error {
-		nextID := uint64(connection.GetNextIdentifier(bucketName))
-		id, obj := fn(nextID)
-		return tx.CreateObjectWithId(bucketName, id, obj)
+	return connection.tracedTx("CreateObject", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.CreateObject(bucketName, fn)
 	})
 }
 
 // CreateObjectWithId creates an object with a specified ID
 func (connection *DbConnection) CreateObjectWithId(bucketName string, id int, obj any) error {
-	return connection.UpdateTx(func(tx portainer.Transaction) error {
+	return connection.tracedTx("CreateObjectWithId", bucketName, connection.txOptions, func(tx *DbTransaction) error {
 		return tx.CreateObjectWithId(bucketName, id, obj)
 	})
 }
 
 // CreateObjectWithStringId creates an object with a string ID
 func (connection *DbConnection) CreateObjectWithStringId(bucketName string, id []byte, obj any) error {
-	return connection.UpdateTx(func(tx portainer.Transaction) error {
+	return connection.tracedTx("CreateObjectWithStringId", bucketName, connection.txOptions, func(tx *DbTransaction) error {
 		return tx.CreateObjectWithStringId(bucketName, id, obj)
 	})
 }
 
-// MarshalObject converts an object to JSON
-// func (connection *DbConnection) MarshalObject(obj any) ([]byte, error) {
-// 	return json.Marshal(obj)
-// }
-
-// // UnmarshalObject converts JSON to an object
-// func (connection *DbConnection) UnmarshalObject(data []byte, obj any) error {
-// 	return json.Unmarshal(data, obj)
-// }
-
-// Other methods would be implemented similarly...
-
 // GetObject retrieves an object from a table
 func (connection *DbConnection) GetObject(bucketName string, key []byte, object any) error {
-	return connection.ViewTx(func(tx portainer.Transaction) error {
+	if ttl, ok := connection.cache.Load().ttl(bucketName); ok {
+		// the reads of a transaction must see its own writes
+		if _, inTx := TxFromContext(connection.ctx); !inTx {
+			return connection.getCachedObject(connection.cache.Load(), bucketName, key, object, ttl)
+		}
+	}
+
+	return connection.tracedViewTx("GetObject", bucketName, func(tx *DbTransaction) error {
 		return tx.GetObject(bucketName, key, object)
 	})
 }
 
 // UpdateObject updates an object in a table
 func (connection *DbConnection) UpdateObject(bucketName string, key []byte, object any) error {
-	return connection.UpdateTx(func(tx portainer.Transaction) error {
+	return connection.tracedTx("UpdateObject", bucketName, connection.txOptions, func(tx *DbTransaction) error {
 		return tx.UpdateObject(bucketName, key, object)
 	})
 }
 
+// UpdateObjectFunc updates an object in a table while holding a lock on its row,
+// so that concurrent updates of the same object cannot overwrite each other
+func (connection *DbConnection) UpdateObjectFunc(bucketName string, key []byte, object any, updateFn func()) error {
+	return connection.tracedTx("UpdateObjectFunc", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.UpdateObjectFunc(bucketName, key, object, updateFn)
+	})
+}
+
+// UpdateObjectField sets a single field of an object, see DbTransaction.UpdateObjectField
+func (connection *DbConnection) UpdateObjectField(bucketName string, key []byte, path []string, value any) error {
+	return connection.tracedTx("UpdateObjectField", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.UpdateObjectField(bucketName, key, path, value)
+	})
+}
+
+// PatchObject merges fields into an object, see DbTransaction.PatchObject
+func (connection *DbConnection) PatchObject(bucketName string, key []byte, patch map[string]any) error {
+	return connection.tracedTx("PatchObject", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.PatchObject(bucketName, key, patch)
+	})
+}
+
 // DeleteObject removes an object from a table
 func (connection *DbConnection) DeleteObject(bucketName string, key []byte) error {
-	return connection.UpdateTx(func(tx portainer.Transaction) error {
+	return connection.tracedTx("DeleteObject", bucketName, connection.txOptions, func(tx *DbTransaction) error {
 		return tx.DeleteObject(bucketName, key)
 	})
 }
 
+// DeleteAllObjects removes the objects of a table for which matching returns true
+func (connection *DbConnection) DeleteAllObjects(bucketName string, obj any, matching func(o any) (id int, ok bool)) error {
+	return connection.tracedTx("DeleteAllObjects", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.DeleteAllObjects(bucketName, obj, matching)
+	})
+}
+
 // GetAll retrieves all objects from a table
 func (connection *DbConnection) GetAll(bucketName string, obj any, appendFn func(o any) (any, error)) error {
-	return connection.ViewTx(func(tx portainer.Transaction) error {
+	return connection.tracedViewTx("GetAll", bucketName, func(tx *DbTransaction) error {
 		return tx.GetAll(bucketName, obj, appendFn)
 	})
 }
 
-// BackupMetadata retrieves sequence/identity information
-func (connection *DbConnection) BackupMetadata() (map[string]any, error) {
-	metadata := make(map[string]any)
+// GetAllWithKeyPrefix retrieves the objects of a table whose key starts with keyPrefix
+func (connection *DbConnection) GetAllWithKeyPrefix(bucketName string, keyPrefix []byte, obj any, appendFn func(o any) (any, error)) error {
+	return connection.tracedViewTx("GetAllWithKeyPrefix", bucketName, func(tx *DbTransaction) error {
+		return tx.GetAllWithKeyPrefix(bucketName, keyPrefix, obj, appendFn)
+	})
+}
+
+// SequenceMetadata holds the last value of the id sequence of each bucket, it is the metadata
+// written by BackupMetadata and read back by RestoreMetadata
+type SequenceMetadata map[string]int64
+
+// parseSequenceMetadata converts the metadata passed to RestoreMetadata, it returns the values
+// that could be converted along with an error naming the buckets of the other ones
+func parseSequenceMetadata(s map[string]any) (SequenceMetadata, error) {
+	metadata := make(SequenceMetadata, len(s))
+
+	var errs []error
+	for tableName, v := range s {
+		id, ok := sequenceValue(v)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unsupported sequence value %T", tableName, v))
+			continue
+		}
 
-	rows, err := connection.DB.Query(`
-		SELECT tablename, pg_get_serial_sequence(tablename, 'id') as seq
-		FROM pg_tables 
-		WHERE schemaname = 'public'
+		metadata[tableName] = id
+	}
+
+	return metadata, errors.Join(errs...)
+}
+
+// toMap returns the metadata in the form of the portainer.Connection interface
+func (metadata SequenceMetadata) toMap() map[string]any {
+	m := make(map[string]any, len(metadata))
+	for tableName, id := range metadata {
+		m[tableName] = id
+	}
+
+	return m
+}
+
+// BackupMetadata returns the last value of the id sequence of each bucket, see SequenceMetadata
+func (connection *DbConnection) BackupMetadata() (_ map[string]any, err error) {
+	ctx, end := connection.startSpan(connection.ctx, "BackupMetadata", "")
+	defer func() { end(err) }()
+
+	metadata := make(SequenceMetadata)
+
+	var tables []string
+	err = connection.SelectContext(ctx, &tables, `
+		SELECT table_name
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND column_name = 'id'
 	`)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var tableName, seqName string
-		var seqValue sql.NullInt64
+	for _, table := range tables {
+		tableName, ok := connection.bucketOf(table)
+		if !ok {
+			continue
+		}
 
-		if err := rows.Scan(&tableName, &seqName); err != nil {
+		seqName, err := connection.serialSequence(ctx, table)
+		if err != nil {
 			return nil, err
 		}
 
-		if seqName != "" {
-			err := connection.Get(&seqValue, fmt.Sprintf("SELECT last_value FROM %s", seqName))
-			if err == nil && seqValue.Valid {
-				metadata[tableName] = seqValue.Int64
-			}
+		if !seqName.Valid {
+			continue
+		}
+
+		// The name returned by pg_get_serial_sequence is already quoted when needed
+		var seqValue sql.NullInt64
+		err = connection.GetContext(ctx, &seqValue, fmt.Sprintf("SELECT last_value FROM %s", seqName.String))
+		if err == nil && seqValue.Valid {
+			metadata[tableName] = seqValue.Int64
 		}
 	}
 
-	return metadata, nil
+	return metadata.toMap(), nil
 }
 
-// RestoreMetadata sets sequence/identity values for tables
-func (connection *DbConnection) RestoreMetadata(s map[string]any) error {
-	for tableName, v := range s {
-		id, ok := v.(float64)
-		if !ok {
-			log.Error().Str("table", tableName).Msg("failed to restore metadata")
+// RestoreMetadata moves the id sequence of each bucket to the value saved by BackupMetadata.
+// The values are int64 when they come straight from BackupMetadata, float64 or json.Number
+// after a JSON round trip. The tables that could not be restored are listed in the returned
+// error, the other ones are restored regardless.
+func (connection *DbConnection) RestoreMetadata(s map[string]any) (err error) {
+	ctx, end := connection.startSpan(connection.ctx, "RestoreMetadata", "")
+	defer func() { end(err) }()
+
+	metadata, parseErr := parseSequenceMetadata(s)
+
+	tableNames := make([]string, 0, len(metadata))
+	for tableName := range metadata {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+
+	errs := []error{parseErr}
+	for _, tableName := range tableNames {
+		id := metadata[tableName]
+		seqName, err := connection.serialSequence(ctx, connection.table(tableName))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to find the sequence of the table: %w", tableName, err))
+			continue
+		} else if !seqName.Valid {
+			errs = append(errs, fmt.Errorf("%s: the table has no id sequence", tableName))
 			continue
 		}
 
-		seqName := fmt.Sprintf("%s_id_seq", tableName)
-		_, err := connection.Exec(fmt.Sprintf("ALTER SEQUENCE %s RESTART WITH %d", seqName, int64(id)))
-		if err != nil {
-			log.Error().Err(err).Str("table", tableName).Msg("failed to restore sequence")
+		if _, err := connection.ExecContext(ctx, "SELECT setval($1, $2)", seqName.String, id); err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to restore the sequence: %w", tableName, err))
 		}
 	}
 
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to restore the metadata of some tables: %w", err)
+	}
+
 	return nil
-}
\ No newline at end of file
+}
+
+// sequenceValue converts a sequence value of the metadata, it is a float64 or a json.Number
+// after a JSON round trip and an int64 when it comes straight from BackupMetadata
+func sequenceValue(v any) (int64, bool) {
+	switch value := v.(type) {
+	case int:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float32:
+		return int64(value), true
+	case float64:
+		return int64(value), true
+	case json.Number:
+		id, err := value.Int64()
+		return id, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// serialSequence returns the name of the sequence backing the id column of a table,
+// it is not valid when the column has no sequence
+func (connection *DbConnection) serialSequence(ctx context.Context, tableName string) (sql.NullString, error) {
+	var seqName sql.NullString
+	err := connection.GetContext(ctx, &seqName, "SELECT pg_get_serial_sequence(quote_ident($1), 'id')", tableName)
+
+	return seqName, err
+}
@@ -1,131 +1,855 @@
 package postgres
 
 import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_NeedsEncryptionMigration(t *testing.T) {
-	is := assert.New(t)
-
-	// Mock database setup
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("Failed to create sqlmock: %v", err)
-	}
-	defer db.Close()
-
 	cases := []struct {
 		name         string
-		dbname       string
+		unencrypted  bool
+		encrypted    bool
 		key          bool
 		expectError  error
 		expectResult bool
-		setupMocks   func()
 	}{
-		{
-			name:         "portainer.edb + key",
-			dbname:       EncryptedMetadataTable,
-			key:          true,
-			expectError:  nil,
-			expectResult: false,
-			setupMocks: func() {
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'encrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-			},
-		},
-		{
-			name:         "portainer.db + key (migration needed)",
-			dbname:       UnencryptedMetadataTable,
-			key:          true,
-			expectError:  nil,
-			expectResult: true,
-			setupMocks: func() {
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'unencrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-			},
-		},
-		{
-			name:         "portainer.db + no key",
-			dbname:       UnencryptedMetadataTable,
-			key:          false,
-			expectError:  nil,
-			expectResult: false,
-			setupMocks: func() {
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'unencrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-			},
-		},
-		{
-			name:         "NoDB (new) + key",
-			dbname:       "",
-			key:          true,
-			expectError:  nil,
-			expectResult: false,
-			setupMocks: func() {
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'unencrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
-			},
-		},
-		{
-			name:         "NoDB (new) + no key",
-			dbname:       "",
-			key:          false,
-			expectError:  nil,
-			expectResult: false,
-			setupMocks: func() {
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'unencrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
-			},
-		},
-		{
-			name:         "portainer.edb + no key",
-			dbname:       EncryptedMetadataTable,
-			key:          false,
-			expectError:  ErrHaveEncryptedWithNoKey,
-			expectResult: false,
-			setupMocks: func() {
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'encrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-			},
-		},
-		{
-			name:         "portainer.db & portainer.edb",
-			dbname:       "both",
-			key:          true,
-			expectError:  ErrHaveEncryptedAndUnencrypted,
-			expectResult: false,
-			setupMocks: func() {
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'encrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-				mock.ExpectQuery("SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'unencrypted_metadata'").
-					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
-			},
-		},
+		{name: "portainer.edb + key", encrypted: true, key: true},
+		{name: "portainer.db + key (migration needed)", unencrypted: true, key: true, expectResult: true},
+		{name: "portainer.db + no key", unencrypted: true},
+		{name: "NoDB (new) + key", key: true},
+		{name: "NoDB (new) + no key"},
+		{name: "portainer.edb + no key", encrypted: true, expectError: ErrHaveEncryptedWithNoKey},
+		{name: "portainer.db & portainer.edb", unencrypted: true, encrypted: true, key: true, expectError: ErrHaveEncryptedAndUnencrypted},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			connection := DbConnection{}
+			connection, mock := newMockConnection(t)
 
 			if tc.key {
 				connection.EncryptionKey = []byte("secret")
 			}
 
-			if tc.setupMocks != nil {
-				tc.setupMocks()
+			for _, table := range []struct {
+				name   string
+				exists bool
+			}{
+				{UnencryptedMetadataTable, tc.unencrypted},
+				{EncryptedMetadataTable, tc.encrypted},
+				{MigrationStateTable, false},
+			} {
+				mock.ExpectQuery("SELECT EXISTS").WithArgs(table.name).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(table.exists))
 			}
 
 			result, err := connection.NeedsEncryptionMigration()
 
-			is.Equal(tc.expectError, err, "Fatal Error failure. Test: %s", tc.name)
-			is.Equal(result, tc.expectResult, "Failed test: %s", tc.name)
+			assert.Equal(t, tc.expectError, err)
+			assert.Equal(t, tc.expectResult, result)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_BackupMetadata_QuotedSequence(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectQuery("SELECT table_name").
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("Order").AddRow("version"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_get_serial_sequence(quote_ident($1), 'id')")).WithArgs("Order").
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(`public."Order_custom_seq"`))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT last_value FROM public."Order_custom_seq"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"last_value"}).AddRow(42))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_get_serial_sequence(quote_ident($1), 'id')")).WithArgs("version").
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(nil))
+
+	metadata, err := conn.BackupMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"Order": int64(42)}, metadata)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_RestoreMetadata_QuotedSequence(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_get_serial_sequence(quote_ident($1), 'id')")).WithArgs("Order").
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(`public."Order_custom_seq"`))
+	mock.ExpectExec(regexp.QuoteMeta("SELECT setval($1, $2)")).WithArgs(`public."Order_custom_seq"`, int64(42)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.NoError(t, conn.RestoreMetadata(map[string]any{"Order": float64(42)}))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_RestoreMetadata_AggregatedError(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_get_serial_sequence(quote_ident($1), 'id')")).WithArgs("endpoints").
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow("endpoints_id_seq"))
+	mock.ExpectExec(regexp.QuoteMeta("SELECT setval($1, $2)")).WithArgs("endpoints_id_seq", int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT pg_get_serial_sequence(quote_ident($1), 'id')")).WithArgs("version").
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(nil))
+
+	err := conn.RestoreMetadata(map[string]any{"endpoints": int64(3), "settings": "7", "version": json.Number("2")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "settings: unsupported sequence value string")
+	assert.Contains(t, err.Error(), "version: the table has no id sequence")
+	assert.NotContains(t, err.Error(), "endpoints")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Metadata_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, `"Order"`)
+
+	// A keyword with uppercase letters and a sequence that does not follow the <table>_id_seq pattern
+	_, err := conn.Exec(`CREATE TABLE "Order" (id SERIAL PRIMARY KEY, data JSONB NOT NULL)`)
+	require.NoError(t, err)
+	_, err = conn.Exec(`ALTER SEQUENCE "Order_id_seq" RENAME TO "Order_custom_seq"`)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = conn.Exec(`INSERT INTO "Order" (data) VALUES ('{}')`)
+		require.NoError(t, err)
+	}
+
+	metadata, err := conn.BackupMetadata()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), metadata["Order"])
+
+	_, err = conn.Exec(`SELECT setval('"Order_custom_seq"', 10)`)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.RestoreMetadata(map[string]any{"Order": float64(3)}))
+
+	var next int
+	require.NoError(t, conn.GetContext(context.Background(), &next, `SELECT nextval('"Order_custom_seq"')`))
+	assert.Equal(t, 4, next)
+}
+
+func Test_sequenceValue(t *testing.T) {
+	for _, v := range []any{int(7), int32(7), int64(7), float32(7), float64(7), json.Number("7")} {
+		id, ok := sequenceValue(v)
+		assert.True(t, ok, "%T", v)
+		assert.Equal(t, int64(7), id, "%T", v)
+	}
+
+	for _, v := range []any{"7", json.Number("7.5"), nil} {
+		_, ok := sequenceValue(v)
+		assert.False(t, ok, "%T", v)
+	}
+}
+
+func Test_RestoreMetadata_RoundTrips(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "metadata_test")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "metadata_test", nil))
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, conn.CreateObject("metadata_test", func(id uint64) (int, any) {
+			return int(id), map[string]any{"ID": id}
+		}))
+	}
+	_, err := conn.Exec("SELECT setval(pg_get_serial_sequence('metadata_test', 'id'), 5)")
+	require.NoError(t, err)
+
+	metadata, err := conn.BackupMetadata()
+	require.NoError(t, err)
+
+	encoded, err := json.Marshal(metadata)
+	require.NoError(t, err)
+
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+	var numbers map[string]any
+	require.NoError(t, dec.Decode(&numbers))
+
+	for name, restored := range map[string]map[string]any{"in-memory": metadata, "json": decoded, "json.Number": numbers} {
+		t.Run(name, func(t *testing.T) {
+			_, err := conn.Exec("SELECT setval(pg_get_serial_sequence('metadata_test', 'id'), 1)")
+			require.NoError(t, err)
+
+			require.NoError(t, conn.RestoreMetadata(restored))
+
+			var last int64
+			require.NoError(t, conn.Get(&last, "SELECT last_value FROM metadata_test_id_seq"))
+			assert.Equal(t, int64(5), last)
+
+			// the new ids continue from the backed up position
+			var created int
+			require.NoError(t, conn.CreateObject("metadata_test", func(id uint64) (int, any) {
+				created = int(id)
+				return int(id), map[string]any{"ID": id}
+			}))
+			assert.Equal(t, 6, created)
+			require.NoError(t, conn.DeleteObject("metadata_test", conn.ConvertToKey(created)))
+		})
+	}
+}
+
+func Test_UpdateObjectFunc_KeyEncodings(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	for _, key := range [][]byte{[]byte("1"), conn.ConvertToKey(1)} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM endpoints WHERE id = $1 FOR UPDATE")).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"local","Count":1}`)))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE endpoints SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).
+			WithArgs([]byte(`{"Name":"local","Count":2}`), 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		var endpoint struct {
+			Name  string
+			Count int
+		}
+		err := conn.UpdateObjectFunc("endpoints", key, &endpoint, func() {
+			endpoint.Count++
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, endpoint.Count)
+	}
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_ConvertToKey(t *testing.T) {
+	conn := &DbConnection{}
+
+	cases := []struct {
+		id       int
+		expected []byte
+	}{
+		{id: 0, expected: []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{id: 1, expected: []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+		{id: -1, expected: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{id: math.MaxInt64, expected: []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{id: math.MinInt64, expected: []byte{0x80, 0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tc := range cases {
+		key := conn.ConvertToKey(tc.id)
+		assert.Equal(t, tc.expected, key, "id %d", tc.id)
+
+		id, err := keyToID(key)
+		require.NoError(t, err)
+		assert.Equal(t, tc.id, id)
+	}
+}
+
+func Test_GetObject_NegativeKey(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM endpoints WHERE id = $1")).WithArgs(-1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	mock.ExpectRollback()
+
+	var endpoint map[string]any
+	err := conn.GetObject("endpoints", conn.ConvertToKey(-1), &endpoint)
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateObjectFunc_NotFound(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM endpoints WHERE id = $1 FOR UPDATE")).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	mock.ExpectRollback()
+
+	var endpoint map[string]any
+	err := conn.UpdateObjectFunc("endpoints", []byte("7"), &endpoint, func() {
+		t.Error("updateFn must not be called for a missing object")
+	})
+	assert.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateObjectFunc_Concurrent(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "counter_test")
+
+	type counter struct {
+		Value int
+	}
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "counter_test", nil))
+	require.NoError(t, conn.CreateObjectWithId("counter_test", 1, counter{}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var c counter
+			assert.NoError(t, conn.UpdateObjectFunc("counter_test", conn.ConvertToKey(1), &c, func() {
+				c.Value++
+			}))
+		}()
+	}
+	wg.Wait()
+
+	var c counter
+	require.NoError(t, conn.GetObject("counter_test", []byte("1"), &c))
+	assert.Equal(t, 50, c.Value)
+}
+
+func Test_UpdateObjectField(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE endpoints SET data = "+
+		"jsonb_set(jsonb_set(jsonb_set(data, $3::text[], COALESCE(data #> $3::text[], '{}'::jsonb), true), "+
+		"$4::text[], COALESCE(data #> $4::text[], '{}'::jsonb), true), $5::text[], $1::jsonb, true), version = version + 1, updated_at = now() WHERE id = $2")).
+		WithArgs([]byte(`{"Running":3}`), 1, `{"Snapshot"}`, `{"Snapshot","Docker"}`, `{"Snapshot","Docker","Containers"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.UpdateObjectField("endpoints", conn.ConvertToKey(1), []string{"Snapshot", "Docker", "Containers"}, map[string]int{"Running": 3})
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE endpoints SET data = jsonb_set(data, $3::text[], $1::jsonb, true), version = version + 1, updated_at = now() WHERE id = $2")).
+		WithArgs([]byte(`2`), 5, `{"Status"}`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = conn.UpdateObjectField("endpoints", []byte("5"), []string{"Status"}, 2)
+	assert.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateObjectField_EncryptedStore(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = []byte("secret")
+	conn.SetEncrypted(true)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	err := conn.UpdateObjectField("endpoints", []byte("1"), []string{"Status"}, 2)
+	assert.ErrorIs(t, err, ErrEncryptedStore)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PatchObject(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	query := regexp.QuoteMeta("UPDATE endpoints SET data = (data || $1::jsonb) - $3::text[], version = version + 1, updated_at = now() WHERE id = $2")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WithArgs([]byte(`{"Name":"local","Status":2}`), 1, `{"EdgeKey","TLS"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.PatchObject("endpoints", conn.ConvertToKey(1), map[string]any{"Status": 2, "Name": "local", "TLS": nil, "EdgeKey": nil})
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WithArgs([]byte(`{"Status":2}`), 5, `{}`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = conn.PatchObject("endpoints", []byte("5"), map[string]any{"Status": 2})
+	assert.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PatchObject_EncryptedStore(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = []byte("secret")
+	conn.SetEncrypted(true)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	err := conn.PatchObject("endpoints", []byte("1"), map[string]any{"Status": 2})
+	assert.ErrorIs(t, err, ErrEncryptedStore)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// capturedArg matches any argument and keeps its value
+type capturedArg struct {
+	value driver.Value
+}
+
+func (a *capturedArg) Match(v driver.Value) bool {
+	a.value = v
+	return true
+}
+
+func Test_DbTransaction_EncryptedObjectsBoundToKey(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	// a legacy object encrypted without being bound to its key is rewritten bound to it
+	legacy, err := conn.MarshalObject(map[string]any{"Username": "admin"})
+	require.NoError(t, err)
+
+	written := &capturedArg{}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM users WHERE id = $1 FOR UPDATE")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(legacy))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs(written, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var user map[string]any
+	require.NoError(t, conn.UpdateObjectFunc("users", []byte("1"), &user, func() {
+		user["Role"] = 1
+	}))
+
+	rewritten, ok := written.value.([]byte)
+	require.True(t, ok)
+	require.Error(t, conn.UnmarshalObject(rewritten, &user))
+	require.NoError(t, conn.UnmarshalObjectForKey("users", []byte("1"), rewritten, &user))
+
+	// the object of user 1 copied over user 2 fails to decrypt
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM users WHERE id = $1")).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(rewritten))
+	mock.ExpectRollback()
+
+	user = nil
+	err = conn.GetObject("users", []byte("2"), &user)
+	require.ErrorContains(t, err, "message authentication failed")
+	assert.Nil(t, user)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", rewritten).AddRow("2", rewritten))
+	mock.ExpectRollback()
+
+	var users []map[string]any
+	err = conn.GetAll("users", &user, func(o any) (any, error) {
+		users = append(users, *o.(*map[string]any))
+		return o, nil
+	})
+	require.ErrorContains(t, err, "message authentication failed")
+	assert.Len(t, users, 1)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateObjectField_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "field_test")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "field_test", nil))
+	require.NoError(t, conn.CreateObjectWithId("field_test", 1, map[string]any{"Name": "local", "Status": 1}))
+
+	require.NoError(t, conn.UpdateObjectField("field_test", []byte("1"), []string{"Status"}, 2))
+	require.NoError(t, conn.UpdateObjectField("field_test", []byte("1"), []string{"Snapshot", "Docker", "Info"}, map[string]any{"Swarm": false}))
+	require.NoError(t, conn.UpdateObjectField("field_test", []byte("1"), []string{"Snapshot", "Docker", "Containers"}, 12))
+
+	var object map[string]any
+	require.NoError(t, conn.GetObject("field_test", []byte("1"), &object))
+	assert.Equal(t, map[string]any{
+		"Name":   "local",
+		"Status": float64(2),
+		"Snapshot": map[string]any{
+			"Docker": map[string]any{
+				"Info":       map[string]any{"Swarm": false},
+				"Containers": float64(12),
+			},
+		},
+	}, object)
+}
+
+func Test_PatchObject_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "patch_test")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "patch_test", nil))
+	require.NoError(t, conn.CreateObjectWithId("patch_test", 1, map[string]any{
+		"Name":     "local",
+		"Status":   1,
+		"EdgeKey":  "key",
+		"Snapshot": map[string]any{"Running": 3, "Stopped": 1},
+	}))
+
+	// the patched fields replace the stored ones, the nested objects are not merged
+	require.NoError(t, conn.PatchObject("patch_test", []byte("1"), map[string]any{"Status": 2, "Snapshot": map[string]any{"Running": 4}}))
+	require.NoError(t, conn.PatchObject("patch_test", []byte("1"), map[string]any{"EdgeKey": nil, "Missing": nil}))
+
+	var object map[string]any
+	require.NoError(t, conn.GetObject("patch_test", []byte("1"), &object))
+	assert.Equal(t, map[string]any{
+		"Name":     "local",
+		"Status":   float64(2),
+		"Snapshot": map[string]any{"Running": float64(4)},
+	}, object)
+
+	err := conn.PatchObject("patch_test", []byte("2"), map[string]any{"Status": 2})
+	assert.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+}
+
+func Test_DbTransaction_ContextDeadline(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	sqlTx, err := conn.BeginTxx(context.Background(), nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	tx := &DbTransaction{conn: conn, tx: sqlTx, ctx: ctx}
+
+	var endpoint map[string]any
+	err = tx.GetObject("endpoints", []byte("1"), &endpoint)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = tx.GetAllWithKeyPrefix("endpoints", []byte("1"), &endpoint, func(o any) (any, error) { return o, nil })
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = tx.UpdateObject("endpoints", []byte("1"), endpoint)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, sqlTx.Rollback())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_GetNextIdentifierErr(t *testing.T) {
+	failure := errors.New("canceling statement due to statement timeout")
+
+	t.Run("connection", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectNextIdentifier(mock, "webhooks").WillReturnError(failure)
+		mock.ExpectRollback()
+		// the sequence is known to exist from then on
+		mock.ExpectBegin()
+		mock.ExpectQuery(nextIdentifierQuery("webhooks")).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		mock.ExpectCommit()
+
+		_, err := conn.GetNextIdentifierErr("webhooks")
+		require.ErrorIs(t, err, failure)
+
+		id, err := conn.GetNextIdentifierErr("webhooks")
+		require.NoError(t, err)
+		assert.Equal(t, 3, id)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("legacy signature", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		buf := captureLogs(t)
+
+		mock.ExpectBegin()
+		expectNextIdentifier(mock, "webhooks").WillReturnError(failure)
+		mock.ExpectRollback()
+
+		assert.Zero(t, conn.GetNextIdentifier("webhooks"), "no valid identifier is made up")
+		require.NoError(t, mock.ExpectationsWereMet())
+		assert.Contains(t, buf.String(), "failed to get the next identifier", "the failure is logged")
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectNextIdentifier(mock, "webhooks").WillReturnError(failure)
+		mock.ExpectRollback()
+
+		err := conn.UpdateTx(func(tx portainer.Transaction) error {
+			_, err := tx.(*DbTransaction).GetNextIdentifierErr("webhooks")
+			return err
+		})
+		require.ErrorIs(t, err, failure)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_GetNextIdentifierErr_CreatesSequence(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	for range 2 {
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass($1) IS NOT NULL")).WithArgs("webhooks_id_seq").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_xact_lock($1)")).WithArgs(BucketsLockKey).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("CREATE SEQUENCE IF NOT EXISTS webhooks_id_seq OWNED BY webhooks.id")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(nextIdentifierQuery("webhooks")).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectCommit()
+	}
+
+	// the sequence created by a transaction is looked up again until it is known to exist
+	for range 2 {
+		id, err := conn.GetNextIdentifierErr("webhooks")
+		require.NoError(t, err)
+		assert.Equal(t, 1, id)
+	}
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_CreateObject_ExplicitIds_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "explicit_ids")
+
+	require.NoError(t, conn.SetServiceName("explicit_ids"))
+
+	create := func() int {
+		var created int
+		require.NoError(t, conn.CreateObject("explicit_ids", func(id uint64) (int, any) {
+			created = int(id)
+			return created, map[string]int{"Id": created}
+		}))
+
+		return created
+	}
+
+	require.NoError(t, conn.CreateObjectWithId("explicit_ids", 1, map[string]int{"Id": 1}))
+	assert.Equal(t, 2, create())
+
+	require.NoError(t, conn.CreateObjectWithId("explicit_ids", 5, map[string]int{"Id": 5}))
+	assert.Equal(t, 6, create())
+	assert.Equal(t, 7, create())
+
+	require.NoError(t, conn.CreateObjectWithId("explicit_ids", 8, map[string]int{"Id": 8}))
+	require.NoError(t, conn.CreateObjectWithId("explicit_ids", 3, map[string]int{"Id": 3}))
+	assert.Equal(t, 9, create())
+
+	var sequence string
+	require.NoError(t, conn.Get(&sequence, "SELECT pg_get_serial_sequence('explicit_ids', 'id')"))
+	assert.Contains(t, sequence, "explicit_ids_id_seq")
+}
+
+func Test_CreateObject_NextIdentifierFailure(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	failure := errors.New("connection reset by peer")
+	mock.ExpectBegin()
+	expectNextIdentifier(mock, "webhooks").WillReturnError(failure)
+	mock.ExpectRollback()
+
+	called := false
+	err := conn.CreateObject("webhooks", func(id uint64) (int, any) {
+		called = true
+		return int(id), map[string]int{"Id": int(id)}
+	})
+	require.ErrorIs(t, err, failure)
+	assert.False(t, called, "the object must not be generated without an identifier")
+
+	// sqlmock fails any INSERT that was not expected
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteObjects(t *testing.T) {
+	const deleteQuery = "DELETE FROM edge_jobs WHERE id = ANY($1) RETURNING id::text"
+
+	t.Run("partial match", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(deleteQuery)).WithArgs(`{"1","2","7"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("7"))
+		mock.ExpectCommit()
+
+		var deleted int
+		err := conn.UpdateTx(func(tx portainer.Transaction) (err error) {
+			deleted, err = tx.(*DbTransaction).DeleteObjects("edge_jobs", [][]byte{conn.ConvertToKey(1), []byte("2"), conn.ConvertToKey(7)})
+			return err
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("string keys", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM resource_control WHERE id = ANY($1)")).WithArgs(`{"stack_1","stack_2"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("stack_2"))
+		mock.ExpectCommit()
+
+		var deleted int
+		err := conn.UpdateTx(func(tx portainer.Transaction) (err error) {
+			deleted, err = tx.(*DbTransaction).DeleteObjects("resource_control", [][]byte{[]byte("stack_1"), []byte("stack_2")})
+			return err
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("empty key list", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+
+		err := conn.UpdateTx(func(tx portainer.Transaction) error {
+			deleted, err := tx.(*DbTransaction).DeleteObjects("edge_jobs", nil)
+			assert.Zero(t, deleted)
+			return err
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("read-only transaction", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
 
-			if err := mock.ExpectationsWereMet(); err != nil {
-				t.Errorf("Unfulfilled expectations: %v", err)
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+
+		err := conn.ViewTx(func(tx portainer.Transaction) error {
+			_, err := tx.(*DbTransaction).DeleteObjects("edge_jobs", [][]byte{[]byte("1")})
+			assert.ErrorIs(t, err, ErrTxReadOnly)
+			assert.ErrorIs(t, tx.(*DbTransaction).Truncate("edge_jobs"), ErrTxReadOnly)
+			return nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_Truncate(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("TRUNCATE TABLE edge_jobs RESTART IDENTITY")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectNextIdentifier(mock, "edge_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO edge_jobs (id, data) VALUES ($1, $2)")).WithArgs(1, []byte(`{"Id":1}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.(*DbTransaction).Truncate("edge_jobs"); err != nil {
+			return err
+		}
+
+		return tx.CreateObject("edge_jobs", func(id uint64) (int, any) {
+			return int(id), map[string]int{"Id": int(id)}
+		})
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_DeleteObjects_Truncate_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "bulk_delete_test")
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("bulk_delete_test"); err != nil {
+			return err
+		}
+
+		for id := 1; id <= 5; id++ {
+			if err := tx.CreateObjectWithId("bulk_delete_test", id, map[string]int{"Id": id}); err != nil {
+				return err
 			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = conn.UpdateTx(func(tx portainer.Transaction) error {
+		deleted, err := tx.(*DbTransaction).DeleteObjects("bulk_delete_test", [][]byte{conn.ConvertToKey(2), []byte("4"), []byte("9")})
+		assert.Equal(t, 2, deleted)
+		return err
+	})
+	require.NoError(t, err)
+
+	var ids []int
+	err = conn.GetAll("bulk_delete_test", &map[string]int{}, func(o any) (any, error) {
+		ids = append(ids, (*o.(*map[string]int))["Id"])
+		return o, nil
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{1, 3, 5}, ids)
+
+	var created int
+	err = conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.(*DbTransaction).Truncate("bulk_delete_test"); err != nil {
+			return err
+		}
+
+		return tx.CreateObject("bulk_delete_test", func(id uint64) (int, any) {
+			created = int(id)
+			return int(id), map[string]int{"Id": int(id)}
 		})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+}
+
+func Test_WithContext(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	mock.MatchExpectationsInOrder(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := conn.WithContext(ctx)
+	other := conn.WithContext(context.Background())
+
+	assert.Same(t, conn.DB, canceled.DB)
+	assert.Same(t, conn.connectionState, canceled.connectionState)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM slow WHERE id = $1")).WithArgs(1).
+		WillDelayFor(time.Minute).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{}`)))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM fast WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"fast"}`)))
+	mock.ExpectCommit()
+
+	slowDone := make(chan error, 1)
+	go func() {
+		var object map[string]any
+		slowDone <- canceled.GetObject("slow", []byte("1"), &object)
+	}()
+
+	// the request using another context is not affected by the slow one
+	var object map[string]any
+	require.NoError(t, other.GetObject("fast", []byte("1"), &object))
+	assert.Equal(t, "fast", object["Name"])
+
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-slowDone:
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the query was not aborted by the cancellation of its context")
 	}
+
+	require.NoError(t, conn.ctx.Err())
 }
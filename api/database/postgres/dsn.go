@@ -0,0 +1,271 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// redactedValue replaces the password of a redacted connection string, or the whole connection
+// string when it cannot be parsed
+const redactedValue = "***"
+
+// redactDSN is MaskDSN for the connection strings that are logged, displayed or wrapped in
+// errors, the connection string is masked entirely when it cannot be parsed
+func redactDSN(dsn string) string {
+	masked, err := MaskDSN(dsn)
+	if err != nil {
+		return redactedValue
+	}
+
+	return masked
+}
+
+// isURLDSN returns whether a connection string is a URL rather than keyword/value pairs
+func isURLDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// MaskDSN replaces the password of a URL or keyword/value connection string with ***, so that
+// it can be logged, the user and the other parameters are kept. It fails when the connection
+// string cannot be parsed, the error does not quote it. Every connection string of the package
+// is masked by it, see redactDSN.
+func MaskDSN(dsn string) (string, error) {
+	if !isURLDSN(dsn) {
+		params, err := parseKeywordDSN(dsn)
+		if err != nil {
+			return "", errors.New("the connection string cannot be parsed")
+		}
+
+		for i := range params {
+			if params[i].key == "password" {
+				params[i].value = redactedValue
+			}
+		}
+
+		return formatKeywordDSN(params), nil
+	}
+
+	// the error of url.Parse quotes the URL, the password included
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", errors.New("the connection URL cannot be parsed")
+	}
+
+	// the mask is inserted once the URL is formatted, String would escape it
+	masked := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.User(u.User.Username())
+			masked = true
+		}
+	}
+
+	// the query is masked in place, Encode would reorder it and escape the mask
+	if u.RawQuery != "" {
+		parts := strings.Split(u.RawQuery, "&")
+		for i, part := range parts {
+			key, _, _ := strings.Cut(part, "=")
+			if name, err := url.QueryUnescape(key); err == nil && name == "password" {
+				parts[i] = key + "=" + redactedValue
+			}
+		}
+		u.RawQuery = strings.Join(parts, "&")
+	}
+
+	if !masked {
+		return u.String(), nil
+	}
+
+	user := "://" + u.User.String() + "@"
+
+	return strings.Replace(u.String(), user, strings.TrimSuffix(user, "@")+":"+redactedValue+"@", 1), nil
+}
+
+// databaseName returns the name of the database of a URL or keyword/value connection string,
+// it is empty when the connection string does not name one
+func databaseName(dsn string) string {
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return ""
+		}
+
+		return strings.TrimPrefix(u.Path, "/")
+	}
+
+	params, err := parseKeywordDSN(dsn)
+	if err != nil {
+		return ""
+	}
+
+	for _, param := range params {
+		if param.key == "dbname" {
+			return param.value
+		}
+	}
+
+	return ""
+}
+
+// dsnParam is a parameter of a keyword/value connection string
+type dsnParam struct {
+	key   string
+	value string
+}
+
+// parseKeywordDSN parses a connection string such as "host=localhost password='secret'",
+// following the quoting rules of libpq
+func parseKeywordDSN(dsn string) ([]dsnParam, error) {
+	var params []dsnParam
+
+	s := []rune(dsn)
+	i := 0
+	for {
+		for i < len(s) && unicode.IsSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && !unicode.IsSpace(s[i]) {
+			i++
+		}
+		key := string(s[start:i])
+
+		for i < len(s) && unicode.IsSpace(s[i]) {
+			i++
+		}
+		if key == "" || i >= len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("missing value of the connection parameter %q", key)
+		}
+		i++
+
+		for i < len(s) && unicode.IsSpace(s[i]) {
+			i++
+		}
+
+		var value []rune
+		quoted := i < len(s) && s[i] == '\''
+		if quoted {
+			i++
+		}
+
+		for ; i < len(s); i++ {
+			if quoted && s[i] == '\'' || !quoted && unicode.IsSpace(s[i]) {
+				break
+			}
+
+			if s[i] == '\\' {
+				i++
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated escape in the connection parameter %q", key)
+				}
+			}
+
+			value = append(value, s[i])
+		}
+
+		if quoted {
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted value of the connection parameter %q", key)
+			}
+			i++
+		}
+
+		params = append(params, dsnParam{key: key, value: string(value)})
+	}
+
+	return params, nil
+}
+
+// formatKeywordDSN formats the parameters of a keyword/value connection string,
+// the values are quoted when needed
+func formatKeywordDSN(params []dsnParam) string {
+	parts := make([]string, 0, len(params))
+	for _, param := range params {
+		value := param.value
+		if value == "" || strings.ContainsAny(value, " \t\n\r'\\") {
+			value = "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+		}
+
+		parts = append(parts, param.key+"="+value)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// targetSessionAttrs lists the supported values of the target_session_attrs parameter
+var targetSessionAttrs = map[string]bool{
+	"":           true,
+	"any":        true,
+	"read-write": true,
+	"read-only":  true,
+	"primary":    true,
+	"standby":    true,
+}
+
+// DSNConfig describes how to reach the PostgreSQL server, DSN turns it into a connection string
+type DSNConfig struct {
+	// Hosts are tried in order until one accepts the connection, a host may carry its own port as host:port
+	Hosts []string
+	Port  int
+
+	// SocketDir is the directory of the unix domain socket of the server, it replaces Hosts
+	SocketDir string
+
+	User     string
+	Password string
+	Database string
+	SSLMode  string
+
+	// TargetSessionAttrs is any (the default), read-write, read-only, primary or standby,
+	// the hosts that do not match are skipped
+	TargetSessionAttrs string
+}
+
+// DSN returns the keyword/value connection string of the configuration
+func (c DSNConfig) DSN() (string, error) {
+	if c.SocketDir != "" && len(c.Hosts) > 0 {
+		return "", errors.New("a socket directory and hosts cannot be used together")
+	}
+
+	if c.SocketDir != "" && !strings.HasPrefix(c.SocketDir, "/") {
+		return "", fmt.Errorf("the socket directory %q is not an absolute path", c.SocketDir)
+	}
+
+	if !targetSessionAttrs[c.TargetSessionAttrs] {
+		return "", fmt.Errorf("unsupported target_session_attrs %q", c.TargetSessionAttrs)
+	}
+
+	var params []dsnParam
+	add := func(key, value string) {
+		if value != "" {
+			params = append(params, dsnParam{key: key, value: value})
+		}
+	}
+
+	for _, host := range c.Hosts {
+		if host == "" || strings.Contains(host, ",") {
+			return "", fmt.Errorf("invalid host %q", host)
+		}
+	}
+
+	add("host", c.SocketDir)
+	add("host", strings.Join(c.Hosts, ","))
+	if c.Port != 0 {
+		add("port", strconv.Itoa(c.Port))
+	}
+	add("user", c.User)
+	add("password", c.Password)
+	add("dbname", c.Database)
+	add("sslmode", c.SSLMode)
+	add("target_session_attrs", c.TargetSessionAttrs)
+
+	return formatKeywordDSN(params), nil
+}
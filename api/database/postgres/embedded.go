@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultEmbeddedPort is the port of the embedded server, it is not the default PostgreSQL
+	// port so that it does not clash with a server already running on the host
+	DefaultEmbeddedPort = 5433
+
+	embeddedDatabase = "portainer"
+	embeddedUser     = "portainer"
+	embeddedPassword = "portainer"
+)
+
+var ErrEmbeddedServerStart = errors.New("failed to start the embedded PostgreSQL server")
+
+// embeddedServer is a PostgreSQL server run by the connection, it keeps its data under dir
+type embeddedServer struct {
+	dir  string
+	port uint32
+
+	mu      sync.Mutex
+	server  *embeddedpostgres.EmbeddedPostgres
+	running bool
+}
+
+// NewEmbeddedConnection starts a PostgreSQL server keeping its data under dir and returns a
+// connection to it. The server is started by Open and stopped by Close, the connection otherwise
+// behaves like one to an external server. It is meant for development and tests, the server
+// binaries are downloaded on the first start and cached in the home directory.
+func NewEmbeddedConnection(dir string, port uint32, encryptionKey []byte, opts ...ConnectionOption) (*DbConnection, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("%w: the data directory cannot be empty", ErrEmbeddedServerStart)
+	}
+
+	dsn := fmt.Sprintf("postgres://%s:%s@localhost:%d/%s?sslmode=disable", embeddedUser, embeddedPassword, port, embeddedDatabase)
+
+	return NewConnection(dsn, encryptionKey, append(opts, withEmbeddedServer(dir, port))...)
+}
+
+// withEmbeddedServer makes Open start the embedded server and Close stop it
+func withEmbeddedServer(dir string, port uint32) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.embedded = &embeddedServer{dir: dir, port: port}
+		connection.Path = dir
+	}
+}
+
+// start starts the server unless it is already running
+func (server *embeddedServer) start() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.running {
+		return nil
+	}
+
+	if err := checkPortAvailable(server.port); err != nil {
+		return err
+	}
+
+	server.server = embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(server.port).
+		Database(embeddedDatabase).
+		Username(embeddedUser).
+		Password(embeddedPassword).
+		RuntimePath(filepath.Join(server.dir, "runtime")).
+		DataPath(filepath.Join(server.dir, "data")).
+		Logger(io.Discard))
+
+	log.Info().Str("component", "postgres").Str("path", server.dir).Uint32("port", server.port).Msg("starting the embedded PostgreSQL server")
+
+	if err := server.server.Start(); err != nil {
+		return fmt.Errorf("%w in %s: %w%s", ErrEmbeddedServerStart, server.dir, err, embeddedStartHint(err))
+	}
+
+	server.running = true
+
+	return nil
+}
+
+// stop stops the server when it is running
+func (server *embeddedServer) stop() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if !server.running {
+		return nil
+	}
+
+	server.running = false
+
+	log.Info().Str("component", "postgres").Str("path", server.dir).Msg("stopping the embedded PostgreSQL server")
+
+	return server.server.Stop()
+}
+
+// checkPortAvailable fails when another process listens on port, which embedded-postgres only
+// reports as a startup timeout when the process does not speak the PostgreSQL protocol
+func checkPortAvailable(port uint32) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return fmt.Errorf("%w: port %d is already in use, stop the process listening on it or choose another port: %w", ErrEmbeddedServerStart, port, err)
+	}
+
+	return listener.Close()
+}
+
+// embeddedStartHint returns what to do about a startup failure of the embedded server
+func embeddedStartHint(err error) string {
+	msg := err.Error()
+
+	switch {
+	case strings.Contains(msg, "error fetching postgres"), strings.Contains(msg, "unable to connect to"), strings.Contains(msg, "no version found"):
+		return " (the PostgreSQL binaries could not be downloaded, check the access to repo1.maven.org or copy them to ~/.embedded-postgres-go)"
+	case strings.Contains(msg, "unable to extract postgres archive"):
+		return " (the cached PostgreSQL binaries are unusable, remove ~/.embedded-postgres-go and retry)"
+	case strings.Contains(msg, "could not start postgres"):
+		return " (the data directory may belong to another PostgreSQL version or be in use by another server)"
+	}
+
+	return ""
+}
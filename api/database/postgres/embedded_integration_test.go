@@ -0,0 +1,33 @@
+//go:build integration
+
+package postgres
+
+import (
+	"testing"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewTestConnection(t *testing.T) {
+	conn := NewTestConnection(t)
+
+	type object struct {
+		ID   int    `json:"Id"`
+		Name string `json:"Name"`
+	}
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("embedded_test"); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithId("embedded_test", 1, object{ID: 1, Name: "first"})
+	})
+	require.NoError(t, err)
+
+	var got object
+	require.NoError(t, conn.GetObject("embedded_test", conn.ConvertToKey(1), &got))
+	assert.Equal(t, "first", got.Name)
+}
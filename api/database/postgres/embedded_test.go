@@ -0,0 +1,38 @@
+package postgres
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkPortAvailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+
+	err = checkPortAvailable(port)
+	require.ErrorIs(t, err, ErrEmbeddedServerStart)
+	assert.Contains(t, err.Error(), "already in use")
+
+	free, err := freePort()
+	require.NoError(t, err)
+	require.NoError(t, checkPortAvailable(free))
+}
+
+func Test_embeddedStartHint(t *testing.T) {
+	assert.Contains(t, embeddedStartHint(errors.New("error fetching postgres: timeout")), "could not be downloaded")
+	assert.Contains(t, embeddedStartHint(errors.New("unable to extract postgres archive: EOF")), "remove ~/.embedded-postgres-go")
+	assert.Contains(t, embeddedStartHint(errors.New("could not start postgres using pg_ctl")), "data directory")
+	assert.Empty(t, embeddedStartHint(errors.New("unexpected")))
+}
+
+func Test_NewEmbeddedConnection_EmptyDir(t *testing.T) {
+	_, err := NewEmbeddedConnection("", DefaultEmbeddedPort, nil)
+	require.ErrorIs(t, err, ErrEmbeddedServerStart)
+}
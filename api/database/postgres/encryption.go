@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+// dataColumnType returns the type of the data column of the bucket tables, the objects of an
+// encrypted store are ciphertexts which PostgreSQL would reject as JSON documents
+func (connection *DbConnection) dataColumnType() string {
+	if connection.IsEncryptedStore() {
+		return "BYTEA"
+	}
+
+	return "JSONB"
+}
+
+// hasJSONDataColumn returns whether the data column of a bucket is JSONB, that is whether the
+// bucket was created before the store was encrypted and was not used by the encrypted store yet
+func (tx *DbTransaction) hasJSONDataColumn(ctx context.Context, bucketName string) (bool, error) {
+	table := tx.conn.table(bucketName)
+
+	var columnType string
+	err := tx.tx.GetContext(ctx, &columnType, `
+		SELECT data_type
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'data'
+	`, table)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up the data column of table %s: %w", table, err)
+	}
+
+	return columnType == "jsonb", nil
+}
+
+// convertDataColumn converts the JSONB data column of a bucket created before the store was
+// encrypted to BYTEA, the objects are kept as their JSON text until they are encrypted.
+// converted is false when the column is already BYTEA.
+func (tx *DbTransaction) convertDataColumn(ctx context.Context, bucketName string) (converted bool, err error) {
+	table := tx.conn.table(bucketName)
+
+	if isJSON, err := tx.hasJSONDataColumn(ctx, bucketName); err != nil || !isJSON {
+		return false, err
+	}
+
+	query := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN data TYPE BYTEA USING convert_to(data::text, 'UTF8')", table)
+	if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+		return false, fmt.Errorf("failed to convert the data column of table %s: %w", table, err)
+	}
+
+	return true, nil
+}
+
+// encryptBucket converts the data column of a bucket created before the store was encrypted
+// and encrypts its objects. It is a no-op when the column is already BYTEA, so that the
+// conversion is done once, the first time the bucket is used by the encrypted store.
+func (tx *DbTransaction) encryptBucket(ctx context.Context, bucketName string) error {
+	table := tx.conn.table(bucketName)
+
+	converted, err := tx.convertDataColumn(ctx, bucketName)
+	if err != nil || !converted {
+		return err
+	}
+
+	log.Info().Str("component", "postgres").Str("table", table).Msg("encrypting bucket")
+
+	type row struct {
+		ID   string `db:"id"`
+		Data []byte `db:"data"`
+	}
+
+	var rows []row
+	if err := tx.tx.SelectContext(ctx, &rows, fmt.Sprintf("SELECT id::text AS id, data FROM %s", table)); err != nil {
+		return fmt.Errorf("failed to read table %s: %w", table, err)
+	}
+
+	// the objects are rewritten, BackupSince must write them again
+	update := fmt.Sprintf("UPDATE %s SET data = $1, %s WHERE id = $2", table, bumpVersion)
+	for _, r := range rows {
+		data, err := tx.marshal(bucketName, []byte(r.ID), json.RawMessage(r.Data))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt object %s of table %s: %w", r.ID, table, err)
+		}
+
+		if _, err := tx.tx.ExecContext(ctx, update, data, r.ID); err != nil {
+			return fmt.Errorf("failed to encrypt object %s of table %s: %w", r.ID, table, err)
+		}
+	}
+
+	log.Info().Str("component", "postgres").Str("table", table).Int("rows", len(rows)).Msg("bucket encrypted")
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SetServiceName_EncryptedStore(t *testing.T) {
+	const columnTypeQuery = "SELECT data_type FROM information_schema.columns"
+
+	t.Run("new bucket", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		conn.EncryptionKey = secretToEncryptionKey(passphrase)
+		conn.SetEncrypted(true)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("data BYTEA NOT NULL")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTimestampColumns(mock, "users")
+		mock.ExpectQuery(regexp.QuoteMeta(columnTypeQuery)).WithArgs("users").
+			WillReturnRows(sqlmock.NewRows([]string{"data_type"}).AddRow("bytea"))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+			return tx.SetServiceName("users")
+		}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("bucket created before the encryption", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		conn.EncryptionKey = secretToEncryptionKey(passphrase)
+		conn.SetEncrypted(true)
+
+		written := &capturedArg{}
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("data BYTEA NOT NULL")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTimestampColumns(mock, "users")
+		mock.ExpectQuery(regexp.QuoteMeta(columnTypeQuery)).WithArgs("users").
+			WillReturnRows(sqlmock.NewRows([]string{"data_type"}).AddRow("jsonb"))
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE users ALTER COLUMN data TYPE BYTEA USING convert_to(data::text, 'UTF8')")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT id::text AS id, data FROM users")).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", []byte(`{"Username":"admin"}`)))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs(written, "1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+			return tx.SetServiceName("users")
+		}))
+		require.NoError(t, mock.ExpectationsWereMet())
+
+		encrypted, ok := written.value.([]byte)
+		require.True(t, ok)
+		assert.False(t, json.Valid(encrypted))
+
+		var user map[string]any
+		require.NoError(t, conn.UnmarshalObjectForKey("users", conn.ConvertToKey(1), encrypted, &user))
+		assert.Equal(t, map[string]any{"Username": "admin"}, user)
+	})
+}
+
+func Test_ExportTableCSV_EncryptedStore(t *testing.T) {
+	conn, _ := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	err := conn.ExportTableCSV(context.Background(), "users", &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrEncryptedStore)
+}
+
+func Test_EncryptedStore_RealDatabase(t *testing.T) {
+	type user struct {
+		ID       int
+		Username string
+	}
+
+	plain := newTestConnection(t)
+	dropTestTables(t, plain, "encrypted_users")
+
+	// the bucket is created and filled before the store is encrypted
+	require.NoError(t, plain.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("encrypted_users"); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithId("encrypted_users", 1, user{ID: 1, Username: "admin"})
+	}))
+
+	conn := newTestConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("encrypted_users"); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithId("encrypted_users", 2, user{ID: 2, Username: "operator"})
+	}))
+
+	var got user
+	require.NoError(t, conn.GetObject("encrypted_users", conn.ConvertToKey(1), &got))
+	assert.Equal(t, user{ID: 1, Username: "admin"}, got)
+
+	require.NoError(t, conn.UpdateObject("encrypted_users", conn.ConvertToKey(2), user{ID: 2, Username: "viewer"}))
+	require.NoError(t, conn.GetObject("encrypted_users", conn.ConvertToKey(2), &got))
+	assert.Equal(t, user{ID: 2, Username: "viewer"}, got)
+
+	// the ciphertexts are stored as they are
+	var raw []byte
+	require.NoError(t, conn.Get(&raw, "SELECT data FROM encrypted_users WHERE id = 2"))
+	assert.NotContains(t, string(raw), "viewer")
+
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTables(context.Background(), []string{"encrypted_users"}, &buf, ExportFormatJSON))
+
+	var exported map[string][]map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &exported))
+	require.Len(t, exported["encrypted_users"], 2)
+	assert.Equal(t, map[string]any{"ID": float64(1), "Username": "admin"}, exported["encrypted_users"][0]["data"])
+	assert.Equal(t, map[string]any{"ID": float64(2), "Username": "viewer"}, exported["encrypted_users"][1]["data"])
+}
@@ -0,0 +1,527 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+// MigrationStateTable records the progress of MigrateEncryption and RemoveEncryption bucket by
+// bucket, it is dropped once every bucket is migrated
+const MigrationStateTable = "migration_state"
+
+// DefaultEncryptionBatchSize is the number of objects MigrateEncryption and RemoveEncryption
+// migrate per transaction
+const DefaultEncryptionBatchSize = 1000
+
+// encryptionProgressInterval is the number of objects between the progress lines logged by
+// MigrateEncryption and RemoveEncryption
+const encryptionProgressInterval = 10000
+
+// The directions of the migrations recorded in MigrationStateTable
+const (
+	migrationEncrypt = "encrypt"
+	migrationDecrypt = "decrypt"
+)
+
+var (
+	// ErrEncryptionKeyRequired is returned by MigrateEncryption and RemoveEncryption without encryption key
+	ErrEncryptionKeyRequired = errors.New("an encryption key is required to migrate the store")
+	// ErrConfirmationRequired is returned by RemoveEncryption unless the removal is confirmed
+	ErrConfirmationRequired = errors.New("removing the encryption of the store must be confirmed")
+	// ErrMigrationInProgress is returned when a migration in the other direction was interrupted
+	ErrMigrationInProgress = errors.New("a migration in the other direction was interrupted, it must be completed first")
+)
+
+// MigrationProgress describes the progress of MigrateEncryption or RemoveEncryption. The
+// objects migrated by a previous run that was interrupted are counted as processed. TotalRows
+// is the number of objects counted when the migration started.
+type MigrationProgress struct {
+	Running       bool   `json:"running"`
+	Decrypting    bool   `json:"decrypting,omitempty"`
+	Bucket        string `json:"bucket,omitempty"`
+	RowsProcessed int64  `json:"rows_processed"`
+	TotalRows     int64  `json:"total_rows"`
+}
+
+// migrationState is the progress of the migration of a bucket recorded in MigrationStateTable,
+// LastKey is the key of the last object migrated
+type migrationState struct {
+	Bucket    string         `db:"bucket"`
+	Direction string         `db:"direction"`
+	RowsDone  int64          `db:"rows_done"`
+	LastKey   sql.NullString `db:"last_key"`
+	Completed bool           `db:"completed"`
+}
+
+// WithEncryptionBatchSize sets the number of objects MigrateEncryption and RemoveEncryption
+// migrate per transaction, DefaultEncryptionBatchSize by default
+func WithEncryptionBatchSize(n int) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.encryptionBatchSize = n
+	}
+}
+
+// MigrationProgress returns the progress of the running or last MigrateEncryption or RemoveEncryption
+func (connection *DbConnection) MigrationProgress() MigrationProgress {
+	if progress := connection.encryptionProgress.Load(); progress != nil {
+		return *progress
+	}
+
+	return MigrationProgress{}
+}
+
+// setMigrationProgress publishes the progress of a migration and logs a line each time
+// encryptionProgressInterval more objects were migrated
+func (connection *DbConnection) setMigrationProgress(progress MigrationProgress) {
+	previous := connection.encryptionProgress.Swap(&progress)
+	if previous == nil || previous.RowsProcessed/encryptionProgressInterval == progress.RowsProcessed/encryptionProgressInterval {
+		return
+	}
+
+	msg := "encrypting the store"
+	if progress.Decrypting {
+		msg = "decrypting the store"
+	}
+
+	log.Info().Str("component", "postgres").Str("bucket", progress.Bucket).
+		Int64("rows_processed", progress.RowsProcessed).Int64("total_rows", progress.TotalRows).
+		Msg(msg)
+}
+
+// MigrateEncryption encrypts the objects of an unencrypted store with the encryption key of the
+// connection. The buckets are encrypted in batches committed independently, their progress is
+// recorded in MigrationStateTable along with each batch, so that a migration interrupted by a
+// restart resumes where it stopped rather than starting over, see NeedsEncryptionMigration.
+// The objects already encrypted are never encrypted twice. Once every bucket is encrypted, the
+// store is marked as encrypted and the state is dropped.
+func (connection *DbConnection) MigrateEncryption(ctx context.Context) (err error) {
+	ctx, end := connection.startSpan(ctx, "MigrateEncryption", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	if connection.EncryptionKey == nil {
+		return ErrEncryptionKeyRequired
+	}
+
+	connection.SetEncrypted(true)
+
+	return connection.migrateStore(ctx, migrationEncrypt)
+}
+
+// RemoveEncryption decrypts the objects of an encrypted store with key and stores them back as
+// plain JSON documents, so that the store can be opened without an encryption key and read by
+// the tools that cannot decrypt it. Anyone with access to the database can read the objects
+// afterwards, including the credentials they hold, so the removal must be confirmed. The
+// buckets are decrypted in batches like MigrateEncryption encrypts them, a removal interrupted
+// by a restart is resumed by calling RemoveEncryption again with the same key.
+func (connection *DbConnection) RemoveEncryption(key []byte, confirm bool) (err error) {
+	ctx, end := connection.startSpan(connection.ctx, "RemoveEncryption", "")
+	defer func() { end(err) }()
+
+	if !confirm {
+		return ErrConfirmationRequired
+	}
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	if key == nil {
+		return ErrEncryptionKeyRequired
+	}
+
+	log.Warn().Str("component", "postgres").
+		Msg("removing the encryption of the store, the objects and the credentials they hold will be readable by anyone with access to the database")
+
+	connection.EncryptionKey = key
+	connection.SetEncrypted(true)
+
+	if err := connection.migrateStore(ctx, migrationDecrypt); err != nil {
+		return err
+	}
+
+	connection.EncryptionKey = nil
+	connection.SetEncrypted(false)
+
+	return nil
+}
+
+// migrateStore migrates the buckets of the store in the given direction, resuming the
+// migration recorded in MigrationStateTable if any
+func (connection *DbConnection) migrateStore(ctx context.Context, direction string) error {
+	if err := connection.createMigrationStateTable(ctx); err != nil {
+		return err
+	}
+
+	buckets, err := connection.listBuckets(ctx, connection.DB)
+	if err != nil {
+		return err
+	}
+
+	var states []migrationState
+	query := fmt.Sprintf("SELECT bucket, direction, rows_done, last_key, completed FROM %s", connection.table(MigrationStateTable))
+	if err := connection.SelectContext(ctx, &states, query); err != nil {
+		return fmt.Errorf("failed to read %s: %w", MigrationStateTable, err)
+	}
+
+	done := make(map[string]migrationState, len(states))
+	progress := MigrationProgress{Running: true, Decrypting: direction == migrationDecrypt}
+	for _, state := range states {
+		if state.Direction != direction {
+			return ErrMigrationInProgress
+		}
+
+		done[state.Bucket] = state
+		progress.RowsProcessed += state.RowsDone
+		progress.TotalRows += state.RowsDone
+	}
+
+	for _, bucket := range buckets {
+		if done[bucket].Completed {
+			continue
+		}
+
+		var remaining int64
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE $1::text IS NULL OR id > CAST($1 AS %s)",
+			connection.table(bucket), idSQLType(connection.keyType(bucket)))
+		if err := connection.GetContext(ctx, &remaining, query, done[bucket].LastKey); err != nil {
+			return fmt.Errorf("failed to count the objects of bucket %s: %w", bucket, err)
+		}
+
+		progress.TotalRows += remaining
+	}
+
+	if len(states) > 0 {
+		log.Info().Str("component", "postgres").Str("direction", direction).Int64("rows_processed", progress.RowsProcessed).
+			Msg("resuming the migration of the store")
+	}
+
+	connection.setMigrationProgress(progress)
+	defer func() {
+		progress := connection.MigrationProgress()
+		progress.Running = false
+		connection.setMigrationProgress(progress)
+	}()
+
+	for _, bucket := range buckets {
+		if done[bucket].Completed {
+			continue
+		}
+
+		if err := connection.migrateBucketInBatches(ctx, bucket, direction); err != nil {
+			return err
+		}
+	}
+
+	err = connection.tracedTxCtx(ctx, "MigrateEncryption", "", connection.txOptions, func(tx *DbTransaction) error {
+		return tx.markStore(direction == migrationEncrypt)
+	})
+	if err != nil {
+		return err
+	}
+
+	msg := "the store is encrypted"
+	if direction == migrationDecrypt {
+		msg = "the store is decrypted"
+	}
+
+	log.Info().Str("component", "postgres").Int64("rows_processed", connection.MigrationProgress().RowsProcessed).Msg(msg)
+
+	return nil
+}
+
+// createMigrationStateTable creates MigrationStateTable unless a previous migration left it
+func (connection *DbConnection) createMigrationStateTable(ctx context.Context) error {
+	query := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			bucket TEXT PRIMARY KEY,
+			direction TEXT NOT NULL,
+			rows_done BIGINT NOT NULL DEFAULT 0,
+			last_key TEXT,
+			completed BOOLEAN NOT NULL DEFAULT false,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, connection.table(MigrationStateTable))
+	if _, err := connection.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create %s: %w", MigrationStateTable, err)
+	}
+
+	return nil
+}
+
+// pendingMigration returns the direction of the migration recorded in MigrationStateTable, it
+// is empty when no migration was interrupted
+func (connection *DbConnection) pendingMigration(ctx context.Context) (string, error) {
+	exists, err := connection.tableExists(ctx, connection.DB, MigrationStateTable)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	// the migration was interrupted before its first batch, which is the same in both directions
+	var direction string
+	query := fmt.Sprintf("SELECT direction FROM %s LIMIT 1", connection.table(MigrationStateTable))
+	err = connection.GetContext(ctx, &direction, query)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return direction, err
+}
+
+// migrateBucketInBatches migrates the objects of a bucket a batch at a time, starting after
+// the last object recorded in MigrationStateTable
+func (connection *DbConnection) migrateBucketInBatches(ctx context.Context, bucketName, direction string) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var migrated int
+		var completed bool
+		err := connection.tracedTxCtx(ctx, "MigrateEncryption", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+			var err error
+			migrated, completed, err = tx.migrateBatch(bucketName, direction)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to %s bucket %s: %w", direction, bucketName, err)
+		}
+
+		// the progress is published once the batch is committed
+		progress := connection.MigrationProgress()
+		progress.Bucket = bucketName
+		progress.RowsProcessed += int64(migrated)
+		connection.setMigrationProgress(progress)
+
+		if completed {
+			log.Info().Str("component", "postgres").Str("bucket", bucketName).Str("direction", direction).Msg("bucket migrated")
+			return nil
+		}
+	}
+}
+
+// migrateBatch migrates the next batch of objects of a bucket and records it in
+// MigrationStateTable, it returns the number of objects of the batch and completed is true once
+// the bucket has no object left. When encrypting, the data column is converted to BYTEA along
+// with the first batch. When decrypting, the objects are stored as unencrypted envelopes, which
+// the encrypted store still reads, until the data column is converted back to JSONB along with
+// the last batch.
+func (tx *DbTransaction) migrateBatch(bucketName, direction string) (n int, completed bool, err error) {
+	ctx := tx.context()
+	table := tx.conn.table(bucketName)
+	stateTable := tx.conn.table(MigrationStateTable)
+
+	var state migrationState
+	query := fmt.Sprintf("SELECT bucket, direction, rows_done, last_key, completed FROM %s WHERE bucket = $1 FOR UPDATE", stateTable)
+	err = tx.tx.GetContext(ctx, &state, query, bucketName)
+	if errors.Is(err, sql.ErrNoRows) {
+		state = migrationState{Bucket: bucketName, Direction: direction}
+
+		if direction == migrationEncrypt {
+			if _, err := tx.convertDataColumn(ctx, bucketName); err != nil {
+				return 0, false, err
+			}
+		} else {
+			// the buckets never used by the encrypted store hold plain JSON documents already
+			if state.Completed, err = tx.hasJSONDataColumn(ctx, bucketName); err != nil {
+				return 0, false, err
+			}
+		}
+
+		query = fmt.Sprintf("INSERT INTO %s (bucket, direction, completed) VALUES ($1, $2, $3)", stateTable)
+		if _, err := tx.tx.ExecContext(ctx, query, bucketName, direction, state.Completed); err != nil {
+			return 0, false, fmt.Errorf("failed to record the migration of bucket %s: %w", bucketName, err)
+		}
+	} else if err != nil {
+		return 0, false, fmt.Errorf("failed to read the migration state of bucket %s: %w", bucketName, err)
+	}
+
+	if state.Direction != direction {
+		return 0, false, ErrMigrationInProgress
+	}
+
+	if state.Completed {
+		return 0, true, nil
+	}
+
+	batchSize := tx.conn.encryptionBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultEncryptionBatchSize
+	}
+
+	query = fmt.Sprintf(`
+		SELECT id::text AS id, data FROM %s
+		WHERE $1::text IS NULL OR id > CAST($1 AS %s)
+		ORDER BY id LIMIT $2`, table, idSQLType(tx.conn.keyType(bucketName)))
+
+	var rows []struct {
+		ID   string `db:"id"`
+		Data []byte `db:"data"`
+	}
+	if err := tx.tx.SelectContext(ctx, &rows, query, state.LastKey, batchSize); err != nil {
+		return 0, false, fmt.Errorf("failed to read table %s: %w", table, err)
+	}
+
+	if len(rows) == 0 {
+		if direction == migrationDecrypt {
+			if err := tx.restoreDataColumn(ctx, bucketName); err != nil {
+				return 0, false, err
+			}
+		}
+
+		query = fmt.Sprintf("UPDATE %s SET completed = true, updated_at = now() WHERE bucket = $1", stateTable)
+		if _, err := tx.tx.ExecContext(ctx, query, bucketName); err != nil {
+			return 0, false, fmt.Errorf("failed to record the migration of bucket %s: %w", bucketName, err)
+		}
+
+		return 0, true, nil
+	}
+
+	// the objects are rewritten, BackupSince must write them again
+	update := fmt.Sprintf("UPDATE %s SET data = $1, %s WHERE id = $2", table, bumpVersion)
+	for _, r := range rows {
+		flags, _, ok := parseEnvelope(r.Data)
+
+		var data []byte
+		if direction == migrationEncrypt {
+			// the objects written by an encrypted store since the column was converted are skipped
+			if ok && flags&envelopeEncrypted != 0 {
+				continue
+			}
+
+			// the envelope documents are encrypted as the JSON document of the object they hold
+			document := r.Data
+			if envelope, wrapped := unwrapEnvelope(r.Data); wrapped {
+				decrypted, decodeErr := tx.conn.decryptedEnvelope(bucketName, []byte(r.ID), envelope)
+				if decodeErr != nil {
+					return 0, false, fmt.Errorf("failed to %s object %s of table %s: %w", direction, r.ID, table, decodeErr)
+				}
+
+				document = decrypted[envelopeHeaderSize:]
+			}
+
+			data, err = tx.marshal(bucketName, []byte(r.ID), json.RawMessage(document))
+		} else {
+			// the objects decrypted by a previous run are skipped
+			if ok && flags == 0 {
+				continue
+			}
+
+			data, err = tx.conn.decryptedEnvelope(bucketName, []byte(r.ID), r.Data)
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to %s object %s of table %s: %w", direction, r.ID, table, err)
+		}
+
+		if _, err := tx.tx.ExecContext(ctx, update, data, r.ID); err != nil {
+			return 0, false, fmt.Errorf("failed to %s object %s of table %s: %w", direction, r.ID, table, err)
+		}
+	}
+
+	lastKey := rows[len(rows)-1].ID
+	query = fmt.Sprintf("UPDATE %s SET rows_done = rows_done + $1, last_key = $2, updated_at = now() WHERE bucket = $3", stateTable)
+	if _, err := tx.tx.ExecContext(ctx, query, len(rows), lastKey, bucketName); err != nil {
+		return 0, false, fmt.Errorf("failed to record the migration of bucket %s: %w", bucketName, err)
+	}
+
+	return len(rows), false, nil
+}
+
+// decryptedEnvelope decodes the object stored at key in a bucket and returns its JSON document
+// in an unencrypted envelope, the raw strings are turned into JSON strings
+func (connection *DbConnection) decryptedEnvelope(bucketName string, key, data []byte) ([]byte, error) {
+	var document []byte
+	if flags, _, ok := parseEnvelope(data); ok && flags&envelopeRawString != 0 {
+		var s string
+		if err := connection.UnmarshalObjectForKey(bucketName, key, data, &s); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if document, err = json.Marshal(s); err != nil {
+			return nil, err
+		}
+	} else {
+		var raw json.RawMessage
+		if err := connection.UnmarshalObjectForKey(bucketName, key, data, &raw); err != nil {
+			return nil, err
+		}
+
+		document = raw
+	}
+
+	return append(envelopeHeader(0), document...), nil
+}
+
+// restoreDataColumn converts the BYTEA data column of a decrypted bucket back to JSONB, its
+// objects being unencrypted envelopes holding their JSON document
+func (tx *DbTransaction) restoreDataColumn(ctx context.Context, bucketName string) error {
+	table := tx.conn.table(bucketName)
+
+	query := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN data TYPE JSONB USING convert_from(substring(data from %d), 'UTF8')::jsonb",
+		table, envelopeHeaderSize+1)
+	if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to convert the data column of table %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// markStore replaces the metadata table of an unencrypted store with the one of an encrypted
+// store, or the other way around, and drops MigrationStateTable
+func (tx *DbTransaction) markStore(encrypted bool) error {
+	ctx := tx.context()
+
+	from, to := UnencryptedMetadataTable, EncryptedMetadataTable
+	if !encrypted {
+		from, to = to, from
+	}
+
+	haveFrom, err := tx.conn.tableExists(ctx, tx.tx, from)
+	if err != nil {
+		return fmt.Errorf("failed to check %s table: %w", from, err)
+	}
+
+	haveTo, err := tx.conn.tableExists(ctx, tx.tx, to)
+	if err != nil {
+		return fmt.Errorf("failed to check %s table: %w", to, err)
+	}
+
+	var query string
+	switch {
+	case haveFrom && !haveTo:
+		query = fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tx.conn.table(from), tx.conn.table(to))
+	case haveFrom:
+		query = "DROP TABLE " + tx.conn.table(from)
+	case !haveTo:
+		query = fmt.Sprintf("CREATE TABLE %s (migrated_at TIMESTAMPTZ NOT NULL DEFAULT now())", tx.conn.table(to))
+	}
+
+	if query != "" {
+		if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to replace the %s table: %w", from, err)
+		}
+	}
+
+	if _, err := tx.tx.ExecContext(ctx, "DROP TABLE "+tx.conn.table(MigrationStateTable)); err != nil {
+		return fmt.Errorf("failed to drop %s: %w", MigrationStateTable, err)
+	}
+
+	return nil
+}
+
+// idSQLType returns the SQL type of the keys of a bucket
+func idSQLType(keyType KeyType) string {
+	if keyType == KeyTypeText {
+		return "TEXT"
+	}
+
+	return "INTEGER"
+}
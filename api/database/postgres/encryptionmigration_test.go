@@ -0,0 +1,345 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectMigrationStart expects MigrateEncryption to create MigrationStateTable and to read the
+// buckets and their state
+func expectMigrationStart(mock sqlmock.Sqlmock, state *sqlmock.Rows, remaining int) {
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS migration_state")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectManagedTables(mock, "users")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT bucket, direction, rows_done, last_key, completed FROM migration_state")).WillReturnRows(state)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users")).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(remaining))
+}
+
+func Test_MigrateEncryption_Resume(t *testing.T) {
+	const (
+		stateQuery = "SELECT bucket, direction, rows_done, last_key, completed FROM migration_state WHERE bucket = $1 FOR UPDATE"
+		batchQuery = "SELECT id::text AS id, data FROM users"
+		update     = "UPDATE users SET data = $1, version = version + 1, updated_at = now() WHERE id = $2"
+		record     = "UPDATE migration_state SET rows_done = rows_done + $1, last_key = $2"
+	)
+
+	stateColumns := []string{"bucket", "direction", "rows_done", "last_key", "completed"}
+	key := secretToEncryptionKey(passphrase)
+
+	// the first run is killed after its first batch
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = key
+	conn.encryptionBatchSize = 2
+
+	first, second := &capturedArg{}, &capturedArg{}
+	expectMigrationStart(mock, sqlmock.NewRows(stateColumns), 4)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(stateQuery)).WithArgs("users").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data_type FROM information_schema.columns")).WithArgs("users").
+		WillReturnRows(sqlmock.NewRows([]string{"data_type"}).AddRow("jsonb"))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE users ALTER COLUMN data TYPE BYTEA")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO migration_state (bucket, direction, completed) VALUES ($1, $2, $3)")).WithArgs("users", migrationEncrypt, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(batchQuery)).WithArgs(nil, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", []byte(`{"Username":"admin"}`)).AddRow("2", []byte(`{"Username":"operator"}`)))
+	mock.ExpectExec(regexp.QuoteMeta(update)).WithArgs(first, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(update)).WithArgs(second, "2").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(record)).WithArgs(2, "2", "users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin().WillReturnError(errors.New("the database system is shutting down"))
+
+	require.Error(t, conn.MigrateEncryption(context.Background()))
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, MigrationProgress{Bucket: "users", RowsProcessed: 2, TotalRows: 4}, conn.MigrationProgress())
+
+	var user map[string]any
+	require.NoError(t, conn.UnmarshalObjectForKey("users", []byte("1"), first.value.([]byte), &user))
+	assert.Equal(t, "admin", user["Username"])
+
+	// the second run resumes after the last object of the first one, the object written by the
+	// encrypted store in between is not encrypted twice
+	written, err := conn.MarshalObjectForKey("users", []byte("3"), map[string]any{"Username": "viewer"})
+	require.NoError(t, err)
+
+	conn, mock = newMockConnection(t)
+	conn.EncryptionKey = key
+	conn.encryptionBatchSize = 2
+
+	fourth := &capturedArg{}
+	expectMigrationStart(mock, sqlmock.NewRows(stateColumns).AddRow("users", migrationEncrypt, 2, "2", false), 2)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(stateQuery)).WithArgs("users").
+		WillReturnRows(sqlmock.NewRows(stateColumns).AddRow("users", migrationEncrypt, 2, "2", false))
+	mock.ExpectQuery(regexp.QuoteMeta(batchQuery)).WithArgs("2", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("3", written).AddRow("4", []byte(`{"Username":"helpdesk"}`)))
+	mock.ExpectExec(regexp.QuoteMeta(update)).WithArgs(fourth, "4").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(record)).WithArgs(2, "4", "users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(stateQuery)).WithArgs("users").
+		WillReturnRows(sqlmock.NewRows(stateColumns).AddRow("users", migrationEncrypt, 4, "4", false))
+	mock.ExpectQuery(regexp.QuoteMeta(batchQuery)).WithArgs("4", 2).WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE migration_state SET completed = true")).WithArgs("users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(UnencryptedMetadataTable).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(EncryptedMetadataTable).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE unencrypted_metadata RENAME TO encrypted_metadata")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE migration_state")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.MigrateEncryption(context.Background()))
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, MigrationProgress{Bucket: "users", RowsProcessed: 4, TotalRows: 4}, conn.MigrationProgress())
+
+	require.NoError(t, conn.UnmarshalObjectForKey("users", []byte("4"), fourth.value.([]byte), &user))
+	assert.Equal(t, "helpdesk", user["Username"])
+}
+
+func Test_MigrateEncryption_EnvelopeDocuments(t *testing.T) {
+	stateColumns := []string{"bucket", "direction", "rows_done", "last_key", "completed"}
+
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+
+	// an envelope document carried over from the legacy table is encrypted as the object it holds
+	document, err := wrapEnvelope(append(envelopeHeader(0), `{"Username":"admin"}`...))
+	require.NoError(t, err)
+
+	encrypted := &capturedArg{}
+	expectMigrationStart(mock, sqlmock.NewRows(stateColumns), 1)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT bucket, direction, rows_done, last_key, completed FROM migration_state WHERE bucket = $1 FOR UPDATE")).
+		WithArgs("users").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data_type FROM information_schema.columns")).WithArgs("users").
+		WillReturnRows(sqlmock.NewRows([]string{"data_type"}).AddRow("jsonb"))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE users ALTER COLUMN data TYPE BYTEA")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO migration_state")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id::text AS id, data FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", document))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs(encrypted, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE migration_state SET rows_done")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit().WillReturnError(errors.New("stop"))
+
+	require.Error(t, conn.MigrateEncryption(context.Background()))
+
+	var user map[string]any
+	require.NoError(t, conn.UnmarshalObjectForKey("users", []byte("1"), encrypted.value.([]byte), &user))
+	assert.Equal(t, map[string]any{"Username": "admin"}, user)
+}
+
+func Test_MigrateEncryption_NoKey(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	require.ErrorIs(t, conn.MigrateEncryption(context.Background()), ErrEncryptionKeyRequired)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_NeedsEncryptionMigration_InterruptedMigration(t *testing.T) {
+	for _, withKey := range []bool{true, false} {
+		conn, mock := newMockConnection(t)
+		if withKey {
+			conn.EncryptionKey = secretToEncryptionKey(passphrase)
+		}
+
+		for _, exists := range []bool{false, false, true} {
+			mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT direction FROM migration_state LIMIT 1")).
+			WillReturnRows(sqlmock.NewRows([]string{"direction"}).AddRow(migrationEncrypt))
+
+		needed, err := conn.NeedsEncryptionMigration()
+		if withKey {
+			require.NoError(t, err)
+			assert.True(t, needed)
+		} else {
+			require.ErrorIs(t, err, ErrHaveEncryptedWithNoKey)
+		}
+		require.NoError(t, mock.ExpectationsWereMet())
+	}
+}
+
+func Test_MigrateEncryption_RealDatabase(t *testing.T) {
+	type user struct {
+		ID       int
+		Username string
+	}
+
+	plain := newTestConnection(t)
+	dropTestTables(t, plain, "migrated_users", MigrationStateTable, UnencryptedMetadataTable, EncryptedMetadataTable)
+
+	_, err := plain.Exec("CREATE TABLE " + UnencryptedMetadataTable + " (created_at TIMESTAMPTZ NOT NULL DEFAULT now())")
+	require.NoError(t, err)
+	require.NoError(t, plain.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("migrated_users"); err != nil {
+			return err
+		}
+
+		for id := 1; id <= 5; id++ {
+			if err := tx.CreateObjectWithId("migrated_users", id, user{ID: id, Username: "user"}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}))
+
+	// the first run is killed once its first batch is committed
+	conn := newTestConnection(t, WithEncryptionBatchSize(2))
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	ctx := context.Background()
+	require.NoError(t, conn.createMigrationStateTable(ctx))
+	require.NoError(t, conn.tracedTxCtx(ctx, "MigrateEncryption", "migrated_users", conn.txOptions, func(tx *DbTransaction) error {
+		_, _, err := tx.migrateBatch("migrated_users", migrationEncrypt)
+		return err
+	}))
+
+	conn = newTestConnection(t, WithEncryptionBatchSize(2))
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+
+	needed, err := conn.NeedsEncryptionMigration()
+	require.NoError(t, err)
+	assert.True(t, needed)
+
+	// the second run resumes and encrypts the remaining objects only
+	require.NoError(t, conn.MigrateEncryption(ctx))
+	assert.Equal(t, MigrationProgress{Bucket: "migrated_users", RowsProcessed: 5, TotalRows: 5}, conn.MigrationProgress())
+
+	needed, err = conn.NeedsEncryptionMigration()
+	require.NoError(t, err)
+	assert.False(t, needed)
+
+	for id := 1; id <= 5; id++ {
+		var got user
+		require.NoError(t, conn.GetObject("migrated_users", conn.ConvertToKey(id), &got))
+		assert.Equal(t, user{ID: id, Username: "user"}, got)
+	}
+}
+
+func Test_RemoveEncryption(t *testing.T) {
+	const stateQuery = "SELECT bucket, direction, rows_done, last_key, completed FROM migration_state WHERE bucket = $1 FOR UPDATE"
+
+	stateColumns := []string{"bucket", "direction", "rows_done", "last_key", "completed"}
+	key := secretToEncryptionKey(passphrase)
+
+	conn, mock := newMockConnection(t)
+	require.ErrorIs(t, conn.RemoveEncryption(key, false), ErrConfirmationRequired)
+
+	conn.EncryptionKey = key
+	conn.SetEncrypted(true)
+	admin, err := conn.MarshalObjectForKey("users", []byte("1"), map[string]any{"Username": "admin"})
+	require.NoError(t, err)
+
+	// the second object was decrypted by a previous run which was interrupted before recording it
+	decrypted := append(envelopeHeader(0), `{"Username":"operator"}`...)
+
+	written := &capturedArg{}
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS migration_state")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectManagedTables(mock, "users")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT bucket, direction, rows_done, last_key, completed FROM migration_state")).WillReturnRows(sqlmock.NewRows(stateColumns))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users")).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(stateQuery)).WithArgs("users").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data_type FROM information_schema.columns")).WithArgs("users").
+		WillReturnRows(sqlmock.NewRows([]string{"data_type"}).AddRow("bytea"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO migration_state (bucket, direction, completed)")).WithArgs("users", migrationDecrypt, false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id::text AS id, data FROM users")).WithArgs(nil, DefaultEncryptionBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", admin).AddRow("2", decrypted))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs(written, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE migration_state SET rows_done = rows_done + $1, last_key = $2")).WithArgs(2, "2", "users").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(stateQuery)).WithArgs("users").
+		WillReturnRows(sqlmock.NewRows(stateColumns).AddRow("users", migrationDecrypt, 2, "2", false))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id::text AS id, data FROM users")).WithArgs("2", DefaultEncryptionBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE users ALTER COLUMN data TYPE JSONB USING convert_from(substring(data from 7), 'UTF8')::jsonb")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE migration_state SET completed = true")).WithArgs("users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(EncryptedMetadataTable).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(UnencryptedMetadataTable).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE encrypted_metadata RENAME TO unencrypted_metadata")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE migration_state")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.RemoveEncryption(key, true))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Nil(t, conn.EncryptionKey)
+	assert.False(t, conn.IsEncryptedStore())
+	assert.Equal(t, MigrationProgress{Decrypting: true, Bucket: "users", RowsProcessed: 2, TotalRows: 2}, conn.MigrationProgress())
+	assert.Equal(t, append(envelopeHeader(0), `{"Username":"admin"}`...), written.value)
+}
+
+func Test_RemoveEncryption_MigrationInProgress(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS migration_state")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectManagedTables(mock, "users")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT bucket, direction, rows_done, last_key, completed FROM migration_state")).
+		WillReturnRows(sqlmock.NewRows([]string{"bucket", "direction", "rows_done", "last_key", "completed"}).AddRow("users", migrationEncrypt, 2, "2", false))
+
+	require.ErrorIs(t, conn.RemoveEncryption(secretToEncryptionKey(passphrase), true), ErrMigrationInProgress)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_RemoveEncryption_RealDatabase(t *testing.T) {
+	type user struct {
+		ID       int
+		Username string
+	}
+
+	plain := newTestConnection(t)
+	dropTestTables(t, plain, "decrypted_users", MigrationStateTable, UnencryptedMetadataTable, EncryptedMetadataTable)
+
+	_, err := plain.Exec("CREATE TABLE " + UnencryptedMetadataTable + " (created_at TIMESTAMPTZ NOT NULL DEFAULT now())")
+	require.NoError(t, err)
+	require.NoError(t, plain.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("decrypted_users"); err != nil {
+			return err
+		}
+
+		for id := 1; id <= 5; id++ {
+			if err := tx.CreateObjectWithId("decrypted_users", id, user{ID: id, Username: "user"}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}))
+
+	encrypted := newTestConnection(t, WithEncryptionBatchSize(2))
+	encrypted.EncryptionKey = secretToEncryptionKey(passphrase)
+	require.NoError(t, encrypted.MigrateEncryption(context.Background()))
+
+	require.NoError(t, encrypted.RemoveEncryption(secretToEncryptionKey(passphrase), true))
+
+	// the store is read without an encryption key
+	conn := newTestConnection(t)
+
+	needed, err := conn.NeedsEncryptionMigration()
+	require.NoError(t, err)
+	assert.False(t, needed)
+
+	for id := 1; id <= 5; id++ {
+		var got user
+		require.NoError(t, conn.GetObject("decrypted_users", conn.ConvertToKey(id), &got))
+		assert.Equal(t, user{ID: id, Username: "user"}, got)
+	}
+
+	var columnType string
+	require.NoError(t, conn.Get(&columnType, "SELECT data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'decrypted_users' AND column_name = 'data'"))
+	assert.Equal(t, "jsonb", columnType)
+}
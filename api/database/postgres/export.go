@@ -1,13 +1,34 @@
 package postgres
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
 )
 
-// backupMetadata retrieves metadata about tables in the PostgreSQL database
+// ExportFormat is the output format of ExportTables
+type ExportFormat string
+
+const (
+	// ExportFormatJSON writes the tables in the format of ExportJSON, which ImportFromJSON reads back
+	ExportFormatJSON ExportFormat = "json"
+	// ExportFormatSQL writes the tables as a SQL script recreating them
+	ExportFormatSQL ExportFormat = "sql"
+)
+
+// csvSampleSize is the number of rows inspected by ExportTableCSV to discover the columns
+const csvSampleSize = 100
+
+// backupMetadata retrieves metadata about the tables of the prefix, they are keyed by bucket name
 func (c *DbConnection) backupMetadata() (map[string]any, error) {
 	query := `
 		SELECT 
@@ -15,13 +36,13 @@ func (c *DbConnection) backupMetadata() (map[string]any, error) {
 			(
 				SELECT COUNT(*) 
 				FROM information_schema.columns 
-				WHERE table_schema = 'public' AND table_name = t.table_name
+				WHERE table_schema = current_schema() AND table_name = t.table_name
 			) as column_count
-		FROM information_schema.tables 
-		WHERE table_schema = 'public'
+		FROM information_schema.tables t
+		WHERE table_schema = current_schema()
 	`
 
-	rows, err := c.DB.Query(query)
+	rows, err := c.DB.QueryContext(c.ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -34,46 +55,90 @@ func (c *DbConnection) backupMetadata() (map[string]any, error) {
 		if err := rows.Scan(&tableName, &columnCount); err != nil {
 			return nil, err
 		}
-		buckets[tableName] = columnCount
+
+		if bucket, ok := c.bucketOf(tableName); ok {
+			buckets[bucket] = columnCount
+		}
 	}
 
 	return buckets, nil
 }
 
+// ExportRaw writes the JSON export of the database, along with the table metadata, to filename
+func (c *DbConnection) ExportRaw(filename string) error {
+	data, err := c.ExportJSON(true)
+	if err != nil {
+		return fmt.Errorf("failed to export the database: %w", err)
+	}
+
+	return os.WriteFile(filename, data, 0o600)
+}
+
+// ExportOptions configures ExportJSONWithOptions
+type ExportOptions struct {
+	// Metadata adds the metadata of the tables to the export
+	Metadata bool
+
+	// RedactedFields are the paths of the fields of the objects whose value is replaced with
+	// RedactedFieldValue, see DefaultRedactedFields
+	RedactedFields []string
+
+	// RedactSecrets replaces the credentials found at DefaultSecretPaths and SecretPaths with
+	// RedactedSecretValue, the structure of the objects is left intact
+	RedactSecrets bool
+
+	// SecretPaths are the paths redacted along with DefaultSecretPaths when RedactSecrets is
+	// set, their first name is the table of the objects, e.g. settings.LDAPSettings.Password
+	SecretPaths []string
+}
+
 // ExportJSON creates a JSON representation from the PostgreSQL database
 func (c *DbConnection) ExportJSON(metadata bool) ([]byte, error) {
-	log.Debug().Msg("Exporting database to JSON")
+	return c.ExportJSONWithOptions(ExportOptions{Metadata: metadata})
+}
+
+// ExportJSONWithOptions creates a JSON representation from the PostgreSQL database, like
+// ExportJSON, redacting the fields listed by opts
+func (c *DbConnection) ExportJSONWithOptions(opts ExportOptions) (_ []byte, err error) {
+	_, end := c.startSpan(c.ctx, "ExportJSON", "")
+	defer func() { end(err) }()
+
+	log.Debug().Str("component", "postgres").Msg("Exporting database to JSON")
 
 	backup := make(map[string]any)
+	redactor := newFieldRedactor(opts.RedactedFields)
+	if opts.RedactSecrets {
+		redactor.withTablePaths(DefaultSecretPaths).withTablePaths(opts.SecretPaths)
+	}
 
 	// Export metadata if requested
-	if metadata {
+	if opts.Metadata {
 		meta, err := c.backupMetadata()
 		if err != nil {
-			log.Error().Err(err).Msg("failed exporting metadata")
+			log.Error().Str("component", "postgres").Err(err).Msg("failed exporting metadata")
 		}
 		backup["__metadata"] = meta
 	}
 
-	// List of tables to export
-	tables := []string{
-		"version",
-		"ssl",
-		"settings", 
-		"tunnel_server",
-		// Add other tables you want to export
+	// every bucket is exported, so that ImportFromJSON restores the whole store
+	tables, err := c.managedTables(c.ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, table := range tables {
 		data, err := c.exportTable(table)
 		if err != nil {
 			log.Error().
+				Str("component", "postgres").
 				Str("table", table).
 				Err(err).
 				Msg("failed to export table")
 			continue
 		}
 
+		redactor.redactRows(table, data)
+
 		// Special handling for specific tables
 		switch table {
 		case "version", "ssl", "settings", "tunnel_server":
@@ -89,14 +154,18 @@ func (c *DbConnection) ExportJSON(metadata bool) ([]byte, error) {
 		}
 	}
 
+	if err := c.addJSONManifest(c.ctx, backup, tables); err != nil {
+		return nil, err
+	}
+
 	return json.MarshalIndent(backup, "", "  ")
 }
 
-// exportTable retrieves all rows from a given table
+// exportTable retrieves all rows from the table of a bucket
 func (c *DbConnection) exportTable(tableName string) ([]any, error) {
-	query := fmt.Sprintf("SELECT * FROM %s", tableName)
+	query := fmt.Sprintf("SELECT * FROM %s", c.table(tableName))
 	
-	rows, err := c.DB.Query(query)
+	rows, err := c.DB.QueryContext(c.ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -124,9 +193,22 @@ func (c *DbConnection) exportTable(tableName string) ([]any, error) {
 			return nil, err
 		}
 
-		// Convert row to a map
+		// the encrypted objects are bound to their key
+		var key []byte
+		for i, colName := range columns {
+			if colName == "id" && rowData[i] != nil {
+				key = []byte(fmt.Sprint(rowData[i]))
+			}
+		}
+
+		// Convert row to a map, the version of the objects is not restored by ImportFromJSON,
+		// their timestamps are
 		rowMap := make(map[string]interface{})
 		for i, colName := range columns {
+			if colName == "version" {
+				continue
+			}
+
 			val := rowData[i]
 			
 			// Handle potential nil values
@@ -138,13 +220,18 @@ func (c *DbConnection) exportTable(tableName string) ([]any, error) {
 			// Special handling for byte slices (potentially encrypted)
 			if byteVal, ok := val.([]byte); ok {
 				var obj any
-				err := c.UnmarshalObject(byteVal, &obj)
-				if err == nil {
-					rowMap[colName] = obj
+				var err error
+				if colName == "data" && key != nil {
+					err = c.decodeObject(tableName, key, byteVal, &obj)
 				} else {
-					// If unmarshaling fails, keep original byte value
-					rowMap[colName] = string(byteVal)
+					err = c.UnmarshalObject(byteVal, &obj)
+				}
+				if err != nil {
+					// the undecodable values are never exported as they are, they may be ciphertext
+					return nil, fmt.Errorf("failed to decode column %s of row %s of table %s: %w", colName, key, tableName, err)
 				}
+
+				rowMap[colName] = obj
 			} else {
 				rowMap[colName] = val
 			}
@@ -158,4 +245,214 @@ func (c *DbConnection) exportTable(tableName string) ([]any, error) {
 	}
 
 	return results, nil
-}
\ No newline at end of file
+}
+
+// ExportTableCSV writes the rows of a table as CSV with a header row. There is one column per
+// top-level key found in the data of a sample of the rows, sorted alphabetically after the id.
+// The fields are read by the server, it returns ErrEncryptedStore on an encrypted store and
+// ErrCompressedStore when compression is enabled.
+func (c *DbConnection) ExportTableCSV(ctx context.Context, tableName string, w io.Writer) (err error) {
+	ctx, end := c.startSpan(ctx, "ExportTableCSV", tableName)
+	defer func() { end(err) }()
+
+	if c.DB == nil {
+		return ErrNoConnection
+	}
+
+	if c.IsEncryptedStore() {
+		return fmt.Errorf("%w: cannot read the fields of encrypted objects", ErrEncryptedStore)
+	}
+
+	if c.compression {
+		return fmt.Errorf("%w: cannot read the fields of compressed objects", ErrCompressedStore)
+	}
+
+	table := c.table(tableName)
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	var fields []string
+	err = c.SelectContext(ctx, &fields, fmt.Sprintf(`
+		SELECT DISTINCT key
+		FROM (
+			SELECT data FROM %s WHERE jsonb_typeof(data) = 'object' ORDER BY id LIMIT $1
+		) sample, jsonb_object_keys(sample.data) AS key
+		ORDER BY key
+	`, table), csvSampleSize)
+	if err != nil {
+		return fmt.Errorf("failed to list the fields of table %s: %w", tableName, err)
+	}
+
+	// The field names are passed as parameters so they never end up in the query text
+	columns := []string{"id::text"}
+	args := make([]any, 0, len(fields))
+	for i, field := range fields {
+		columns = append(columns, fmt.Sprintf("data->>$%d::text", i+1))
+		args = append(args, field)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY id", strings.Join(columns, ", "), table)
+	rows, err := c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query table %s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"id"}, fields...)); err != nil {
+		return err
+	}
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	record := make([]string, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to scan row of table %s: %w", tableName, err)
+		}
+
+		for i, value := range values {
+			record[i] = value.String
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// ExportTables exports the given tables only. It returns ErrTableNotFound when one
+// of them is not a managed table, before anything is written.
+func (c *DbConnection) ExportTables(ctx context.Context, tableNames []string, w io.Writer, format ExportFormat) (err error) {
+	ctx, end := c.startSpan(ctx, "ExportTables", "")
+	defer func() { end(err) }()
+
+	if c.DB == nil {
+		return ErrNoConnection
+	}
+
+	if format != ExportFormatJSON && format != ExportFormatSQL {
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+
+	managed, err := c.managedTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool, len(managed))
+	for _, table := range managed {
+		known[table] = true
+	}
+
+	for _, table := range tableNames {
+		if !known[table] {
+			return fmt.Errorf("%w: %q", ErrTableNotFound, table)
+		}
+	}
+
+	if format == ExportFormatSQL {
+		return c.exportTablesSQL(ctx, tableNames, w)
+	}
+
+	backup := make(map[string]any, len(tableNames))
+	for _, table := range tableNames {
+		data, err := c.exportTable(table)
+		if err != nil {
+			return fmt.Errorf("failed to export table %s: %w", table, err)
+		}
+
+		if data == nil {
+			data = []any{}
+		}
+		backup[table] = data
+	}
+
+	if err := c.addJSONManifest(ctx, backup, managed); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+
+	return err
+}
+
+// timestampLiteral returns the SQL literal of an exported timestamp, DEFAULT when it is missing
+func timestampLiteral(timestamp sql.NullString) string {
+	if !timestamp.Valid {
+		return "DEFAULT"
+	}
+
+	return pq.QuoteLiteral(timestamp.String)
+}
+
+// exportTablesSQL writes a script creating the tables, inserting their rows and
+// moving their id sequence past the highest id
+func (c *DbConnection) exportTablesSQL(ctx context.Context, tableNames []string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "BEGIN;")
+
+	for _, bucket := range tableNames {
+		table := c.table(bucket)
+		keyType := c.keyType(bucket)
+		fmt.Fprintf(bw, "\nCREATE TABLE IF NOT EXISTS %s (%s, data %s NOT NULL, %s, %s, %s);\n",
+			table, keyType.idColumn(), c.dataColumnType(), versionColumn, createdAtColumn, updatedAtColumn)
+		fmt.Fprintf(bw, "ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s, ADD COLUMN IF NOT EXISTS %s;\n", table, createdAtColumn, updatedAtColumn)
+		if keyType == KeyTypeInteger {
+			fmt.Fprintf(bw, "CREATE SEQUENCE IF NOT EXISTS %s OWNED BY %s.id;\n", idSequence(table), table)
+		}
+
+		// the tables not used since the timestamps were introduced do not have them yet
+		rows, err := c.QueryContext(ctx, fmt.Sprintf("SELECT id, data::text, to_jsonb(t)->>'created_at', to_jsonb(t)->>'updated_at' FROM %s t ORDER BY id", table))
+		if err != nil {
+			return fmt.Errorf("failed to query table %s: %w", table, err)
+		}
+
+		for rows.Next() {
+			var id, data string
+			var createdAt, updatedAt sql.NullString
+			if err := rows.Scan(&id, &data, &createdAt, &updatedAt); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row of table %s: %w", table, err)
+			}
+
+			if keyType == KeyTypeText {
+				id = pq.QuoteLiteral(id)
+			}
+
+			fmt.Fprintf(bw, "INSERT INTO %s (id, data, created_at, updated_at) VALUES (%s, %s, %s, %s);\n",
+				table, id, pq.QuoteLiteral(data), timestampLiteral(createdAt), timestampLiteral(updatedAt))
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if keyType == KeyTypeInteger {
+			fmt.Fprintf(bw, "SELECT setval('%s', COALESCE((SELECT MAX(id) FROM %s), 0) + 1, false);\n", idSequence(table), table)
+		}
+	}
+
+	fmt.Fprintln(bw, "\nCOMMIT;")
+
+	return bw.Flush()
+}
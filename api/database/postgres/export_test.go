@@ -0,0 +1,221 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ExportTableCSV(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectQuery("SELECT DISTINCT key").WithArgs(csvSampleSize).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}).AddRow("Name").AddRow("URL"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id::text, data->>$1::text, data->>$2::text FROM endpoints ORDER BY id")).
+		WithArgs("Name", "URL").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "Name", "URL"}).
+			AddRow("1", "local", "unix:///var/run/docker.sock").
+			AddRow("2", "remote, with a comma", nil))
+
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTableCSV(context.Background(), "endpoints", &buf))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "Name", "URL"},
+		{"1", "local", "unix:///var/run/docker.sock"},
+		{"2", "remote, with a comma", ""},
+	}, records)
+}
+
+func Test_ExportTableCSV_InvalidTableName(t *testing.T) {
+	conn, _ := newMockConnection(t)
+
+	err := conn.ExportTableCSV(context.Background(), "endpoints; DROP TABLE users", &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrInvalidTableName)
+}
+
+func Test_ExportTableCSV_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "csv_test")
+
+	ctx := context.Background()
+	require.NoError(t, conn.EnsureTableExists(ctx, "csv_test", nil))
+	require.NoError(t, conn.CreateObjectWithId("csv_test", 1, map[string]any{"Name": "local", "Port": 9000}))
+	require.NoError(t, conn.CreateObjectWithId("csv_test", 2, map[string]any{"Name": "remote", "Tags": []string{"a"}}))
+
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTableCSV(ctx, "csv_test", &buf))
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "Name", "Port", "Tags"},
+		{"1", "local", "9000", ""},
+		{"2", "remote", "", `["a"]`},
+	}, records)
+}
+
+// expectManagedTables mocks the lookup of the managed tables
+func expectManagedTables(mock sqlmock.Sqlmock, tables ...string) {
+	rows := sqlmock.NewRows([]string{"table_name"})
+	for _, table := range tables {
+		rows.AddRow(table)
+	}
+
+	mock.ExpectQuery("SELECT table_name").WillReturnRows(rows)
+}
+
+func Test_ExportTables_JSON(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	expectManagedTables(mock, "endpoints", "settings", "users")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow(1, []byte(`{"Username":"admin"}`)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM endpoints")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTables(context.Background(), []string{"users", "endpoints"}, &buf, ExportFormatJSON))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	var export map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &export))
+	require.Contains(t, export, manifestKey)
+
+	var manifest Manifest
+	require.NoError(t, json.Unmarshal(export[manifestKey], &manifest))
+	assert.Equal(t, 1, manifest.Buckets["users"].Rows)
+	assert.Equal(t, 0, manifest.Buckets["endpoints"].Rows)
+
+	var tables map[string][]map[string]any
+	delete(export, manifestKey)
+	b, err := json.Marshal(export)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &tables))
+	assert.Equal(t, map[string][]map[string]any{
+		"users":     {{"id": float64(1), "data": map[string]any{"Username": "admin"}}},
+		"endpoints": {},
+	}, tables)
+}
+
+func Test_ExportTables_SQL(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	expectManagedTables(mock, "endpoints", "settings", "users")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data::text, to_jsonb(t)->>'created_at', to_jsonb(t)->>'updated_at' FROM settings t ORDER BY id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data", "created_at", "updated_at"}).
+			AddRow(1, `{"LogoURL":"it's"}`, "2024-01-02T03:04:05+00:00", "2024-06-07T08:09:10+00:00").
+			AddRow(2, `{}`, nil, nil))
+
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTables(context.Background(), []string{"settings"}, &buf, ExportFormatSQL))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, `BEGIN;
+
+CREATE TABLE IF NOT EXISTS settings (id INTEGER PRIMARY KEY, data JSONB NOT NULL, version BIGINT NOT NULL DEFAULT 1, created_at TIMESTAMPTZ NOT NULL DEFAULT now(), updated_at TIMESTAMPTZ NOT NULL DEFAULT now());
+ALTER TABLE settings ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(), ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE SEQUENCE IF NOT EXISTS settings_id_seq OWNED BY settings.id;
+INSERT INTO settings (id, data, created_at, updated_at) VALUES (1, '{"LogoURL":"it''s"}', '2024-01-02T03:04:05+00:00', '2024-06-07T08:09:10+00:00');
+INSERT INTO settings (id, data, created_at, updated_at) VALUES (2, '{}', DEFAULT, DEFAULT);
+SELECT setval('settings_id_seq', COALESCE((SELECT MAX(id) FROM settings), 0) + 1, false);
+
+COMMIT;
+`, buf.String())
+}
+
+func Test_ExportTables_TableNotFound(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	expectManagedTables(mock, "endpoints", "users")
+
+	var buf bytes.Buffer
+	err := conn.ExportTables(context.Background(), []string{"users", "teams"}, &buf, ExportFormatJSON)
+	assert.ErrorIs(t, err, ErrTableNotFound)
+	assert.Zero(t, buf.Len())
+}
+
+func Test_ExportTables_UndecryptableRow(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	// the object of user 1 was copied over user 2, it fails to decrypt
+	data, err := conn.MarshalObjectForKey("users", conn.ConvertToKey(1), map[string]string{"Username": "admin"})
+	require.NoError(t, err)
+
+	expectManagedTables(mock, "users")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow(2, data))
+
+	var buf bytes.Buffer
+	err = conn.ExportTables(context.Background(), []string{"users"}, &buf, ExportFormatJSON)
+	require.ErrorIs(t, err, errDecryptionFailed)
+	assert.ErrorContains(t, err, "row 2 of table users")
+	assert.NotContains(t, buf.String(), string(data[envelopeHeaderSize:]))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_ExportTables_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "export_a", "export_b", "export_c")
+
+	ctx := context.Background()
+	for i, table := range []string{"export_a", "export_b", "export_c"} {
+		require.NoError(t, conn.EnsureTableExists(ctx, table, nil))
+		require.NoError(t, conn.CreateObjectWithId(table, i+1, map[string]any{"Table": table}))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTables(ctx, []string{"export_a", "export_c"}, &buf, ExportFormatJSON))
+
+	var export map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &export))
+	assert.Len(t, export, 3)
+	assert.Contains(t, export, manifestKey)
+	assert.Contains(t, export, "export_a")
+	assert.Contains(t, export, "export_c")
+
+	buf.Reset()
+	require.NoError(t, conn.ExportTables(ctx, []string{"export_a", "export_c"}, &buf, ExportFormatSQL))
+	assert.Contains(t, buf.String(), "INSERT INTO export_a")
+	assert.Contains(t, buf.String(), "INSERT INTO export_c")
+	assert.NotContains(t, buf.String(), "export_b")
+}
+
+func Test_ExportJSON_AllBuckets(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	expectManagedTables(mock, "endpoints", "settings", "stacks")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM endpoints")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+			AddRow(1, []byte(`{"Name":"local"}`)).
+			AddRow(2, []byte(`{"Name":"remote"}`)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM settings")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow(1, []byte(`{"LogoURL":""}`)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stacks")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+
+	data, err := conn.ExportJSON(false)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	var export map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &export))
+
+	// the singleton buckets are exported as an object, the empty buckets are left out
+	assert.JSONEq(t, `[{"id":1,"data":{"Name":"local"}},{"id":2,"data":{"Name":"remote"}}]`, string(export["endpoints"]))
+	assert.JSONEq(t, `{"id":1,"data":{"LogoURL":""}}`, string(export["settings"]))
+	assert.NotContains(t, export, "stacks")
+	assert.Contains(t, export, manifestKey)
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrStopIteration is returned by the function of ForEach and ForEachObject to stop the
+// iteration early, ForEach then returns nil
+var ErrStopIteration = errors.New("stop iteration")
+
+// forEachFetchSize is the number of rows fetched at once from the cursor of ForEach
+const forEachFetchSize = 1000
+
+// ForEach calls fn for every object of a bucket in the order of the keys, see DbTransaction.ForEach
+func (connection *DbConnection) ForEach(bucketName string, fn func(key []byte, data []byte) error) error {
+	return connection.tracedViewTx("ForEach", bucketName, func(tx *DbTransaction) error {
+		return tx.ForEach(bucketName, fn)
+	})
+}
+
+// ForEachObject calls fn for every object of a bucket in the order of the keys, see
+// DbTransaction.ForEachObject
+func (connection *DbConnection) ForEachObject(bucketName string, makeObj func() any, fn func(key []byte, obj any) error) error {
+	return connection.tracedViewTx("ForEachObject", bucketName, func(tx *DbTransaction) error {
+		return tx.ForEachObject(bucketName, makeObj, fn)
+	})
+}
+
+// ForEach calls fn for every object of a bucket in the order of the keys, with the key as
+// stored, the decimal identifier for the integer keys, and the data column as stored, encrypted
+// on an encrypted store. The rows are read from a server-side cursor forEachFetchSize at a
+// time, so that the memory used does not grow with the bucket, and fn can run statements in
+// the transaction. The iteration stops at the first error returned by fn, which is returned
+// unless it is ErrStopIteration.
+func (tx *DbTransaction) ForEach(bucketName string, fn func(key []byte, data []byte) error) (err error) {
+	ctx, end := tx.startSpan("ForEach", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	return tx.forEach(ctx, bucketName, fn)
+}
+
+// ForEachObject calls fn for every object of a bucket, decoded into a new value returned by
+// makeObj, see ForEach
+func (tx *DbTransaction) ForEachObject(bucketName string, makeObj func() any, fn func(key []byte, obj any) error) (err error) {
+	ctx, end := tx.startSpan("ForEachObject", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	return tx.forEach(ctx, bucketName, func(key, data []byte) error {
+		obj := makeObj()
+		if err := tx.unmarshal(bucketName, key, data, obj); err != nil {
+			return err
+		}
+
+		return fn(key, obj)
+	})
+}
+
+// forEach iterates over the rows of a bucket with a cursor, which is closed unless the
+// iteration fails, the transaction closes it then
+func (tx *DbTransaction) forEach(ctx context.Context, bucketName string, fn func(key, data []byte) error) error {
+	tx.cursors++
+	cursor := fmt.Sprintf("foreach_cursor_%d", tx.cursors)
+
+	query := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR SELECT id::text AS id, data FROM %s ORDER BY id", cursor, tx.conn.table(bucketName))
+	if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	fetch := fmt.Sprintf("FETCH %d FROM %s", forEachFetchSize, cursor)
+	for done := false; !done; {
+		// the rows are read before fn is called, the connection runs one statement at a time
+		var rows []struct {
+			ID   string `db:"id"`
+			Data []byte `db:"data"`
+		}
+		if err := tx.tx.SelectContext(ctx, &rows, fetch); err != nil {
+			return err
+		}
+
+		done = len(rows) < forEachFetchSize
+		for _, row := range rows {
+			err := fn([]byte(row.ID), row.Data)
+			if errors.Is(err, ErrStopIteration) {
+				done = true
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.tx.ExecContext(ctx, "CLOSE "+cursor)
+
+	return err
+}
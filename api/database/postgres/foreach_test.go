@@ -0,0 +1,179 @@
+package postgres
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectForEachFetch expects the fetch of a batch of the cursor of ForEach holding the rows from first to last
+func expectForEachFetch(mock sqlmock.Sqlmock, cursor string, first, last int) {
+	rows := sqlmock.NewRows([]string{"id", "data"})
+	for id := first; id <= last; id++ {
+		rows.AddRow(strconv.Itoa(id), fmt.Appendf(nil, `{"ID":%d}`, id))
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf("FETCH %d FROM %s", forEachFetchSize, cursor))).WillReturnRows(rows)
+}
+
+func Test_ForEach(t *testing.T) {
+	const declare = "DECLARE foreach_cursor_1 NO SCROLL CURSOR FOR SELECT id::text AS id, data FROM users ORDER BY id"
+
+	t.Run("every batch", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		const count = 50 * forEachFetchSize
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(declare)).WillReturnResult(sqlmock.NewResult(0, 0))
+		for first := 1; first <= count; first += forEachFetchSize {
+			expectForEachFetch(mock, "foreach_cursor_1", first, first+forEachFetchSize-1)
+		}
+		// the last batch is full, the cursor is fetched once more
+		expectForEachFetch(mock, "foreach_cursor_1", 1, 0)
+		mock.ExpectExec("CLOSE foreach_cursor_1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		seen := 0
+		require.NoError(t, conn.ForEach("users", func(key, data []byte) error {
+			seen++
+			assert.Equal(t, strconv.Itoa(seen), string(key))
+			assert.Equal(t, fmt.Sprintf(`{"ID":%d}`, seen), string(data))
+
+			return nil
+		}))
+		assert.Equal(t, count, seen)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("stopped early", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(declare)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectForEachFetch(mock, "foreach_cursor_1", 1, forEachFetchSize)
+		mock.ExpectExec("CLOSE foreach_cursor_1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		seen := 0
+		require.NoError(t, conn.ForEach("users", func(key, data []byte) error {
+			if seen++; seen == 10 {
+				return ErrStopIteration
+			}
+
+			return nil
+		}))
+		assert.Equal(t, 10, seen)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("error of fn", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(declare)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectForEachFetch(mock, "foreach_cursor_1", 1, 3)
+		mock.ExpectRollback()
+
+		err := conn.ForEach("users", func(key, data []byte) error {
+			return assert.AnError
+		})
+		require.ErrorIs(t, err, assert.AnError)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("cursors of a transaction", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		for _, cursor := range []string{"foreach_cursor_1", "foreach_cursor_2"} {
+			mock.ExpectExec("DECLARE " + cursor).WillReturnResult(sqlmock.NewResult(0, 0))
+			expectForEachFetch(mock, cursor, 1, 0)
+			mock.ExpectExec("CLOSE " + cursor).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.ViewTx(func(tx portainer.Transaction) error {
+			for range 2 {
+				if err := tx.(*DbTransaction).ForEach("users", func(key, data []byte) error { return nil }); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_ForEachObject_Encrypted(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	rows := sqlmock.NewRows([]string{"id", "data"})
+	for id := 1; id <= 2; id++ {
+		data, err := conn.MarshalObject(multiGetUser{ID: id, Username: "user" + strconv.Itoa(id)})
+		require.NoError(t, err)
+		rows.AddRow(strconv.Itoa(id), data)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DECLARE foreach_cursor_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FETCH").WillReturnRows(rows)
+	mock.ExpectExec("CLOSE foreach_cursor_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	collected := map[string]multiGetUser{}
+	makeObj, collect := collectUsers(collected)
+
+	require.NoError(t, conn.ForEachObject("users", makeObj, collect))
+	assert.Equal(t, map[string]multiGetUser{
+		"1": {ID: 1, Username: "user1"},
+		"2": {ID: 2, Username: "user2"},
+	}, collected)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_ForEach_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "foreach_users")
+
+	const count = 50_000
+
+	require.NoError(t, conn.SetServiceName("foreach_users"))
+	_, err := conn.DB.Exec(`INSERT INTO foreach_users (id, data) SELECT i, jsonb_build_object('ID', i, 'Username', 'user' || i) FROM generate_series(1, $1) AS i`, count)
+	require.NoError(t, err)
+
+	var user multiGetUser
+	all := map[string]multiGetUser{}
+	require.NoError(t, conn.GetAll("foreach_users", &user, func(o any) (any, error) {
+		u := *o.(*multiGetUser)
+		all[strconv.Itoa(u.ID)] = u
+
+		return o, nil
+	}))
+	require.Len(t, all, count)
+
+	collected := map[string]multiGetUser{}
+	makeObj, collect := collectUsers(collected)
+
+	require.NoError(t, conn.ForEachObject("foreach_users", makeObj, collect))
+	assert.Equal(t, all, collected)
+
+	seen := 0
+	require.NoError(t, conn.ForEach("foreach_users", func(key, data []byte) error {
+		if seen++; seen == forEachFetchSize+1 {
+			return ErrStopIteration
+		}
+
+		return nil
+	}))
+	assert.Equal(t, forEachFetchSize+1, seen)
+}
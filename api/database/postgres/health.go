@@ -0,0 +1,28 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+)
+
+// Ping checks that the database can still be reached, for instance for a health check endpoint.
+// The errors wrap ErrNoConnection.
+func (connection *DbConnection) Ping(ctx context.Context) (err error) {
+	ctx, end := connection.startSpan(ctx, "Ping", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	if err := connection.PingContext(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrNoConnection, translateError(err))
+	}
+
+	return nil
+}
+
+// IsHealthy returns whether the database can still be reached, see Ping
+func (connection *DbConnection) IsHealthy(ctx context.Context) bool {
+	return connection.Ping(ctx) == nil
+}
@@ -0,0 +1,40 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Ping(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+	defer db.Close()
+
+	conn := &DbConnection{DB: sqlx.NewDb(db, DatabaseDriverName), ctx: context.Background()}
+	ctx := context.Background()
+
+	mock.ExpectPing()
+	require.NoError(t, conn.Ping(ctx))
+
+	errDown := errors.New("connection refused")
+	mock.ExpectPing().WillReturnError(errDown)
+	err = conn.Ping(ctx)
+	require.ErrorIs(t, err, ErrNoConnection)
+	require.ErrorIs(t, err, errDown)
+
+	mock.ExpectPing().WillReturnError(errDown)
+	assert.False(t, conn.IsHealthy(ctx))
+
+	mock.ExpectPing()
+	assert.True(t, conn.IsHealthy(ctx))
+
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.ErrorIs(t, (&DbConnection{}).Ping(ctx), ErrNoConnection)
+}
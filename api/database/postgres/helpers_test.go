@@ -0,0 +1,84 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestConnection connects to the database pointed to by TEST_DATABASE_URL,
+// the test is skipped when the variable is not set
+func newTestConnection(t testing.TB, opts ...ConnectionOption) *DbConnection {
+	t.Helper()
+
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	conn, err := NewConnection(connStr, nil, opts...)
+	if err != nil {
+		t.Fatalf("failed to open database connection: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn
+}
+
+// dropTestTables removes the given tables once the test is over
+func dropTestTables(t testing.TB, conn *DbConnection, tables ...string) {
+	t.Helper()
+
+	t.Cleanup(func() {
+		for _, table := range tables {
+			if _, err := conn.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+				t.Errorf("failed to drop table %s: %v", table, err)
+			}
+		}
+	})
+}
+
+// newMockConnection returns a connection backed by sqlmock
+func newMockConnection(t *testing.T) (*DbConnection, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return &DbConnection{DB: sqlx.NewDb(db, DatabaseDriverName), ctx: context.Background(), connectionState: &connectionState{}}, mock
+}
+
+// expectNextIdentifier expects GetNextIdentifierErr to look up the existing sequence of a table,
+// the returned expectation is the query of the identifier
+func expectNextIdentifier(mock sqlmock.Sqlmock, table string) *sqlmock.ExpectedQuery {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass($1) IS NOT NULL")).WithArgs(table + "_id_seq").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	return mock.ExpectQuery(nextIdentifierQuery(table))
+}
+
+// expectTimestampColumns expects the timestamp columns to be added to a table the first time
+// the connection uses its bucket
+func expectTimestampColumns(mock sqlmock.Sqlmock, table string) {
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS created_at")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// nextIdentifierQuery returns the pattern of the query of GetNextIdentifierErr on a table
+func nextIdentifierQuery(table string) string {
+	return regexp.QuoteMeta(fmt.Sprintf("SELECT setval('%[1]s_id_seq', GREATEST(nextval('%[1]s_id_seq'), (SELECT COALESCE(MAX(id), 0) + 1 FROM %[1]s)))", table))
+}
@@ -0,0 +1,211 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConflictResolution controls what ImportFromJSON does when a row already exists
+type ConflictResolution int
+
+const (
+	// ConflictSkip keeps the existing row and ignores the imported one
+	ConflictSkip ConflictResolution = iota
+	// ConflictOverwrite replaces the existing row with the imported one
+	ConflictOverwrite
+	// ConflictError aborts the import with ErrDuplicateKey
+	ConflictError
+)
+
+// metadataKey is the key used by ExportJSON to store the table metadata
+const metadataKey = "__metadata"
+
+// ImportOptions configures ImportFromJSON
+type ImportOptions struct {
+	ConflictResolution ConflictResolution
+	// Force restores an export that does not match its manifest, or that was made by a newer
+	// version of Portainer, see ValidateBackup
+	Force bool
+}
+
+// importRow is a single row as written by ExportJSON, the timestamps are missing from the
+// exports made before they were introduced
+type importRow struct {
+	ID        json.RawMessage `json:"id"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt *time.Time      `json:"created_at"`
+	UpdatedAt *time.Time      `json:"updated_at"`
+}
+
+// ImportFromJSON restores the content of a JSON export created by ExportJSON.
+// The whole import, including the creation of the missing tables, runs in a single transaction
+// so a failure leaves the database untouched.
+func (connection *DbConnection) ImportFromJSON(ctx context.Context, r io.Reader, opts ImportOptions) (err error) {
+	ctx, end := connection.startSpan(ctx, "ImportFromJSON", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	var backup map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&backup); err != nil {
+		return fmt.Errorf("failed to decode JSON export: %w", err)
+	}
+
+	// the exports made before the manifest was introduced are restored as they are
+	manifest, found, err := readJSONManifest(backup)
+	if errors.Is(err, ErrBackupNoManifest) {
+		log.Warn().Str("component", "postgres").Msg("the export has no manifest, it cannot be validated")
+	} else if err != nil {
+		return err
+	} else if err := manifest.validate(found, opts.Force); err != nil {
+		return err
+	}
+
+	tables := make(map[string][]importRow, len(backup))
+	for table, raw := range backup {
+		if table == metadataKey || table == manifestKey {
+			continue
+		}
+
+		if err := validateTableName(connection.table(table)); err != nil {
+			return err
+		}
+
+		rows, err := decodeImportRows(raw)
+		if err != nil {
+			return fmt.Errorf("failed to decode rows of table %s: %w", table, err)
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		tables[table] = rows
+	}
+
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	tx, err := connection.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the tables are created by the transaction as well, a failed import does not leave them behind
+	for _, table := range names {
+		if err := connection.createTable(ctx, tx, table, nil); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range names {
+		query := importQuery(connection.table(table), opts.ConflictResolution)
+
+		for _, row := range tables[table] {
+			id, err := importRowID(row.ID)
+			if err != nil {
+				return fmt.Errorf("invalid id in table %s: %w", table, err)
+			}
+
+			// the data column holds the JSON document itself unless the store is encrypted
+			data := []byte(row.Data)
+			if connection.getEncryptionKey() != nil {
+				if data, err = connection.MarshalObjectForKey(table, []byte(id), row.Data); err != nil {
+					return fmt.Errorf("failed to marshal row %s of table %s: %w", id, table, err)
+				}
+			}
+
+			result, err := tx.ExecContext(ctx, query, id, data, row.CreatedAt, row.UpdatedAt)
+			if err != nil {
+				return fmt.Errorf("failed to import row %s of table %s: %w", id, table, err)
+			}
+
+			if opts.ConflictResolution != ConflictError {
+				continue
+			}
+
+			if affected, err := result.RowsAffected(); err != nil {
+				return err
+			} else if affected == 0 {
+				return fmt.Errorf("%w (table=%s, id=%s)", ErrDuplicateKey, table, id)
+			}
+		}
+
+		log.Debug().Str("component", "postgres").Str("table", table).Int("rows", len(tables[table])).Msg("imported table")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	connection.cache.Load().invalidate("", "")
+
+	return nil
+}
+
+// decodeImportRows accepts both the list form and the single object form used by ExportJSON
+func decodeImportRows(raw json.RawMessage) ([]importRow, error) {
+	raw = bytes.TrimSpace(raw)
+
+	switch {
+	case len(raw) == 0 || bytes.Equal(raw, []byte("null")):
+		return nil, nil
+	case raw[0] == '[':
+		var rows []importRow
+		err := json.Unmarshal(raw, &rows)
+		return rows, err
+	default:
+		var row importRow
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return nil, err
+		}
+		return []importRow{row}, nil
+	}
+}
+
+// importRowID converts an exported id, either a JSON number or string, to a query parameter
+func importRowID(raw json.RawMessage) (string, error) {
+	var id any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&id); err != nil {
+		return "", err
+	}
+
+	switch v := id.(type) {
+	case json.Number:
+		return v.String(), nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unsupported id %s", strings.TrimSpace(string(raw)))
+	}
+}
+
+// importQuery builds the INSERT statement matching the conflict resolution strategy, the rows
+// keep their exported timestamps
+func importQuery(table string, resolution ConflictResolution) string {
+	query := fmt.Sprintf("INSERT INTO %s (id, data, created_at, updated_at) VALUES ($1, $2, COALESCE($3, now()), COALESCE($4, now()))", table)
+
+	if resolution == ConflictOverwrite {
+		return query + fmt.Sprintf(" ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, version = %s.version + 1, "+
+			"created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at", table)
+	}
+
+	return query + " ON CONFLICT (id) DO NOTHING"
+}
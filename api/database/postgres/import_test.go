@@ -0,0 +1,152 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ImportFromJSON_ConflictError(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS settings")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "settings")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO settings (id, data, created_at, updated_at) VALUES ($1, $2, COALESCE($3, now()), COALESCE($4, now())) ON CONFLICT (id) DO NOTHING")).
+		WithArgs("1", []byte(`{"LogoURL":""}`), nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	export := `{"settings":{"id":1,"data":{"LogoURL":""}}}`
+	err := conn.ImportFromJSON(context.Background(), strings.NewReader(export), ImportOptions{ConflictResolution: ConflictError})
+	assert.ErrorIs(t, err, ErrDuplicateKey)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_ImportFromJSON_Overwrite(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS endpoints")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "endpoints")
+	query := regexp.QuoteMeta("INSERT INTO endpoints (id, data, created_at, updated_at) VALUES ($1, $2, COALESCE($3, now()), COALESCE($4, now())) " +
+		"ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, version = endpoints.version + 1, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at")
+
+	// the exported timestamps are kept, the rows exported without them get the current time
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	updatedAt := time.Date(2024, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	mock.ExpectExec(query).WithArgs("1", []byte(`{"Name":"local"}`), createdAt, updatedAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs("2", []byte(`{"Name":"remote"}`), nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	export := `{"__metadata":{"endpoints":2},"endpoints":[` +
+		`{"id":1,"data":{"Name":"local"},"created_at":"2024-01-02T03:04:05Z","updated_at":"2024-06-07T08:09:10Z"},` +
+		`{"id":2,"data":{"Name":"remote"}}],"ssl":null}`
+	err := conn.ImportFromJSON(context.Background(), strings.NewReader(export), ImportOptions{ConflictResolution: ConflictOverwrite})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_ImportFromJSON_EncryptedRowsBoundToKey(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	written := &capturedArg{}
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS users")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "users")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (id, data, created_at, updated_at)")).
+		WithArgs("1", written, nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	export := `{"users":[{"id":1,"data":{"Username":"admin"}}]}`
+	require.NoError(t, conn.ImportFromJSON(context.Background(), strings.NewReader(export), ImportOptions{}))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	data, ok := written.value.([]byte)
+	require.True(t, ok)
+
+	var user map[string]any
+	require.Error(t, conn.UnmarshalObject(data, &user), "the row is bound to its bucket and key")
+	require.Error(t, conn.UnmarshalObjectForKey("users", conn.ConvertToKey(2), data, &user))
+	require.NoError(t, conn.UnmarshalObjectForKey("users", conn.ConvertToKey(1), data, &user))
+	assert.Equal(t, map[string]any{"Username": "admin"}, user)
+}
+
+func Test_ImportFromJSON_InvalidTableName(t *testing.T) {
+	conn, _ := newMockConnection(t)
+
+	export := `{"settings; DROP TABLE users":[]}`
+	err := conn.ImportFromJSON(context.Background(), strings.NewReader(export), ImportOptions{})
+	assert.ErrorIs(t, err, ErrInvalidTableName)
+}
+
+func Test_ImportFromJSON_RoundTrip(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "settings", "version")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "settings", nil))
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "version", nil))
+	require.NoError(t, conn.CreateObjectWithId("settings", 1, map[string]any{"LogoURL": "https://example.com/logo.png", "SnapshotInterval": "5m"}))
+	require.NoError(t, conn.CreateObjectWithStringId("version", []byte("VERSION"), map[string]any{"SchemaVersion": "2.21.0", "Edition": 1}))
+
+	export, err := conn.ExportJSON(false)
+	require.NoError(t, err)
+
+	_, err = conn.Exec("DROP TABLE settings, version")
+	require.NoError(t, err)
+
+	err = conn.ImportFromJSON(context.Background(), bytes.NewReader(export), ImportOptions{ConflictResolution: ConflictError})
+	require.NoError(t, err)
+
+	reexport, err := conn.ExportJSON(false)
+	require.NoError(t, err)
+
+	// the manifests differ by their creation time
+	var exported, reexported map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(export, &exported))
+	require.NoError(t, json.Unmarshal(reexport, &reexported))
+	delete(exported, manifestKey)
+	delete(reexported, manifestKey)
+	assert.Equal(t, exported, reexported)
+
+	// importing the same export again must detect the existing rows
+	err = conn.ImportFromJSON(context.Background(), bytes.NewReader(export), ImportOptions{ConflictResolution: ConflictError})
+	assert.ErrorIs(t, err, ErrDuplicateKey)
+
+	err = conn.ImportFromJSON(context.Background(), bytes.NewReader(export), ImportOptions{ConflictResolution: ConflictSkip})
+	assert.NoError(t, err)
+}
+
+func Test_ImportFromJSON_RollbackDropsCreatedTables_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "import_created", "import_existing")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "import_existing", nil))
+	require.NoError(t, conn.CreateObjectWithId("import_existing", 1, map[string]any{"Name": "existing"}))
+
+	// the conflict on import_existing aborts the import once import_created is created
+	export := `{"import_created":[{"id":1,"data":{"Name":"created"}}],"import_existing":[{"id":1,"data":{"Name":"imported"}}]}`
+	err := conn.ImportFromJSON(context.Background(), strings.NewReader(export), ImportOptions{ConflictResolution: ConflictError})
+	require.ErrorIs(t, err, ErrDuplicateKey)
+
+	exists, err := conn.tableExists(context.Background(), conn.DB, "import_created")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
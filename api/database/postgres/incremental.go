@@ -0,0 +1,318 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DeletionsTable records the keys of the deleted objects, so that BackupSince can write
+	// their deletion
+	DeletionsTable = "deletions"
+
+	// AppliedBackupsTable records the backups applied by ApplyIncremental
+	AppliedBackupsTable = "applied_backups"
+)
+
+// ErrBackupBaseMismatch is returned by ApplyIncremental for a backup that does not apply onto
+// the last backup applied to the database
+var ErrBackupBaseMismatch = errors.New("the backup does not apply onto the last backup applied")
+
+// createDeletionsTable creates DeletionsTable unless it exists
+func createDeletionsTable(tx *DbTransaction) error {
+	table := tx.conn.table(DeletionsTable)
+
+	query := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			bucket TEXT NOT NULL,
+			object_key TEXT NOT NULL,
+			deleted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS %[1]s_deleted_at_idx ON %[1]s (deleted_at)`, table)
+	if _, err := tx.tx.ExecContext(tx.context(), query); err != nil {
+		return fmt.Errorf("failed to create %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// recordDeletions records the deletion of objects of a bucket in DeletionsTable
+func (tx *DbTransaction) recordDeletions(ctx context.Context, bucketName string, keys ...string) error {
+	if !tx.conn.trackDeletions || len(keys) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (bucket, object_key) SELECT $1, unnest($2::text[])", tx.conn.table(DeletionsTable))
+	if _, err := tx.tx.ExecContext(ctx, query, bucketName, pq.StringArray(keys)); err != nil {
+		return fmt.Errorf("failed to record the deletions of bucket %s: %w", bucketName, err)
+	}
+
+	return nil
+}
+
+// BackupSince writes the objects updated since the given time in the format of BackupTo, followed
+// by the deletion of the objects deleted since then. since is the CreatedAt of the manifest of
+// the backup it applies onto, it is recorded in its manifest, see ApplyIncremental. Unlike
+// BackupIncremental, it relies on the updated_at column rather than on change tracking. The
+// changes of the transactions in progress when that backup was made can be missed.
+//
+// BackupSince and ApplyIncremental are the authoritative incremental backups of the store: every
+// statement of the connection rewriting an object bumps its updated_at, the encryption and the
+// decryption of the buckets included, and the backups are checked against their base.
+// BackupIncremental and the change_log triggers only complement them for the changes made outside
+// of the connection.
+func (connection *DbConnection) BackupSince(w io.Writer, since time.Time) (err error) {
+	ctx, end := connection.startSpan(connection.ctx, "BackupSince", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	tx, err := connection.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, schemas, err := connection.tableColumns(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	managed, err := connection.listBuckets(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := connection.newSnapshotManifest(ctx, tx, managed)
+	if err != nil {
+		return err
+	}
+
+	base := since.UTC()
+	manifest.BaseCreatedAt = &base
+
+	// the changes are read twice, first to describe the buckets in the manifest
+	for _, table := range managed {
+		bucket := newBackupWriter(io.Discard)
+		if err := connection.writeChanges(ctx, tx, bucket, table, since); err != nil {
+			return err
+		}
+
+		manifest.Buckets[table] = BucketManifest{Rows: bucket.rows, Checksum: bucket.checksum()}
+	}
+
+	bw := newBackupWriter(w)
+	if err := bw.write(backupRecord{Manifest: manifest}); err != nil {
+		return err
+	}
+
+	// the columns let ApplyIncremental create the tables created since the base backup
+	for _, table := range managed {
+		if err := bw.write(backupRecord{Table: table, Columns: schemas[table]}); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range managed {
+		if err := connection.writeChanges(ctx, tx, bw, table, since); err != nil {
+			return err
+		}
+	}
+
+	log.Debug().Str("component", "postgres").Time("since", since).Int("records", bw.rows).Msg("incremental backup written")
+
+	return bw.close()
+}
+
+// writeChanges writes the rows of a bucket updated since the given time, followed by the
+// deletion of the objects deleted since then that were not created again
+func (connection *DbConnection) writeChanges(ctx context.Context, tx *sqlx.Tx, bw *backupWriter, bucket string, since time.Time) error {
+	if _, err := connection.writeTableRows(ctx, tx, bw, bucket, nil, since); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT DISTINCT d.object_key
+		FROM %s d
+		WHERE d.bucket = $1 AND d.deleted_at >= $2
+			AND NOT EXISTS (SELECT 1 FROM %s t WHERE t.id::text = d.object_key)
+		ORDER BY d.object_key`, connection.table(DeletionsTable), connection.table(bucket))
+
+	var deleted []string
+	if err := tx.SelectContext(ctx, &deleted, query, bucket, since); err != nil {
+		return fmt.Errorf("failed to query the deletions of table %s: %w", bucket, err)
+	}
+
+	for _, id := range deleted {
+		if err := bw.write(backupRecord{Table: bucket, ID: id, Operation: backupOperationDelete}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyIncremental restores a backup written by BackupTo or BackupSince in a single transaction:
+// the objects of the backup are created or replaced and the deleted ones are removed. The
+// backups are chained by their manifest, a full backup is applied first onto a database no
+// backup was applied to, then every incremental backup onto the one before it. The others are
+// rejected with ErrBackupBaseMismatch.
+func (connection *DbConnection) ApplyIncremental(r io.Reader) error {
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if err := connection.VerifyBackup(bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	manifest, found, err := readStreamManifest(data)
+	if err != nil {
+		return err
+	}
+
+	if err := manifest.validate(found, false); err != nil {
+		return err
+	}
+
+	if manifest.Encrypted != connection.IsEncryptedStore() {
+		return fmt.Errorf("%w: the backup encrypted=%t cannot be applied to a store encrypted=%t",
+			ErrBackupBaseMismatch, manifest.Encrypted, connection.IsEncryptedStore())
+	}
+
+	err = connection.tracedTxCtx(connection.ctx, "ApplyIncremental", "", connection.txOptions, func(tx *DbTransaction) error {
+		if err := tx.checkBackupBase(manifest); err != nil {
+			return err
+		}
+
+		return tx.applyBackupRecords(manifest, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	connection.cache.Load().invalidate("", "")
+
+	return nil
+}
+
+// checkBackupBase makes sure a backup applies onto the last backup applied to the database and
+// records it in AppliedBackupsTable
+func (tx *DbTransaction) checkBackupBase(manifest *Manifest) error {
+	ctx := tx.context()
+	table := tx.conn.table(AppliedBackupsTable)
+
+	query := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			created_at TIMESTAMPTZ PRIMARY KEY,
+			base_created_at TIMESTAMPTZ,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, table)
+	if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create %s: %w", table, err)
+	}
+
+	// the backups are applied one at a time
+	if _, err := tx.tx.ExecContext(ctx, fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", table)); err != nil {
+		return err
+	}
+
+	var last sql.NullTime
+	if err := tx.tx.GetContext(ctx, &last, fmt.Sprintf("SELECT MAX(created_at) FROM %s", table)); err != nil {
+		return fmt.Errorf("failed to read the last backup applied: %w", err)
+	}
+
+	base := manifest.BaseCreatedAt
+	switch {
+	case base == nil && last.Valid:
+		return fmt.Errorf("%w: a full backup cannot be applied after the backup of %s", ErrBackupBaseMismatch, formatBackupTime(last.Time))
+	case base != nil && !last.Valid:
+		return fmt.Errorf("%w: the backup applies onto the backup of %s, no backup was applied", ErrBackupBaseMismatch, formatBackupTime(*base))
+	case base != nil && !base.Equal(last.Time):
+		return fmt.Errorf("%w: the backup applies onto the backup of %s, the last backup applied is the one of %s",
+			ErrBackupBaseMismatch, formatBackupTime(*base), formatBackupTime(last.Time))
+	}
+
+	query = fmt.Sprintf("INSERT INTO %s (created_at, base_created_at) VALUES ($1, $2)", table)
+	if _, err := tx.tx.ExecContext(ctx, query, manifest.CreatedAt, base); err != nil {
+		return fmt.Errorf("failed to record the backup applied: %w", err)
+	}
+
+	return nil
+}
+
+// applyBackupRecords creates the tables of the buckets of a backup stream and applies its rows
+func (tx *DbTransaction) applyBackupRecords(manifest *Manifest, data []byte) error {
+	ctx := tx.context()
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var record backupRecord
+		if err := dec.Decode(&record); err != nil {
+			return fmt.Errorf("%w: invalid record: %w", ErrBackupCorrupted, err)
+		}
+
+		// the manifest, the footer and the tables of the prefix that are not buckets are skipped
+		if _, ok := manifest.Buckets[record.Table]; !ok {
+			continue
+		}
+
+		table := tx.conn.table(record.Table)
+
+		switch {
+		case record.Columns != nil:
+			keyType := KeyTypeInteger
+			if slices.Contains(record.Columns, "id text") {
+				keyType = KeyTypeText
+			}
+
+			if err := tx.SetServiceNameWithKeyType(record.Table, keyType); err != nil {
+				return err
+			}
+		case record.Operation == backupOperationDelete:
+			if _, err := tx.tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1", table), record.ID); err != nil {
+				return fmt.Errorf("failed to delete row %s of table %s: %w", record.ID, record.Table, err)
+			}
+		default:
+			// the objects of an encrypted store are written as base64 strings, see writeTableRows
+			value := []byte(record.Data)
+			if manifest.Encrypted {
+				if err := json.Unmarshal(record.Data, &value); err != nil {
+					return fmt.Errorf("%w: invalid row %s of table %s: %w", ErrBackupCorrupted, record.ID, record.Table, err)
+				}
+			}
+
+			query := fmt.Sprintf(`
+				INSERT INTO %[1]s (id, data) VALUES ($1, $2)
+				ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, version = %[1]s.version + 1, updated_at = now()`, table)
+			if _, err := tx.tx.ExecContext(ctx, query, record.ID, value); err != nil {
+				return fmt.Errorf("failed to apply row %s of table %s: %w", record.ID, record.Table, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// formatBackupTime formats the creation time of a backup, which identifies it
+func formatBackupTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
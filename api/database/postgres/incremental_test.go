@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestIncrementalStream writes an empty backup stream applying onto the backup of base
+func newTestIncrementalStream(t *testing.T, createdAt, base time.Time, encrypted bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	bw := newBackupWriter(&buf)
+	require.NoError(t, bw.write(backupRecord{Manifest: &Manifest{
+		CreatedAt:     createdAt,
+		BaseCreatedAt: &base,
+		Encrypted:     encrypted,
+		Algorithm:     backupChecksumAlgorithm,
+		Buckets:       map[string]BucketManifest{},
+	}}))
+	require.NoError(t, bw.close())
+
+	return buf.Bytes()
+}
+
+func Test_DeleteObject_RecordsDeletion(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.trackDeletions = true
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO deletions (bucket, object_key) SELECT $1, unnest($2::text[])")).
+		WithArgs("users", `{"1"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.DeleteObject("users", conn.ConvertToKey(1)))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_ApplyIncremental_BaseMismatch(t *testing.T) {
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	createdAt := base.Add(time.Hour)
+
+	expectLastBackup := func(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS applied_backups")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("LOCK TABLE applied_backups IN EXCLUSIVE MODE")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT MAX(created_at) FROM applied_backups")).WillReturnRows(rows)
+		mock.ExpectRollback()
+	}
+
+	t.Run("no backup applied", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		expectLastBackup(mock, sqlmock.NewRows([]string{"max"}).AddRow(nil))
+
+		err := conn.ApplyIncremental(bytes.NewReader(newTestIncrementalStream(t, createdAt, base, false)))
+		require.ErrorIs(t, err, ErrBackupBaseMismatch)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("other backup applied", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		expectLastBackup(mock, sqlmock.NewRows([]string{"max"}).AddRow(base.Add(time.Minute)))
+
+		err := conn.ApplyIncremental(bytes.NewReader(newTestIncrementalStream(t, createdAt, base, false)))
+		require.ErrorIs(t, err, ErrBackupBaseMismatch)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("encrypted backup refused before any change", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		err := conn.ApplyIncremental(bytes.NewReader(newTestIncrementalStream(t, createdAt, base, true)))
+		require.ErrorIs(t, err, ErrBackupBaseMismatch)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_BackupSince_ApplyIncremental_RealDatabase(t *testing.T) {
+	const schema = "incremental_restore_test"
+
+	source := newTestConnection(t)
+	dropTestTables(t, source, "incremental_users", "incremental_teams")
+
+	target := newTestConnection(t, WithSchema(schema))
+	t.Cleanup(func() {
+		if _, err := target.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE"); err != nil {
+			t.Errorf("failed to drop schema %s: %v", schema, err)
+		}
+	})
+
+	require.NoError(t, source.SetServiceName("incremental_users"))
+	for id := 1; id <= 3; id++ {
+		require.NoError(t, source.CreateObjectWithId("incremental_users", id, map[string]any{"Id": id, "Name": "user"}))
+	}
+
+	var full bytes.Buffer
+	require.NoError(t, source.BackupTo(&full))
+
+	var manifest backupRecord
+	require.NoError(t, json.NewDecoder(bytes.NewReader(full.Bytes())).Decode(&manifest))
+	require.NotNil(t, manifest.Manifest)
+
+	require.NoError(t, source.UpdateObject("incremental_users", source.ConvertToKey(1), map[string]any{"Id": 1, "Name": "admin"}))
+	require.NoError(t, source.DeleteObject("incremental_users", source.ConvertToKey(2)))
+	require.NoError(t, source.CreateObjectWithId("incremental_users", 4, map[string]any{"Id": 4, "Name": "user"}))
+	require.NoError(t, source.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.(*DbTransaction).SetServiceNameWithKeyType("incremental_teams", KeyTypeText); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithStringId("incremental_teams", []byte("ops"), map[string]any{"Name": "ops"})
+	}))
+
+	var incremental bytes.Buffer
+	require.NoError(t, source.BackupSince(&incremental, manifest.Manifest.CreatedAt))
+	assert.Equal(t, []string{"1", "4", "2"}, decodeBackupRows(t, incremental.Bytes(), "incremental_users"))
+
+	// the incremental backup applies onto the full backup only
+	require.ErrorIs(t, target.ApplyIncremental(bytes.NewReader(incremental.Bytes())), ErrBackupBaseMismatch)
+	require.NoError(t, target.ApplyIncremental(bytes.NewReader(full.Bytes())))
+	require.NoError(t, target.ApplyIncremental(bytes.NewReader(incremental.Bytes())))
+	require.ErrorIs(t, target.ApplyIncremental(bytes.NewReader(incremental.Bytes())), ErrBackupBaseMismatch)
+
+	for _, bucket := range []string{"incremental_users", "incremental_teams"} {
+		assert.Equal(t, getAllObjects(t, source, bucket), getAllObjects(t, target, bucket), bucket)
+	}
+}
+
+// getAllObjects returns the objects of a bucket in the order of GetAll
+func getAllObjects(t *testing.T, conn *DbConnection, bucket string) []map[string]any {
+	t.Helper()
+
+	var objects []map[string]any
+	var object map[string]any
+	require.NoError(t, conn.GetAll(bucket, &object, func(o any) (any, error) {
+		objects = append(objects, object)
+		object = nil
+		return o, nil
+	}))
+
+	return objects
+}
@@ -0,0 +1,223 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The categories of the objects that CheckIntegrity fails to decode
+const (
+	// IntegrityMissingKey is an encrypted object read without an encryption key
+	IntegrityMissingKey = "missing_key"
+	// IntegrityDecryptionFailed is an object encrypted with another key or for another row
+	IntegrityDecryptionFailed = "decryption_failed"
+	// IntegrityInvalidData is an object whose envelope or JSON document is invalid
+	IntegrityInvalidData = "invalid_data"
+)
+
+// integrityReportLimit is the number of unreadable objects of a bucket described by
+// CheckIntegrity, the others are only counted
+const integrityReportLimit = 1000
+
+// quarantineSuffix is appended to the name of a bucket to name the table of its quarantined objects
+const quarantineSuffix = "_quarantine"
+
+// UnreadableObject describes an object that cannot be decoded
+type UnreadableObject struct {
+	Key      string `json:"key"`
+	Category string `json:"category"`
+	Error    string `json:"error"`
+}
+
+// BucketIntegrity is the result of CheckIntegrity for a bucket. Unreadable describes at most
+// integrityReportLimit of the UnreadableRows objects.
+type BucketIntegrity struct {
+	Bucket         string             `json:"bucket"`
+	Rows           int                `json:"rows"`
+	UnreadableRows int                `json:"unreadable_rows"`
+	Unreadable     []UnreadableObject `json:"unreadable,omitempty"`
+}
+
+// IntegrityReport is the result of CheckIntegrity, the buckets are in the order of their names
+type IntegrityReport struct {
+	Buckets []BucketIntegrity `json:"buckets"`
+}
+
+// Healthy returns whether every object of the report can be decoded
+func (report *IntegrityReport) Healthy() bool {
+	for _, bucket := range report.Buckets {
+		if bucket.UnreadableRows > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// integrityCategory returns the category of a decoding failure
+func integrityCategory(err error) string {
+	switch {
+	case errors.Is(err, ErrHaveEncryptedWithNoKey):
+		return IntegrityMissingKey
+	case errors.Is(err, errDecryptionFailed):
+		return IntegrityDecryptionFailed
+	default:
+		return IntegrityInvalidData
+	}
+}
+
+// decodeAny decodes the data of the object stored at key in a bucket, whatever its type
+func (tx *DbTransaction) decodeAny(bucketName string, key, data []byte) error {
+	var object any
+	err := tx.unmarshal(bucketName, key, data, &object)
+	if err == nil {
+		return nil
+	}
+
+	// the raw strings, such as the version, are only decoded into a string
+	var s string
+	if tx.unmarshal(bucketName, key, data, &s) == nil {
+		return nil
+	}
+
+	return err
+}
+
+// CheckIntegrity decodes every object of every bucket, as GetObject would, and reports the
+// objects that cannot be, for instance after a rotation of the encryption key gone wrong or a
+// partial restore. Nothing is modified. The buckets are read with a cursor, each in its own
+// transaction, and the check stops with the error of ctx once it is done.
+func (connection *DbConnection) CheckIntegrity(ctx context.Context) (report *IntegrityReport, err error) {
+	ctx, end := connection.startSpan(ctx, "CheckIntegrity", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return nil, ErrNoConnection
+	}
+
+	buckets, err := connection.listBuckets(ctx, connection.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	report = &IntegrityReport{Buckets: make([]BucketIntegrity, 0, len(buckets))}
+	for _, bucket := range buckets {
+		result := BucketIntegrity{Bucket: bucket}
+
+		err := connection.WithContext(ctx).tracedViewTx("CheckIntegrity", bucket, func(tx *DbTransaction) error {
+			return tx.forEach(tx.context(), bucket, func(key, data []byte) error {
+				result.Rows++
+
+				if err := tx.decodeAny(bucket, key, data); err != nil {
+					result.UnreadableRows++
+					if len(result.Unreadable) < integrityReportLimit {
+						result.Unreadable = append(result.Unreadable, UnreadableObject{
+							Key:      string(key),
+							Category: integrityCategory(err),
+							Error:    err.Error(),
+						})
+					}
+				}
+
+				return nil
+			})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the integrity of bucket %s: %w", bucket, err)
+		}
+
+		if result.UnreadableRows > 0 {
+			log.Warn().Str("component", "postgres").Str("bucket", bucket).Int("unreadable", result.UnreadableRows).
+				Msg("the bucket holds objects that cannot be decoded")
+		}
+
+		report.Buckets = append(report.Buckets, result)
+	}
+
+	return report, nil
+}
+
+// QuarantineCorrupt moves the objects of a bucket that cannot be decoded to the table of the
+// bucket suffixed with _quarantine, along with the reason, so that the application can start.
+// The table is not a bucket, the objects can be inspected or moved back with SQL. It returns
+// how many objects were moved.
+func (connection *DbConnection) QuarantineCorrupt(bucketName string) (moved int, err error) {
+	err = connection.tracedTx("QuarantineCorrupt", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		moved, err = tx.QuarantineCorrupt(bucketName)
+		return err
+	})
+
+	return moved, err
+}
+
+// QuarantineCorrupt moves the objects of a bucket that cannot be decoded to its quarantine
+// table, see DbConnection.QuarantineCorrupt
+func (tx *DbTransaction) QuarantineCorrupt(bucketName string) (moved int, err error) {
+	ctx, end := tx.startSpan("QuarantineCorrupt", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return 0, ErrTxReadOnly
+	}
+
+	var unreadable []UnreadableObject
+	err = tx.forEach(ctx, bucketName, func(key, data []byte) error {
+		if err := tx.decodeAny(bucketName, key, data); err != nil {
+			unreadable = append(unreadable, UnreadableObject{Key: string(key), Category: integrityCategory(err), Error: err.Error()})
+		}
+
+		return nil
+	})
+	if err != nil || len(unreadable) == 0 {
+		return 0, err
+	}
+
+	quarantine := tx.conn.table(bucketName + quarantineSuffix)
+	if err := validateTableName(quarantine); err != nil {
+		return 0, err
+	}
+
+	// the key column is not named id, so that the table is not taken for a bucket
+	query := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			object_key TEXT NOT NULL,
+			data %s NOT NULL,
+			category TEXT NOT NULL,
+			error TEXT NOT NULL,
+			quarantined_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, quarantine, tx.conn.dataColumnType())
+	if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+		return 0, fmt.Errorf("failed to create %s: %w", quarantine, err)
+	}
+
+	query = fmt.Sprintf(`
+		WITH moved AS (DELETE FROM %s WHERE id::text = $1 RETURNING id::text AS id, data)
+		INSERT INTO %s (object_key, data, category, error) SELECT id, data, $2, $3 FROM moved`,
+		tx.conn.table(bucketName), quarantine)
+
+	keys := make([]string, 0, len(unreadable))
+	for _, object := range unreadable {
+		if _, err := tx.tx.ExecContext(ctx, query, object.Key, object.Category, object.Error); err != nil {
+			return 0, fmt.Errorf("failed to quarantine %s/%s: %w", bucketName, object.Key, err)
+		}
+
+		tx.recordChange(bucketName, object.Key)
+		if err := tx.audit(ctx, bucketName, object.Key, AuditOperationDelete); err != nil {
+			return 0, err
+		}
+
+		keys = append(keys, object.Key)
+	}
+
+	if err := tx.recordDeletions(ctx, bucketName, keys...); err != nil {
+		return 0, err
+	}
+
+	log.Warn().Str("component", "postgres").Str("bucket", bucketName).Int("objects", len(unreadable)).
+		Str("table", quarantine).Msg("quarantined the objects that cannot be decoded")
+
+	return len(unreadable), nil
+}
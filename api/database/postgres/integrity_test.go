@@ -0,0 +1,172 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCorruptRows returns the rows of the users bucket of an encrypted store: the first one is
+// readable, the second one was encrypted with another key, the third one for another row and
+// the fourth one is not a valid envelope
+func newCorruptRows(t *testing.T, conn *DbConnection) *sqlmock.Rows {
+	t.Helper()
+
+	other := &DbConnection{EncryptionKey: secretToEncryptionKey("another passphrase"), connectionState: &connectionState{}}
+	other.SetEncrypted(true)
+
+	readable, err := conn.MarshalObjectForKey("users", []byte("1"), map[string]string{"Username": "admin"})
+	require.NoError(t, err)
+	otherKey, err := other.MarshalObjectForKey("users", []byte("2"), map[string]string{"Username": "operator"})
+	require.NoError(t, err)
+	otherRow, err := conn.MarshalObjectForKey("users", []byte("9"), map[string]string{"Username": "viewer"})
+	require.NoError(t, err)
+	invalid := append(envelopeHeader(envelopeKnownFlags+1), '{', '}')
+
+	return sqlmock.NewRows([]string{"id", "data"}).
+		AddRow("1", readable).
+		AddRow("2", otherKey).
+		AddRow("3", otherRow).
+		AddRow("4", invalid)
+}
+
+func Test_CheckIntegrity(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	mock.ExpectQuery("SELECT table_name").WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("users"))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DECLARE foreach_cursor_1 NO SCROLL CURSOR FOR SELECT id::text AS id, data FROM users ORDER BY id")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("FETCH 1000 FROM foreach_cursor_1")).WillReturnRows(newCorruptRows(t, conn))
+	mock.ExpectExec(regexp.QuoteMeta("CLOSE foreach_cursor_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	report, err := conn.CheckIntegrity(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.False(t, report.Healthy())
+
+	require.Len(t, report.Buckets, 1)
+	bucket := report.Buckets[0]
+	assert.Equal(t, "users", bucket.Bucket)
+	assert.Equal(t, 4, bucket.Rows)
+	assert.Equal(t, 3, bucket.UnreadableRows)
+
+	var categories []string
+	for _, object := range bucket.Unreadable {
+		categories = append(categories, object.Key+":"+object.Category)
+		assert.NotEmpty(t, object.Error)
+	}
+	assert.Equal(t, []string{
+		"2:" + IntegrityDecryptionFailed,
+		"3:" + IntegrityDecryptionFailed,
+		"4:" + IntegrityInvalidData,
+	}, categories)
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		mock.ExpectQuery("SELECT table_name").WillReturnError(context.Canceled)
+
+		_, err := conn.CheckIntegrity(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func Test_QuarantineCorrupt(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	const move = "WITH moved AS (DELETE FROM users WHERE id::text = $1 RETURNING id::text AS id, data) " +
+		"INSERT INTO users_quarantine (object_key, data, category, error) SELECT id, data, $2, $3 FROM moved"
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DECLARE foreach_cursor_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("FETCH 1000 FROM foreach_cursor_1")).WillReturnRows(newCorruptRows(t, conn))
+	mock.ExpectExec(regexp.QuoteMeta("CLOSE foreach_cursor_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS users_quarantine")).WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, key := range []string{"2", "3"} {
+		mock.ExpectExec(regexp.QuoteMeta(move)).WithArgs(key, IntegrityDecryptionFailed, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(regexp.QuoteMeta(move)).WithArgs("4", IntegrityInvalidData, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	moved, err := conn.QuarantineCorrupt("users")
+	require.NoError(t, err)
+	assert.Equal(t, 3, moved)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_CheckIntegrity_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+	dropTestTables(t, conn, "integrity_users", "integrity_users"+quarantineSuffix)
+
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("integrity_users"); err != nil {
+			return err
+		}
+
+		for id := 1; id <= 4; id++ {
+			if err := tx.CreateObjectWithId("integrity_users", id, map[string]int{"ID": id}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}))
+
+	// a row moved to another key and a truncated ciphertext
+	_, err := conn.Exec(`
+		UPDATE integrity_users SET data = (SELECT data FROM integrity_users WHERE id = 1) WHERE id = 2;
+		UPDATE integrity_users SET data = substring(data FROM 1 FOR 10) WHERE id = 3`)
+	require.NoError(t, err)
+
+	report, err := conn.CheckIntegrity(context.Background())
+	require.NoError(t, err)
+
+	var bucket BucketIntegrity
+	for _, b := range report.Buckets {
+		if b.Bucket == "integrity_users" {
+			bucket = b
+		}
+	}
+	assert.Equal(t, 4, bucket.Rows)
+	require.Equal(t, 2, bucket.UnreadableRows)
+	assert.Equal(t, "2", bucket.Unreadable[0].Key)
+	assert.Equal(t, "3", bucket.Unreadable[1].Key)
+
+	moved, err := conn.QuarantineCorrupt("integrity_users")
+	require.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	var count int
+	require.NoError(t, conn.Get(&count, "SELECT COUNT(*) FROM integrity_users"+quarantineSuffix))
+	assert.Equal(t, 2, count)
+
+	var users []map[string]int
+	var user map[string]int
+	require.NoError(t, conn.GetAll("integrity_users", &user, func(o any) (any, error) {
+		users = append(users, user)
+		user = nil
+		return o, nil
+	}))
+	assert.Equal(t, []map[string]int{{"ID": 1}, {"ID": 4}}, users)
+
+	// the quarantine table is not a bucket
+	buckets, err := conn.listBuckets(context.Background(), conn.DB)
+	require.NoError(t, err)
+	assert.NotContains(t, buckets, "integrity_users"+quarantineSuffix)
+}
@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withoutMethod returns the source of file without the method of receiver
+func withoutMethod(t *testing.T, file, receiver, method string) []byte {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	require.NoError(t, err)
+
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if ok && fn.Recv != nil && fn.Name.Name == method {
+			if star, ok := fn.Recv.List[0].Type.(*ast.StarExpr); ok && star.X.(*ast.Ident).Name == receiver {
+				continue
+			}
+		}
+
+		decls = append(decls, decl)
+	}
+
+	require.Len(t, decls, len(f.Decls)-1, "method %s.%s not found in %s", receiver, method, file)
+	f.Decls = decls
+	// the comments of the removed method would otherwise be printed in place of the next declaration
+	f.Comments = nil
+
+	var buf bytes.Buffer
+	require.NoError(t, printer.Fprint(&buf, fset, f))
+
+	return buf.Bytes()
+}
+
+func Test_InterfaceAssertions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the package is not rebuilt in short mode")
+	}
+
+	for _, tc := range []struct {
+		file, receiver, method, missing string
+	}{
+		{file: "export.go", receiver: "DbConnection", method: "ExportRaw", missing: "*DbConnection does not implement portainer.Connection (missing method ExportRaw)"},
+		{file: "tx.go", receiver: "DbTransaction", method: "GetAllWithKeyPrefix", missing: "*DbTransaction does not implement portainer.Transaction (missing method GetAllWithKeyPrefix)"},
+	} {
+		t.Run(tc.receiver, func(t *testing.T) {
+			source, err := filepath.Abs(tc.file)
+			require.NoError(t, err)
+
+			dir := t.TempDir()
+			replacement := filepath.Join(dir, tc.file)
+			require.NoError(t, os.WriteFile(replacement, withoutMethod(t, source, tc.receiver, tc.method), 0o600))
+
+			overlay, err := json.Marshal(map[string]any{"Replace": map[string]string{source: replacement}})
+			require.NoError(t, err)
+
+			overlayFile := filepath.Join(dir, "overlay.json")
+			require.NoError(t, os.WriteFile(overlayFile, overlay, 0o600))
+
+			out, err := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-overlay", overlayFile, ".").CombinedOutput()
+			require.Error(t, err, "the package builds without %s.%s", tc.receiver, tc.method)
+			assert.Contains(t, string(out), tc.missing)
+		})
+	}
+}
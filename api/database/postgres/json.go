@@ -5,6 +5,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"fmt"
 	"io"
 
 	"github.com/pkg/errors"
@@ -13,13 +14,106 @@ import (
 
 var errEncryptedStringTooShort = errors.New("encrypted string too short")
 
-// MarshalObject encodes an object to binary format for PostgreSQL storage
+// errDecryptionFailed is returned for the objects encrypted with another key or for another row
+var errDecryptionFailed = errors.New("Failed decrypting object, it was encrypted with another key or for another row")
+
+// envelopeMagic starts the values written by MarshalObject, 0xff never starts a JSON document
+// nor UTF-8 text. It is followed by the envelope version and flags.
+var envelopeMagic = []byte{0xff, 'P', 'G', 'E'}
+
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 6
+)
+
+// flags of the envelope describing how its payload is encoded
+const (
+	envelopeEncrypted byte = 1 << iota
+	envelopeCompressed
+	envelopeRawString
+
+	envelopeKnownFlags = envelopeEncrypted | envelopeCompressed | envelopeRawString
+)
+
+// envelopeHeader returns the header prepended to a payload encoded according to flags
+func envelopeHeader(flags byte) []byte {
+	header := make([]byte, 0, envelopeHeaderSize)
+	header = append(header, envelopeMagic...)
+
+	return append(header, envelopeVersion, flags)
+}
+
+// parseEnvelope splits a value written by MarshalObject into its flags and payload, ok is
+// false for the legacy values written without an envelope
+func parseEnvelope(data []byte) (flags byte, payload []byte, ok bool) {
+	if len(data) < envelopeHeaderSize || !bytes.HasPrefix(data, envelopeMagic) || data[len(envelopeMagic)] != envelopeVersion {
+		return 0, nil, false
+	}
+
+	return data[envelopeHeaderSize-1], data[envelopeHeaderSize:], true
+}
+
+// envelopeDocument holds an envelope in the JSONB data column of an unencrypted store, which
+// cannot hold its binary form. The envelope is encoded in base64 in the only field of the document.
+type envelopeDocument struct {
+	Envelope []byte `json:"$envelope"`
+}
+
+// envelopeDocumentPrefix starts the envelope documents, as written by json.Marshal and as read
+// back from a JSONB column
+var envelopeDocumentPrefix = []byte(`{"$envelope"`)
+
+// wrapEnvelope returns the envelope document holding envelope
+func wrapEnvelope(envelope []byte) ([]byte, error) {
+	return json.Marshal(envelopeDocument{Envelope: envelope})
+}
+
+// unwrapEnvelope returns the envelope held by an envelope document, ok is false for the other
+// JSON documents
+func unwrapEnvelope(data []byte) (envelope []byte, ok bool) {
+	if !bytes.HasPrefix(data, envelopeDocumentPrefix) {
+		return nil, false
+	}
+
+	var document envelopeDocument
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, false
+	}
+
+	if _, _, ok := parseEnvelope(document.Envelope); !ok {
+		return nil, false
+	}
+
+	return document.Envelope, true
+}
+
+// MarshalObject encodes an object to binary format for PostgreSQL storage. The value starts
+// with an envelope header telling whether it is encrypted and whether it is a raw string,
+// so that it can be decoded regardless of the configuration of the connection.
 func (connection *DbConnection) MarshalObject(object any) ([]byte, error) {
+	return connection.marshalObject(object, nil)
+}
+
+// MarshalObjectForKey is MarshalObject for the object stored at key in a bucket. The encrypted
+// objects are bound to the bucket and the key, so that they cannot be transplanted into another row.
+func (connection *DbConnection) MarshalObjectForKey(bucketName string, key []byte, object any) ([]byte, error) {
+	return connection.marshalObject(object, objectAAD(bucketName, key))
+}
+
+// objectAAD returns the additional authenticated data of the object stored at key in a bucket,
+// the keys encoded by ConvertToKey and their decimal representation are bound alike
+func objectAAD(bucketName string, key []byte) []byte {
+	return []byte(bucketName + "\x00" + changeKey(key))
+}
+
+func (connection *DbConnection) marshalObject(object any, aad []byte) ([]byte, error) {
 	buf := &bytes.Buffer{}
+	var flags byte
 
 	// Special case for VERSION bucket
 	if v, ok := object.(string); ok {
 		buf.WriteString(v)
+		flags |= envelopeRawString
 	} else {
 		enc := json.NewEncoder(buf)
 		enc.SetSortMapKeys(false)
@@ -30,42 +124,148 @@ func (connection *DbConnection) MarshalObject(object any) ([]byte, error) {
 		}
 	}
 
+	payload := buf.Bytes()
+
+	// the payload is compressed first, a ciphertext does not compress
+	if connection.shouldCompress(len(payload)) {
+		var err error
+		if payload, err = compress(payload); err != nil {
+			return nil, err
+		}
+
+		flags |= envelopeCompressed
+	}
+
 	// Check if encryption is enabled
-	if connection.getEncryptionKey() == nil {
-		return buf.Bytes(), nil
+	if key := connection.getEncryptionKey(); key != nil {
+		var err error
+		if payload, err = encryptWithAAD(payload, key, aad); err != nil {
+			return nil, err
+		}
+
+		flags |= envelopeEncrypted
 	}
 
-	return encrypt(buf.Bytes(), connection.getEncryptionKey())
+	return append(envelopeHeader(flags), payload...), nil
 }
 
-// UnmarshalObject decodes an object from binary data for PostgreSQL
+// UnmarshalObject decodes an object from binary data for PostgreSQL. The values written
+// without an envelope by the former versions are decoded according to the configuration
+// of the connection.
 func (connection *DbConnection) UnmarshalObject(data []byte, object any) error {
-	var err error
-	
+	return connection.unmarshalObject(data, object, nil)
+}
+
+// UnmarshalObjectForKey is UnmarshalObject for the object stored at key in a bucket. It fails
+// when an object encrypted by MarshalObjectForKey was moved from another row. The objects
+// encrypted before they were bound to their key are still decoded, until they are written again.
+func (connection *DbConnection) UnmarshalObjectForKey(bucketName string, key []byte, data []byte, object any) error {
+	return connection.unmarshalObject(data, object, objectAAD(bucketName, key))
+}
+
+// decodeObject decodes the data column of the object stored at key in a bucket, it is JSON
+// unless the store is encrypted. The envelope documents of an unencrypted store are decoded
+// as the envelope they hold.
+func (connection *DbConnection) decodeObject(bucketName string, key []byte, data []byte, object any) error {
+	if !connection.IsEncryptedStore() {
+		if envelope, ok := unwrapEnvelope(data); ok {
+			return connection.UnmarshalObjectForKey(bucketName, key, envelope, object)
+		}
+
+		return json.Unmarshal(data, object)
+	}
+
+	return connection.UnmarshalObjectForKey(bucketName, key, data, object)
+}
+
+func (connection *DbConnection) unmarshalObject(data []byte, object any, aad []byte) error {
+	flags, payload, ok := parseEnvelope(data)
+	if !ok {
+		return connection.unmarshalLegacyObject(data, object, aad)
+	}
+
+	err := connection.unmarshalEnvelope(flags, payload, object, aad)
+	if err != nil && connection.getEncryptionKey() != nil {
+		// a legacy encrypted value starts with a random nonce, which may match the header
+		if legacyErr := connection.unmarshalLegacyObject(data, object, aad); legacyErr == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// unmarshalEnvelope decodes the payload of an envelope according to its flags
+func (connection *DbConnection) unmarshalEnvelope(flags byte, payload []byte, object any, aad []byte) error {
+	if flags&^envelopeKnownFlags != 0 {
+		return fmt.Errorf("unsupported envelope flags %#x", flags)
+	}
+
+	if flags&envelopeEncrypted != 0 {
+		key := connection.getEncryptionKey()
+		if key == nil {
+			return ErrHaveEncryptedWithNoKey
+		}
+
+		var err error
+		if payload, err = decryptObject(payload, key, aad); err != nil {
+			return err
+		}
+	}
+
+	if flags&envelopeCompressed != 0 {
+		var err error
+		if payload, err = decompress(payload); err != nil {
+			return err
+		}
+	}
+
+	if flags&envelopeRawString != 0 {
+		s, ok := object.(*string)
+		if !ok {
+			return fmt.Errorf("cannot decode a raw string into %T", object)
+		}
+
+		*s = string(payload)
+
+		return nil
+	}
+
+	return json.Unmarshal(payload, object)
+}
+
+// unmarshalLegacyObject decodes a value written without an envelope, it is considered
+// encrypted when the connection has an encryption key
+func (connection *DbConnection) unmarshalLegacyObject(data []byte, object any, aad []byte) error {
 	// Decrypt if encryption key is present
 	if connection.getEncryptionKey() != nil {
-		data, err = decrypt(data, connection.getEncryptionKey())
-		if err != nil {
-			return errors.Wrap(err, "Failed decrypting object")
+		var err error
+		if data, err = decryptObject(data, connection.getEncryptionKey(), aad); err != nil {
+			return err
 		}
 	}
 
 	// Handle JSON unmarshaling
-	if e := json.Unmarshal(data, object); e != nil {
+	if err := json.Unmarshal(data, object); err != nil {
 		// Special case for VERSION bucket
 		s, ok := object.(*string)
 		if !ok {
-			return errors.Wrap(err, e.Error())
+			return fmt.Errorf("json unmarshal: %w", err)
 		}
 
 		*s = string(data)
 	}
 
-	return err
+	return nil
 }
 
 // encrypt performs AES-GCM encryption
 func encrypt(plaintext []byte, passphrase []byte) (encrypted []byte, err error) {
+	return encryptWithAAD(plaintext, passphrase, nil)
+}
+
+// encryptWithAAD performs AES-GCM encryption authenticating aad along with the plaintext
+func encryptWithAAD(plaintext []byte, passphrase []byte, aad []byte) (encrypted []byte, err error) {
 	block, err := aes.NewCipher(passphrase)
 	if err != nil {
 		return nil, err
@@ -81,37 +281,53 @@ func encrypt(plaintext []byte, passphrase []byte) (encrypted []byte, err error)
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
 }
 
-// decrypt performs AES-GCM decryption
-func decrypt(encrypted []byte, passphrase []byte) (plaintextByte []byte, err error) {
-	// Special case for "false" string
-	if string(encrypted) == "false" {
-		return []byte("false"), nil
+// decryptObject decrypts the data of an object, the objects encrypted before they were bound
+// to aad are decrypted without it. A failure is never recovered from, the ciphertext must
+// not be mistaken for the plaintext of a raw string.
+func decryptObject(data []byte, passphrase []byte, aad []byte) ([]byte, error) {
+	plaintext, err := decryptWithAAD(data, passphrase, aad)
+	if err != nil && aad != nil {
+		plaintext, err = decrypt(data, passphrase)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errDecryptionFailed, err)
 	}
 
+	return plaintext, nil
+}
+
+// decrypt performs AES-GCM decryption, it returns nil data on error
+func decrypt(encrypted []byte, passphrase []byte) (plaintextByte []byte, err error) {
+	return decryptWithAAD(encrypted, passphrase, nil)
+}
+
+// decryptWithAAD performs AES-GCM decryption authenticating aad, it returns nil data on error
+func decryptWithAAD(encrypted []byte, passphrase []byte, aad []byte) (plaintextByte []byte, err error) {
 	block, err := aes.NewCipher(passphrase)
 	if err != nil {
-		return encrypted, errors.Wrap(err, "Error creating cipher block")
+		return nil, errors.Wrap(err, "Error creating cipher block")
 	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return encrypted, errors.Wrap(err, "Error creating GCM")
+		return nil, errors.Wrap(err, "Error creating GCM")
 	}
 
 	nonceSize := gcm.NonceSize()
 	if len(encrypted) < nonceSize {
-		return encrypted, errEncryptedStringTooShort
+		return nil, errEncryptedStringTooShort
 	}
 
 	nonce, ciphertextByteClean := encrypted[:nonceSize], encrypted[nonceSize:]
 
-	plaintextByte, err = gcm.Open(nil, nonce, ciphertextByteClean, nil)
+	plaintextByte, err = gcm.Open(nil, nonce, ciphertextByteClean, aad)
 	if err != nil {
-		return encrypted, errors.Wrap(err, "Error decrypting text")
+		return nil, errors.Wrap(err, "Error decrypting text")
 	}
 
 	return plaintextByte, err
-}
\ No newline at end of file
+}
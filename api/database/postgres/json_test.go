@@ -1,12 +1,17 @@
 package postgres
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/sha256"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/gofrs/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -88,7 +93,14 @@ func Test_MarshalObjectUnencrypted(t *testing.T) {
 		t.Run(fmt.Sprintf("%s -> %s", test.object, test.expected), func(t *testing.T) {
 			data, err := conn.MarshalObject(test.object)
 			is.NoError(err)
-			is.Equal(test.expected, string(data))
+
+			var flags byte
+			if _, ok := test.object.(string); ok {
+				flags = envelopeRawString
+			}
+
+			is.Equal(envelopeHeader(flags), data[:envelopeHeaderSize])
+			is.Equal(test.expected, string(data[envelopeHeaderSize:]))
 		})
 	}
 }
@@ -168,4 +180,259 @@ func Test_ObjectMarshallingEncrypted(t *testing.T) {
 			is.Equal(test.object, object)
 		})
 	}
-}
\ No newline at end of file
+}
+
+// encryptedConnection returns a connection encrypting the objects with passphrase
+func encryptedConnection() *DbConnection {
+	conn := &DbConnection{EncryptionKey: secretToEncryptionKey(passphrase)}
+	conn.SetEncrypted(true)
+
+	return conn
+}
+
+func Test_MarshalObject_Envelope(t *testing.T) {
+	plain := &DbConnection{}
+	encrypted := encryptedConnection()
+
+	tests := []struct {
+		name   string
+		conn   *DbConnection
+		object any
+		flags  byte
+	}{
+		{"plaintext JSON", plain, map[string]any{"Name": "local"}, 0},
+		{"encrypted JSON", encrypted, map[string]any{"Name": "local"}, envelopeEncrypted},
+		{"raw version string", plain, "2.21.0", envelopeRawString},
+		{"encrypted raw version string", encrypted, "2.21.0", envelopeEncrypted | envelopeRawString},
+		{"false", plain, false, 0},
+		{"encrypted false", encrypted, false, envelopeEncrypted},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := tc.conn.MarshalObject(tc.object)
+			require.NoError(t, err)
+
+			flags, _, ok := parseEnvelope(data)
+			require.True(t, ok)
+			assert.Equal(t, tc.flags, flags)
+
+			// the envelope is enough to decode the value, whatever the configuration
+			for _, conn := range []*DbConnection{tc.conn, encrypted} {
+				object := reflect.New(reflect.TypeOf(tc.object))
+				require.NoError(t, conn.UnmarshalObject(data, object.Interface()))
+				assert.Equal(t, tc.object, object.Elem().Interface())
+			}
+		})
+	}
+}
+
+func Test_UnmarshalObject_EncryptedWithoutKey(t *testing.T) {
+	data, err := encryptedConnection().MarshalObject(map[string]any{"Name": "local"})
+	require.NoError(t, err)
+
+	var object map[string]any
+	err = (&DbConnection{}).UnmarshalObject(data, &object)
+	assert.ErrorIs(t, err, ErrHaveEncryptedWithNoKey)
+}
+
+func Test_UnmarshalObject_UnsupportedEnvelope(t *testing.T) {
+	conn := &DbConnection{}
+
+	var object map[string]any
+	err := conn.UnmarshalObject(append(envelopeHeader(0x80), `{}`...), &object)
+	assert.ErrorContains(t, err, "unsupported envelope flags")
+
+	err = conn.UnmarshalObject(append(envelopeHeader(envelopeCompressed), `{}`...), &object)
+	assert.ErrorContains(t, err, "failed to decompress object")
+
+	var n int
+	err = conn.UnmarshalObject(append(envelopeHeader(envelopeRawString), "2.21.0"...), &n)
+	assert.ErrorContains(t, err, "cannot decode a raw string")
+}
+
+func Test_UnmarshalObject_Legacy(t *testing.T) {
+	encrypted := encryptedConnection()
+
+	legacyEncrypted := func(plaintext string) []byte {
+		data, err := encrypt([]byte(plaintext), encrypted.EncryptionKey)
+		require.NoError(t, err)
+
+		return data
+	}
+
+	t.Run("plaintext JSON", func(t *testing.T) {
+		var object map[string]any
+		require.NoError(t, (&DbConnection{}).UnmarshalObject([]byte(`{"Name":"local"}`), &object))
+		assert.Equal(t, map[string]any{"Name": "local"}, object)
+	})
+
+	t.Run("raw version string", func(t *testing.T) {
+		var version string
+		require.NoError(t, (&DbConnection{}).UnmarshalObject([]byte("2.21.0"), &version))
+		assert.Equal(t, "2.21.0", version)
+	})
+
+	t.Run("encrypted JSON", func(t *testing.T) {
+		var object map[string]any
+		require.NoError(t, encrypted.UnmarshalObject(legacyEncrypted(`{"Name":"local"}`), &object))
+		assert.Equal(t, map[string]any{"Name": "local"}, object)
+	})
+
+	t.Run("encrypted raw version string", func(t *testing.T) {
+		var version string
+		require.NoError(t, encrypted.UnmarshalObject(legacyEncrypted("2.21.0"), &version))
+		assert.Equal(t, "2.21.0", version)
+	})
+
+	t.Run("plaintext corrupt JSON", func(t *testing.T) {
+		var object map[string]any
+		err := (&DbConnection{}).UnmarshalObject([]byte(`{"Name":`), &object)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "json unmarshal")
+	})
+
+	t.Run("encrypted corrupt JSON", func(t *testing.T) {
+		// the decryption succeeds, the decoding of its plaintext fails
+		var object map[string]any
+		err := encrypted.UnmarshalObject(legacyEncrypted(`{"Name":`), &object)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "json unmarshal")
+	})
+
+	t.Run("plaintext false", func(t *testing.T) {
+		// only the values written with an envelope can be plaintext in an encrypted store
+		var b bool
+		assert.Error(t, encrypted.UnmarshalObject([]byte("false"), &b))
+	})
+
+	t.Run("encrypted value starting with the magic bytes", func(t *testing.T) {
+		block, err := aes.NewCipher(encrypted.EncryptionKey)
+		require.NoError(t, err)
+		gcm, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+
+		nonce := make([]byte, gcm.NonceSize())
+		copy(nonce, envelopeHeader(envelopeEncrypted))
+		data := gcm.Seal(nonce, nonce, []byte(`{"Name":"local"}`), nil)
+
+		var object map[string]any
+		require.NoError(t, encrypted.UnmarshalObject(data, &object))
+		assert.Equal(t, map[string]any{"Name": "local"}, object)
+	})
+}
+
+func Test_UnmarshalObject_MixedDatabase(t *testing.T) {
+	plain := &DbConnection{}
+	encrypted := encryptedConnection()
+
+	// values written before and after the encryption of the database, with and without envelope
+	envelopePlain, err := plain.MarshalObject(map[string]any{"Id": 1})
+	require.NoError(t, err)
+	envelopeEncrypted, err := encrypted.MarshalObject(map[string]any{"Id": 2})
+	require.NoError(t, err)
+	legacyEncrypted, err := encrypt([]byte(`{"Id":3}`), encrypted.EncryptionKey)
+	require.NoError(t, err)
+
+	for i, data := range [][]byte{envelopePlain, envelopeEncrypted, legacyEncrypted} {
+		var object map[string]any
+		require.NoError(t, encrypted.UnmarshalObject(data, &object))
+		assert.Equal(t, map[string]any{"Id": float64(i + 1)}, object)
+	}
+
+	// a legacy plaintext value cannot be told apart from a legacy encrypted one
+	var object map[string]any
+	assert.Error(t, encrypted.UnmarshalObject([]byte(`{"Id":4}`), &object))
+}
+
+func Test_UnmarshalObject_CorruptedCiphertext(t *testing.T) {
+	conn := encryptedConnection()
+
+	envelopeData, err := conn.MarshalObject("2.21.0")
+	require.NoError(t, err)
+	legacyData, err := encrypt([]byte("2.21.0"), conn.EncryptionKey)
+	require.NoError(t, err)
+
+	for name, data := range map[string][]byte{"envelope": envelopeData, "legacy": legacyData} {
+		t.Run(name, func(t *testing.T) {
+			// corrupt one byte of the ciphertext, after the nonce
+			corrupted := bytes.Clone(data)
+			corrupted[len(corrupted)-1] ^= 0xff
+
+			version := "unchanged"
+			err := conn.UnmarshalObject(corrupted, &version)
+			require.ErrorContains(t, err, "Failed decrypting object")
+			assert.Equal(t, "unchanged", version)
+
+			var raw []byte
+			require.Error(t, conn.UnmarshalObject(corrupted, &raw))
+			assert.Nil(t, raw)
+		})
+	}
+}
+
+func Test_decrypt_ReturnsNilOnError(t *testing.T) {
+	key := secretToEncryptionKey(passphrase)
+
+	data, err := encrypt([]byte(`{"Name":"local"}`), key)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+
+	plaintext, err := decrypt(data, key)
+	require.Error(t, err)
+	assert.Nil(t, plaintext)
+
+	plaintext, err = decrypt([]byte("short"), key)
+	require.ErrorIs(t, err, errEncryptedStringTooShort)
+	assert.Nil(t, plaintext)
+
+	plaintext, err = decrypt([]byte("false"), key)
+	require.Error(t, err)
+	assert.Nil(t, plaintext)
+
+	plaintext, err = decrypt(data, []byte("short"))
+	require.Error(t, err)
+	assert.Nil(t, plaintext)
+}
+
+func Test_ObjectForKey_SwappedCiphertext(t *testing.T) {
+	conn := encryptedConnection()
+
+	admin, err := conn.MarshalObjectForKey("users", conn.ConvertToKey(1), map[string]any{"Username": "admin"})
+	require.NoError(t, err)
+
+	var user map[string]any
+	require.NoError(t, conn.UnmarshalObjectForKey("users", conn.ConvertToKey(1), admin, &user))
+	assert.Equal(t, "admin", user["Username"])
+
+	// both encodings of the key are bound alike
+	require.NoError(t, conn.UnmarshalObjectForKey("users", []byte("1"), admin, &user))
+
+	// the ciphertext moved to another row or bucket fails to authenticate
+	user = nil
+	err = conn.UnmarshalObjectForKey("users", conn.ConvertToKey(2), admin, &user)
+	require.ErrorContains(t, err, "message authentication failed")
+	assert.Nil(t, user)
+
+	err = conn.UnmarshalObjectForKey("teams", conn.ConvertToKey(1), admin, &user)
+	require.ErrorContains(t, err, "message authentication failed")
+
+	err = conn.UnmarshalObject(admin, &user)
+	require.ErrorContains(t, err, "message authentication failed")
+}
+
+func Test_UnmarshalObjectForKey_WithoutAAD(t *testing.T) {
+	conn := encryptedConnection()
+
+	// the objects encrypted before they were bound to their key
+	envelopeData, err := conn.MarshalObject(map[string]any{"Id": 1})
+	require.NoError(t, err)
+	legacyData, err := encrypt([]byte(`{"Id":1}`), conn.EncryptionKey)
+	require.NoError(t, err)
+
+	for _, data := range [][]byte{envelopeData, legacyData} {
+		var object map[string]any
+		require.NoError(t, conn.UnmarshalObjectForKey("endpoints", []byte("1"), data, &object))
+		assert.Equal(t, map[string]any{"Id": float64(1)}, object)
+	}
+}
@@ -0,0 +1,197 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BucketRegistryTable records the key type of the buckets created by SetServiceNameWithKeyType
+const BucketRegistryTable = "bucket_registry"
+
+// ErrKeyTypeMismatch is returned when a key does not match the key type of its bucket
+var ErrKeyTypeMismatch = errors.New("the key does not match the key type of the bucket")
+
+// KeyType is the type of the id column of a bucket
+type KeyType string
+
+const (
+	// KeyTypeInteger is the default key type, the keys are integers encoded by ConvertToKey
+	// or their decimal representation
+	KeyTypeInteger KeyType = "integer"
+	// KeyTypeText is the key type of the buckets using composite string keys, such as "5.edge.async"
+	KeyTypeText KeyType = "text"
+)
+
+// idColumn returns the definition of the id column of the buckets of the key type, the
+// sequence of the integer keys is created by ensureSequenceForTable
+func (keyType KeyType) idColumn() string {
+	if keyType == KeyTypeText {
+		return "id TEXT PRIMARY KEY"
+	}
+
+	return "id INTEGER PRIMARY KEY"
+}
+
+// defaultKeyTypes holds the key type of the Portainer buckets that do not have integer keys
+var defaultKeyTypes = map[string]KeyType{
+	// the version bucket holds the VERSION and DB_UPDATING keys
+	versionBucket: KeyTypeText,
+}
+
+// keyType returns the key type of a bucket, the buckets missing from the registry have the key
+// type found in defaultKeyTypes or integer keys
+func (connection *DbConnection) keyType(bucketName string) KeyType {
+	if keyType, ok := connection.keyTypes.Load(bucketName); ok {
+		return keyType.(KeyType)
+	}
+
+	if keyType, ok := defaultKeyTypes[bucketName]; ok {
+		return keyType
+	}
+
+	return KeyTypeInteger
+}
+
+// loadKeyTypes loads the bucket registry, so that the key type of a bucket is known without a query
+func (connection *DbConnection) loadKeyTypes(ctx context.Context, q sqlx.QueryerContext) error {
+	registry := connection.table(BucketRegistryTable)
+
+	var exists bool
+	if err := sqlx.GetContext(ctx, q, &exists, "SELECT to_regclass($1) IS NOT NULL", registry); err != nil {
+		return fmt.Errorf("failed to look up %s: %w", registry, err)
+	}
+
+	if !exists {
+		return nil
+	}
+
+	var rows []struct {
+		Bucket  string  `db:"bucket_name"`
+		KeyType KeyType `db:"key_type"`
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, "SELECT bucket_name, key_type FROM "+registry); err != nil {
+		return fmt.Errorf("failed to read %s: %w", registry, err)
+	}
+
+	for _, row := range rows {
+		connection.keyTypes.Store(row.Bucket, row.KeyType)
+	}
+
+	return nil
+}
+
+// SetServiceNameWithKeyType creates the table of a bucket with keys of the given type and records
+// the type in the bucket registry. It returns ErrKeyTypeMismatch when the bucket already exists
+// with another key type.
+func (tx *DbTransaction) SetServiceNameWithKeyType(bucketName string, keyType KeyType) (err error) {
+	ctx, end := tx.startSpan("SetServiceNameWithKeyType", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if keyType != KeyTypeInteger && keyType != KeyTypeText {
+		return fmt.Errorf("unsupported key type %q", keyType)
+	}
+
+	registry := tx.conn.table(BucketRegistryTable)
+	if _, err := tx.tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			bucket_name TEXT PRIMARY KEY,
+			key_type TEXT NOT NULL
+		)`, registry)); err != nil {
+		return fmt.Errorf("failed to create %s: %w", registry, err)
+	}
+
+	current, err := tx.registeredKeyType(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+
+	if current != "" && current != keyType {
+		return fmt.Errorf("%w: bucket %s has %s keys, not %s keys", ErrKeyTypeMismatch, bucketName, current, keyType)
+	}
+
+	if err := tx.createBucketTable(ctx, bucketName, keyType); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (bucket_name, key_type) VALUES ($1, $2) ON CONFLICT (bucket_name) DO NOTHING", registry)
+	if _, err := tx.tx.ExecContext(ctx, query, bucketName, keyType); err != nil {
+		return fmt.Errorf("failed to register bucket %s: %w", bucketName, err)
+	}
+
+	tx.conn.keyTypes.Store(bucketName, keyType)
+
+	return nil
+}
+
+// registeredKeyType returns the key type of a bucket found in the registry or, for the buckets
+// created before it, the type of their id column. It is empty when the bucket does not exist.
+func (tx *DbTransaction) registeredKeyType(ctx context.Context, bucketName string) (KeyType, error) {
+	var keyType KeyType
+	query := fmt.Sprintf("SELECT key_type FROM %s WHERE bucket_name = $1", tx.conn.table(BucketRegistryTable))
+	err := tx.tx.GetContext(ctx, &keyType, query, bucketName)
+	if err == nil {
+		return keyType, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("failed to look up bucket %s in the registry: %w", bucketName, err)
+	}
+
+	var dataType string
+	err = tx.tx.GetContext(ctx, &dataType, `
+		SELECT data_type
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'id'
+	`, tx.conn.table(bucketName))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to look up the id column of bucket %s: %w", bucketName, err)
+	case dataType == "text":
+		return KeyTypeText, nil
+	}
+
+	return KeyTypeInteger, nil
+}
+
+// checkIntegerKeys rejects the operations generating integer keys on a bucket with text keys
+func (tx *DbTransaction) checkIntegerKeys(bucketName string) error {
+	if tx.conn.keyType(bucketName) == KeyTypeText {
+		return fmt.Errorf("%w: bucket %s has text keys", ErrKeyTypeMismatch, bucketName)
+	}
+
+	return nil
+}
+
+// keyArg returns the value of the id column matching key in a bucket
+func (tx *DbTransaction) keyArg(bucketName string, key []byte) (any, error) {
+	if tx.conn.keyType(bucketName) == KeyTypeText {
+		return string(key), nil
+	}
+
+	id, err := keyToID(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrKeyTypeMismatch, err)
+	}
+
+	return id, nil
+}
+
+// keyPrefixCondition returns the condition matching the keys of a bucket starting with the
+// parameter $1, which is escaped by likePrefix
+func (tx *DbTransaction) keyPrefixCondition(bucketName string) string {
+	if tx.conn.keyType(bucketName) == KeyTypeText {
+		return "id LIKE $1"
+	}
+
+	return "id::text LIKE $1"
+}
+
+// likePrefix returns the LIKE pattern matching the strings starting with prefix
+func likePrefix(prefix []byte) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(string(prefix)) + "%"
+}
@@ -0,0 +1,146 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SetServiceNameWithKeyType(t *testing.T) {
+	const (
+		registryQuery = "SELECT key_type FROM bucket_registry WHERE bucket_name = $1"
+		columnQuery   = "SELECT data_type FROM information_schema.columns"
+	)
+
+	t.Run("new bucket", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS bucket_registry")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(registryQuery)).WithArgs("tunnels").WillReturnRows(sqlmock.NewRows([]string{"key_type"}))
+		mock.ExpectQuery(regexp.QuoteMeta(columnQuery)).WithArgs("tunnels").WillReturnRows(sqlmock.NewRows([]string{"data_type"}))
+		mock.ExpectExec(regexp.QuoteMeta("id TEXT PRIMARY KEY")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTimestampColumns(mock, "tunnels")
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO bucket_registry (bucket_name, key_type) VALUES ($1, $2) ON CONFLICT (bucket_name) DO NOTHING")).
+			WithArgs("tunnels", KeyTypeText).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+			return tx.(*DbTransaction).SetServiceNameWithKeyType("tunnels", KeyTypeText)
+		}))
+		assert.Equal(t, KeyTypeText, conn.keyType("tunnels"))
+		assert.Equal(t, KeyTypeInteger, conn.keyType("endpoints"))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mixing key types", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS bucket_registry")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(registryQuery)).WithArgs("endpoints").WillReturnRows(sqlmock.NewRows([]string{"key_type"}))
+		// created by SetServiceName before the registry
+		mock.ExpectQuery(regexp.QuoteMeta(columnQuery)).WithArgs("endpoints").WillReturnRows(sqlmock.NewRows([]string{"data_type"}).AddRow("integer"))
+		mock.ExpectRollback()
+
+		err := conn.UpdateTx(func(tx portainer.Transaction) error {
+			return tx.(*DbTransaction).SetServiceNameWithKeyType("endpoints", KeyTypeText)
+		})
+		require.ErrorIs(t, err, ErrKeyTypeMismatch)
+		assert.Contains(t, err.Error(), "bucket endpoints has integer keys")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_KeyTypes(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.keyTypes.Store("tunnels", KeyTypeText)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO tunnels (id, data) VALUES ($1, $2)")).WithArgs("5.edge.async", []byte(`{}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM tunnels WHERE id LIKE $1")).WithArgs(`5.edge\_%`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM endpoints WHERE id::text LIKE $1")).WithArgs("1%").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	mock.ExpectRollback()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		require.NoError(t, tx.CreateObjectWithStringId("tunnels", []byte("5.edge.async"), map[string]any{}))
+
+		var obj map[string]any
+		appendFn := func(o any) (any, error) { return o, nil }
+		require.NoError(t, tx.GetAllWithKeyPrefix("tunnels", []byte("5.edge_"), &obj, appendFn))
+		require.NoError(t, tx.GetAllWithKeyPrefix("endpoints", []byte("1"), &obj, appendFn))
+
+		// the integer keys are not mixed with text keys
+		require.ErrorIs(t, tx.CreateObjectWithId("tunnels", 1, obj), ErrKeyTypeMismatch)
+		require.ErrorIs(t, tx.CreateObjectWithStringId("endpoints", []byte("5.edge.async"), obj), ErrKeyTypeMismatch)
+		_, err := tx.(*DbTransaction).GetNextIdentifierErr("tunnels")
+		require.ErrorIs(t, err, ErrKeyTypeMismatch)
+
+		return ErrKeyTypeMismatch
+	})
+	require.ErrorIs(t, err, ErrKeyTypeMismatch)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_TextKeys_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "text_keys_test", BucketRegistryTable)
+
+	type tunnel struct {
+		Name string
+	}
+
+	keys := []string{"5.edge.async", "5.edge.sync", "50.edge.async", "6.edge.async"}
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.(*DbTransaction).SetServiceNameWithKeyType("text_keys_test", KeyTypeText); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := tx.CreateObjectWithStringId("text_keys_test", []byte(key), tunnel{Name: key}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var got tunnel
+	require.NoError(t, conn.GetObject("text_keys_test", []byte("5.edge.async"), &got))
+	assert.Equal(t, "5.edge.async", got.Name)
+
+	require.NoError(t, conn.UpdateObject("text_keys_test", []byte("5.edge.sync"), tunnel{Name: "updated"}))
+	require.NoError(t, conn.GetObject("text_keys_test", []byte("5.edge.sync"), &got))
+	assert.Equal(t, "updated", got.Name)
+
+	var names []string
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetAllWithKeyPrefix("text_keys_test", []byte("5."), &got, func(o any) (any, error) {
+			names = append(names, o.(*tunnel).Name)
+			return &tunnel{}, nil
+		})
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"5.edge.async", "updated"}, names)
+
+	require.NoError(t, conn.DeleteObject("text_keys_test", []byte("6.edge.async")))
+	require.Error(t, conn.GetObject("text_keys_test", []byte("6.edge.async"), &got))
+
+	// the key type is remembered by the registry
+	reopened := newTestConnection(t)
+	assert.Equal(t, KeyTypeText, reopened.keyType("text_keys_test"))
+
+	err = reopened.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.(*DbTransaction).SetServiceNameWithKeyType("text_keys_test", KeyTypeInteger)
+	})
+	require.ErrorIs(t, err, ErrKeyTypeMismatch)
+}
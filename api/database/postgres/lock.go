@@ -0,0 +1,146 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// InstanceLockKey is the session-level advisory lock held by the Portainer instance using the database
+const InstanceLockKey int64 = 0x706f7274696e73 // "portins"
+
+var ErrInstanceLocked = errors.New("the database is already in use by another Portainer instance")
+
+// InstanceLockMode controls what Open does when another instance holds the instance lock
+type InstanceLockMode int
+
+const (
+	// InstanceLockFailFast makes Open return ErrInstanceLocked
+	InstanceLockFailFast InstanceLockMode = iota
+	// InstanceLockWait makes Open block until the other instance releases the lock
+	InstanceLockWait
+	// InstanceLockDisabled skips the instance lock, it is meant for tooling working next to a running instance
+	InstanceLockDisabled
+)
+
+// WithInstanceLockMode sets the behavior of Open when the instance lock is already held
+func WithInstanceLockMode(mode InstanceLockMode) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.instanceLockMode = mode
+	}
+}
+
+// AcquireInstanceLock blocks until this connection holds the instance lock
+func (connection *DbConnection) AcquireInstanceLock(ctx context.Context) (err error) {
+	ctx, end := connection.startSpan(ctx, "AcquireInstanceLock", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	_, err = connection.lockInstance(ctx, connection.DB, true)
+
+	return err
+}
+
+// TryAcquireInstanceLock acquires the instance lock without waiting, it returns
+// false when the lock is held by another instance
+func (connection *DbConnection) TryAcquireInstanceLock(ctx context.Context) (locked bool, err error) {
+	ctx, end := connection.startSpan(ctx, "TryAcquireInstanceLock", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return false, ErrNoConnection
+	}
+
+	return connection.lockInstance(ctx, connection.DB, false)
+}
+
+// ReleaseInstanceLock releases the instance lock, it is a no-op when the lock is not held
+func (connection *DbConnection) ReleaseInstanceLock() (err error) {
+	_, end := connection.startSpan(connection.ctx, "ReleaseInstanceLock", "")
+	defer func() { end(err) }()
+
+	connection.instanceLockMu.Lock()
+	defer connection.instanceLockMu.Unlock()
+
+	if lock := connection.instanceTableLock; lock != nil {
+		connection.instanceTableLock = nil
+
+		if err := connection.releaseInstanceTable(lock); err != nil {
+			return fmt.Errorf("failed to release the instance lock: %w", err)
+		}
+
+		return nil
+	}
+
+	if connection.instanceLock == nil {
+		return nil
+	}
+
+	conn := connection.instanceLock
+	connection.instanceLock = nil
+
+	// The connection goes back to the pool, so the lock must be released explicitly
+	_, err = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", InstanceLockKey)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to release the instance lock: %w", err)
+	}
+
+	return nil
+}
+
+// lockInstance takes the instance lock on a dedicated connection of db, which is kept
+// until the lock is released since advisory locks belong to the session. In pgBouncer mode,
+// the lock is held in InstanceLockTable instead.
+func (connection *DbConnection) lockInstance(ctx context.Context, db *sqlx.DB, wait bool) (bool, error) {
+	connection.instanceLockMu.Lock()
+	defer connection.instanceLockMu.Unlock()
+
+	if connection.instanceLock != nil || connection.instanceTableLock != nil {
+		return true, nil
+	}
+
+	if connection.pgBouncerMode {
+		return connection.lockInstanceTable(ctx, db, wait)
+	}
+
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire a connection: %w", err)
+	}
+
+	var locked bool
+	if err := conn.GetContext(ctx, &locked, "SELECT pg_try_advisory_lock($1)", InstanceLockKey); err != nil {
+		conn.Close()
+		return false, fmt.Errorf("failed to acquire the instance lock: %w", err)
+	}
+
+	if !locked && wait {
+		log.Info().Str("component", "postgres").Msg("the database is in use by another Portainer instance, waiting for it to stop")
+
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", InstanceLockKey); err != nil {
+			conn.Close()
+			return false, fmt.Errorf("failed to acquire the instance lock: %w", err)
+		}
+
+		locked = true
+	}
+
+	if !locked {
+		conn.Close()
+		return false, nil
+	}
+
+	connection.instanceLock = conn
+
+	return true, nil
+}
@@ -0,0 +1,78 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TryAcquireInstanceLock(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	ctx := context.Background()
+
+	mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(InstanceLockKey).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+
+	locked, err := conn.TryAcquireInstanceLock(ctx)
+	require.NoError(t, err)
+	assert.False(t, locked)
+
+	mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(InstanceLockKey).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+
+	locked, err = conn.TryAcquireInstanceLock(ctx)
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	// the lock is already held by this connection
+	locked, err = conn.TryAcquireInstanceLock(ctx)
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(InstanceLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.NoError(t, conn.ReleaseInstanceLock())
+	require.NoError(t, conn.ReleaseInstanceLock())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_InstanceLock(t *testing.T) {
+	first := newTestConnection(t)
+	connStr := os.Getenv("TEST_DATABASE_URL")
+
+	_, err := NewConnection(connStr, nil)
+	require.ErrorIs(t, err, ErrInstanceLocked)
+
+	opened := make(chan *DbConnection)
+	go func() {
+		second, err := NewConnection(connStr, nil, WithInstanceLockMode(InstanceLockWait))
+		assert.NoError(t, err)
+		opened <- second
+	}()
+
+	select {
+	case <-opened:
+		t.Fatal("the second instance opened the database while the first one holds the lock")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	require.NoError(t, first.ReleaseInstanceLock())
+
+	select {
+	case second := <-opened:
+		require.NotNil(t, second)
+		defer second.Close()
+
+		locked, err := first.TryAcquireInstanceLock(context.Background())
+		require.NoError(t, err)
+		assert.False(t, locked)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the second instance did not open the database after the lock was released")
+	}
+}
@@ -0,0 +1,60 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// withLogger attaches a logger to ctx for the entries logged during a transaction. It carries
+// the trace ID of the span found in ctx so that the entries can be correlated with the trace.
+func withLogger(ctx context.Context) context.Context {
+	logger := *ctxLogger(ctx)
+
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		logger = logger.With().Str("trace_id", spanContext.TraceID().String()).Logger()
+	}
+
+	return logger.WithContext(ctx)
+}
+
+// ctxLogger returns the logger attached to ctx, or the global logger when there is none
+func ctxLogger(ctx context.Context) *zerolog.Logger {
+	if ctx != nil {
+		if logger := log.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+			return logger
+		}
+	}
+
+	return &log.Logger
+}
+
+// startTx starts the span of a transaction made on behalf of ctx and logs its start, the
+// returned function ends the span and logs the end of the transaction with its duration
+func (connection *DbConnection) startTx(ctx context.Context, operation, table string) (context.Context, func(err error)) {
+	ctx, end := connection.startSpan(ctx, operation, table)
+	ctx = withLogger(ctx)
+	start := time.Now()
+
+	ctxLogger(ctx).Trace().
+		Str("component", "postgres").
+		Str("operation", operation).
+		Str("table", table).
+		Msg("transaction started")
+
+	return ctx, func(err error) {
+		ctxLogger(ctx).Trace().
+			Str("component", "postgres").
+			Str("operation", operation).
+			Str("table", table).
+			Dur("duration", time.Since(start)).
+			Err(err).
+			Msg("transaction ended")
+
+		connection.observeTxDuration(ctx, operation, table, start)
+		end(err)
+	}
+}
@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logEntries returns the entries written to buf
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func Test_UpdateTx_Logging(t *testing.T) {
+	conn, mock, exporter := newTracedMockConnection(t)
+	buf := captureLogs(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.DeleteObject("users", []byte("1"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	spans := exporter.GetSpans()
+	require.NotEmpty(t, spans)
+	traceID := spans[len(spans)-1].SpanContext.TraceID().String()
+
+	entries := logEntries(t, buf)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, "trace", entries[0]["level"])
+	assert.Equal(t, "transaction started", entries[0]["message"])
+	assert.Equal(t, "UpdateTx", entries[0]["operation"])
+
+	assert.Equal(t, "trace", entries[1]["level"])
+	assert.Equal(t, "transaction ended", entries[1]["message"])
+	assert.Contains(t, entries[1], "duration")
+
+	for _, entry := range entries {
+		assert.Equal(t, "postgres", entry["component"])
+		assert.Equal(t, traceID, entry["trace_id"])
+	}
+}
+
+func Test_Logging_Component(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	buf := captureLogs(t)
+
+	failure := errors.New("connection reset")
+	mock.ExpectBegin()
+	expectNextIdentifier(mock, "users").WillReturnError(failure)
+	mock.ExpectRollback().WillReturnError(errors.New("rollback failed"))
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if tx.GetNextIdentifier("users") == 0 {
+			return failure
+		}
+
+		return nil
+	})
+	require.ErrorIs(t, err, failure)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	entries := logEntries(t, buf)
+	messages := make([]any, 0, len(entries))
+	for _, entry := range entries {
+		assert.Equal(t, "postgres", entry["component"], entry["message"])
+		assert.NotContains(t, entry, "trace_id", "the noop tracer records no trace")
+		messages = append(messages, entry["message"])
+	}
+
+	assert.Contains(t, messages, "failed to get the next identifier")
+	assert.Contains(t, messages, "failed to rollback transaction")
+}
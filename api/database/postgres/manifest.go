@@ -0,0 +1,329 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/jmoiron/sqlx"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/portainer/portainer/api/database/models"
+	"github.com/rs/zerolog/log"
+)
+
+// manifestKey is the key of the manifest in the exports written by ExportJSON and ExportTables
+const manifestKey = "__manifest"
+
+var (
+	ErrBackupNoManifest    = errors.New("the backup has no manifest")
+	ErrBackupNewerVersion  = errors.New("the backup was made by a newer version of Portainer")
+	ErrBackupFormatUnknown = errors.New("the backup format is not recognized")
+)
+
+// BucketManifest describes the content of a bucket in a backup
+type BucketManifest struct {
+	Rows     int    `json:"rows"`
+	Checksum string `json:"checksum"`
+}
+
+// Manifest describes what produced a backup, it comes first in the backups written by BackupTo
+// and in the exports written by ExportJSON and ExportTables
+type Manifest struct {
+	// SchemaVersion is the Portainer schema version found in the version bucket, it is empty when
+	// the bucket does not exist yet
+	SchemaVersion string                    `json:"schema_version"`
+	CreatedAt     time.Time                 `json:"created_at"`
+	Encrypted     bool                      `json:"encrypted"`
+	Algorithm     string                    `json:"algorithm"`
+	Buckets       map[string]BucketManifest `json:"buckets"`
+	// BaseCreatedAt is set on the incremental backups written by BackupSince, it identifies the
+	// backup they apply onto by its creation time
+	BaseCreatedAt *time.Time `json:"base_created_at,omitempty"`
+}
+
+// newManifest returns the manifest of a backup of the database made in q
+func (connection *DbConnection) newManifest(ctx context.Context, q sqlx.QueryerContext, buckets []string) (*Manifest, error) {
+	version, err := connection.schemaVersion(ctx, q, buckets)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manifest{
+		SchemaVersion: version,
+		CreatedAt:     time.Now().UTC(),
+		Encrypted:     connection.IsEncryptedStore(),
+		Algorithm:     backupChecksumAlgorithm,
+		Buckets:       make(map[string]BucketManifest, len(buckets)),
+	}, nil
+}
+
+// schemaVersion reads the Portainer schema version from the version bucket when it is one of buckets
+func (connection *DbConnection) schemaVersion(ctx context.Context, q sqlx.QueryerContext, buckets []string) (string, error) {
+	found := false
+	for _, bucket := range buckets {
+		found = found || bucket == versionBucket
+	}
+
+	if !found {
+		return "", nil
+	}
+
+	var data []byte
+	query := fmt.Sprintf("SELECT data FROM %s WHERE id::text = $1", connection.table(versionBucket))
+	if err := sqlx.GetContext(ctx, q, &data, query, versionKey); errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read the schema version: %w", err)
+	}
+
+	var version models.Version
+	if err := connection.UnmarshalObjectForKey(versionBucket, []byte(versionKey), data, &version); err != nil {
+		return "", fmt.Errorf("failed to decode the schema version: %w", err)
+	}
+
+	return version.SchemaVersion, nil
+}
+
+// checkVersion refuses the backups made by a newer version of Portainer than the running one
+func (manifest *Manifest) checkVersion() error {
+	if manifest.SchemaVersion == "" {
+		return nil
+	}
+
+	backupVersion, err := semver.NewVersion(manifest.SchemaVersion)
+	if err != nil {
+		return fmt.Errorf("invalid schema version %q in the backup manifest: %w", manifest.SchemaVersion, err)
+	}
+
+	if backupVersion.GreaterThan(semver.MustParse(portainer.APIVersion)) {
+		return fmt.Errorf("%w: %s is newer than %s", ErrBackupNewerVersion, manifest.SchemaVersion, portainer.APIVersion)
+	}
+
+	return nil
+}
+
+// checkBuckets compares the buckets found in a backup with the ones of its manifest
+func (manifest *Manifest) checkBuckets(found map[string]BucketManifest) error {
+	if manifest.Algorithm != backupChecksumAlgorithm {
+		return fmt.Errorf("unsupported backup checksum algorithm %q", manifest.Algorithm)
+	}
+
+	for bucket, expected := range manifest.Buckets {
+		actual, ok := found[bucket]
+		if !ok && expected.Rows > 0 {
+			return fmt.Errorf("%w: bucket %s is missing", ErrBackupCorrupted, bucket)
+		}
+
+		if ok && actual != expected {
+			return fmt.Errorf("%w: bucket %s does not match the manifest (expected %d rows with checksum %s, found %d rows with checksum %s)",
+				ErrBackupCorrupted, bucket, expected.Rows, expected.Checksum, actual.Rows, actual.Checksum)
+		}
+	}
+
+	for bucket := range found {
+		if _, ok := manifest.Buckets[bucket]; !ok {
+			return fmt.Errorf("%w: bucket %s is missing from the manifest", ErrBackupCorrupted, bucket)
+		}
+	}
+
+	return nil
+}
+
+// validate checks a backup against its manifest, the failures are only logged when force is set
+func (manifest *Manifest) validate(found map[string]BucketManifest, force bool) error {
+	err := manifest.checkVersion()
+	if err == nil {
+		err = manifest.checkBuckets(found)
+	}
+
+	if err != nil && force {
+		log.Warn().Str("component", "postgres").Err(err).Msg("restoring a backup that does not match its manifest")
+		return nil
+	}
+
+	return err
+}
+
+// checksum returns the hex encoded checksum of data
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// jsonBucketManifest describes a bucket of an export, the checksum covers the compact JSON
+// encoding of its value so that it does not depend on the indentation
+func jsonBucketManifest(value json.RawMessage) (BucketManifest, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, value); err != nil {
+		return BucketManifest{}, err
+	}
+
+	rows, err := decodeImportRows(value)
+	if err != nil {
+		return BucketManifest{}, err
+	}
+
+	return BucketManifest{Rows: len(rows), Checksum: checksum(compact.Bytes())}, nil
+}
+
+// addJSONManifest adds the manifest describing the buckets of an export to it
+func (connection *DbConnection) addJSONManifest(ctx context.Context, export map[string]any, buckets []string) error {
+	manifest, err := connection.newManifest(ctx, connection.DB, buckets)
+	if err != nil {
+		return err
+	}
+
+	for bucket, value := range export {
+		if bucket == metadataKey {
+			continue
+		}
+
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		if manifest.Buckets[bucket], err = jsonBucketManifest(b); err != nil {
+			return fmt.Errorf("failed to describe bucket %s: %w", bucket, err)
+		}
+	}
+
+	export[manifestKey] = manifest
+
+	return nil
+}
+
+// readJSONManifest returns the manifest of an export along with the description of its buckets
+func readJSONManifest(export map[string]json.RawMessage) (*Manifest, map[string]BucketManifest, error) {
+	raw, ok := export[manifestKey]
+	if !ok {
+		return nil, nil, ErrBackupNoManifest
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid manifest: %w", ErrBackupCorrupted, err)
+	}
+
+	found := make(map[string]BucketManifest, len(export))
+	for bucket, value := range export {
+		if bucket == manifestKey || bucket == metadataKey {
+			continue
+		}
+
+		description, err := jsonBucketManifest(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid bucket %s: %w", ErrBackupCorrupted, bucket, err)
+		}
+
+		found[bucket] = description
+	}
+
+	return &manifest, found, nil
+}
+
+// readStreamManifest returns the manifest of a backup written by BackupTo along with the
+// description of its buckets. The checksum of a bucket covers the lines of its rows.
+func readStreamManifest(data []byte) (*Manifest, map[string]BucketManifest, error) {
+	var manifest *Manifest
+
+	type bucketHash struct {
+		rows int
+		hash []byte
+	}
+
+	rows := make(map[string]*bucketHash)
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record backupRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, nil, fmt.Errorf("%w: invalid record: %w", ErrBackupCorrupted, err)
+			}
+
+			switch {
+			case record.Manifest != nil:
+				manifest = record.Manifest
+			case record.Table != "" && record.Columns == nil:
+				b, ok := rows[record.Table]
+				if !ok {
+					b = &bucketHash{}
+					rows[record.Table] = b
+				}
+
+				b.rows++
+				b.hash = append(b.hash, line...)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to read backup: %w", err)
+		}
+	}
+
+	if manifest == nil {
+		return nil, nil, ErrBackupNoManifest
+	}
+
+	found := make(map[string]BucketManifest, len(rows))
+	for bucket, b := range rows {
+		found[bucket] = BucketManifest{Rows: b.rows, Checksum: checksum(b.hash)}
+	}
+
+	return manifest, found, nil
+}
+
+// ValidateBackup checks a backup written by BackupTo, or an export written by ExportJSON or
+// ExportTables, before it is restored: its manifest must be present, the backup must not come
+// from a newer version of Portainer and its buckets must match the row counts and the checksums
+// of the manifest. The manifest is returned whenever it could be read.
+func (connection *DbConnection) ValidateBackup(r io.Reader) (Manifest, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	var manifest *Manifest
+	var found map[string]BucketManifest
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var first json.RawMessage
+	if err := dec.Decode(&first); err != nil {
+		return Manifest{}, fmt.Errorf("%w: %w", ErrBackupFormatUnknown, err)
+	}
+
+	if dec.More() {
+		// a backup stream has one record per line followed by the checksum footer
+		if err := connection.VerifyBackup(bytes.NewReader(data)); err != nil {
+			return Manifest{}, err
+		}
+
+		manifest, found, err = readStreamManifest(data)
+	} else {
+		var export map[string]json.RawMessage
+		if err := json.Unmarshal(first, &export); err != nil {
+			return Manifest{}, fmt.Errorf("%w: %w", ErrBackupFormatUnknown, err)
+		}
+
+		manifest, found, err = readJSONManifest(export)
+	}
+
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	return *manifest, manifest.validate(found, false)
+}
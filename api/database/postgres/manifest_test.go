@@ -0,0 +1,156 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBackupStream writes a backup stream holding rows in the settings bucket, described by
+// a manifest of the given schema version. The rows counted by the manifest can differ from rows.
+func newTestBackupStream(t *testing.T, version string, rows []string, manifestRows []string) []byte {
+	t.Helper()
+
+	describe := func(data []string) BucketManifest {
+		bw := newBackupWriter(&bytes.Buffer{})
+		for i, row := range data {
+			require.NoError(t, bw.write(backupRecord{Table: "settings", ID: string(rune('1' + i)), Data: json.RawMessage(row)}))
+		}
+
+		return BucketManifest{Rows: bw.rows, Checksum: bw.checksum()}
+	}
+
+	var buf bytes.Buffer
+	bw := newBackupWriter(&buf)
+	require.NoError(t, bw.write(backupRecord{Manifest: &Manifest{
+		SchemaVersion: version,
+		CreatedAt:     time.Now(),
+		Algorithm:     backupChecksumAlgorithm,
+		Buckets:       map[string]BucketManifest{"settings": describe(manifestRows)},
+	}}))
+	require.NoError(t, bw.write(backupRecord{Table: "settings", Columns: []string{"id integer", "data jsonb"}}))
+	for i, row := range rows {
+		require.NoError(t, bw.write(backupRecord{Table: "settings", ID: string(rune('1' + i)), Data: json.RawMessage(row)}))
+	}
+	require.NoError(t, bw.close())
+
+	return buf.Bytes()
+}
+
+// newTestExport returns an export of the settings bucket in the format of ExportJSON, described
+// by a manifest of the given schema version. The rows described by the manifest can differ from rows.
+func newTestExport(t *testing.T, version string, rows string, manifestRows string) []byte {
+	t.Helper()
+
+	description, err := jsonBucketManifest(json.RawMessage(manifestRows))
+	require.NoError(t, err)
+
+	export, err := json.MarshalIndent(map[string]any{
+		manifestKey: Manifest{
+			SchemaVersion: version,
+			CreatedAt:     time.Now(),
+			Algorithm:     backupChecksumAlgorithm,
+			Buckets:       map[string]BucketManifest{"settings": description},
+		},
+		"settings": json.RawMessage(rows),
+	}, "", "  ")
+	require.NoError(t, err)
+
+	return export
+}
+
+func Test_ValidateBackup(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	rows := []string{`{"Name":"first"}`, `{"Name":"second"}`}
+	exportRows := `[{"id":1,"data":{"Name":"first"}},{"id":2,"data":{"Name":"second"}}]`
+
+	t.Run("valid backup", func(t *testing.T) {
+		var backup bytes.Buffer
+		expectBackup(mock)
+		require.NoError(t, conn.BackupTo(&backup))
+		require.NoError(t, mock.ExpectationsWereMet())
+
+		manifest, err := conn.ValidateBackup(bytes.NewReader(backup.Bytes()))
+		require.NoError(t, err)
+		assert.Equal(t, backupChecksumAlgorithm, manifest.Algorithm)
+		assert.False(t, manifest.Encrypted)
+		assert.Empty(t, manifest.SchemaVersion)
+		assert.Equal(t, 2, manifest.Buckets["settings"].Rows)
+	})
+
+	t.Run("valid export", func(t *testing.T) {
+		manifest, err := conn.ValidateBackup(bytes.NewReader(newTestExport(t, "2.21.0", exportRows, exportRows)))
+		require.NoError(t, err)
+		assert.Equal(t, "2.21.0", manifest.SchemaVersion)
+		assert.Equal(t, 2, manifest.Buckets["settings"].Rows)
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		manifest, err := conn.ValidateBackup(bytes.NewReader(newTestBackupStream(t, "99.0.0", rows, rows)))
+		require.ErrorIs(t, err, ErrBackupNewerVersion)
+		assert.Equal(t, "99.0.0", manifest.SchemaVersion)
+
+		_, err = conn.ValidateBackup(bytes.NewReader(newTestExport(t, "99.0.0", exportRows, exportRows)))
+		require.ErrorIs(t, err, ErrBackupNewerVersion)
+	})
+
+	t.Run("corrupted bucket", func(t *testing.T) {
+		// the checksum footer matches, the bucket does not match the manifest
+		_, err := conn.ValidateBackup(bytes.NewReader(newTestBackupStream(t, "2.21.0", rows[:1], rows)))
+		require.ErrorIs(t, err, ErrBackupCorrupted)
+
+		_, err = conn.ValidateBackup(bytes.NewReader(newTestExport(t, "2.21.0", `[{"id":1,"data":{"Name":"changed"}}]`, exportRows)))
+		require.ErrorIs(t, err, ErrBackupCorrupted)
+	})
+
+	t.Run("missing manifest", func(t *testing.T) {
+		_, err := conn.ValidateBackup(bytes.NewReader([]byte(`{"settings":[]}`)))
+		require.ErrorIs(t, err, ErrBackupNoManifest)
+	})
+}
+
+func Test_ImportFromJSON_Manifest(t *testing.T) {
+	rows := `[{"id":1,"data":{"Name":"first"}}]`
+
+	t.Run("newer version refused before any change", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		err := conn.ImportFromJSON(context.Background(), bytes.NewReader(newTestExport(t, "99.0.0", rows, rows)), ImportOptions{})
+		require.ErrorIs(t, err, ErrBackupNewerVersion)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("corrupted bucket refused before any change", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		export := newTestExport(t, "2.21.0", `[{"id":1,"data":{"Name":"changed"}}]`, rows)
+		err := conn.ImportFromJSON(context.Background(), bytes.NewReader(export), ImportOptions{})
+		require.ErrorIs(t, err, ErrBackupCorrupted)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS settings")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTimestampColumns(mock, "settings")
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO settings (id, data, created_at, updated_at) VALUES ($1, $2")).
+			WithArgs("1", sqlmock.AnyArg(), nil, nil).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		err := conn.ImportFromJSON(context.Background(), bytes.NewReader(newTestExport(t, "99.0.0", rows, rows)), ImportOptions{Force: true})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
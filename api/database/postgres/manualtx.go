@@ -0,0 +1,124 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	portainer "github.com/portainer/portainer/api"
+)
+
+// ErrTransactionClosed is returned when a transaction is used after it was committed or rolled back
+var ErrTransactionClosed = errors.New("the transaction is already committed or rolled back")
+
+// CommitFn commits a transaction begun by BeginTransaction
+type CommitFn func() error
+
+// RollbackFn rolls back a transaction begun by BeginTransaction
+type RollbackFn func() error
+
+// manualTx is the state of a transaction begun by BeginTransaction
+type manualTx struct {
+	tx   *DbTransaction
+	end  func(err error)
+	done func()
+
+	mu         sync.Mutex
+	committed  bool
+	rolledBack bool
+}
+
+// BeginTransaction begins a transaction which is committed or rolled back by the caller, for
+// the code that cannot run its changes in the function of UpdateTx. The transaction is traced,
+// timed and subject to the timeouts like the ones of UpdateTx, but it cannot be retried: a
+// serialization failure is returned as ErrTransactionConflict for the caller to start over.
+// Either commit or rollback must be called, the transactions still open past the thresholds of
+// SetTransactionDurationThresholds are logged. Ending a transaction twice returns ErrTransactionClosed.
+func (connection *DbConnection) BeginTransaction(ctx context.Context, opts TxOptions) (portainer.Transaction, CommitFn, RollbackFn, error) {
+	setTx, err := opts.statement()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	done, err := connection.trackTx()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ctx, end := connection.startTx(ctx, "BeginTransaction", "")
+
+	db, release := connection.acquirePool()
+	tx, err := connection.beginTx(ctx, db, setTx)
+	if err != nil {
+		end(err)
+		release()
+		done()
+		return nil, nil, nil, err
+	}
+
+	tx.readOnly = opts.ReadOnly
+
+	m := &manualTx{
+		tx:  tx,
+		end: end,
+		done: func() {
+			release()
+			done()
+		},
+	}
+
+	return tx, m.commit, m.rollback, nil
+}
+
+// commit commits the transaction unless it was already ended
+func (m *manualTx) commit() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.closedError(); err != nil {
+		return err
+	}
+
+	m.committed = true
+	err := abortedError(m.tx.ctx, timeoutError(translateError(m.tx.commit())))
+	m.finish(err)
+
+	return err
+}
+
+// rollback rolls the transaction back unless it was already ended
+func (m *manualTx) rollback() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.closedError(); err != nil {
+		return err
+	}
+
+	m.rolledBack = true
+	m.tx.closed.Store(true)
+	err := abortedError(m.tx.ctx, translateError(m.tx.tx.Rollback()))
+	m.tx.release()
+	m.finish(err)
+
+	return err
+}
+
+// closedError tells how the transaction was ended, it is nil while the transaction is open
+func (m *manualTx) closedError() error {
+	switch {
+	case m.committed:
+		return fmt.Errorf("%w: it was committed", ErrTransactionClosed)
+	case m.rolledBack:
+		return fmt.Errorf("%w: it was rolled back", ErrTransactionClosed)
+	}
+
+	return nil
+}
+
+// finish ends the span of the transaction and lets Shutdown proceed
+func (m *manualTx) finish(err error) {
+	m.end(err)
+	m.done()
+}
@@ -0,0 +1,185 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BeginTransaction(t *testing.T) {
+	t.Run("commit", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		tx, commit, rollback, err := conn.BeginTransaction(context.Background(), TxOptions{})
+		require.NoError(t, err)
+		require.NoError(t, tx.DeleteObject("users", []byte("1")))
+		require.NoError(t, commit())
+
+		require.ErrorIs(t, commit(), ErrTransactionClosed)
+		require.ErrorIs(t, rollback(), ErrTransactionClosed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectRollback()
+
+		tx, commit, rollback, err := conn.BeginTransaction(context.Background(), TxOptions{Isolation: sql.LevelSerializable})
+		require.NoError(t, err)
+		require.NoError(t, tx.DeleteObject("users", []byte("1")))
+		require.NoError(t, rollback())
+
+		err = commit()
+		require.ErrorIs(t, err, ErrTransactionClosed)
+		assert.Contains(t, err.Error(), "rolled back")
+		require.ErrorIs(t, rollback(), ErrTransactionClosed)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION READ ONLY")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		tx, _, rollback, err := conn.BeginTransaction(context.Background(), TxOptions{ReadOnly: true})
+		require.NoError(t, err)
+		_, err = tx.(*DbTransaction).DeleteObjects("users", [][]byte{[]byte("1")})
+		require.ErrorIs(t, err, ErrTxReadOnly)
+		require.NoError(t, rollback())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("begin failure", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin().WillReturnError(io.ErrUnexpectedEOF)
+
+		_, _, _, err := conn.BeginTransaction(context.Background(), TxOptions{})
+		require.ErrorIs(t, err, errBeginTx)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_BeginTransaction_LeakedTransactionIsLogged(t *testing.T) {
+	type entry struct {
+		level zerolog.Level
+		msg   string
+	}
+
+	entries := make(chan entry, 10)
+	logger := log.Logger
+	log.Logger = zerolog.New(io.Discard).Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, msg string) {
+		if msg == "transaction still open" {
+			entries <- entry{level: level, msg: msg}
+		}
+	}))
+	t.Cleanup(func() {
+		log.Logger = logger
+	})
+
+	conn, mock := newMockConnection(t)
+	conn.SetTransactionDurationThresholds(10*time.Millisecond, 20*time.Millisecond)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	_, _, rollback, err := conn.BeginTransaction(context.Background(), TxOptions{})
+	require.NoError(t, err)
+
+	for _, level := range []zerolog.Level{zerolog.WarnLevel, zerolog.ErrorLevel} {
+		select {
+		case e := <-entries:
+			assert.Equal(t, level, e.level)
+			assert.Equal(t, "transaction still open", e.msg)
+		case <-time.After(time.Second):
+			t.Fatal("the leaked transaction was not logged")
+		}
+	}
+
+	require.NoError(t, rollback())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_RawTx(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version()")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("PostgreSQL 16.2"))
+	mock.ExpectCommit()
+
+	var leaked *DbTransaction
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		leaked = tx.(*DbTransaction)
+
+		raw, err := leaked.RawTx()
+		if err != nil {
+			return err
+		}
+
+		var version string
+		if err := raw.Get(&version, "SELECT version()"); err != nil {
+			return err
+		}
+		assert.Contains(t, version, "PostgreSQL")
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = leaked.RawTx()
+	require.ErrorIs(t, err, ErrTransactionClosed)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	tx, _, rollback, err := conn.BeginTransaction(context.Background(), TxOptions{})
+	require.NoError(t, err)
+	require.NoError(t, rollback())
+
+	_, err = tx.(*DbTransaction).RawTx()
+	require.ErrorIs(t, err, ErrTransactionClosed)
+}
+
+func Test_RawTx_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+
+	err := conn.ViewTx(func(tx portainer.Transaction) error {
+		raw, err := tx.(*DbTransaction).RawTx()
+		if err != nil {
+			return err
+		}
+
+		var version string
+		if err := raw.Get(&version, "SELECT version()"); err != nil {
+			return err
+		}
+		assert.NotEmpty(t, version)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
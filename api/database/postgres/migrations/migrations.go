@@ -0,0 +1,186 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// SchemaMigrationsTable records the migrations applied to the database, it is prefixed like
+	// the other tables of a connection, see Table
+	SchemaMigrationsTable = "schema_migrations"
+
+	// advisoryLockKey is the session-level advisory lock held while migrating,
+	// it prevents two instances starting at the same time from both migrating
+	advisoryLockKey int64 = 0x706f7274616d67 // "portamg"
+)
+
+// Table returns the name of the table recording the migrations of the tables starting with
+// prefix, the instances sharing a schema with different prefixes migrate their tables separately
+func Table(prefix string) string {
+	return prefix + SchemaMigrationsTable
+}
+
+// lockKey returns the advisory lock held while migrating the tables starting with prefix, the
+// unprefixed tables keep the historical key
+func lockKey(prefix string) int64 {
+	if prefix == "" {
+		return advisoryLockKey
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(prefix))
+
+	return advisoryLockKey ^ int64(h.Sum64())
+}
+
+// Migration is a numbered schema change applied exactly once to a database
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx portainer.Transaction) error
+}
+
+// TxFactory wraps a raw transaction into the portainer.Transaction handed to the migrations
+type TxFactory func(tx *sqlx.Tx) portainer.Transaction
+
+var (
+	mu       sync.Mutex
+	registry []Migration
+)
+
+// Register adds a migration to the registry. It panics when the version is not
+// strictly positive or is already registered, as this is a programming error.
+//
+// !IMPORTANT: never renumber or remove a released migration, only append new ones.
+func Register(version int, description string, up func(tx portainer.Transaction) error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if version <= 0 {
+		panic(fmt.Sprintf("invalid schema migration version %d", version))
+	}
+
+	for _, m := range registry {
+		if m.Version == version {
+			panic(fmt.Sprintf("schema migration %d is registered twice", version))
+		}
+	}
+
+	registry = append(registry, Migration{
+		Version:     version,
+		Description: description,
+		Up:          up,
+	})
+}
+
+// Registered returns the registered migrations ordered by version
+func Registered() []Migration {
+	mu.Lock()
+	defer mu.Unlock()
+
+	migrations := make([]Migration, len(registry))
+	copy(migrations, registry)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations
+}
+
+// RunMigrations applies the registered migrations that have not been applied yet to the tables
+// starting with prefix
+func RunMigrations(ctx context.Context, db *sqlx.DB, prefix string, newTx TxFactory) error {
+	return Run(ctx, db, prefix, newTx, Registered())
+}
+
+// Run applies the pending migrations of the list in version order. Each migration runs
+// in its own transaction together with the insertion of its version, so a failing
+// migration leaves no trace and stops the run. The applied migrations are recorded in the
+// table of the prefix, see Table.
+func Run(ctx context.Context, db *sqlx.DB, prefix string, newTx TxFactory, migrations []Migration) (err error) {
+	table := Table(prefix)
+	key := lockKey(prefix)
+
+	// The advisory lock belongs to the session, so every statement must use the same connection
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire a connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		return fmt.Errorf("failed to acquire the migration lock: %w", err)
+	}
+
+	defer func() {
+		if _, unlockErr := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); unlockErr != nil {
+			log.Error().Str("component", "postgres").Err(unlockErr).Msg("failed to release the migration lock")
+
+			if err == nil {
+				err = unlockErr
+			}
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, table))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", table, err)
+	}
+
+	var versions []int
+	if err := conn.SelectContext(ctx, &versions, "SELECT version FROM "+table); err != nil {
+		return fmt.Errorf("failed to read the applied migrations: %w", err)
+	}
+
+	applied := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		if err := apply(ctx, conn, table, newTx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// apply runs a single migration and records it within the same transaction
+func apply(ctx context.Context, conn *sqlx.Conn, table string, newTx TxFactory, m Migration) error {
+	log.Info().Str("component", "postgres").Int("version", m.Version).Str("description", m.Description).Msg("applying schema migration")
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for migration %d: %w", m.Version, err)
+	}
+	defer tx.Rollback()
+
+	if err := m.Up(newTx(tx)); err != nil {
+		return fmt.Errorf("schema migration %d (%s) failed: %w", m.Version, m.Description, err)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (version, description) VALUES ($1, $2)", table)
+	if _, err := tx.ExecContext(ctx, query, m.Version, m.Description); err != nil {
+		return fmt.Errorf("failed to record schema migration %d: %w", m.Version, err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,205 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nilTx is enough for migrations that only record their execution
+func nilTx(tx *sqlx.Tx) portainer.Transaction {
+	return nil
+}
+
+func newMockDB(t *testing.T) (*sqlx.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return sqlx.NewDb(db, "postgres"), mock
+}
+
+func expectPrologue(mock sqlmock.Sqlmock, applied ...int) {
+	rows := sqlmock.NewRows([]string{"version"})
+	for _, v := range applied {
+		rows.AddRow(v)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).
+		WithArgs(advisoryLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM schema_migrations")).
+		WillReturnRows(rows)
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+		WithArgs(advisoryLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func Test_Run_AppliesPendingMigrationsInOrder(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	var order []int
+	up := func(v int) func(portainer.Transaction) error {
+		return func(portainer.Transaction) error {
+			order = append(order, v)
+			return nil
+		}
+	}
+
+	expectPrologue(mock, 1)
+	for _, v := range []int{2, 3} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, description) VALUES ($1, $2)")).
+			WithArgs(v, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	expectUnlock(mock)
+
+	err := Run(context.Background(), db, "", nilTx, []Migration{
+		{Version: 1, Description: "already applied", Up: up(1)},
+		{Version: 2, Description: "second", Up: up(2)},
+		{Version: 3, Description: "third", Up: up(3)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, order)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Run_IsIdempotent(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	expectPrologue(mock, 1, 2)
+	expectUnlock(mock)
+
+	err := Run(context.Background(), db, "", nilTx, []Migration{
+		{Version: 1, Description: "first", Up: func(portainer.Transaction) error { t.Fatal("migration 1 ran twice"); return nil }},
+		{Version: 2, Description: "second", Up: func(portainer.Transaction) error { t.Fatal("migration 2 ran twice"); return nil }},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Run_FailingMigrationRollsBack(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	expectPrologue(mock)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	expectUnlock(mock)
+
+	errBoom := errors.New("boom")
+	err := Run(context.Background(), db, "", nilTx, []Migration{
+		{Version: 1, Description: "failing", Up: func(portainer.Transaction) error { return errBoom }},
+		{Version: 2, Description: "never applied", Up: func(portainer.Transaction) error { t.Fatal("migration 2 should not run"); return nil }},
+	})
+	assert.ErrorIs(t, err, errBoom)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Run_TablePrefixes(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// the unprefixed instance applied every migration, the prefixed one applies them all to its tables
+	migrated := map[string][]int{}
+	migrations := func(prefix string) []Migration {
+		up := func(v int) func(portainer.Transaction) error {
+			return func(portainer.Transaction) error {
+				migrated[prefix] = append(migrated[prefix], v)
+				return nil
+			}
+		}
+
+		return []Migration{
+			{Version: 1, Description: "first", Up: up(1)},
+			{Version: 2, Description: "second", Up: up(2)},
+		}
+	}
+
+	expectPrologue(mock, 1, 2)
+	expectUnlock(mock)
+	require.NoError(t, Run(context.Background(), db, "", nilTx, migrations("")))
+
+	key := lockKey("edge_")
+	assert.NotEqual(t, advisoryLockKey, key)
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WithArgs(key).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS edge_schema_migrations")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM edge_schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	for _, v := range []int{1, 2} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO edge_schema_migrations (version, description) VALUES ($1, $2)")).
+			WithArgs(v, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WithArgs(key).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	require.NoError(t, Run(context.Background(), db, "edge_", nilTx, migrations("edge_")))
+	assert.Equal(t, map[string][]int{"edge_": {1, 2}}, migrated)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Register(t *testing.T) {
+	assert.Panics(t, func() { Register(0, "invalid", nil) })
+
+	Register(99999, "registered once", func(portainer.Transaction) error { return nil })
+	assert.Panics(t, func() { Register(99999, "registered twice", nil) })
+
+	registered := Registered()
+	assert.Equal(t, 99999, registered[len(registered)-1].Version)
+}
+
+func Test_Run_RealDatabase(t *testing.T) {
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sqlx.Connect("postgres", connStr)
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("DROP TABLE IF EXISTS schema_migrations_probe")
+	require.NoError(t, err)
+	defer db.Exec("DROP TABLE IF EXISTS schema_migrations_probe")
+	defer db.Exec("DELETE FROM schema_migrations WHERE version >= 9000")
+
+	runs := 0
+	migrations := []Migration{
+		{Version: 9000, Description: "probe", Up: func(portainer.Transaction) error { runs++; return nil }},
+	}
+
+	require.NoError(t, Run(context.Background(), db, "", nilTx, migrations))
+	require.NoError(t, Run(context.Background(), db, "", nilTx, migrations))
+	assert.Equal(t, 1, runs)
+
+	failing := append(migrations, Migration{Version: 9001, Description: "failing", Up: func(portainer.Transaction) error {
+		return errors.New("boom")
+	}})
+	assert.Error(t, Run(context.Background(), db, "", nilTx, failing))
+
+	var count int
+	require.NoError(t, db.Get(&count, "SELECT COUNT(*) FROM schema_migrations WHERE version = 9001"))
+	assert.Zero(t, count)
+}
@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+)
+
+// MissingKeysError is returned by GetObjects when some of the keys have no object, the objects
+// of the other keys are collected nonetheless. It matches dserrors.ErrObjectNotFound.
+type MissingKeysError struct {
+	Bucket string
+	// Keys are the missing keys as they were given to GetObjects
+	Keys [][]byte
+}
+
+func (e *MissingKeysError) Error() string {
+	keys := make([]string, 0, len(e.Keys))
+	for _, key := range e.Keys {
+		keys = append(keys, changeKey(key))
+	}
+
+	return fmt.Sprintf("%s (bucket=%s, keys=%s)", dserrors.ErrObjectNotFound, e.Bucket, strings.Join(keys, ","))
+}
+
+func (e *MissingKeysError) Unwrap() error {
+	return dserrors.ErrObjectNotFound
+}
+
+// GetObjects reads the objects stored at keys in a single statement. Each object is decoded
+// into a new value returned by makeObj and passed to collect along with its key, the keys are
+// given in the encoding of GetObject. A *MissingKeysError lists the keys without an object.
+func (connection *DbConnection) GetObjects(bucketName string, keys [][]byte, makeObj func() any, collect func(key []byte, obj any) error) error {
+	return connection.tracedViewTx("GetObjects", bucketName, func(tx *DbTransaction) error {
+		return tx.GetObjects(bucketName, keys, makeObj, collect)
+	})
+}
+
+// GetObjects reads the objects stored at keys in a single statement, see DbConnection.GetObjects.
+// collect is called once per key found, the duplicate keys are read once.
+func (tx *DbTransaction) GetObjects(bucketName string, keys [][]byte, makeObj func() any, collect func(key []byte, obj any) error) (err error) {
+	ctx, end := tx.startSpan("GetObjects", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	// the type of the array is inferred from the id column, so that it matches integer and text ids
+	ids := make(pq.StringArray, 0, len(keys))
+	requested := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		id, err := tx.keyArg(bucketName, key)
+		if err != nil {
+			return err
+		}
+
+		idText := fmt.Sprint(id)
+		if _, ok := requested[idText]; !ok {
+			requested[idText] = key
+			ids = append(ids, idText)
+		}
+	}
+
+	var rows []struct {
+		ID   string `db:"id"`
+		Data []byte `db:"data"`
+	}
+
+	query := fmt.Sprintf("SELECT id::text AS id, data FROM %s WHERE id = ANY($1) ORDER BY id", tx.conn.table(bucketName))
+	if err := tx.tx.SelectContext(ctx, &rows, query, ids); err != nil {
+		return err
+	}
+
+	// the objects are decoded once the rows are read, collect may run statements of its own
+	found := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		key := requested[row.ID]
+		found[row.ID] = true
+
+		obj := makeObj()
+		if err := tx.unmarshal(bucketName, key, row.Data, obj); err != nil {
+			return err
+		}
+
+		if err := collect(key, obj); err != nil {
+			return err
+		}
+	}
+
+	if len(found) == len(ids) {
+		return nil
+	}
+
+	missing := &MissingKeysError{Bucket: bucketName}
+	for _, id := range ids {
+		if !found[id] {
+			missing.Keys = append(missing.Keys, requested[id])
+		}
+	}
+
+	return missing
+}
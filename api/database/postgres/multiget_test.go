@@ -0,0 +1,166 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type multiGetUser struct {
+	ID       int
+	Username string
+}
+
+// collectUsers returns the functions of GetObjects collecting the users by key
+func collectUsers(collected map[string]multiGetUser) (func() any, func(key []byte, obj any) error) {
+	return func() any {
+			return &multiGetUser{}
+		}, func(key []byte, obj any) error {
+			if _, ok := collected[string(key)]; ok {
+				return assert.AnError
+			}
+
+			collected[string(key)] = *obj.(*multiGetUser)
+
+			return nil
+		}
+}
+
+func Test_GetObjects(t *testing.T) {
+	const query = "SELECT id::text AS id, data FROM users WHERE id = ANY($1) ORDER BY id"
+
+	t.Run("integer keys", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(`{"1","2","9"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+				AddRow("1", []byte(`{"ID":1,"Username":"admin"}`)).
+				AddRow("2", []byte(`{"ID":2,"Username":"alice"}`)))
+		mock.ExpectRollback()
+
+		collected := map[string]multiGetUser{}
+		makeObj, collect := collectUsers(collected)
+
+		// the keys are given in both encodings, the duplicate key is read once
+		err := conn.GetObjects("users", [][]byte{conn.ConvertToKey(1), []byte("2"), conn.ConvertToKey(9), []byte("1")}, makeObj, collect)
+		require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+
+		var missing *MissingKeysError
+		require.ErrorAs(t, err, &missing)
+		assert.Equal(t, "users", missing.Bucket)
+		assert.Equal(t, [][]byte{conn.ConvertToKey(9)}, missing.Keys)
+
+		assert.Equal(t, map[string]multiGetUser{
+			string(conn.ConvertToKey(1)): {ID: 1, Username: "admin"},
+			"2":                          {ID: 2, Username: "alice"},
+		}, collected)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("string keys", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		conn.keyTypes.Store("users", KeyTypeText)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(`{"admin","bob"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+				AddRow("admin", []byte(`{"ID":1,"Username":"admin"}`)))
+		mock.ExpectRollback()
+
+		collected := map[string]multiGetUser{}
+		makeObj, collect := collectUsers(collected)
+
+		err := conn.GetObjects("users", [][]byte{[]byte("admin"), []byte("bob")}, makeObj, collect)
+
+		var missing *MissingKeysError
+		require.ErrorAs(t, err, &missing)
+		assert.Equal(t, [][]byte{[]byte("bob")}, missing.Keys)
+		assert.Equal(t, map[string]multiGetUser{"admin": {ID: 1, Username: "admin"}}, collected)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("encrypted store", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		conn.EncryptionKey = secretToEncryptionKey(passphrase)
+		conn.SetEncrypted(true)
+
+		data, err := conn.MarshalObject(multiGetUser{ID: 1, Username: "admin"})
+		require.NoError(t, err)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(`{"1"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", data))
+		mock.ExpectCommit()
+
+		collected := map[string]multiGetUser{}
+		makeObj, collect := collectUsers(collected)
+
+		require.NoError(t, conn.GetObjects("users", [][]byte{conn.ConvertToKey(1)}, makeObj, collect))
+		assert.Equal(t, map[string]multiGetUser{string(conn.ConvertToKey(1)): {ID: 1, Username: "admin"}}, collected)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("key type mismatch", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+
+		err := conn.GetObjects("users", [][]byte{[]byte("admin")}, func() any { return &multiGetUser{} }, func([]byte, any) error {
+			t.Fatal("no object is collected")
+			return nil
+		})
+		require.ErrorIs(t, err, ErrKeyTypeMismatch)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.ViewTx(func(tx portainer.Transaction) error {
+			return tx.(*DbTransaction).GetObjects("users", nil, nil, nil)
+		}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_GetObjects_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "multi_get_users", "multi_get_teams")
+
+	require.NoError(t, conn.SetServiceName("multi_get_users"))
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.(*DbTransaction).SetServiceNameWithKeyType("multi_get_teams", KeyTypeText)
+	}))
+
+	for id := 1; id <= 3; id++ {
+		require.NoError(t, conn.CreateObjectWithId("multi_get_users", id, multiGetUser{ID: id, Username: "user"}))
+	}
+	require.NoError(t, conn.CreateObjectWithStringId("multi_get_teams", []byte("team_a"), multiGetUser{ID: 10, Username: "team_a"}))
+
+	collected := map[string]multiGetUser{}
+	makeObj, collect := collectUsers(collected)
+
+	err := conn.GetObjects("multi_get_users", [][]byte{conn.ConvertToKey(1), []byte("3"), []byte("4")}, makeObj, collect)
+
+	var missing *MissingKeysError
+	require.ErrorAs(t, err, &missing)
+	assert.Equal(t, [][]byte{[]byte("4")}, missing.Keys)
+	assert.Len(t, collected, 2)
+	assert.Equal(t, 3, collected["3"].ID)
+
+	collected = map[string]multiGetUser{}
+	makeObj, collect = collectUsers(collected)
+
+	require.NoError(t, conn.GetObjects("multi_get_teams", [][]byte{[]byte("team_a")}, makeObj, collect))
+	assert.Equal(t, 10, collected["team_a"].ID)
+}
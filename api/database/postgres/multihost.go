@@ -0,0 +1,208 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+)
+
+// hostConnector opens the connections on the first host accepting them that matches the
+// target_session_attrs of the connection string. lib/pq supports neither several hosts
+// nor target_session_attrs, the connection string is split into one per host instead.
+type hostConnector struct {
+	hosts        []string
+	connectors   []driver.Connector
+	sessionAttrs string
+
+	// connectedHost is the host of the last connection opened
+	connectedHost atomic.Pointer[string]
+}
+
+// newHostConnector returns the connector of a URL or keyword/value connection string whose
+// host and port parameters may be comma-separated lists
+func newHostConnector(dsn string) (*hostConnector, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	params, err := parseKeywordDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	var hostList, portList string
+	c := &hostConnector{}
+	others := make([]dsnParam, 0, len(params))
+	for _, param := range params {
+		switch param.key {
+		case "host":
+			hostList = param.value
+		case "port":
+			portList = param.value
+		case "target_session_attrs":
+			c.sessionAttrs = param.value
+		default:
+			others = append(others, param)
+		}
+	}
+
+	if !targetSessionAttrs[c.sessionAttrs] {
+		return nil, fmt.Errorf("unsupported target_session_attrs %q", c.sessionAttrs)
+	}
+
+	hosts := strings.Split(hostList, ",")
+	ports := strings.Split(portList, ",")
+	if len(ports) != 1 && len(ports) != len(hosts) {
+		return nil, fmt.Errorf("could not match %d port numbers to %d hosts", len(ports), len(hosts))
+	}
+
+	for i, host := range hosts {
+		port := ports[0]
+		if len(ports) > 1 {
+			port = ports[i]
+		}
+
+		// the hosts of a URL carry their own port
+		if !strings.HasPrefix(host, "/") {
+			if h, p, err := net.SplitHostPort(host); err == nil {
+				host, port = h, p
+			}
+		}
+
+		hostParams := append([]dsnParam(nil), others...)
+		if host != "" {
+			hostParams = append(hostParams, dsnParam{key: "host", value: host})
+		}
+		if port != "" {
+			hostParams = append(hostParams, dsnParam{key: "port", value: port})
+		}
+
+		connector, err := pq.NewConnector(formatKeywordDSN(hostParams))
+		if err != nil {
+			return nil, err
+		}
+
+		if host == "" {
+			host = "localhost"
+		}
+
+		c.hosts = append(c.hosts, host)
+		c.connectors = append(c.connectors, connector)
+	}
+
+	return c, nil
+}
+
+func (c *hostConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var errs []error
+	for i, connector := range c.connectors {
+		conn, err := connector.Connect(ctx)
+		if err == nil {
+			if err = checkSessionAttrs(ctx, conn, c.sessionAttrs); err != nil {
+				conn.Close()
+			}
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.hosts[i], err))
+			if ctx.Err() != nil {
+				break
+			}
+
+			continue
+		}
+
+		c.connectedHost.Store(&c.hosts[i])
+
+		return conn, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// setDialer makes the connectors of every host open their connections with dialer
+func (c *hostConnector) setDialer(dialer pq.Dialer) {
+	for _, connector := range c.connectors {
+		if pqConnector, ok := connector.(*pq.Connector); ok {
+			pqConnector.Dialer(dialer)
+		}
+	}
+}
+
+func (c *hostConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// Host returns the host of the last connection opened, it is empty when none was opened
+func (c *hostConnector) Host() string {
+	if host := c.connectedHost.Load(); host != nil {
+		return *host
+	}
+
+	return ""
+}
+
+// checkSessionAttrs returns an error when the server of conn does not match the target_session_attrs
+func checkSessionAttrs(ctx context.Context, conn driver.Conn, attrs string) error {
+	var query, expected string
+	switch attrs {
+	case "", "any":
+		return nil
+	case "read-write":
+		query, expected = "SHOW transaction_read_only", "off"
+	case "read-only":
+		query, expected = "SHOW transaction_read_only", "on"
+	case "primary":
+		query, expected = "SELECT pg_is_in_recovery()::text", "false"
+	case "standby":
+		query, expected = "SELECT pg_is_in_recovery()::text", "true"
+	default:
+		return fmt.Errorf("unsupported target_session_attrs %q", attrs)
+	}
+
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return errors.New("the connection cannot check the target_session_attrs")
+	}
+
+	rows, err := queryer.QueryContext(ctx, query, nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("no result for %q", query)
+		}
+
+		return err
+	}
+
+	var value string
+	switch v := dest[0].(type) {
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		value = fmt.Sprint(v)
+	}
+
+	if value != expected {
+		return fmt.Errorf("the server does not match target_session_attrs=%s", attrs)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ChangesChannel is the channel on which the changes of the objects are notified
+	ChangesChannel = "portainer_changes"
+
+	changeEventsBuffer = 256
+
+	listenerMinReconnectInterval = time.Second
+	listenerMaxReconnectInterval = time.Minute
+)
+
+// ChangeEvent notifies that an object was created, updated or deleted. The events are best
+// effort: an event with an empty Bucket is sent when some of them may have been missed, the
+// subscriber must then assume that every object may have changed.
+type ChangeEvent struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// WithNotifyOnChange makes the transactions notify their changes on ChangesChannel
+// when they are committed, so that the other instances can invalidate their caches
+func WithNotifyOnChange() ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.notifyOnChange = true
+	}
+}
+
+// changeKey returns the key of an object as it appears in the change events
+func changeKey(key []byte) string {
+	if id, err := keyToID(key); err == nil {
+		return strconv.Itoa(id)
+	}
+
+	return string(key)
+}
+
+// recordChange records the change of an object, it is notified when the transaction is committed
+// and the object is removed from the cache
+func (tx *DbTransaction) recordChange(bucketName, key string) {
+	tx.invalidateCache(bucketName, key)
+
+	if !tx.conn.notifyOnChange {
+		return
+	}
+
+	event := ChangeEvent{Bucket: bucketName, Key: key}
+	for _, change := range tx.changes {
+		if change == event {
+			return
+		}
+	}
+
+	tx.changes = append(tx.changes, event)
+}
+
+// notifyChanges notifies the changes recorded by the transaction, PostgreSQL delivers
+// them once the transaction is committed
+func (tx *DbTransaction) notifyChanges() error {
+	for _, change := range tx.changes {
+		payload, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.tx.ExecContext(tx.context(), "SELECT pg_notify($1, $2)", ChangesChannel, string(payload)); err != nil {
+			return fmt.Errorf("failed to notify the change of %s/%s: %w", change.Bucket, change.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe returns the changes notified by every instance sharing the database, including
+// this one, until ctx is done. The notifications are received on a dedicated connection that
+// is reestablished automatically. The events are dropped when the channel is full.
+func (connection *DbConnection) Subscribe(ctx context.Context) (<-chan ChangeEvent, error) {
+	connected := make(chan error, 1)
+	var once sync.Once
+
+	listener := pq.NewListener(connection.ConnectionString, listenerMinReconnectInterval, listenerMaxReconnectInterval,
+		func(event pq.ListenerEventType, err error) {
+			switch event {
+			case pq.ListenerEventConnected:
+				once.Do(func() { connected <- nil })
+			case pq.ListenerEventConnectionAttemptFailed:
+				once.Do(func() { connected <- err })
+			case pq.ListenerEventDisconnected:
+				log.Warn().Str("component", "postgres").Err(err).Msg("the change notifications connection was lost")
+			}
+		})
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to connect the change notifications listener: %w", err)
+		}
+	case <-ctx.Done():
+		listener.Close()
+		return nil, ctx.Err()
+	}
+
+	if err := listener.Listen(ChangesChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen to %s: %w", ChangesChannel, err)
+	}
+
+	events := make(chan ChangeEvent, changeEventsBuffer)
+
+	go func() {
+		defer close(events)
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-listener.Notify:
+				// a nil notification follows a reconnection, the changes made meanwhile are lost
+				var event ChangeEvent
+				if notification != nil {
+					if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+						log.Warn().Str("component", "postgres").Err(err).Str("payload", notification.Extra).Msg("invalid change notification")
+						continue
+					}
+				}
+
+				select {
+				case events <- event:
+				default:
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NotifyOnChange(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithNotifyOnChange()(conn)
+
+	notify := regexp.QuoteMeta("SELECT pg_notify($1, $2)")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(notify).WithArgs(ChangesChannel, `{"bucket":"endpoints","key":"1"}`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(notify).WithArgs(ChangesChannel, `{"bucket":"endpoints","key":"2"}`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(notify).WithArgs(ChangesChannel, `{"bucket":"users","key":"3"}`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		// the changes of the same object are coalesced
+		for i := 0; i < 2; i++ {
+			if err := tx.UpdateObject("endpoints", []byte("1"), map[string]any{}); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.DeleteObject("endpoints", conn.ConvertToKey(2)); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithId("users", 3, map[string]any{})
+	})
+	require.NoError(t, err)
+
+	// nothing is notified when the transaction is rolled back
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	err = conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.UpdateObject("endpoints", []byte("1"), map[string]any{}); err != nil {
+			return err
+		}
+
+		return assert.AnError
+	})
+	require.ErrorIs(t, err, assert.AnError)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_NotifyOnChange_Disabled(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.DeleteObject("endpoints", []byte("1")))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Subscribe_RealDatabase(t *testing.T) {
+	writer := newTestConnection(t, WithNotifyOnChange())
+	reader := newTestConnection(t, WithInstanceLockMode(InstanceLockDisabled))
+	dropTestTables(t, writer, "notify_test")
+
+	require.NoError(t, writer.EnsureTableExists(context.Background(), "notify_test", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := reader.Subscribe(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.CreateObjectWithId("notify_test", 1, map[string]any{"Name": "local"}))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, ChangeEvent{Bucket: "notify_test", Key: "1"}, event)
+	case <-time.After(time.Second):
+		t.Fatal("no change event received")
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,168 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+)
+
+// ErrConcurrentModification is returned by UpdateObjectIfVersion when the object was modified
+// since its version was read
+var ErrConcurrentModification = errors.New("the object was modified concurrently")
+
+// versionColumn is the definition of the column counting the updates of the objects of a
+// bucket, the objects start at version 1
+const versionColumn = "version BIGINT NOT NULL DEFAULT 1"
+
+// bumpVersion is the assignment of the statements updating the data of an object, it also
+// records when the object was updated
+const bumpVersion = "version = version + 1, updated_at = now()"
+
+// addVersionColumn adds the version column to the tables of the buckets created before it
+func addVersionColumn(tx *DbTransaction) error {
+	ctx := tx.context()
+
+	buckets, err := tx.conn.listBuckets(ctx, tx.tx)
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range buckets {
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", tx.conn.table(bucket), versionColumn)
+		if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to add the version column to bucket %s: %w", bucket, err)
+		}
+	}
+
+	return nil
+}
+
+// GetObjectWithVersion unmarshals the object stored at key into object and returns its version,
+// to be given to UpdateObjectIfVersion or UpdateObjectWithVersion. The version is read from the
+// version column shared by every optimistic update, there is no separate _version column: the
+// objects start at version 1, not 0, and every update increments it.
+func (tx *DbTransaction) GetObjectWithVersion(bucketName string, key []byte, object any) (version int64, err error) {
+	ctx, end := tx.startSpan("GetObjectWithVersion", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf("SELECT data, version FROM %s WHERE id = $1", tx.conn.table(bucketName))
+
+	var jsonData []byte
+	err = tx.tx.QueryRowContext(ctx, query, id).Scan(&jsonData, &version)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%w (bucket=%s, key=%s)", dserrors.ErrObjectNotFound, bucketName, changeKey(key))
+	} else if err != nil {
+		return 0, err
+	}
+
+	return version, tx.unmarshal(bucketName, key, jsonData, object)
+}
+
+// UpdateObjectIfVersion replaces the object stored at key unless it was modified since
+// expectedVersion was read by GetObjectWithVersion, in which case ErrConcurrentModification is
+// returned. The version of the object is incremented, as it is by every update.
+func (tx *DbTransaction) UpdateObjectIfVersion(bucketName string, key []byte, object any, expectedVersion int64) (err error) {
+	ctx, end := tx.startSpan("UpdateObjectIfVersion", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	current, updated, err := tx.updateObjectIfVersion(ctx, bucketName, key, object, expectedVersion)
+	if err != nil || updated {
+		return err
+	}
+
+	return fmt.Errorf("%w (bucket=%s, key=%s): expected version %d, found version %d",
+		ErrConcurrentModification, bucketName, changeKey(key), expectedVersion, current)
+}
+
+// UpdateObjectWithVersion replaces the object stored at key unless it was modified since
+// expectedVersion was read by GetObjectWithVersion, in which case it returns false and no error.
+// The version of the object is incremented, as it is by every update.
+func (tx *DbTransaction) UpdateObjectWithVersion(bucketName string, key []byte, object any, expectedVersion int64) (updated bool, err error) {
+	ctx, end := tx.startSpan("UpdateObjectWithVersion", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	_, updated, err = tx.updateObjectIfVersion(ctx, bucketName, key, object, expectedVersion)
+
+	return updated, err
+}
+
+// updateObjectIfVersion replaces the object stored at key when it is at expectedVersion, it
+// returns the version found otherwise and ErrObjectNotFound when the object is missing
+func (tx *DbTransaction) updateObjectIfVersion(ctx context.Context, bucketName string, key []byte, object any, expectedVersion int64) (current int64, updated bool, err error) {
+	if tx.readOnly {
+		return 0, false, ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	data, err := tx.marshal(bucketName, key, object)
+	if err != nil {
+		return 0, false, err
+	}
+
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET data = $1, %s WHERE id = $2 AND version = $3", tx.conn.table(bucketName), bumpVersion)
+	result, err := tx.tx.ExecContext(ctx, query, data, id, expectedVersion)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return 0, false, err
+	} else if affected == 0 {
+		// the object is either missing or at another version
+		query := fmt.Sprintf("SELECT version FROM %s WHERE id = $1", tx.conn.table(bucketName))
+		if err := tx.tx.GetContext(ctx, &current, query, id); err == sql.ErrNoRows {
+			return 0, false, fmt.Errorf("%w (bucket=%s, key=%s)", dserrors.ErrObjectNotFound, bucketName, changeKey(key))
+		} else if err != nil {
+			return 0, false, err
+		}
+
+		return current, false, nil
+	}
+
+	tx.recordChange(bucketName, changeKey(key))
+
+	return expectedVersion + 1, true, tx.audit(ctx, bucketName, changeKey(key), AuditOperationUpdate)
+}
+
+// GetObjectWithVersion unmarshals the object stored at key into object and returns its version
+func (connection *DbConnection) GetObjectWithVersion(bucketName string, key []byte, object any) (version int64, err error) {
+	err = connection.tracedViewTx("GetObjectWithVersion", bucketName, func(tx *DbTransaction) error {
+		version, err = tx.GetObjectWithVersion(bucketName, key, object)
+		return err
+	})
+
+	return version, err
+}
+
+// UpdateObjectIfVersion replaces the object stored at key unless it was modified since
+// expectedVersion was read, see DbTransaction.UpdateObjectIfVersion
+func (connection *DbConnection) UpdateObjectIfVersion(bucketName string, key []byte, object any, expectedVersion int64) error {
+	return connection.tracedTx("UpdateObjectIfVersion", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.UpdateObjectIfVersion(bucketName, key, object, expectedVersion)
+	})
+}
+
+// UpdateObjectWithVersion replaces the object stored at key unless it was modified since
+// expectedVersion was read, see DbTransaction.UpdateObjectWithVersion
+func (connection *DbConnection) UpdateObjectWithVersion(bucketName string, key []byte, object any, expectedVersion int64) (updated bool, err error) {
+	err = connection.tracedTx("UpdateObjectWithVersion", bucketName, connection.txOptions, func(tx *DbTransaction) error {
+		updated, err = tx.UpdateObjectWithVersion(bucketName, key, object, expectedVersion)
+		return err
+	})
+
+	return updated, err
+}
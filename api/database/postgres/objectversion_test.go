@@ -0,0 +1,241 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UpdateObjectIfVersion(t *testing.T) {
+	updateQuery := regexp.QuoteMeta("UPDATE stacks SET data = $1, version = version + 1, updated_at = now() WHERE id = $2 AND version = $3")
+
+	t.Run("success", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(updateQuery).WithArgs([]byte(`{"Name":"web"}`), 1, int64(3)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.UpdateObjectIfVersion("stacks", conn.ConvertToKey(1), map[string]string{"Name": "web"}, 3))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(updateQuery).WithArgs([]byte(`{"Name":"web"}`), 1, int64(3)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM stacks WHERE id = $1")).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(4))
+		mock.ExpectRollback()
+
+		err := conn.UpdateObjectIfVersion("stacks", conn.ConvertToKey(1), map[string]string{"Name": "web"}, 3)
+		require.ErrorIs(t, err, ErrConcurrentModification)
+		assert.Contains(t, err.Error(), "expected version 3, found version 4")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(updateQuery).WithArgs([]byte(`{"Name":"web"}`), 1, int64(3)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM stacks WHERE id = $1")).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"version"}))
+		mock.ExpectRollback()
+
+		err := conn.UpdateObjectIfVersion("stacks", conn.ConvertToKey(1), map[string]string{"Name": "web"}, 3)
+		require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_UpdateObjectWithVersion(t *testing.T) {
+	updateQuery := regexp.QuoteMeta("UPDATE stacks SET data = $1, version = version + 1, updated_at = now() WHERE id = $2 AND version = $3")
+
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data, version FROM stacks WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data", "version"}).AddRow([]byte(`{"Name":"web"}`), 3))
+	mock.ExpectCommit()
+
+	var stack map[string]string
+	version, err := conn.GetObjectWithVersion("stacks", conn.ConvertToKey(1), &stack)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, version)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(updateQuery).WithArgs([]byte(`{"Name":"web"}`), 1, int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	updated, err := conn.UpdateObjectWithVersion("stacks", conn.ConvertToKey(1), stack, version)
+	require.NoError(t, err)
+	assert.True(t, updated)
+
+	// a stale version is not an error
+	mock.ExpectBegin()
+	mock.ExpectExec(updateQuery).WithArgs([]byte(`{"Name":"web"}`), 1, int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM stacks WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(4))
+	mock.ExpectCommit()
+
+	updated, err = conn.UpdateObjectWithVersion("stacks", conn.ConvertToKey(1), stack, version)
+	require.NoError(t, err)
+	assert.False(t, updated)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(updateQuery).WithArgs([]byte(`{"Name":"web"}`), 2, int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM stacks WHERE id = $1")).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectRollback()
+
+	_, err = conn.UpdateObjectWithVersion("stacks", conn.ConvertToKey(2), stack, version)
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_GetObjectWithVersion_EncryptedStore(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	data, err := conn.MarshalObjectForKey("stacks", []byte("1"), map[string]string{"Name": "web"})
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data, version FROM stacks WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data", "version"}).AddRow(data, 7))
+	mock.ExpectCommit()
+
+	written := &capturedArg{}
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE stacks SET data = $1, version = version + 1, updated_at = now() WHERE id = $2 AND version = $3")).
+		WithArgs(written, 1, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var stack map[string]string
+	version, err := conn.GetObjectWithVersion("stacks", conn.ConvertToKey(1), &stack)
+	require.NoError(t, err)
+	assert.EqualValues(t, 7, version)
+	assert.Equal(t, "web", stack["Name"])
+
+	stack["Name"] = "api"
+	require.NoError(t, conn.UpdateObjectIfVersion("stacks", conn.ConvertToKey(1), stack, version))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// the object is written in the envelope bound to its key
+	rewritten, ok := written.value.([]byte)
+	require.True(t, ok)
+	require.NoError(t, conn.UnmarshalObjectForKey("stacks", []byte("1"), rewritten, &stack))
+	assert.Equal(t, "api", stack["Name"])
+}
+
+func Test_ObjectVersion_RealDatabase(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		name := "unencrypted"
+		if encrypted {
+			name = "encrypted"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			conn := newTestConnection(t)
+			dropTestTables(t, conn, "version_test")
+
+			if encrypted {
+				conn.EncryptionKey = secretToEncryptionKey(passphrase)
+			}
+
+			type stack struct {
+				ID   int    `json:"Id"`
+				Name string `json:"Name"`
+			}
+
+			err := conn.UpdateTx(func(tx portainer.Transaction) error {
+				if err := tx.SetServiceName("version_test"); err != nil {
+					return err
+				}
+
+				return tx.CreateObjectWithId("version_test", 1, stack{ID: 1, Name: "web"})
+			})
+			require.NoError(t, err)
+
+			var first, second stack
+			firstVersion, err := conn.GetObjectWithVersion("version_test", conn.ConvertToKey(1), &first)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, firstVersion)
+
+			secondVersion, err := conn.GetObjectWithVersion("version_test", conn.ConvertToKey(1), &second)
+			require.NoError(t, err)
+
+			first.Name = "first"
+			require.NoError(t, conn.UpdateObjectIfVersion("version_test", conn.ConvertToKey(1), first, firstVersion))
+
+			second.Name = "second"
+			err = conn.UpdateObjectIfVersion("version_test", conn.ConvertToKey(1), second, secondVersion)
+			require.ErrorIs(t, err, ErrConcurrentModification)
+
+			// the regular updates increment the version as well
+			require.NoError(t, conn.UpdateObject("version_test", conn.ConvertToKey(1), stack{ID: 1, Name: "regular"}))
+
+			var got stack
+			version, err := conn.GetObjectWithVersion("version_test", conn.ConvertToKey(1), &got)
+			require.NoError(t, err)
+			assert.EqualValues(t, 3, version)
+			assert.Equal(t, "regular", got.Name)
+		})
+	}
+}
+
+func Test_UpdateObjectWithVersion_ConcurrentModifier_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "version_modifier_test")
+
+	require.NoError(t, conn.SetServiceName("version_modifier_test"))
+	require.NoError(t, conn.CreateObjectWithId("version_modifier_test", 1, map[string]string{"Name": "web"}))
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		pgTx := tx.(*DbTransaction)
+
+		var stack map[string]string
+		version, err := pgTx.GetObjectWithVersion("version_modifier_test", conn.ConvertToKey(1), &stack)
+		if err != nil {
+			return err
+		}
+
+		// another writer updates the object in a transaction of its own
+		if err := conn.UpdateObject("version_modifier_test", conn.ConvertToKey(1), map[string]string{"Name": "modifier"}); err != nil {
+			return err
+		}
+
+		stack["Name"] = "stale"
+		updated, err := pgTx.UpdateObjectWithVersion("version_modifier_test", conn.ConvertToKey(1), stack, version)
+		require.NoError(t, err)
+		assert.False(t, updated)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var stack map[string]string
+	version, err := conn.GetObjectWithVersion("version_modifier_test", conn.ConvertToKey(1), &stack)
+	require.NoError(t, err)
+	assert.Equal(t, "modifier", stack["Name"])
+
+	stack["Name"] = "fresh"
+	updated, err := conn.UpdateObjectWithVersion("version_modifier_test", conn.ConvertToKey(1), stack, version)
+	require.NoError(t, err)
+	assert.True(t, updated)
+}
@@ -0,0 +1,181 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// InstanceLockTable holds the instance lock when the advisory locks cannot be used
+const InstanceLockTable = "instance_lock"
+
+// instanceLockStaleAfter is the time after which the instance lock held in InstanceLockTable is
+// considered abandoned, its holder renews it every third of that time
+const instanceLockStaleAfter = 30 * time.Second
+
+// instanceLockPollInterval is the interval between the attempts to take the instance lock held
+// by another instance in InstanceLockTable
+const instanceLockPollInterval = time.Second
+
+// WithPgBouncerMode makes the connection usable through pgBouncer in transaction pooling mode,
+// where the server connection changes from one transaction to the next:
+//   - the timeouts and the search_path are set for each transaction with SET LOCAL rather than
+//     for the session as runtime parameters, which pgBouncer rejects
+//   - the parameters of the queries are sent along with them, without a prepared statement, and
+//     the statements of the hot CRUD paths are not cached, see WithStatementCache
+//   - the instance lock is held in InstanceLockTable rather than by a session advisory lock
+//
+// The statements run outside of a transaction, such as EnsureTableExists, use the search_path of
+// the role, and Subscribe needs a direct connection to the server.
+func WithPgBouncerMode(enabled bool) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.pgBouncerMode = enabled
+	}
+}
+
+// pgBouncerConnectionString returns dsn without prepared statements
+func pgBouncerConnectionString(dsn string) string {
+	return withRuntimeParameters(dsn, map[string]string{"binary_parameters": "yes"})
+}
+
+// transactionSettings returns the SET LOCAL statements applying the session settings of the
+// connection to a transaction, it is empty unless the connection is in pgBouncer mode
+func (connection *DbConnection) transactionSettings() string {
+	if !connection.pgBouncerMode {
+		return ""
+	}
+
+	statements := []string{
+		fmt.Sprintf("SET LOCAL statement_timeout = %d", connection.statementTimeout.Milliseconds()),
+		fmt.Sprintf("SET LOCAL lock_timeout = %d", connection.lockTimeout.Milliseconds()),
+	}
+
+	if connection.schema != "" {
+		statements = append(statements, "SET LOCAL search_path = "+connection.schema)
+	}
+
+	return strings.Join(statements, "; ")
+}
+
+// tableLock is the instance lock held in InstanceLockTable
+type tableLock struct {
+	db     *sqlx.DB
+	holder string
+	stop   context.CancelFunc
+}
+
+// lockInstanceTable takes the instance lock in InstanceLockTable, the lock of a holder which
+// stopped renewing it is taken over. It is renewed in the background until it is released.
+func (connection *DbConnection) lockInstanceTable(ctx context.Context, db *sqlx.DB, wait bool) (bool, error) {
+	table := connection.table(InstanceLockTable)
+
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, holder TEXT NOT NULL, renewed_at TIMESTAMPTZ NOT NULL)", table)
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", table, err)
+	}
+
+	holder, err := newLockHolder()
+	if err != nil {
+		return false, err
+	}
+
+	lockQuery := fmt.Sprintf(`
+		INSERT INTO %[1]s (id, holder, renewed_at) VALUES (1, $1, now())
+		ON CONFLICT (id) DO UPDATE SET holder = EXCLUDED.holder, renewed_at = now()
+		WHERE %[1]s.renewed_at < now() - make_interval(secs => $2)
+		RETURNING holder
+	`, table)
+
+	for logged := false; ; logged = true {
+		rows, err := db.QueryContext(ctx, lockQuery, holder, instanceLockStaleAfter.Seconds())
+		if err != nil {
+			return false, fmt.Errorf("failed to acquire the instance lock: %w", err)
+		}
+
+		locked := rows.Next()
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return false, fmt.Errorf("failed to acquire the instance lock: %w", err)
+		}
+
+		if locked {
+			break
+		}
+
+		if !wait {
+			return false, nil
+		}
+
+		if !logged {
+			log.Info().Str("component", "postgres").Msg("the database is in use by another Portainer instance, waiting for it to stop")
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, fmt.Errorf("failed to acquire the instance lock: %w", ctx.Err())
+		case <-time.After(instanceLockPollInterval):
+		}
+	}
+
+	renewCtx, stop := context.WithCancel(context.Background())
+	go connection.renewInstanceLock(renewCtx, db, holder)
+
+	connection.instanceTableLock = &tableLock{db: db, holder: holder, stop: stop}
+
+	return true, nil
+}
+
+// renewInstanceLock keeps the instance lock held in InstanceLockTable until ctx is done
+func (connection *DbConnection) renewInstanceLock(ctx context.Context, db *sqlx.DB, holder string) {
+	ticker := time.NewTicker(instanceLockStaleAfter / 3)
+	defer ticker.Stop()
+
+	query := fmt.Sprintf("UPDATE %s SET renewed_at = now() WHERE id = 1 AND holder = $1", connection.table(InstanceLockTable))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := db.ExecContext(ctx, query, holder)
+			if err == nil {
+				var renewed int64
+				if renewed, err = result.RowsAffected(); err == nil && renewed == 0 {
+					log.Error().Str("component", "postgres").Msg("the instance lock was taken over by another Portainer instance")
+					return
+				}
+			}
+
+			if err != nil && ctx.Err() == nil {
+				log.Warn().Str("component", "postgres").Err(err).Msg("failed to renew the instance lock")
+			}
+		}
+	}
+}
+
+// releaseInstanceTable releases the instance lock held in InstanceLockTable
+func (connection *DbConnection) releaseInstanceTable(lock *tableLock) error {
+	lock.stop()
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = 1 AND holder = $1", connection.table(InstanceLockTable))
+	_, err := lock.db.ExecContext(context.Background(), query, lock.holder)
+
+	return err
+}
+
+// newLockHolder returns a random identifier of the holder of the instance lock
+func newLockHolder() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate the instance lock holder: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,142 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PgBouncerConnectionString(t *testing.T) {
+	assert.Equal(t,
+		"postgres://user@localhost/portainer?binary_parameters=yes&sslmode=disable",
+		pgBouncerConnectionString("postgres://user@localhost/portainer?sslmode=disable"),
+	)
+	assert.Equal(t,
+		"host=localhost dbname=portainer binary_parameters=yes",
+		pgBouncerConnectionString("host=localhost dbname=portainer"),
+	)
+}
+
+func Test_PgBouncerMode_TransactionSettings(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.statementTimeout = 5 * time.Second
+	conn.lockTimeout = time.Second
+	conn.schema = "portainer"
+
+	assert.Empty(t, conn.transactionSettings())
+
+	WithPgBouncerMode(true)(conn)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET LOCAL statement_timeout = 5000; SET LOCAL lock_timeout = 1000; SET LOCAL search_path = portainer")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM bucket WHERE id = $1")).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.DeleteObject("bucket", []byte("1"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PgBouncerMode_InstanceLock(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithPgBouncerMode(true)(conn)
+	ctx := context.Background()
+
+	expectLock := func(locked bool) {
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS instance_lock")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		rows := sqlmock.NewRows([]string{"holder"})
+		if locked {
+			rows.AddRow("holder")
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO instance_lock")).
+			WithArgs(sqlmock.AnyArg(), instanceLockStaleAfter.Seconds()).
+			WillReturnRows(rows)
+	}
+
+	expectLock(false)
+
+	locked, err := conn.TryAcquireInstanceLock(ctx)
+	require.NoError(t, err)
+	assert.False(t, locked)
+
+	expectLock(true)
+
+	locked, err = conn.TryAcquireInstanceLock(ctx)
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	// the lock is already held by this connection
+	locked, err = conn.TryAcquireInstanceLock(ctx)
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM instance_lock WHERE id = 1 AND holder = $1")).
+		WithArgs(conn.instanceTableLock.holder).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.NoError(t, conn.ReleaseInstanceLock())
+	require.NoError(t, conn.ReleaseInstanceLock())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PgBouncerMode_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t, WithPgBouncerMode(true), WithStatementTimeout(7*time.Second))
+	dropTestTables(t, conn, "pgbouncer_test")
+
+	// without idle connections, every transaction runs on a new session as it would behind
+	// pgBouncer in transaction pooling mode
+	conn.DB.SetMaxIdleConns(0)
+
+	for range 2 {
+		err := conn.UpdateTx(func(tx portainer.Transaction) error {
+			return tx.SetServiceName("pgbouncer_test")
+		})
+		require.NoError(t, err)
+	}
+
+	type object struct {
+		ID   int    `json:"Id"`
+		Name string `json:"Name"`
+	}
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.CreateObjectWithId("pgbouncer_test", 1, object{ID: 1, Name: "first"})
+	})
+	require.NoError(t, err)
+
+	err = conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.UpdateObject("pgbouncer_test", conn.ConvertToKey(1), object{ID: 1, Name: "updated"})
+	})
+	require.NoError(t, err)
+
+	var got object
+	require.NoError(t, conn.GetObject("pgbouncer_test", conn.ConvertToKey(1), &got))
+	assert.Equal(t, "updated", got.Name)
+
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		var timeout string
+		if err := tx.(*DbTransaction).tx.Get(&timeout, "SHOW statement_timeout"); err != nil {
+			return err
+		}
+		assert.Equal(t, "7s", timeout)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, conn.DeleteObject("pgbouncer_test", conn.ConvertToKey(1)))
+	err = conn.GetObject("pgbouncer_test", conn.ConvertToKey(1), &got)
+	assert.Error(t, err)
+}
@@ -0,0 +1,58 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// WithMaxOpenConns sets the maximum number of open connections of the pool, 0 means unlimited
+func WithMaxOpenConns(n int) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.maxOpenConns = n
+	}
+}
+
+// WithMaxIdleConns sets the maximum number of idle connections kept by the pool
+func WithMaxIdleConns(n int) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.maxIdleConns = n
+	}
+}
+
+// configurePool applies the pool settings of the connection to db
+func (connection *DbConnection) configurePool(db *sqlx.DB) {
+	db.SetMaxOpenConns(connection.maxOpenConns)
+	db.SetMaxIdleConns(connection.maxIdleConns)
+	db.SetConnMaxLifetime(DatabaseTimeout)
+}
+
+// Stats returns the statistics of the connection pool, they are empty when the
+// connection is not open
+func (connection *DbConnection) Stats() sql.DBStats {
+	if connection.DB == nil {
+		return sql.DBStats{}
+	}
+
+	return connection.DB.Stats()
+}
+
+// MaxOpenConns returns the maximum number of open connections of the pool
+func (connection *DbConnection) MaxOpenConns() int {
+	return connection.maxOpenConns
+}
+
+// MaxIdleConns returns the maximum number of idle connections kept by the pool
+func (connection *DbConnection) MaxIdleConns() int {
+	return connection.maxIdleConns
+}
+
+// SQLDB returns the underlying *sql.DB, for instance to register a
+// collectors.NewDBStatsCollector. It is nil when the connection is not open.
+func (connection *DbConnection) SQLDB() *sql.DB {
+	if connection.DB == nil {
+		return nil
+	}
+
+	return connection.DB.DB
+}
@@ -0,0 +1,54 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Stats(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithMaxOpenConns(5)(conn)
+	WithMaxIdleConns(2)(conn)
+	conn.configurePool(conn.DB)
+
+	assert.Equal(t, 5, conn.MaxOpenConns())
+	assert.Equal(t, 2, conn.MaxIdleConns())
+	assert.Equal(t, 5, conn.Stats().MaxOpenConnections)
+
+	// sqlmock opens a connection to ping the database
+	stats := conn.Stats()
+	assert.Equal(t, 1, stats.OpenConnections)
+	assert.Equal(t, 0, stats.InUse)
+
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectQuery("SELECT 2").WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(2))
+
+	first, err := conn.Queryx("SELECT 1")
+	require.NoError(t, err)
+	second, err := conn.Queryx("SELECT 2")
+	require.NoError(t, err)
+
+	stats = conn.Stats()
+	assert.Equal(t, 2, stats.OpenConnections)
+	assert.Equal(t, 2, stats.InUse)
+
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	stats = conn.Stats()
+	assert.Equal(t, 2, stats.OpenConnections)
+	assert.Equal(t, 2, stats.Idle)
+
+	assert.Same(t, conn.DB.DB, conn.SQLDB())
+}
+
+func Test_Stats_NotOpen(t *testing.T) {
+	conn := &DbConnection{}
+
+	assert.Zero(t, conn.Stats())
+	assert.Nil(t, conn.SQLDB())
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+)
+
+// SQLSTATE codes translated into the dataservices errors
+const (
+	sqlStateUniqueViolation   = "23505"
+	sqlStateUndefinedTable    = "42P01"
+	sqlStateDuplicateTable    = "42P07"
+	sqlStateAdminShutdown     = "57P01"
+	sqlStateCrashShutdown     = "57P02"
+	sqlStateCannotConnectNow  = "57P03"
+	sqlClassConnectionFailure = "08"
+)
+
+// isUniqueViolation returns true when err is caused by the insertion of a key that already exists
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == sqlStateUniqueViolation
+}
+
+// isDuplicateTable returns true when err is caused by the creation of a relation that already exists
+func isDuplicateTable(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == sqlStateDuplicateTable
+}
+
+// isLockNotAvailable returns true when err is caused by a lock taken with NOWAIT while it is held
+func isLockNotAvailable(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == sqlStateLockNotAvailable
+}
+
+// translateError wraps the PostgreSQL errors into the dataservices error they correspond to, so
+// that the callers can check them without knowing the driver. The original error is kept in the
+// chain for the logs.
+func translateError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	for _, sentinel := range []error{
+		dserrors.ErrObjectNotFound,
+		dserrors.ErrAlreadyExists,
+		dserrors.ErrTransactionConflict,
+		dserrors.ErrDatabaseUnavailable,
+	} {
+		if errors.Is(err, sentinel) {
+			return err
+		}
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == sqlStateUniqueViolation:
+			return fmt.Errorf("%w: %w", dserrors.ErrAlreadyExists, err)
+		case pqErr.Code == sqlStateUndefinedTable:
+			return fmt.Errorf("%w: %w", dserrors.ErrObjectNotFound, err)
+		case pqErr.Code == sqlStateSerializationFailure, pqErr.Code == sqlStateDeadlockDetected:
+			return fmt.Errorf("%w: %w", dserrors.ErrTransactionConflict, err)
+		case pqErr.Code.Class() == sqlClassConnectionFailure,
+			pqErr.Code == sqlStateAdminShutdown,
+			pqErr.Code == sqlStateCrashShutdown,
+			pqErr.Code == sqlStateCannotConnectNow:
+			return fmt.Errorf("%w: %w", dserrors.ErrDatabaseUnavailable, err)
+		}
+
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %w", dserrors.ErrDatabaseUnavailable, err)
+	}
+
+	return err
+}
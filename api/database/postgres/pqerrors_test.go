@@ -0,0 +1,139 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/portainer/portainer/api/dataservices"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_translateError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"unique violation", &pq.Error{Code: "23505"}, dserrors.ErrAlreadyExists},
+		{"undefined table", &pq.Error{Code: "42P01"}, dserrors.ErrObjectNotFound},
+		{"serialization failure", &pq.Error{Code: "40001"}, dserrors.ErrTransactionConflict},
+		{"deadlock", &pq.Error{Code: "40P01"}, dserrors.ErrTransactionConflict},
+		{"connection failure", &pq.Error{Code: "08006"}, dserrors.ErrDatabaseUnavailable},
+		{"cannot connect now", &pq.Error{Code: "57P03"}, dserrors.ErrDatabaseUnavailable},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, dserrors.ErrDatabaseUnavailable},
+		{"wrapped", fmt.Errorf("failed: %w", &pq.Error{Code: "23505"}), dserrors.ErrAlreadyExists},
+		{"bad connection", driver.ErrBadConn, dserrors.ErrDatabaseUnavailable},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, dserrors.ErrDatabaseUnavailable},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := translateError(tc.err)
+			assert.ErrorIs(t, err, tc.expected)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func Test_translateError_Unchanged(t *testing.T) {
+	for _, err := range []error{
+		nil,
+		errors.New("unexpected"),
+		&pq.Error{Code: "22P02"},
+		context.DeadlineExceeded,
+		fmt.Errorf("%w (bucket=endpoints, key=1)", dserrors.ErrObjectNotFound),
+	} {
+		assert.Equal(t, err, translateError(err))
+	}
+}
+
+func Test_DbTransaction_TranslatesErrors(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (id, data) VALUES ($1, $2)")).
+		WillReturnError(&pq.Error{Code: "23505", Message: `duplicate key value violates unique constraint "users_pkey"`})
+	mock.ExpectRollback()
+
+	err := conn.CreateObjectWithId("users", 1, map[string]any{"Username": "admin"})
+	require.True(t, dataservices.IsErrAlreadyExists(err))
+
+	var pqErr *pq.Error
+	require.ErrorAs(t, err, &pqErr)
+	assert.Equal(t, sqlStateUniqueViolation, string(pqErr.Code))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_CreateObject_AlreadyExists(t *testing.T) {
+	duplicate := &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}
+	insert := regexp.QuoteMeta("INSERT INTO %s (id, data) VALUES ($1, $2)")
+
+	t.Run("duplicate int key", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(fmt.Sprintf(insert, "webhooks")).WithArgs(3, []byte(`{"Id":3}`)).WillReturnError(duplicate)
+		mock.ExpectRollback()
+
+		err := conn.CreateObjectWithId("webhooks", 3, map[string]int{"Id": 3})
+		require.ErrorIs(t, err, dserrors.ErrAlreadyExists)
+		require.ErrorIs(t, err, duplicate)
+		assert.Contains(t, err.Error(), "(bucket=webhooks, key=3)")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("duplicate string key", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+		conn.keyTypes.Store("resource_control", KeyTypeText)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(fmt.Sprintf(insert, "resource_control")).WithArgs("stack_1", []byte(`{}`)).WillReturnError(duplicate)
+		mock.ExpectRollback()
+
+		err := conn.UpdateTx(func(tx portainer.Transaction) error {
+			return tx.CreateObjectWithStringId("resource_control", []byte("stack_1"), map[string]any{})
+		})
+		require.ErrorIs(t, err, dserrors.ErrAlreadyExists)
+		assert.Contains(t, err.Error(), "(bucket=resource_control, key=stack_1)")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("duplicate sequence value", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectNextIdentifier(mock, "webhooks").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+		mock.ExpectExec(fmt.Sprintf(insert, "webhooks")).WithArgs(4, []byte(`{"Id":4}`)).WillReturnError(duplicate)
+		mock.ExpectRollback()
+
+		err := conn.CreateObject("webhooks", func(id uint64) (int, any) {
+			return int(id), map[string]int{"Id": int(id)}
+		})
+		require.ErrorIs(t, err, dserrors.ErrAlreadyExists)
+		assert.Contains(t, err.Error(), "(bucket=webhooks, key=4)")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("new key", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(fmt.Sprintf(insert, "webhooks")).WithArgs(5, []byte(`{"Id":5}`)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		require.NoError(t, conn.CreateObjectWithId("webhooks", 5, map[string]int{"Id": 5}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// WithReadOnlyRole makes ViewTx, GetObject and GetAll connect to the primary as user, a role
+// that should only be granted SELECT on the tables, through a second connection pool. The
+// writes use the role of the connection string. The read replica is still preferred when one
+// is configured, and the reads fall back to the primary role when the pool of user cannot be
+// opened or its connections fail.
+func WithReadOnlyRole(user, password string) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.readerUser = user
+		connection.readerPassword = password
+	}
+}
+
+// openReaderPool opens the pool of the read-only role, the reads use the primary role when it
+// cannot be opened
+func (connection *DbConnection) openReaderPool() {
+	dsn, err := withDSNCredentials(connection.ConnectionString, connection.readerUser, connection.readerPassword)
+	if err != nil {
+		log.Warn().Str("component", "postgres").Err(err).Msg("failed to open the pool of the read-only role, reading with the primary role")
+		return
+	}
+
+	reader, _, err := connection.openPool(dsn)
+	if err == nil {
+		if err = reader.PingContext(connection.ctx); err != nil {
+			reader.Close()
+		}
+	}
+
+	if err != nil {
+		log.Warn().Str("component", "postgres").Err(err).Str("user", connection.readerUser).
+			Msg("failed to open the pool of the read-only role, reading with the primary role")
+		return
+	}
+
+	connection.reader = reader
+}
+
+// readPool returns the pool of the read-only transactions and its name for the logs, it is nil
+// when they use the primary
+func (connection *DbConnection) readPool() (*sqlx.DB, string) {
+	if connection.replica != nil && !connection.replicaDegraded.Load() {
+		return connection.replica, "read replica"
+	}
+
+	if connection.reader != nil {
+		return connection.reader, "read-only role"
+	}
+
+	return nil, ""
+}
+
+// withDSNCredentials replaces the user and the password of a URL or keyword/value connection string
+func withDSNCredentials(dsn, user, password string) (string, error) {
+	if user == "" {
+		return "", errors.New("the user is empty")
+	}
+
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", errors.New("the connection URL cannot be parsed")
+		}
+
+		u.User = url.UserPassword(user, password)
+
+		// the parameters take precedence over the user information of the URL
+		query := u.Query()
+		query.Del("user")
+		query.Del("password")
+		u.RawQuery = query.Encode()
+
+		return u.String(), nil
+	}
+
+	dsn, err := withDSNParameter(dsn, "user", user)
+	if err != nil {
+		return "", err
+	}
+
+	return withDSNParameter(dsn, "password", password)
+}
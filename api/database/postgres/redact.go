@@ -0,0 +1,162 @@
+package postgres
+
+import (
+	"strings"
+)
+
+const (
+	// RedactedFieldValue replaces the value of the fields redacted from an export, see
+	// ExportOptions.RedactedFields
+	RedactedFieldValue = "[REDACTED]"
+
+	// RedactedSecretValue replaces the value of the credentials redacted from an export, see
+	// ExportOptions.RedactSecrets
+	RedactedSecretValue = "<redacted>"
+)
+
+// DefaultRedactedFields lists the names of the fields holding credentials in the objects of
+// Portainer, see ExportOptions.RedactedFields
+var DefaultRedactedFields = []string{
+	"password",
+	"token",
+	"secret",
+	"privateKey",
+	"apiKey",
+	"accessToken",
+	"refreshToken",
+	"clientSecret",
+}
+
+// DefaultSecretPaths lists the paths of the credentials held by the objects of Portainer, see
+// ExportOptions.RedactSecrets. The first name of a path is the table of the object.
+var DefaultSecretPaths = []string{
+	"settings.LDAPSettings.Password",
+	"settings.OAuthSettings.ClientSecret",
+	"settings.openAMTConfiguration.mpsPassword",
+	"settings.openAMTConfiguration.certFilePassword",
+	"registries.Password",
+	"registries.AccessToken",
+	"registries.ManagementConfiguration.Password",
+	"registries.ManagementConfiguration.AccessToken",
+	"endpoints.AzureCredentials.AuthenticationKey",
+	"stacks.GitConfig.Authentication.Password",
+	"customtemplates.GitConfig.Authentication.Password",
+	"dockerhub.Password",
+	"tunnel_server.PrivateKeySeed",
+}
+
+// fieldRedactor replaces the value of the fields of the exported objects matching its paths.
+// A path is a list of field names separated by dots. A single name matches the fields of that
+// name at any depth, a dotted path matches from the root of the object only, the arrays being
+// traversed. The names are compared case-insensitively, so that password matches the Password
+// field of a Portainer object.
+type fieldRedactor struct {
+	names map[string]bool
+	paths [][]string
+
+	// tablePaths are the paths redacted from the objects of a table only, by table
+	tablePaths map[string][][]string
+}
+
+func newFieldRedactor(fields []string) *fieldRedactor {
+	r := &fieldRedactor{names: make(map[string]bool)}
+	for _, field := range fields {
+		path := strings.Split(strings.ToLower(field), ".")
+		if len(path) == 1 {
+			r.names[path[0]] = true
+		} else {
+			r.paths = append(r.paths, path)
+		}
+	}
+
+	return r
+}
+
+// withTablePaths adds paths whose first name is the table of the objects they are redacted
+// from, the paths naming a field only are ignored
+func (r *fieldRedactor) withTablePaths(paths []string) *fieldRedactor {
+	if r.tablePaths == nil {
+		r.tablePaths = make(map[string][][]string)
+	}
+
+	for _, path := range paths {
+		table, field, ok := strings.Cut(path, ".")
+		if ok && field != "" {
+			table = strings.ToLower(table)
+			r.tablePaths[table] = append(r.tablePaths[table], strings.Split(strings.ToLower(field), "."))
+		}
+	}
+
+	return r
+}
+
+// redactRows redacts the data of the rows of a table returned by exportTable
+func (r *fieldRedactor) redactRows(table string, rows []any) {
+	tablePaths := r.tablePaths[strings.ToLower(table)]
+	if len(r.names) == 0 && len(r.paths) == 0 && len(tablePaths) == 0 {
+		return
+	}
+
+	for _, row := range rows {
+		if row, ok := row.(map[string]any); ok {
+			data := r.redact(row["data"])
+			for _, path := range tablePaths {
+				redactPath(data, path, RedactedSecretValue)
+			}
+
+			row["data"] = data
+		}
+	}
+}
+
+// redact returns value with the matching fields redacted, the maps are modified in place
+func (r *fieldRedactor) redact(value any) any {
+	value = r.redactNames(value)
+	for _, path := range r.paths {
+		redactPath(value, path, RedactedFieldValue)
+	}
+
+	return value
+}
+
+// redactNames redacts the fields whose name is one of the single names of the redactor
+func (r *fieldRedactor) redactNames(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if r.names[strings.ToLower(key)] {
+				v[key] = RedactedFieldValue
+			} else {
+				v[key] = r.redactNames(field)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = r.redactNames(item)
+		}
+	}
+
+	return value
+}
+
+// redactPath replaces the value of the fields found at path in value with placeholder
+func redactPath(value any, path []string, placeholder string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if !strings.EqualFold(key, path[0]) {
+				continue
+			}
+
+			if len(path) == 1 {
+				v[key] = placeholder
+			} else {
+				redactPath(field, path[1:], placeholder)
+			}
+		}
+	case []any:
+		for _, item := range v {
+			redactPath(item, path, placeholder)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package postgres
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fieldRedactor(t *testing.T) {
+	object := func() any {
+		var v any
+		err := json.Unmarshal([]byte(`{
+			"Username": "admin",
+			"Password": "secret",
+			"AzureCredentials": {"ApplicationID": "app", "AuthenticationKey": "key"},
+			"Registries": [{"Name": "hub", "Password": "hub-secret"}],
+			"TLSConfig": {"TLSKeyPath": "/certs/key.pem"}
+		}`), &v)
+		require.NoError(t, err)
+
+		return v
+	}
+
+	r := newFieldRedactor(DefaultRedactedFields)
+	assert.Equal(t, map[string]any{
+		"Username":         "admin",
+		"Password":         RedactedFieldValue,
+		"AzureCredentials": map[string]any{"ApplicationID": "app", "AuthenticationKey": "key"},
+		"Registries":       []any{map[string]any{"Name": "hub", "Password": RedactedFieldValue}},
+		"TLSConfig":        map[string]any{"TLSKeyPath": "/certs/key.pem"},
+	}, r.redact(object()))
+
+	// a dotted path matches from the root only
+	r = newFieldRedactor([]string{"AzureCredentials.AuthenticationKey", "registries.password", "TLSKeyPath.Missing"})
+	assert.Equal(t, map[string]any{
+		"Username":         "admin",
+		"Password":         "secret",
+		"AzureCredentials": map[string]any{"ApplicationID": "app", "AuthenticationKey": RedactedFieldValue},
+		"Registries":       []any{map[string]any{"Name": "hub", "Password": RedactedFieldValue}},
+		"TLSConfig":        map[string]any{"TLSKeyPath": "/certs/key.pem"},
+	}, r.redact(object()))
+
+	// the scalar objects are left as is
+	assert.Equal(t, "2.21.0", newFieldRedactor(DefaultRedactedFields).redact("2.21.0"))
+}
+
+func Test_ExportJSONWithOptions_RedactedFields(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	expectManagedTables(mock, "settings")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM settings")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+			AddRow(1, []byte(`{"LogoURL":"https://example.com/logo.png","OAuthSettings":{"ClientID":"portainer","ClientSecret":"oauth-secret"},"Password":"admin-password"}`)))
+
+	data, err := conn.ExportJSONWithOptions(ExportOptions{RedactedFields: DefaultRedactedFields})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.NotContains(t, string(data), "admin-password")
+	assert.NotContains(t, string(data), "oauth-secret")
+	assert.Contains(t, string(data), `"[REDACTED]"`)
+
+	var export struct {
+		Settings struct {
+			Data map[string]any `json:"data"`
+		} `json:"settings"`
+	}
+	require.NoError(t, json.Unmarshal(data, &export))
+	assert.Equal(t, map[string]any{
+		"LogoURL":       "https://example.com/logo.png",
+		"OAuthSettings": map[string]any{"ClientID": "portainer", "ClientSecret": "[REDACTED]"},
+		"Password":      "[REDACTED]",
+	}, export.Settings.Data)
+}
+
+func Test_fieldRedactor_TablePaths(t *testing.T) {
+	rows := func(objects ...string) []any {
+		var rows []any
+		for i, object := range objects {
+			var data any
+			require.NoError(t, json.Unmarshal([]byte(object), &data))
+			rows = append(rows, map[string]any{"id": i + 1, "data": data})
+		}
+
+		return rows
+	}
+
+	r := newFieldRedactor(nil).withTablePaths(DefaultSecretPaths).withTablePaths([]string{"Settings.Webhooks.Token", "users"})
+
+	// every registry is redacted
+	registries := rows(
+		`{"Name":"hub","Username":"admin","Password":"hub-secret","ManagementConfiguration":{"Username":"admin","Password":"mgmt-secret"}}`,
+		`{"Name":"quay","Username":"robot","Password":"quay-secret","ManagementConfiguration":null}`,
+	)
+	r.redactRows("registries", registries)
+	assert.Equal(t, rows(
+		`{"Name":"hub","Username":"admin","Password":"<redacted>","ManagementConfiguration":{"Username":"admin","Password":"<redacted>"}}`,
+		`{"Name":"quay","Username":"robot","Password":"<redacted>","ManagementConfiguration":null}`,
+	), registries)
+
+	// the nested secrets and the ones of the arrays are redacted, the other fields are untouched
+	settings := rows(`{
+		"LDAPSettings": {"ReaderDN": "cn=reader", "Password": "ldap-secret", "URLs": ["ldap://ldap"]},
+		"OAuthSettings": {"ClientID": "portainer", "ClientSecret": "oauth-secret"},
+		"Webhooks": [{"URL": "https://example.com", "Token": "first"}, {"URL": "https://example.org", "Token": "second"}],
+		"Password": "not-a-known-secret"
+	}`)
+	r.redactRows("settings", settings)
+	assert.Equal(t, rows(`{
+		"LDAPSettings": {"ReaderDN": "cn=reader", "Password": "<redacted>", "URLs": ["ldap://ldap"]},
+		"OAuthSettings": {"ClientID": "portainer", "ClientSecret": "<redacted>"},
+		"Webhooks": [{"URL": "https://example.com", "Token": "<redacted>"}, {"URL": "https://example.org", "Token": "<redacted>"}],
+		"Password": "not-a-known-secret"
+	}`), settings)
+
+	// the paths of the other tables do not apply
+	users := rows(`{"Username":"admin","Password":"hash"}`)
+	r.redactRows("users", users)
+	assert.Equal(t, rows(`{"Username":"admin","Password":"hash"}`), users)
+}
+
+func Test_ExportJSONWithOptions_RedactSecrets(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	expectManagedTables(mock, "settings", "tunnel_server")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM settings")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+			AddRow(1, []byte(`{"LogoURL":"https://example.com/logo.png","LDAPSettings":{"ReaderDN":"cn=reader","Password":"ldap-secret"},"Webhooks":[{"Token":"webhook-secret"}]}`)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM tunnel_server")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow(1, []byte(`{"PrivateKeySeed":"seed"}`)))
+
+	data, err := conn.ExportJSONWithOptions(ExportOptions{RedactSecrets: true, SecretPaths: []string{"settings.Webhooks.Token"}})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.NotContains(t, string(data), "ldap-secret")
+	assert.NotContains(t, string(data), "webhook-secret")
+	assert.NotContains(t, string(data), `"seed"`)
+	assert.NotContains(t, string(data), RedactedFieldValue)
+
+	var export struct {
+		Settings struct {
+			Data map[string]any `json:"data"`
+		} `json:"settings"`
+		TunnelServer struct {
+			Data map[string]any `json:"data"`
+		} `json:"tunnel_server"`
+	}
+	require.NoError(t, json.Unmarshal(data, &export))
+	assert.Equal(t, map[string]any{
+		"LogoURL":      "https://example.com/logo.png",
+		"LDAPSettings": map[string]any{"ReaderDN": "cn=reader", "Password": "<redacted>"},
+		"Webhooks":     []any{map[string]any{"Token": "<redacted>"}},
+	}, export.Settings.Data)
+	assert.Equal(t, map[string]any{"PrivateKeySeed": "<redacted>"}, export.TunnelServer.Data)
+}
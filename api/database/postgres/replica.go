@@ -0,0 +1,149 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errBeginTx is returned when a transaction cannot be started, for instance because the
+// database is unreachable
+var errBeginTx = errors.New("failed to begin transaction")
+
+// Default settings of the health checks of the read replica
+const (
+	DefaultReplicaMaxLag              = 30 * time.Second
+	DefaultReplicaHealthCheckInterval = 10 * time.Second
+)
+
+// ReplicaConfig describes the read replica of a connection
+type ReplicaConfig struct {
+	ConnectionString string
+
+	// MaxLag is the replication lag past which the reads go to the primary, it defaults to
+	// DefaultReplicaMaxLag
+	MaxLag time.Duration
+
+	// HealthCheckInterval is the interval between the checks of the lag and the availability
+	// of the replica, it defaults to DefaultReplicaHealthCheckInterval
+	HealthCheckInterval time.Duration
+}
+
+// WithReadReplica routes ViewTx, GetObject and GetAll to the read replica of cfg, the writes and
+// GetNextIdentifier always use the primary. The replica is checked in the background: the reads
+// go to the primary while it is unreachable or lags behind the primary by more than cfg.MaxLag.
+func WithReadReplica(cfg ReplicaConfig) ConnectionOption {
+	if cfg.MaxLag <= 0 {
+		cfg.MaxLag = DefaultReplicaMaxLag
+	}
+
+	if cfg.HealthCheckInterval <= 0 {
+		cfg.HealthCheckInterval = DefaultReplicaHealthCheckInterval
+	}
+
+	return func(connection *DbConnection) {
+		connection.replicaConfig = cfg
+	}
+}
+
+// WithReadReplicaDSN routes the reads to the read replica at dsn, see WithReadReplica
+func WithReadReplicaDSN(dsn string) ConnectionOption {
+	return WithReadReplica(ReplicaConfig{ConnectionString: dsn})
+}
+
+// openReadReplica opens the pool of the read replica and starts checking its health, the
+// reads use the primary when it cannot be opened
+func (connection *DbConnection) openReadReplica() {
+	dsn := connection.replicaConfig.ConnectionString
+
+	replica, _, err := connection.openPool(dsn)
+	if err != nil {
+		log.Warn().Str("component", "postgres").Err(err).Str("connection", redactDSN(dsn)).Msg("failed to open the read replica, reading from the primary")
+		return
+	}
+
+	connection.replica = replica
+	connection.checkReplica(connection.ctx)
+
+	go connection.watchReplica(connection.ctx)
+}
+
+// watchReplica checks the health of the read replica until ctx is done
+func (connection *DbConnection) watchReplica(ctx context.Context) {
+	ticker := time.NewTicker(connection.replicaConfig.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			connection.checkReplica(ctx)
+		}
+	}
+}
+
+// checkReplica measures the replication lag of the read replica, the reads go to the primary
+// while the replica is unreachable or lagging. The lag is 0 when the replica has replayed all
+// the WAL it received, so that an idle primary does not make the replica look late.
+func (connection *DbConnection) checkReplica(ctx context.Context) {
+	var lag float64
+	err := connection.replica.GetContext(ctx, &lag, `
+		SELECT CASE
+			WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END
+	`)
+	if ctx.Err() != nil {
+		// the connection is closing
+		return
+	}
+
+	maxLag := connection.replicaConfig.MaxLag
+	healthy := err == nil && time.Duration(lag*float64(time.Second)) <= maxLag
+
+	if wasDegraded := connection.replicaDegraded.Swap(!healthy); wasDegraded == !healthy {
+		return
+	}
+
+	if healthy {
+		log.Info().Str("component", "postgres").Msg("the read replica is back, reading from it")
+		return
+	}
+
+	event := log.Warn().Str("component", "postgres")
+	if err != nil {
+		event = event.Err(err)
+	} else {
+		event = event.Float64("lag_seconds", lag).Dur("max_lag", maxLag)
+	}
+
+	event.Msg("the read replica is unreachable or lagging, reading from the primary")
+}
+
+// viewTx runs fn inside a new transaction on the read replica, or with the read-only role, or
+// on the primary when there are neither or they are unreachable
+func (connection *DbConnection) viewTx(ctx context.Context, fn func(*DbTransaction) error) error {
+	fn = readOnlyTx(fn)
+
+	db, name := connection.readPool()
+	if db == nil {
+		return connection.updateTxWithOptions(ctx, connection.txOptions, fn)
+	}
+
+	setTx, err := connection.txOptions.statement()
+	if err != nil {
+		return err
+	}
+
+	err = connection.runTx(ctx, db, setTx, fn)
+	if !errors.Is(err, errBeginTx) {
+		return timeoutError(err)
+	}
+
+	ctxLogger(ctx).Warn().Str("component", "postgres").Err(err).Msgf("the %s is unreachable, falling back to the primary", name)
+
+	return connection.updateTxWithOptions(ctx, connection.txOptions, fn)
+}
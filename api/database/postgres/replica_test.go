@@ -0,0 +1,153 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReplicaMockConnection returns a mock connection with a mock read replica
+func newReplicaMockConnection(t *testing.T) (*DbConnection, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, primary := newMockConnection(t)
+
+	db, replica, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	conn.replica = sqlx.NewDb(db, DatabaseDriverName)
+
+	return conn, primary, replica
+}
+
+func Test_ReadReplica(t *testing.T) {
+	conn, primary, replica := newReplicaMockConnection(t)
+
+	replica.ExpectBegin()
+	replica.ExpectQuery("SELECT data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"replica"}`)))
+	replica.ExpectCommit()
+	replica.ExpectBegin()
+	replica.ExpectQuery("SELECT id, data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", []byte(`{"Name":"replica"}`)))
+	replica.ExpectCommit()
+	replica.ExpectBegin()
+	replica.ExpectQuery("SELECT id, data FROM users").WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	replica.ExpectCommit()
+
+	primary.ExpectBegin()
+	primary.ExpectExec("UPDATE endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	primary.ExpectCommit()
+	primary.ExpectBegin()
+	expectNextIdentifier(primary, "endpoints").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	primary.ExpectCommit()
+
+	var endpoint map[string]any
+	require.NoError(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+	assert.Equal(t, "replica", endpoint["Name"])
+
+	require.NoError(t, conn.GetAll("endpoints", &endpoint, func(o any) (any, error) { return o, nil }))
+
+	err := conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetAll("users", &endpoint, func(o any) (any, error) { return o, nil })
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, conn.UpdateObject("endpoints", []byte("1"), endpoint))
+	nextID, err := conn.GetNextIdentifierErr("endpoints")
+	require.NoError(t, err)
+	assert.Equal(t, 2, nextID)
+
+	require.NoError(t, replica.ExpectationsWereMet())
+	require.NoError(t, primary.ExpectationsWereMet())
+}
+
+func Test_ReadReplica_FallsBackToPrimary(t *testing.T) {
+	conn, primary, replica := newReplicaMockConnection(t)
+
+	replica.ExpectBegin().WillReturnError(errors.New("connection refused"))
+
+	primary.ExpectBegin()
+	primary.ExpectQuery("SELECT data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"primary"}`)))
+	primary.ExpectCommit()
+
+	var endpoint map[string]any
+	require.NoError(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+	assert.Equal(t, "primary", endpoint["Name"])
+
+	// the errors of the transaction itself are returned as is
+	failure := errors.New("unexpected")
+	replica.ExpectBegin()
+	replica.ExpectRollback()
+
+	err := conn.ViewTx(func(tx portainer.Transaction) error {
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+
+	require.NoError(t, replica.ExpectationsWereMet())
+	require.NoError(t, primary.ExpectationsWereMet())
+}
+
+func Test_WithReadReplica(t *testing.T) {
+	conn := &DbConnection{}
+	WithReadReplicaDSN("host=replica")(conn)
+	assert.Equal(t, ReplicaConfig{
+		ConnectionString:    "host=replica",
+		MaxLag:              DefaultReplicaMaxLag,
+		HealthCheckInterval: DefaultReplicaHealthCheckInterval,
+	}, conn.replicaConfig)
+
+	WithReadReplica(ReplicaConfig{ConnectionString: "host=replica", MaxLag: time.Second, HealthCheckInterval: time.Minute})(conn)
+	assert.Equal(t, time.Second, conn.replicaConfig.MaxLag)
+	assert.Equal(t, time.Minute, conn.replicaConfig.HealthCheckInterval)
+}
+
+func Test_ReadReplica_HealthCheck(t *testing.T) {
+	conn, primary, replica := newReplicaMockConnection(t)
+	WithReadReplica(ReplicaConfig{MaxLag: 10 * time.Second})(conn)
+
+	const lagQuery = "SELECT CASE"
+	expectLag := func(seconds float64) {
+		replica.ExpectQuery(lagQuery).WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(seconds))
+	}
+
+	readFrom := func(mock sqlmock.Sqlmock, name string) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"` + name + `"}`)))
+		mock.ExpectCommit()
+
+		var endpoint map[string]any
+		require.NoError(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+		assert.Equal(t, name, endpoint["Name"])
+	}
+
+	expectLag(2)
+	conn.checkReplica(context.Background())
+	readFrom(replica, "replica")
+
+	// lagging
+	expectLag(60)
+	conn.checkReplica(context.Background())
+	readFrom(primary, "primary")
+
+	expectLag(0)
+	conn.checkReplica(context.Background())
+	readFrom(replica, "replica")
+
+	// disconnected
+	replica.ExpectQuery(lagQuery).WillReturnError(errors.New("connection refused"))
+	conn.checkReplica(context.Background())
+	readFrom(primary, "primary")
+
+	require.NoError(t, replica.ExpectationsWereMet())
+	require.NoError(t, primary.ExpectationsWereMet())
+}
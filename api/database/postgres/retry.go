@@ -0,0 +1,55 @@
+package postgres
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// DefaultMaxTxRetries is the number of times a transaction aborted by a
+	// serialization failure or a deadlock is retried
+	DefaultMaxTxRetries = 3
+
+	txRetryBaseDelay = 10 * time.Millisecond
+)
+
+// SQLSTATE codes of the transient failures that are resolved by running the transaction again
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+)
+
+// WithMaxTxRetries sets the number of times UpdateTx retries a transaction aborted by a
+// serialization failure or a deadlock, 0 disables the retries
+func WithMaxTxRetries(retries int) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.maxTxRetries = retries
+	}
+}
+
+// TxRetries returns the number of transactions retried since the connection was created
+func (connection *DbConnection) TxRetries() uint64 {
+	return connection.txRetries.Load()
+}
+
+// isRetryableTxError returns true when the transaction failed because of a
+// serialization failure or a deadlock
+func isRetryableTxError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	return pqErr.Code == sqlStateSerializationFailure || pqErr.Code == sqlStateDeadlockDetected
+}
+
+// txRetryBackoff returns the delay before the given retry, it grows exponentially
+// and is jittered so that the conflicting transactions do not collide again
+func txRetryBackoff(retry int) time.Duration {
+	delay := txRetryBaseDelay << retry
+
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,142 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UpdateTx_RetriesSerializationFailures(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.maxTxRetries = DefaultMaxTxRetries
+
+	query := regexp.QuoteMeta("UPDATE settings SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WillReturnError(&pq.Error{Code: sqlStateSerializationFailure})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit().WillReturnError(&pq.Error{Code: sqlStateDeadlockDetected})
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	calls := 0
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		calls++
+		return tx.UpdateObject("settings", []byte("1"), map[string]any{"LogoURL": ""})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, uint64(2), conn.TxRetries())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateTx_GivesUpAfterMaxRetries(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.maxTxRetries = 2
+
+	failure := &pq.Error{Code: sqlStateSerializationFailure}
+	for i := 0; i < 3; i++ {
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+	}
+
+	calls := 0
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		calls++
+		return fmt.Errorf("failed to update: %w", failure)
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, uint64(2), conn.TxRetries())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateTx_DoesNotRetryOtherErrors(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.maxTxRetries = DefaultMaxTxRetries
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	failure := errors.New("unexpected")
+	calls := 0
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		calls++
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 1, calls)
+	assert.Zero(t, conn.TxRetries())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_txRetryBackoff(t *testing.T) {
+	for retry := 0; retry < 4; retry++ {
+		delay := txRetryBackoff(retry)
+		assert.GreaterOrEqual(t, delay, (txRetryBaseDelay<<retry)/2)
+		assert.LessOrEqual(t, delay, txRetryBaseDelay<<retry)
+	}
+}
+
+func Test_UpdateTx_RetriesDeadlocks(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "retry_test")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "retry_test", nil))
+	require.NoError(t, conn.CreateObjectWithId("retry_test", 1, map[string]any{"Value": 0}))
+	require.NoError(t, conn.CreateObjectWithId("retry_test", 2, map[string]any{"Value": 0}))
+
+	// Both transactions lock their first row before updating the row locked by the other one
+	var ready sync.WaitGroup
+	ready.Add(2)
+
+	var calls atomic.Int32
+	update := func(first, second string) func(portainer.Transaction) error {
+		var once sync.Once
+
+		return func(tx portainer.Transaction) error {
+			calls.Add(1)
+
+			if err := tx.UpdateObject("retry_test", []byte(first), map[string]any{"Value": first}); err != nil {
+				return err
+			}
+
+			once.Do(func() {
+				ready.Done()
+				ready.Wait()
+			})
+
+			return tx.UpdateObject("retry_test", []byte(second), map[string]any{"Value": first})
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- conn.UpdateTx(update("1", "2")) }()
+	go func() { errs <- conn.UpdateTx(update("2", "1")) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+		case <-time.After(30 * time.Second):
+			t.Fatal("the transactions did not complete")
+		}
+	}
+
+	assert.Equal(t, int32(3), calls.Load())
+	assert.Equal(t, uint64(1), conn.TxRetries())
+}
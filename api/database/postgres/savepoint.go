@@ -0,0 +1,68 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	portainer "github.com/portainer/portainer/api"
+)
+
+// txContextKey is the key of the transaction carried by the contexts of its calls
+type txContextKey struct{}
+
+// TxFromContext returns the transaction carried by ctx, it is set in the context passed to the
+// function of UpdateTxCtx
+func TxFromContext(ctx context.Context) (*DbTransaction, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+
+	tx, ok := ctx.Value(txContextKey{}).(*DbTransaction)
+
+	return tx, ok
+}
+
+// UpdateTxCtx is UpdateTx on behalf of ctx, fn receives a context carrying the transaction.
+// An UpdateTxCtx call made with that context, or with one derived from it, does not start a new
+// transaction: its function runs within a savepoint of the current one. When the nested function
+// fails, only its changes are rolled back and its error is returned to the outer function, which
+// either handles it and goes on or returns it to roll back the whole transaction. The options
+// and the retries are those of the outermost call.
+func (connection *DbConnection) UpdateTxCtx(ctx context.Context, fn func(ctx context.Context, tx portainer.Transaction) error) error {
+	return connection.tracedTxCtx(ctx, "UpdateTxCtx", "", connection.txOptions, func(tx *DbTransaction) error {
+		return fn(tx.ctx, tx)
+	})
+}
+
+// withSavepoint runs fn within a new savepoint of the transaction, which is released when fn
+// succeeds and rolled back to when it fails, without aborting the transaction
+func (tx *DbTransaction) withSavepoint(operation, table string, fn func(*DbTransaction) error) (err error) {
+	ctx, end := tx.startSpan(operation, table)
+	defer func() { end(err) }()
+
+	tx.savepoints++
+	name := fmt.Sprintf("sp_%d", tx.savepoints)
+
+	if _, err := tx.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return translateError(err)
+	}
+
+	// a nested read must not make the rest of the transaction read-only, and the changes
+	// rolled back are not notified
+	readOnly, changes := tx.readOnly, len(tx.changes)
+	defer func() { tx.readOnly = readOnly }()
+
+	if err := fn(tx); err != nil {
+		if _, rbErr := tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+			ctxLogger(ctx).Error().Str("component", "postgres").Err(rbErr).Str("savepoint", name).Msg("failed to rollback to savepoint")
+		}
+
+		tx.changes = tx.changes[:changes]
+
+		return err
+	}
+
+	_, err = tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+
+	return translateError(err)
+}
@@ -0,0 +1,126 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UpdateTxCtx_Savepoints(t *testing.T) {
+	errInner := errors.New("inner failure")
+
+	expectDelete := func(mock sqlmock.Sqlmock, table string) {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM " + table + " WHERE id = $1")).WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	t.Run("nested success", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		expectDelete(mock, "outer_bucket")
+		mock.ExpectExec(regexp.QuoteMeta("SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectDelete(mock, "inner_bucket")
+		mock.ExpectExec(regexp.QuoteMeta("RELEASE SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		err := conn.UpdateTxCtx(context.Background(), func(ctx context.Context, tx portainer.Transaction) error {
+			if err := tx.DeleteObject("outer_bucket", []byte("1")); err != nil {
+				return err
+			}
+
+			return conn.UpdateTxCtx(ctx, func(ctx context.Context, inner portainer.Transaction) error {
+				assert.Same(t, tx, inner)
+
+				return inner.DeleteObject("inner_bucket", []byte("1"))
+			})
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("inner failure contained", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectDelete(mock, "inner_bucket")
+		mock.ExpectExec(regexp.QuoteMeta("ROLLBACK TO SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectDelete(mock, "outer_bucket")
+		mock.ExpectCommit()
+
+		err := conn.UpdateTxCtx(context.Background(), func(ctx context.Context, tx portainer.Transaction) error {
+			err := conn.UpdateTxCtx(ctx, func(ctx context.Context, inner portainer.Transaction) error {
+				if err := inner.DeleteObject("inner_bucket", []byte("1")); err != nil {
+					return err
+				}
+
+				return errInner
+			})
+			require.ErrorIs(t, err, errInner)
+
+			return tx.DeleteObject("outer_bucket", []byte("1"))
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("inner failure propagated", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("ROLLBACK TO SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		err := conn.UpdateTxCtx(context.Background(), func(ctx context.Context, tx portainer.Transaction) error {
+			return conn.UpdateTxCtx(ctx, func(ctx context.Context, inner portainer.Transaction) error {
+				return errInner
+			})
+		})
+		require.ErrorIs(t, err, errInner)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("connection bound to the transaction context", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectDelete(mock, "inner_bucket")
+		mock.ExpectExec(regexp.QuoteMeta("RELEASE SAVEPOINT sp_1")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		err := conn.UpdateTxCtx(context.Background(), func(ctx context.Context, tx portainer.Transaction) error {
+			bound := conn.WithContext(ctx)
+
+			return bound.DeleteObject("inner_bucket", []byte("1"))
+		})
+		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_TxFromContext(t *testing.T) {
+	_, ok := TxFromContext(context.Background())
+	assert.False(t, ok)
+
+	conn, mock := newMockConnection(t)
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+
+	err := conn.UpdateTxCtx(context.Background(), func(ctx context.Context, tx portainer.Transaction) error {
+		current, ok := TxFromContext(ctx)
+		require.True(t, ok)
+		assert.Same(t, tx, current)
+
+		return nil
+	})
+	require.NoError(t, err)
+}
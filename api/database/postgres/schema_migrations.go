@@ -0,0 +1,57 @@
+package postgres
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/portainer/portainer/api/database/postgres/migrations"
+)
+
+// The schema migrations of the postgres backend, see the migrations package.
+// !IMPORTANT: never renumber or remove a released migration, only append new ones.
+func init() {
+	migrations.Register(1, "move the portainer_buckets rows to per-bucket tables", func(tx portainer.Transaction) error {
+		pgTx, err := asDbTransaction(tx)
+		if err != nil {
+			return err
+		}
+
+		return migrateLegacyBuckets(pgTx)
+	})
+
+	migrations.Register(2, "add the version column to the bucket tables", func(tx portainer.Transaction) error {
+		pgTx, err := asDbTransaction(tx)
+		if err != nil {
+			return err
+		}
+
+		return addVersionColumn(pgTx)
+	})
+
+	migrations.Register(3, "create the deletions table", func(tx portainer.Transaction) error {
+		pgTx, err := asDbTransaction(tx)
+		if err != nil {
+			return err
+		}
+
+		return createDeletionsTable(pgTx)
+	})
+}
+
+// newTransaction wraps a raw transaction for the schema migrations
+func (connection *DbConnection) newTransaction(tx *sqlx.Tx) portainer.Transaction {
+	return &DbTransaction{
+		conn: connection,
+		tx:   tx,
+	}
+}
+
+func asDbTransaction(tx portainer.Transaction) (*DbTransaction, error) {
+	pgTx, ok := tx.(*DbTransaction)
+	if !ok {
+		return nil, fmt.Errorf("unexpected transaction type %T", tx)
+	}
+
+	return pgTx, nil
+}
@@ -0,0 +1,56 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrShuttingDown is returned by the transactions started once Shutdown was called
+var ErrShuttingDown = errors.New("the database connection is shutting down")
+
+// trackTx registers a new transaction so that Shutdown waits for it, done must be called once
+// the transaction is committed or rolled back
+func (connection *DbConnection) trackTx() (done func(), err error) {
+	connection.shutdownMu.RLock()
+	defer connection.shutdownMu.RUnlock()
+
+	if connection.shuttingDown {
+		return nil, ErrShuttingDown
+	}
+
+	connection.activeTxs.Add(1)
+
+	return connection.activeTxs.Done, nil
+}
+
+// Shutdown closes the connection once the transactions in progress are over, the transactions
+// started in the meantime fail with ErrShuttingDown. When ctx is done first, the connection is
+// closed regardless, which rolls back the remaining transactions, and the error of ctx is returned.
+func (connection *DbConnection) Shutdown(ctx context.Context) error {
+	connection.shutdownMu.Lock()
+	connection.shuttingDown = true
+	connection.shutdownMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		connection.activeTxs.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("failed to wait for the transactions in progress: %w", ctx.Err())
+		log.Warn().Str("component", "postgres").Err(err).Msg("rolling back the transactions in progress")
+	}
+
+	if closeErr := connection.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
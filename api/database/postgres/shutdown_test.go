@@ -0,0 +1,101 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newShutdownConnection returns a mock connection cancelled by Close like an opened one
+func newShutdownConnection(t *testing.T) (*DbConnection, sqlmock.Sqlmock) {
+	conn, mock := newMockConnection(t)
+	conn.ctx, conn.cancelFunc = context.WithCancel(context.Background())
+
+	return conn, mock
+}
+
+func Test_Shutdown_DrainsTransactions(t *testing.T) {
+	conn, mock := newShutdownConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM endpoints WHERE id = $1")).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectClose()
+
+	started := make(chan struct{})
+	txErr := make(chan error, 1)
+	go func() {
+		txErr <- conn.UpdateTx(func(tx portainer.Transaction) error {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+
+			return tx.DeleteObject("endpoints", []byte("1"))
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- conn.Shutdown(ctx) }()
+
+	// the new transactions are refused while the shutdown waits for the one in progress
+	require.Eventually(t, func() bool {
+		err := conn.ViewTx(func(tx portainer.Transaction) error { return nil })
+		return errors.Is(err, ErrShuttingDown)
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, <-txErr)
+	require.NoError(t, <-shutdown)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.ErrorIs(t, conn.UpdateTx(func(tx portainer.Transaction) error { return nil }), ErrShuttingDown)
+}
+
+func Test_Shutdown_Timeout(t *testing.T) {
+	conn, mock := newShutdownConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	mock.ExpectClose()
+
+	started := make(chan struct{})
+	txErr := make(chan error, 1)
+	go func() {
+		txErr <- conn.UpdateTx(func(tx portainer.Transaction) error {
+			close(started)
+
+			// the transaction outlives the timeout of the shutdown
+			<-tx.(*DbTransaction).ctx.Done()
+
+			return tx.DeleteObject("endpoints", []byte("1"))
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := conn.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	select {
+	case err := <-txErr:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transaction was not rolled back")
+	}
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,151 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// queryTablePattern finds the first table named by a statement
+var queryTablePattern = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE|TABLE(?:\s+IF\s+(?:NOT\s+)?EXISTS)?)\s+([A-Za-z0-9_."]+)`)
+
+// WithSlowQueryThreshold logs a warning for every statement running for longer than
+// threshold, 0 disables the logging
+func WithSlowQueryThreshold(threshold time.Duration) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.slowQueryThreshold = threshold
+	}
+}
+
+// wrapConnector returns connector, timing the statements of its connections when a slow
+// query threshold is set
+func (connection *DbConnection) wrapConnector(connector driver.Connector) driver.Connector {
+	if connection.slowQueryThreshold <= 0 {
+		return connector
+	}
+
+	return &slowQueryConnector{Connector: connector, threshold: connection.slowQueryThreshold}
+}
+
+// queryTable returns the table named by query, it is empty when none is found
+func queryTable(query string) string {
+	match := queryTablePattern.FindStringSubmatch(query)
+	if match == nil {
+		return ""
+	}
+
+	return match[1]
+}
+
+// logSlowQuery logs query when it ran for longer than threshold since start
+func logSlowQuery(threshold time.Duration, start time.Time, query string, err error) {
+	duration := time.Since(start)
+	if duration < threshold {
+		return
+	}
+
+	log.Warn().
+		Str("component", "postgres").
+		Str("query", query).
+		Str("table", queryTable(query)).
+		Dur("duration", duration).
+		Dur("threshold", threshold).
+		Err(err).
+		Msg("slow database query")
+}
+
+type slowQueryConnector struct {
+	driver.Connector
+
+	threshold time.Duration
+}
+
+func (c *slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowQueryConn{Conn: conn, threshold: c.threshold}, nil
+}
+
+// slowQueryConn times the statements of a driver connection, the optional interfaces
+// of the connection are forwarded so that database/sql keeps using them
+type slowQueryConn struct {
+	driver.Conn
+
+	threshold time.Duration
+}
+
+func (c *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	defer func(start time.Time) { logSlowQuery(c.threshold, start, query, err) }(time.Now())
+
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (result driver.Result, err error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	defer func(start time.Time) { logSlowQuery(c.threshold, start, query, err) }(time.Now())
+
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+
+	return c.Conn.Prepare(query)
+}
+
+func (c *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c *slowQueryConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *slowQueryConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *slowQueryConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+
+	return true
+}
+
+func (c *slowQueryConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs redirects the global logger to a buffer until the end of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	t.Cleanup(func() {
+		log.Logger = logger
+	})
+
+	return &buf
+}
+
+// slowQueryLogs returns the slow query entries written to buf
+func slowQueryLogs(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["message"] == "slow database query" {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// mockConnector opens the sqlmock connection registered under dsn
+type mockConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c *mockConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *mockConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func Test_queryTable(t *testing.T) {
+	tests := map[string]string{
+		"SELECT data FROM endpoints WHERE id = $1":                  "endpoints",
+		"INSERT INTO users (id, data) VALUES ($1, $2)":              "users",
+		"UPDATE settings SET data = $1 WHERE id = $2":               "settings",
+		"CREATE TABLE IF NOT EXISTS stacks (id SERIAL PRIMARY KEY)": "stacks",
+		"SELECT pg_sleep(1)":                                        "",
+	}
+
+	for query, table := range tests {
+		assert.Equal(t, table, queryTable(query), query)
+	}
+}
+
+func Test_WithSlowQueryThreshold(t *testing.T) {
+	buf := captureLogs(t)
+
+	mockDB, mock, err := sqlmock.NewWithDSN("slow_query_threshold")
+	require.NoError(t, err)
+	defer mockDB.Close()
+
+	conn := &DbConnection{ctx: context.Background()}
+	WithSlowQueryThreshold(50 * time.Millisecond)(conn)
+
+	db := sql.OpenDB(conn.wrapConnector(&mockConnector{driver: mockDB.Driver(), dsn: "slow_query_threshold"}))
+	defer db.Close()
+	conn.DB = sqlx.NewDb(db, DatabaseDriverName)
+
+	mock.ExpectQuery("SELECT data FROM endpoints").WithArgs("1").
+		WillDelayFor(100 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte("{}")))
+	mock.ExpectExec("DELETE FROM users").WithArgs("2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var data []byte
+	require.NoError(t, conn.Get(&data, "SELECT data FROM endpoints WHERE id = $1", "1"))
+	_, err = conn.Exec("DELETE FROM users WHERE id = $1", "2")
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	entries := slowQueryLogs(t, buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "warn", entries[0]["level"])
+	assert.Equal(t, "SELECT data FROM endpoints WHERE id = $1", entries[0]["query"])
+	assert.Equal(t, "endpoints", entries[0]["table"])
+	assert.GreaterOrEqual(t, entries[0]["duration"], float64(100))
+}
+
+func Test_WithSlowQueryThreshold_Disabled(t *testing.T) {
+	conn := &DbConnection{}
+	connector := &mockConnector{}
+
+	assert.Same(t, connector, conn.wrapConnector(connector))
+}
+
+func Test_WithSlowQueryThreshold_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t, WithSlowQueryThreshold(50*time.Millisecond))
+	buf := captureLogs(t)
+
+	_, err := conn.Exec("SELECT pg_sleep(0.1)")
+	require.NoError(t, err)
+
+	entries := slowQueryLogs(t, buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "SELECT pg_sleep(0.1)", entries[0]["query"])
+}
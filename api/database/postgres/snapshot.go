@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// snapshotTxOptions are the options of the transaction of a snapshot, its statements all see
+// the database as it was when its first statement ran
+var snapshotTxOptions = TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// PostgresSnapshot is a consistent read-only view of every bucket of the store, it is backed
+// by a REPEATABLE READ transaction which is open until Close is called
+type PostgresSnapshot struct {
+	tx *PostgresTx
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Snapshot begins a consistent read-only view of the store, for the reads spanning several
+// buckets that must not see the writes committed while they run. Unlike View, the writes of
+// the store are not held back while the snapshot is open. The snapshot must be closed.
+func (s *PostgresStore) Snapshot() (*PostgresSnapshot, error) {
+	conn := s.conn
+
+	setTx, err := snapshotTxOptions.statement()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := conn.beginTx(conn.ctx, conn.DB, setTx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the snapshot of a REPEATABLE READ transaction is taken by its first statement, not by BEGIN
+	if _, err := tx.tx.ExecContext(tx.ctx, "SELECT 1"); err != nil {
+		tx.tx.Rollback()
+		tx.release()
+		return nil, fmt.Errorf("failed to take the snapshot: %w", translateError(err))
+	}
+
+	tx.readOnly = true
+
+	return &PostgresSnapshot{
+		tx: &PostgresTx{
+			tx:        tx,
+			ctx:       tx.ctx,
+			writeable: false,
+		},
+	}, nil
+}
+
+// Bucket retrieves a bucket as seen by the snapshot, it returns nil when the bucket does not exist
+func (snapshot *PostgresSnapshot) Bucket(name []byte) *PostgresBucket {
+	return snapshot.tx.Bucket(name)
+}
+
+// Close ends the snapshot, it can be called more than once
+func (snapshot *PostgresSnapshot) Close() error {
+	snapshot.closeOnce.Do(func() {
+		snapshot.tx.tx.closed.Store(true)
+		snapshot.closeErr = translateError(snapshot.tx.tx.tx.Commit())
+		snapshot.tx.tx.release()
+	})
+
+	return snapshot.closeErr
+}
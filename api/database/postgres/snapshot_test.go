@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PostgresStore_Snapshot(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SELECT 1")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectBucketExists(mock, "endpoints", true)
+	expectBucketExists(mock, "missing", false)
+	mock.ExpectCommit()
+
+	snapshot, err := store.Snapshot()
+	require.NoError(t, err)
+
+	b := snapshot.Bucket([]byte("endpoints"))
+	require.NotNil(t, b)
+	require.ErrorIs(t, b.Put([]byte("1"), []byte(`{}`)), ErrTxReadOnly)
+	assert.Nil(t, snapshot.Bucket([]byte("missing")))
+
+	require.NoError(t, snapshot.Close())
+	require.NoError(t, snapshot.Close())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_Snapshot_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "snapshot_test")
+	store := &PostgresStore{conn: conn}
+
+	put := func(key int, value string) {
+		err := store.Update(func(tx *PostgresTx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("snapshot_test"))
+			if err != nil {
+				return err
+			}
+
+			return b.Put(conn.ConvertToKey(key), []byte(value))
+		})
+		require.NoError(t, err)
+	}
+
+	put(1, `"before"`)
+
+	snapshot, err := store.Snapshot()
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	put(1, `"after"`)
+	put(2, `"added"`)
+
+	b := snapshot.Bucket([]byte("snapshot_test"))
+	require.NotNil(t, b)
+	assert.JSONEq(t, `"before"`, string(b.Get(conn.ConvertToKey(1))))
+	assert.Nil(t, b.Get(conn.ConvertToKey(2)))
+
+	values, err := b.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, values, 1)
+
+	require.NoError(t, snapshot.Close())
+
+	err = store.View(func(tx *PostgresTx) error {
+		assert.JSONEq(t, `"after"`, string(tx.Bucket([]byte("snapshot_test")).Get(conn.ConvertToKey(1))))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,39 @@
+//go:build integration
+
+package postgres
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Open_UnixSocket(t *testing.T) {
+	socketDir := os.Getenv("TEST_DATABASE_SOCKET_DIR")
+	if socketDir == "" {
+		socketDir = "/var/run/postgresql"
+	}
+
+	if _, err := os.Stat(filepath.Join(socketDir, ".s.PGSQL.5432")); err != nil {
+		t.Skipf("no PostgreSQL socket in %s", socketDir)
+	}
+
+	dsn, err := DSNConfig{
+		SocketDir: socketDir,
+		User:      os.Getenv("TEST_DATABASE_USER"),
+		Database:  os.Getenv("TEST_DATABASE_NAME"),
+		SSLMode:   "disable",
+	}.DSN()
+	require.NoError(t, err)
+
+	conn, err := NewConnection(dsn, nil, WithInstanceLockMode(InstanceLockDisabled))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var socket bool
+	require.NoError(t, conn.Get(&socket, "SELECT inet_server_addr() IS NULL"))
+	assert.True(t, socket)
+}
@@ -0,0 +1,132 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// The operations of the cached statements
+const (
+	stmtSelect = "select"
+	stmtInsert = "insert"
+	stmtUpdate = "update"
+	stmtDelete = "delete"
+)
+
+// stmtKey identifies a cached statement, the statements are prepared on the pool of db
+type stmtKey struct {
+	db        *sqlx.DB
+	bucket    string
+	operation string
+}
+
+// stmtPreparing is the placeholder of a statement while it is being prepared
+type stmtPreparing struct{}
+
+// WithStatementCache enables the cache of the prepared statements of the hot CRUD paths, it is
+// enabled by default. The cache is always disabled in pgBouncer mode, where the server
+// connection changes from one transaction to the next and the prepared statements are lost.
+func WithStatementCache(enabled bool) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.cacheStatements = enabled
+	}
+}
+
+// cachedStmt returns the prepared statement of the operation on a bucket, or nil when it is not
+// prepared yet. The statement is then prepared in the background: the transaction holds a
+// connection of the pool and preparing the statement needs another one, waiting for it could
+// exhaust the pool.
+func (tx *DbTransaction) cachedStmt(bucketName, operation, query string) *sqlx.Stmt {
+	connection := tx.conn
+	if !connection.cacheStatements || connection.pgBouncerMode || tx.db == nil {
+		return nil
+	}
+
+	key := stmtKey{db: tx.db, bucket: bucketName, operation: operation}
+
+	value, loaded := connection.stmts.LoadOrStore(key, stmtPreparing{})
+	if !loaded {
+		go connection.prepareStmt(key, query)
+	}
+
+	stmt, _ := value.(*sqlx.Stmt)
+
+	return stmt
+}
+
+// prepareStmt prepares the statement of key and caches it, unless it was invalidated meanwhile
+func (connection *DbConnection) prepareStmt(key stmtKey, query string) {
+	stmt, err := key.db.Preparex(query)
+	if err != nil {
+		// the bucket may not exist yet, the statement is prepared again by its next use
+		log.Debug().Str("component", "postgres").Err(err).Str("bucket", key.bucket).Str("operation", key.operation).Msg("failed to prepare statement")
+		connection.stmts.CompareAndDelete(key, stmtPreparing{})
+
+		return
+	}
+
+	if !connection.stmts.CompareAndSwap(key, stmtPreparing{}, stmt) {
+		stmt.Close()
+	}
+}
+
+// invalidateStmts closes the cached statements of a bucket, or every cached statement when
+// bucketName is empty
+func (connection *DbConnection) invalidateStmts(bucketName string) {
+	connection.stmts.Range(func(k, _ any) bool {
+		if key := k.(stmtKey); bucketName == "" || key.bucket == bucketName {
+			if value, loaded := connection.stmts.LoadAndDelete(key); loaded {
+				if stmt, ok := value.(*sqlx.Stmt); ok {
+					stmt.Close()
+				}
+			}
+		}
+
+		return true
+	})
+}
+
+// invalidatePoolStmts closes the cached statements prepared on the pool of db
+func (connection *DbConnection) invalidatePoolStmts(db *sqlx.DB) {
+	connection.stmts.Range(func(k, _ any) bool {
+		if key := k.(stmtKey); key.db == db {
+			if value, loaded := connection.stmts.LoadAndDelete(key); loaded {
+				if stmt, ok := value.(*sqlx.Stmt); ok {
+					stmt.Close()
+				}
+			}
+		}
+
+		return true
+	})
+}
+
+// execStmt executes query, the operation on a bucket, with its cached statement if any
+func (tx *DbTransaction) execStmt(ctx context.Context, bucketName, operation, query string, args ...any) (sql.Result, error) {
+	stmt := tx.cachedStmt(bucketName, operation, query)
+	if stmt == nil {
+		return tx.tx.ExecContext(ctx, query, args...)
+	}
+
+	txStmt := tx.tx.StmtxContext(ctx, stmt)
+	defer txStmt.Close()
+
+	return txStmt.ExecContext(ctx, args...)
+}
+
+// getStmt runs query, the operation on a bucket, with its cached statement if any and scans
+// the returned row into dest
+func (tx *DbTransaction) getStmt(ctx context.Context, bucketName, operation string, dest any, query string, args ...any) error {
+	stmt := tx.cachedStmt(bucketName, operation, query)
+	if stmt == nil {
+		return tx.tx.GetContext(ctx, dest, query, args...)
+	}
+
+	txStmt := tx.tx.StmtxContext(ctx, stmt)
+	defer txStmt.Close()
+
+	return txStmt.GetContext(ctx, dest, args...)
+}
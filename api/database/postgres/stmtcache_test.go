@@ -0,0 +1,173 @@
+package postgres
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStmtCacheConnection returns a mock connection caching its statements. The pool holds a
+// single connection, so that the statements are prepared once the transaction that first used
+// them is over and on the connection of the next transactions.
+func newStmtCacheConnection(t *testing.T) (*DbConnection, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock := newMockConnection(t)
+	conn.cacheStatements = true
+	conn.DB.SetMaxOpenConns(1)
+
+	return conn, mock
+}
+
+// waitForStmt waits until the statement of the operation on a bucket is prepared
+func waitForStmt(t *testing.T, conn *DbConnection, bucketName, operation string) {
+	t.Helper()
+
+	key := stmtKey{db: conn.DB, bucket: bucketName, operation: operation}
+	require.Eventually(t, func() bool {
+		value, ok := conn.stmts.Load(key)
+		_, prepared := value.(*sqlx.Stmt)
+
+		return ok && prepared
+	}, time.Second, 5*time.Millisecond)
+}
+
+func Test_StmtCache_ReusesPreparedStatement(t *testing.T) {
+	conn, mock := newStmtCacheConnection(t)
+
+	query := regexp.QuoteMeta("SELECT data FROM settings WHERE id = $1")
+
+	// the first read is not prepared, the statement is prepared once it is over
+	expectObjectRead(mock, "settings", 1, []byte(`{"LogoURL":"logo.png"}`))
+	prepared := mock.ExpectPrepare(query)
+
+	var settings map[string]any
+	require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	waitForStmt(t, conn, "settings", stmtSelect)
+
+	for range 3 {
+		mock.ExpectBegin()
+		prepared.ExpectQuery().WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"LogoURL":"logo.png"}`)))
+		mock.ExpectCommit()
+	}
+
+	for range 3 {
+		require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+		assert.Equal(t, "logo.png", settings["LogoURL"])
+	}
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_StmtCache_InvalidatedByDropBucket(t *testing.T) {
+	conn, mock := newStmtCacheConnection(t)
+
+	query := regexp.QuoteMeta("DELETE FROM settings WHERE id = $1")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectPrepare(query).WillBeClosed()
+
+	require.NoError(t, conn.DeleteObject("settings", conn.ConvertToKey(1)))
+	waitForStmt(t, conn, "settings", stmtDelete)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE IF EXISTS settings")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DROP SEQUENCE IF EXISTS seq_settings")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.DropBucket("settings"))
+
+	_, cached := conn.stmts.Load(stmtKey{db: conn.DB, bucket: "settings", operation: stmtDelete})
+	assert.False(t, cached)
+
+	// the statement of the table created again is prepared again
+	mock.ExpectBegin()
+	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectPrepare(query)
+
+	require.NoError(t, conn.DeleteObject("settings", conn.ConvertToKey(1)))
+	waitForStmt(t, conn, "settings", stmtDelete)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_StmtCache_InvalidatedByRenameBucket(t *testing.T) {
+	conn, mock := newStmtCacheConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM edge_groups WHERE id = $1")).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectPrepare(regexp.QuoteMeta("DELETE FROM edge_groups WHERE id = $1")).WillBeClosed()
+
+	require.NoError(t, conn.DeleteObject("edge_groups", conn.ConvertToKey(1)))
+	waitForStmt(t, conn, "edge_groups", stmtDelete)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE IF EXISTS edge_groups RENAME TO edgegroups")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER SEQUENCE IF EXISTS edge_groups_id_seq RENAME TO edgegroups_id_seq")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER SEQUENCE IF EXISTS seq_edge_groups RENAME TO seq_edgegroups")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.RenameBucket("edge_groups", "edgegroups"))
+
+	_, cached := conn.stmts.Load(stmtKey{db: conn.DB, bucket: "edge_groups", operation: stmtDelete})
+	assert.False(t, cached)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_StmtCache_DisabledInPgBouncerMode(t *testing.T) {
+	conn, mock := newStmtCacheConnection(t)
+	conn.pgBouncerMode = true
+
+	// the session settings are applied to every transaction in pgBouncer mode
+	for range 2 {
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL statement_timeout").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM settings WHERE id = $1")).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{}`)))
+		mock.ExpectCommit()
+	}
+
+	for range 2 {
+		var settings map[string]any
+		require.NoError(t, conn.GetObject("settings", conn.ConvertToKey(1), &settings))
+	}
+
+	conn.stmts.Range(func(key, _ any) bool {
+		t.Errorf("statement cached in pgBouncer mode: %v", key)
+		return true
+	})
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Benchmark_GetObject_StmtCache(b *testing.B) {
+	for _, enabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache=%t", enabled), func(b *testing.B) {
+			conn := newTestConnection(b, WithStatementCache(enabled))
+			dropTestTables(b, conn, "stmt_cache_bench")
+
+			require.NoError(b, conn.CreateObjectWithId("stmt_cache_bench", 1, map[string]string{"Name": "bench"}))
+
+			var object map[string]string
+			// the first read prepares the statement
+			require.NoError(b, conn.GetObject("stmt_cache_bench", conn.ConvertToKey(1), &object))
+			time.Sleep(100 * time.Millisecond)
+
+			b.ResetTimer()
+			for range b.N {
+				if err := conn.GetObject("stmt_cache_bench", conn.ConvertToKey(1), &object); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
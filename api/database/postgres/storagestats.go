@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// BucketStorageStats describes the storage used by the table of a bucket, the sizes are in
+// bytes. LastModified is the latest updated_at of its objects, it is nil for an empty bucket
+// or a table that has no timestamp columns yet.
+type BucketStorageStats struct {
+	Bucket       string     `json:"bucket"`
+	Rows         int64      `json:"rows"`
+	TotalSize    int64      `json:"total_size"`
+	IndexSize    int64      `json:"index_size"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+}
+
+// StorageStats describes the storage used by the database, the buckets are in the order of
+// their names
+type StorageStats struct {
+	DatabaseSize int64                `json:"database_size"`
+	Buckets      []BucketStorageStats `json:"buckets"`
+}
+
+// storageStatsQuery returns the size of the database along with the statistics of the tables
+// of the buckets as a JSON array. The rows are counted by a query built for each table and
+// run by query_to_xml, so that every table is read in the same round trip.
+const storageStatsQuery = `
+	WITH tables AS (
+		SELECT c.oid, c.relname,
+			EXISTS (
+				SELECT 1 FROM pg_attribute a
+				WHERE a.attrelid = c.oid AND a.attname = 'updated_at' AND NOT a.attisdropped
+			) AS timestamped
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND c.relkind IN ('r', 'p')
+			AND left(c.relname, length($1::text)) = $1::text AND NOT c.relname::text = ANY($2::text[])
+			AND (
+				SELECT COUNT(*) FROM pg_attribute a
+				WHERE a.attrelid = c.oid AND a.attname IN ('id', 'data') AND NOT a.attisdropped
+			) = 2
+	), counts AS (
+		SELECT t.oid, t.relname, query_to_xml(format(
+			'SELECT count(*) AS row_count, %s AS last_modified FROM %I.%I',
+			CASE WHEN t.timestamped THEN 'max(updated_at)' ELSE 'NULL::timestamptz' END,
+			current_schema(), t.relname), false, true, '') AS doc
+		FROM tables t
+	)
+	SELECT pg_database_size(current_database()) AS database_size,
+		COALESCE((
+			SELECT json_agg(json_build_object(
+				'table', c.relname,
+				'rows', (xpath('/row/row_count/text()', c.doc))[1]::text::bigint,
+				'total_size', pg_total_relation_size(c.oid),
+				'index_size', pg_indexes_size(c.oid),
+				'last_modified', (xpath('/row/last_modified/text()', c.doc))[1]::text::timestamptz
+			) ORDER BY c.relname)
+			FROM counts c
+		), '[]') AS tables`
+
+// storageStatsRow is a table described by storageStatsQuery
+type storageStatsRow struct {
+	Table        string     `json:"table"`
+	Rows         int64      `json:"rows"`
+	TotalSize    int64      `json:"total_size"`
+	IndexSize    int64      `json:"index_size"`
+	LastModified *time.Time `json:"last_modified"`
+}
+
+// StorageStats returns the size of the database and, for every bucket, its number of objects,
+// the size of its table with and without its indexes and when it was last modified, so that
+// the buckets using the most space can be found. Everything is read with a single query. The
+// rows are counted exactly, the tables are read sequentially.
+func (connection *DbConnection) StorageStats(ctx context.Context) (stats *StorageStats, err error) {
+	ctx, end := connection.startSpan(ctx, "StorageStats", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return nil, ErrNoConnection
+	}
+
+	excluded := make([]string, 0, len(metadataTables))
+	for table := range metadataTables {
+		excluded = append(excluded, connection.table(table))
+	}
+
+	var result struct {
+		DatabaseSize int64  `db:"database_size"`
+		Tables       []byte `db:"tables"`
+	}
+	if err := connection.GetContext(ctx, &result, storageStatsQuery, connection.tablePrefix, pq.StringArray(excluded)); err != nil {
+		return nil, fmt.Errorf("failed to read the storage statistics: %w", err)
+	}
+
+	var rows []storageStatsRow
+	if err := json.Unmarshal(result.Tables, &rows); err != nil {
+		return nil, fmt.Errorf("failed to decode the storage statistics: %w", err)
+	}
+
+	stats = &StorageStats{DatabaseSize: result.DatabaseSize, Buckets: make([]BucketStorageStats, 0, len(rows))}
+	for _, row := range rows {
+		bucket, ok := connection.bucketOf(row.Table)
+		if !ok {
+			continue
+		}
+
+		stats.Buckets = append(stats.Buckets, BucketStorageStats{
+			Bucket:       bucket,
+			Rows:         row.Rows,
+			TotalSize:    row.TotalSize,
+			IndexSize:    row.IndexSize,
+			LastModified: row.LastModified,
+		})
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,78 @@
+package postgres
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/portainer/portainer/api/database/postgres/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StorageStats(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectQuery("SELECT pg_database_size").
+		WithArgs("", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"database_size", "tables"}).AddRow(int64(8<<20), []byte(`[
+			{"table": "settings", "rows": 1, "total_size": 32768, "index_size": 16384, "last_modified": "2024-01-02T03:04:05.5+00:00"},
+			{"table": "users", "rows": 0, "total_size": 16384, "index_size": 8192, "last_modified": null}
+		]`)))
+
+	stats, err := conn.StorageStats(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 500_000_000, time.UTC)
+	assert.Equal(t, int64(8<<20), stats.DatabaseSize)
+	require.Len(t, stats.Buckets, 2)
+	require.NotNil(t, stats.Buckets[0].LastModified)
+	assert.True(t, modified.Equal(*stats.Buckets[0].LastModified))
+	stats.Buckets[0].LastModified = nil
+	assert.Equal(t, BucketStorageStats{Bucket: "settings", Rows: 1, TotalSize: 32768, IndexSize: 16384}, stats.Buckets[0])
+	assert.Equal(t, BucketStorageStats{Bucket: "users", TotalSize: 16384, IndexSize: 8192}, stats.Buckets[1])
+}
+
+func Test_StorageStats_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "stats_small", "stats_large", "stats_empty")
+
+	require.NoError(t, conn.SetServiceName("stats_empty"))
+	require.NoError(t, conn.SetServiceName("stats_small"))
+	require.NoError(t, conn.CreateObjectWithId("stats_small", 1, map[string]any{"Name": "small"}))
+
+	require.NoError(t, conn.SetServiceName("stats_large"))
+	for id := 1; id <= 500; id++ {
+		require.NoError(t, conn.CreateObjectWithId("stats_large", id, map[string]any{"Name": strings.Repeat("x", 1000)}))
+	}
+
+	stats, err := conn.StorageStats(context.Background())
+	require.NoError(t, err)
+
+	buckets := map[string]BucketStorageStats{}
+	var total int64
+	for _, bucket := range stats.Buckets {
+		buckets[bucket.Bucket] = bucket
+		total += bucket.TotalSize
+	}
+
+	empty, small, large := buckets["stats_empty"], buckets["stats_small"], buckets["stats_large"]
+	assert.Equal(t, int64(0), empty.Rows)
+	assert.Nil(t, empty.LastModified)
+	assert.Equal(t, int64(1), small.Rows)
+	assert.NotNil(t, small.LastModified)
+	assert.Equal(t, int64(500), large.Rows)
+	assert.NotNil(t, large.LastModified)
+
+	assert.Greater(t, large.TotalSize, small.TotalSize)
+	assert.Positive(t, large.IndexSize)
+	assert.Less(t, large.IndexSize, large.TotalSize)
+	assert.GreaterOrEqual(t, stats.DatabaseSize, total)
+
+	// the metadata tables are not buckets
+	_, found := buckets[migrations.SchemaMigrationsTable]
+	assert.False(t, found)
+}
@@ -1,184 +1,658 @@
 package postgres
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
+	"unicode/utf8"
+
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/rs/zerolog/log"
 )
 
-// PostgresStore mimics BoltDB's Store structure
+// LegacyBucketsTable is the single key/value table used by the former PostgresStore layout
+const LegacyBucketsTable = "portainer_buckets"
+
+var (
+	ErrTxReadOnly    = errors.New("transaction is read-only")
+	ErrInvalidConfig = errors.New("invalid store configuration")
+)
+
+// PostgresStore mimics BoltDB's Store structure on top of the per-bucket tables of DbConnection.
+// A bucket is a whole table, so the scans of a bucket read the table in the order of its primary
+// key index on id and need no index on a bucket name.
 type PostgresStore struct {
-    db *sql.DB
-    mu sync.RWMutex
+	conn *DbConnection
+	mu   sync.RWMutex
 }
 
 // PostgresTx simulates bolt.Tx behavior
 type PostgresTx struct {
-    tx        *sql.Tx
-    ctx       context.Context
-    writeable bool
+	tx        *DbTransaction
+	ctx       context.Context
+	writeable bool
+
+	// cursors is the number of cursors created, it names them uniquely within the transaction
+	cursors int
 }
 
 // Bucket simulation for PostgreSQL
 type PostgresBucket struct {
-    tx         *PostgresTx
-    bucketName string
+	tx         *PostgresTx
+	bucketName string
 }
 
-// NewPostgresStore creates a new PostgreSQL store
-func NewPostgresStore(host, port, dbname, user, password string) (*PostgresStore, error) {
-    connStr := fmt.Sprintf(
-        "host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
-        host, port, dbname, user, password,
-    )
-
-    db, err := sql.Open("postgres", connStr)
-    if err != nil {
-        return nil, err
-    }
-
-    // Initialize schema
-    if err := initializeSchema(db); err != nil {
-        return nil, err
-    }
-
-    return &PostgresStore{db: db}, nil
-}
-
-// initializeSchema creates necessary tables
-func initializeSchema(db *sql.DB) error {
-    // Create a generic key-value store table to mimic BoltDB buckets
-    _, err := db.Exec(`
-        CREATE TABLE IF NOT EXISTS portainer_buckets (
-            bucket_name TEXT NOT NULL,
-            key BYTEA NOT NULL,
-            value BYTEA NOT NULL,
-            PRIMARY KEY (bucket_name, key)
-        )
-    `)
-    return err
-}
-
-// View implements read-only transaction
-func (s *PostgresStore) View(fn func(*PostgresTx) error) error {
-    s.mu.RLock()
-    defer s.mu.RUnlock()
+// PostgresStoreConfig describes how NewPostgresStore reaches the PostgreSQL server
+type PostgresStoreConfig struct {
+	Host     string
+	Port     string
+	DBName   string
+	User     string
+	Password string
 
-    tx, err := s.db.Begin()
-    if err != nil {
-        return err
-    }
-    defer tx.Rollback()
+	// SSLMode defaults to disable
+	SSLMode string
 
-    ptx := &PostgresTx{
-        tx:        tx,
-        ctx:       context.Background(),
-        writeable: false,
-    }
+	// ConnectTimeout is rounded up to the second, 0 waits indefinitely
+	ConnectTimeout time.Duration
+}
 
-    if err := fn(ptx); err != nil {
-        return err
-    }
+// Validate returns ErrInvalidConfig when the host or the database name is missing or when
+// the port is not a valid TCP port, the port may be left empty to use the default one
+func (cfg PostgresStoreConfig) Validate() error {
+	if cfg.Host == "" {
+		return fmt.Errorf("%w: the host is required", ErrInvalidConfig)
+	}
+
+	if cfg.DBName == "" {
+		return fmt.Errorf("%w: the database name is required", ErrInvalidConfig)
+	}
+
+	if cfg.Port != "" {
+		port, err := strconv.Atoi(cfg.Port)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("%w: invalid port %q", ErrInvalidConfig, cfg.Port)
+		}
+	}
+
+	if cfg.ConnectTimeout < 0 {
+		return fmt.Errorf("%w: negative connect timeout", ErrInvalidConfig)
+	}
+
+	return nil
+}
 
-    return tx.Commit()
+// DSN returns the keyword/value connection string of the configuration
+func (cfg PostgresStoreConfig) DSN() string {
+	sslMode := cfg.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	params := []dsnParam{
+		{key: "host", value: cfg.Host},
+		{key: "port", value: cfg.Port},
+		{key: "dbname", value: cfg.DBName},
+		{key: "user", value: cfg.User},
+		{key: "password", value: cfg.Password},
+		{key: "sslmode", value: sslMode},
+	}
+
+	if cfg.ConnectTimeout > 0 {
+		seconds := (cfg.ConnectTimeout + time.Second - 1) / time.Second
+		params = append(params, dsnParam{key: "connect_timeout", value: strconv.Itoa(int(seconds))})
+	}
+
+	// the empty parameters are left out so that the defaults of the driver apply
+	set := params[:0]
+	for _, param := range params {
+		if param.value != "" {
+			set = append(set, param)
+		}
+	}
+
+	return formatKeywordDSN(set)
 }
 
-// Update implements read-write transaction
-func (s *PostgresStore) Update(fn func(*PostgresTx) error) error {
-    s.mu.Lock()
-    defer s.mu.Unlock()
+// NewPostgresStore creates a new PostgreSQL store
+func NewPostgresStore(cfg PostgresStoreConfig) (*PostgresStore, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
-    tx, err := s.db.Begin()
-    if err != nil {
-        return err
-    }
+	conn, err := NewConnection(cfg.DSN(), nil)
+	if err != nil {
+		return nil, err
+	}
 
-    ptx := &PostgresTx{
-        tx:        tx,
-        ctx:       context.Background(),
-        writeable: true,
-    }
+	return &PostgresStore{conn: conn}, nil
+}
 
-    if err := fn(ptx); err != nil {
-        tx.Rollback()
-        return err
-    }
+// View implements read-only transaction, it runs on the read replica or with the read-only role
+// when one is configured, see DbConnection.ViewTx
+func (s *PostgresStore) View(fn func(*PostgresTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.conn.viewTx(s.conn.ctx, func(tx *DbTransaction) error {
+		return fn(&PostgresTx{
+			tx:        tx,
+			ctx:       s.conn.ctx,
+			writeable: false,
+		})
+	})
+}
 
-    return tx.Commit()
+// Update implements read-write transaction
+func (s *PostgresStore) Update(fn func(*PostgresTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn.updateTx(func(tx *DbTransaction) error {
+		return fn(&PostgresTx{
+			tx:        tx,
+			ctx:       s.conn.ctx,
+			writeable: true,
+		})
+	})
 }
 
-// Bucket creates or retrieves a bucket
+// Bucket retrieves a bucket, it returns nil when the bucket does not exist
 func (tx *PostgresTx) Bucket(bucketName []byte) *PostgresBucket {
-    return &PostgresBucket{
-        tx:         tx,
-        bucketName: string(bucketName),
-    }
+	name := string(bucketName)
+	if err := validateTableName(tx.tx.conn.table(name)); err != nil {
+		ctxLogger(tx.ctx).Error().Str("component", "postgres").Err(err).Msg("invalid bucket name")
+		return nil
+	}
+
+	var exists bool
+	if err := tx.tx.tx.GetContext(tx.ctx, &exists, "SELECT to_regclass($1) IS NOT NULL", tx.tx.conn.table(name)); err != nil {
+		ctxLogger(tx.ctx).Error().Str("component", "postgres").Err(err).Str("bucket", name).Msg("failed to look up bucket")
+		return nil
+	}
+
+	if !exists {
+		return nil
+	}
+
+	return &PostgresBucket{
+		tx:         tx,
+		bucketName: name,
+	}
 }
 
-// Put stores a key-value pair
-func (b *PostgresBucket) Put(key, value []byte) error {
-    if !b.tx.writeable {
-        return fmt.Errorf("transaction is read-only")
-    }
+// CreateBucketIfNotExists simulates bolt's bucket creation, each bucket is backed by its own table
+func (tx *PostgresTx) CreateBucketIfNotExists(bucketName []byte) (*PostgresBucket, error) {
+	if !tx.writeable {
+		return nil, ErrTxReadOnly
+	}
+
+	name := string(bucketName)
+	if err := validateTableName(tx.tx.conn.table(name)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.tx.SetServiceName(name); err != nil {
+		return nil, err
+	}
+
+	return &PostgresBucket{
+		tx:         tx,
+		bucketName: name,
+	}, nil
+}
+
+// DeleteBucket removes every key/value pair of a bucket and resets its sequence, the table
+// backing the bucket is kept. It returns ErrObjectNotFound when the bucket does not exist.
+func (tx *PostgresTx) DeleteBucket(bucketName []byte) error {
+	if !tx.writeable {
+		return ErrTxReadOnly
+	}
 
-    _, err := b.tx.tx.Exec(`
-        INSERT INTO portainer_buckets (bucket_name, key, value)
-        VALUES ($1, $2, $3)
-        ON CONFLICT (bucket_name, key) DO UPDATE 
-        SET value = $3
-    `, b.bucketName, key, value)
+	b := tx.Bucket(bucketName)
+	if b == nil {
+		return fmt.Errorf("%w (bucket=%s)", dserrors.ErrObjectNotFound, bucketName)
+	}
 
-    return err
+	if _, err := tx.tx.tx.ExecContext(tx.ctx, "DELETE FROM "+b.table()); err != nil {
+		return err
+	}
+	tx.tx.invalidateCache(b.bucketName, "")
+
+	return tx.tx.dropBucketSequence(tx.ctx, b.bucketName)
 }
 
-// Get retrieves a value by key
-func (b *PostgresBucket) Get(key []byte) []byte {
-    var value []byte
-    err := b.tx.tx.QueryRow(`
-        SELECT value FROM portainer_buckets 
-        WHERE bucket_name = $1 AND key = $2
-    `, b.bucketName, key).Scan(&value)
+// DropBucketTable drops the table backing a bucket along with its sequence, it is a no-op
+// when the bucket does not exist
+func (tx *PostgresTx) DropBucketTable(bucketName []byte) error {
+	if !tx.writeable {
+		return ErrTxReadOnly
+	}
+
+	return tx.tx.DropBucket(string(bucketName))
+}
 
-    if err != nil {
-        return nil
-    }
+// table returns the name of the table of the bucket
+func (b *PostgresBucket) table() string {
+	return b.tx.tx.conn.table(b.bucketName)
+}
+
+// Put stores a key-value pair, the value must be a JSON document
+func (b *PostgresBucket) Put(key, value []byte) error {
+	if !b.tx.writeable {
+		return ErrTxReadOnly
+	}
+
+	id, err := b.tx.tx.keyArg(b.bucketName, key)
+	if err != nil {
+		return err
+	}
+
+	// xmax is 0 for the inserted rows, the audit log tells the creations from the updates
+	var inserted bool
+	err = b.tx.tx.tx.GetContext(b.tx.ctx, &inserted, fmt.Sprintf(`
+		INSERT INTO %[1]s (id, data)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE
+		SET data = EXCLUDED.data, version = %[1]s.version + 1, updated_at = now()
+		RETURNING (xmax = 0) AS inserted
+	`, b.table()), id, value)
+	if err != nil {
+		return err
+	}
+
+	b.tx.tx.recordChange(b.bucketName, fmt.Sprint(id))
+
+	operation := AuditOperationUpdate
+	if inserted {
+		operation = AuditOperationCreate
+	}
+
+	return b.tx.tx.audit(b.tx.ctx, b.bucketName, fmt.Sprint(id), operation)
+}
 
-    return value
+// Get retrieves a value by key, it returns nil when the key does not exist. The values carried
+// over from the legacy table in an envelope document are returned as the envelope they hold.
+func (b *PostgresBucket) Get(key []byte) []byte {
+	id, err := b.tx.tx.keyArg(b.bucketName, key)
+	if err != nil {
+		return nil
+	}
+
+	var value []byte
+	err = b.tx.tx.tx.GetContext(b.tx.ctx, &value, fmt.Sprintf("SELECT data FROM %s WHERE id = $1", b.table()), id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			ctxLogger(b.tx.ctx).Error().Str("component", "postgres").Err(err).Str("bucket", b.bucketName).Msg("failed to get value")
+		}
+
+		return nil
+	}
+
+	if envelope, ok := unwrapEnvelope(value); ok {
+		return envelope
+	}
+
+	return value
 }
 
 // Delete removes a key-value pair
 func (b *PostgresBucket) Delete(key []byte) error {
-    if !b.tx.writeable {
-        return fmt.Errorf("transaction is read-only")
-    }
+	if !b.tx.writeable {
+		return ErrTxReadOnly
+	}
+
+	id, err := b.tx.tx.keyArg(b.bucketName, key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.tx.tx.tx.ExecContext(b.tx.ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1", b.table()), id); err != nil {
+		return err
+	}
+
+	b.tx.tx.recordChange(b.bucketName, fmt.Sprint(id))
 
-    _, err := b.tx.tx.Exec(`
-        DELETE FROM portainer_buckets 
-        WHERE bucket_name = $1 AND key = $2
-    `, b.bucketName, key)
+	if err := b.tx.tx.recordDeletions(b.tx.ctx, b.bucketName, fmt.Sprint(id)); err != nil {
+		return err
+	}
 
-    return err
+	return b.tx.tx.audit(b.tx.ctx, b.bucketName, fmt.Sprint(id), AuditOperationDelete)
 }
 
-// CreateBucketIfNotExists simulates bolt's bucket creation
-func (tx *PostgresTx) CreateBucketIfNotExists(bucketName []byte) (*PostgresBucket, error) {
-    // In PostgreSQL, tables are analogous to buckets
-    // This is mostly a no-op since we use a single table
-    return tx.Bucket(bucketName), nil
+// NextSequence returns the next value of the sequence of the bucket, starting at 1. Like
+// the identifiers of PostgreSQL sequences, the values consumed by rolled back transactions
+// are not reused.
+func (b *PostgresBucket) NextSequence() (uint64, error) {
+	if !b.tx.writeable {
+		return 0, ErrTxReadOnly
+	}
+
+	conn := b.tx.tx.conn
+	sequence := conn.table(bucketSequence(b.bucketName))
+
+	if err := conn.ensureSequence(b.tx.ctx, sequence); err != nil {
+		return 0, err
+	}
+
+	var value uint64
+	if err := b.tx.tx.tx.GetContext(b.tx.ctx, &value, "SELECT nextval($1)", sequence); err != nil {
+		return 0, fmt.Errorf("failed to get the next value of %s: %w", sequence, err)
+	}
+
+	return value, nil
+}
+
+// ensureSequence creates a sequence outside of the running transaction, so that it is visible
+// to the other transactions at once and is not dropped when the transaction rolls back
+func (connection *DbConnection) ensureSequence(ctx context.Context, sequence string) error {
+	if _, ok := connection.sequences.Load(sequence); ok {
+		return nil
+	}
+
+	_, err := connection.ExecContext(ctx, "CREATE SEQUENCE IF NOT EXISTS "+sequence)
+	// concurrent creations of the same sequence may fail although it exists
+	if err != nil && !isUniqueViolation(err) && !isDuplicateTable(err) {
+		return fmt.Errorf("failed to create the sequence %s: %w", sequence, err)
+	}
+
+	connection.sequences.Store(sequence, struct{}{})
+
+	return nil
+}
+
+// ForEach calls fn for every key/value pair of the bucket in the lexicographic order of the
+// keys, which are encoded as by ConvertToKey unless the bucket has text keys. It stops at the
+// first error returned by fn and returns it. The values are returned as by Get.
+func (b *PostgresBucket) ForEach(fn func(k, v []byte) error) error {
+	conn := b.tx.tx.conn
+	textKeys := conn.keyType(b.bucketName) == KeyTypeText
+
+	// the text keys are sorted byte-wise whatever the collation of the database
+	query := fmt.Sprintf("SELECT id, data FROM %s ORDER BY id", b.table())
+	if textKeys {
+		query += ` COLLATE "C"`
+	}
+
+	rows, err := b.tx.tx.tx.QueryContext(b.tx.ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var value []byte
+		if err := rows.Scan(&id, &value); err != nil {
+			return err
+		}
+
+		key := []byte(id)
+		if !textKeys {
+			n, err := strconv.Atoi(id)
+			if err != nil {
+				return err
+			}
+
+			key = conn.ConvertToKey(n)
+		}
+
+		if envelope, ok := unwrapEnvelope(value); ok {
+			value = envelope
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetAll returns the values of the bucket in the order of their keys, see ForEach. It returns
+// an empty slice when the bucket is empty.
+func (b *PostgresBucket) GetAll() ([][]byte, error) {
+	values := [][]byte{}
+	err := b.ForEach(func(_, v []byte) error {
+		values = append(values, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// GetAllKeyValues returns the key/value pairs of the bucket in the order of their keys, see
+// ForEach. It returns an empty slice when the bucket is empty.
+func (b *PostgresBucket) GetAllKeyValues() ([][2][]byte, error) {
+	pairs := [][2][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		pairs = append(pairs, [2][]byte{k, v})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+// ForEach calls fn for every key/value pair of a bucket inside a read-only transaction, see
+// PostgresBucket.ForEach. It is a no-op when the bucket does not exist.
+func (s *PostgresStore) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	return s.View(func(tx *PostgresTx) error {
+		b := tx.Bucket(bucketName)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(fn)
+	})
+}
+
+// DeleteBucket removes every key/value pair of a bucket, see PostgresTx.DeleteBucket
+func (s *PostgresStore) DeleteBucket(bucketName []byte) error {
+	return s.Update(func(tx *PostgresTx) error {
+		return tx.DeleteBucket(bucketName)
+	})
+}
+
+// DropBucketTable drops the table backing a bucket, see PostgresTx.DropBucketTable
+func (s *PostgresStore) DropBucketTable(bucketName []byte) error {
+	return s.Update(func(tx *PostgresTx) error {
+		return tx.DropBucketTable(bucketName)
+	})
+}
+
+// BucketStats holds the size of a bucket
+type BucketStats struct {
+	Count int64
+	// SizeBytes estimates the size of the bucket as the total length of its keys and values
+	SizeBytes int64
+}
+
+// Stats returns the number of key/value pairs and the estimated size of every bucket, the
+// buckets are counted within a single read-only transaction. The size of the documents is the
+// size they are stored with, they are not rendered as text to be measured.
+func (s *PostgresStore) Stats(ctx context.Context) (map[string]BucketStats, error) {
+	buckets, err := s.conn.managedTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]BucketStats, len(buckets))
+	err = s.View(func(tx *PostgresTx) error {
+		for _, bucket := range buckets {
+			var row struct {
+				Count     int64 `db:"count"`
+				SizeBytes int64 `db:"size_bytes"`
+			}
+
+			query := fmt.Sprintf(`
+				SELECT COUNT(*) AS count, COALESCE(SUM(octet_length(id::text) + pg_column_size(data)), 0) AS size_bytes
+				FROM %s
+			`, s.conn.table(bucket))
+			if err := tx.tx.tx.GetContext(ctx, &row, query); err != nil {
+				return fmt.Errorf("failed to get the stats of bucket %s: %w", bucket, translateError(err))
+			}
+
+			stats[bucket] = BucketStats{Count: row.Count, SizeBytes: row.SizeBytes}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
 }
 
 // Close the database connection
 func (s *PostgresStore) Close() error {
-    return s.db.Close()
+	return s.conn.Close()
+}
+
+// MigrateLegacyBuckets moves the rows of the legacy portainer_buckets table into
+// the per-bucket tables and drops it. It is a no-op when the legacy table does not exist.
+// It runs as the first schema migration when the connection is opened.
+func (connection *DbConnection) MigrateLegacyBuckets() error {
+	return connection.tracedTx("MigrateLegacyBuckets", "", connection.txOptions, migrateLegacyBuckets)
 }
 
-// Helper functions for serialization
-func serializeToBytes(v interface{}) ([]byte, error) {
-    return json.Marshal(v)
+func migrateLegacyBuckets(tx *DbTransaction) error {
+	ctx := tx.context()
+
+	var exists bool
+	if err := tx.tx.GetContext(ctx, &exists, "SELECT to_regclass($1) IS NOT NULL", LegacyBucketsTable); err != nil {
+		return fmt.Errorf("failed to look up %s: %w", LegacyBucketsTable, err)
+	}
+
+	if !exists {
+		return nil
+	}
+
+	log.Info().Str("component", "postgres").Str("table", LegacyBucketsTable).Msg("migrating legacy buckets to per-bucket tables")
+
+	type legacyRow struct {
+		Bucket string `db:"bucket_name"`
+		Key    []byte `db:"key"`
+		Value  []byte `db:"value"`
+	}
+
+	var rows []legacyRow
+	if err := tx.tx.SelectContext(ctx, &rows, "SELECT bucket_name, key, value FROM "+LegacyBucketsTable); err != nil {
+		return fmt.Errorf("failed to read %s: %w", LegacyBucketsTable, err)
+	}
+
+	// the rows are grouped by bucket, in the order of their first row
+	var buckets []string
+	bucketRows := make(map[string][]legacyRow)
+	for _, row := range rows {
+		if _, ok := bucketRows[row.Bucket]; !ok {
+			buckets = append(buckets, row.Bucket)
+		}
+		bucketRows[row.Bucket] = append(bucketRows[row.Bucket], row)
+	}
+
+	for _, bucket := range buckets {
+		if err := validateTableName(tx.conn.table(bucket)); err != nil {
+			return err
+		}
+
+		// a bucket holding a key that is not an integer, such as VERSION, gets text keys
+		keyType := tx.conn.keyType(bucket)
+		for _, row := range bucketRows[bucket] {
+			if _, err := keyToID(row.Key); err != nil {
+				keyType = KeyTypeText
+			}
+		}
+
+		var err error
+		if keyType == tx.conn.keyType(bucket) {
+			err = tx.SetServiceName(bucket)
+		} else {
+			err = tx.SetServiceNameWithKeyType(bucket, keyType)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to migrate bucket %s: %w", bucket, err)
+		}
+
+		query := fmt.Sprintf("INSERT INTO %s (id, data) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", tx.conn.table(bucket))
+		for _, row := range bucketRows[bucket] {
+			var id any = legacyTextKey(row.Key)
+			if keyType == KeyTypeInteger {
+				id, _ = keyToID(row.Key)
+			}
+
+			value, err := tx.conn.legacyBucketValue(row.Value)
+			if err != nil {
+				return fmt.Errorf("failed to migrate key %v of bucket %s: %w", id, bucket, err)
+			}
+
+			if _, err := tx.tx.ExecContext(ctx, query, id, value); err != nil {
+				return fmt.Errorf("failed to migrate bucket %s: %w", bucket, err)
+			}
+		}
+	}
+
+	if _, err := tx.tx.ExecContext(ctx, "DROP TABLE "+LegacyBucketsTable); err != nil {
+		return fmt.Errorf("failed to drop %s: %w", LegacyBucketsTable, err)
+	}
+
+	log.Info().Str("component", "postgres").Int("rows", len(rows)).Int("buckets", len(buckets)).Msg("legacy buckets migrated")
+
+	return nil
 }
 
-func deserializeFromBytes(data []byte, v interface{}) error {
-    return json.Unmarshal(data, v)
-}
\ No newline at end of file
+// legacyTextKey returns the id of a legacy key in a bucket with text keys, the keys that are not
+// UTF-8 text, such as the ones encoded by ConvertToKey, are turned into their decimal representation
+func legacyTextKey(key []byte) string {
+	if utf8.Valid(key) && bytes.IndexByte(key, 0) == -1 {
+		return string(key)
+	}
+
+	return changeKey(key)
+}
+
+// legacyBucketValue converts a legacy value to the data column of its bucket. The JSON documents
+// are kept as they are and the other values are carried over in an envelope: the values written
+// by MarshalObject have one already, the UTF-8 text is a raw string and anything else is taken
+// for an object encrypted before the envelopes. The envelopes are wrapped in an envelope document
+// in the JSONB data column of an unencrypted store.
+func (connection *DbConnection) legacyBucketValue(value []byte) ([]byte, error) {
+	encrypted := connection.IsEncryptedStore()
+
+	if json.Valid(value) {
+		if !encrypted {
+			return value, nil
+		}
+
+		// an encrypted store would try to decrypt the value without an envelope
+		return append(envelopeHeader(0), value...), nil
+	}
+
+	envelope := value
+	if _, _, ok := parseEnvelope(value); !ok {
+		flags := envelopeEncrypted
+		if utf8.Valid(value) {
+			flags = envelopeRawString
+		}
+
+		envelope = append(envelopeHeader(flags), value...)
+	}
+
+	if encrypted {
+		return envelope, nil
+	}
+
+	return wrapEnvelope(envelope)
+}
@@ -0,0 +1,868 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMockStore(t *testing.T) (*PostgresStore, sqlmock.Sqlmock) {
+	conn, mock := newMockConnection(t)
+
+	return &PostgresStore{conn: conn}, mock
+}
+
+func expectBucketExists(mock sqlmock.Sqlmock, bucket string, exists bool) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass($1) IS NOT NULL")).
+		WithArgs(bucket).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+}
+
+func Test_PostgresStore_ViewIsReadOnly(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectCommit()
+
+	err := store.View(func(tx *PostgresTx) error {
+		b := tx.Bucket([]byte("endpoints"))
+		assert.NotNil(t, b)
+
+		assert.ErrorIs(t, b.Put([]byte("1"), []byte(`{}`)), ErrTxReadOnly)
+		assert.ErrorIs(t, b.Delete([]byte("1")), ErrTxReadOnly)
+
+		_, err := tx.CreateBucketIfNotExists([]byte("stacks"))
+		assert.ErrorIs(t, err, ErrTxReadOnly)
+
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_ViewReadsFromReplica(t *testing.T) {
+	conn, primary, replica := newReplicaMockConnection(t)
+	store := &PostgresStore{conn: conn}
+
+	replica.ExpectBegin()
+	expectBucketExists(replica, "endpoints", true)
+	replica.ExpectQuery(regexp.QuoteMeta("SELECT data FROM endpoints WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"replica"}`)))
+	replica.ExpectCommit()
+
+	err := store.View(func(tx *PostgresTx) error {
+		assert.Equal(t, []byte(`{"Name":"replica"}`), tx.Bucket([]byte("endpoints")).Get(conn.ConvertToKey(1)))
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, replica.ExpectationsWereMet())
+	require.NoError(t, primary.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_MissingBucketAndKey(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "stacks", false)
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM endpoints WHERE id = $1")).
+		WithArgs(7).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM endpoints WHERE id = $1")).
+		WithArgs(8).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Id":8}`)))
+	mock.ExpectCommit()
+
+	err := store.View(func(tx *PostgresTx) error {
+		assert.Nil(t, tx.Bucket([]byte("stacks")))
+
+		b := tx.Bucket([]byte("endpoints"))
+		assert.Nil(t, b.Get(conn.ConvertToKey(7)))
+		assert.Equal(t, []byte(`{"Id":8}`), b.Get([]byte("8")))
+
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_Update(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS endpoints")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "endpoints")
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO endpoints (id, data)")).
+		WithArgs(1, []byte(`{"Id":1}`)).
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM endpoints WHERE id = $1")).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := store.Update(func(tx *PostgresTx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("endpoints"))
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put(conn.ConvertToKey(1), []byte(`{"Id":1}`)); err != nil {
+			return err
+		}
+
+		return b.Delete([]byte("2"))
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_ForEach(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+
+	rows := sqlmock.NewRows([]string{"id", "data"})
+	for id := 1; id <= 10; id++ {
+		rows.AddRow(id, []byte(fmt.Sprintf(`{"Id":%d}`, id)))
+	}
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM endpoints ORDER BY id")).WillReturnRows(rows)
+	mock.ExpectCommit()
+
+	var keys, values [][]byte
+	err := store.ForEach([]byte("endpoints"), func(k, v []byte) error {
+		keys = append(keys, k)
+		values = append(values, v)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Len(t, keys, 10)
+	assert.True(t, slices.IsSortedFunc(keys, bytes.Compare))
+	for i, k := range keys {
+		assert.Equal(t, conn.ConvertToKey(i+1), k)
+		assert.Equal(t, fmt.Sprintf(`{"Id":%d}`, i+1), string(values[i]))
+	}
+}
+
+func Test_PostgresStore_ForEachStops(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM endpoints ORDER BY id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+			AddRow(1, []byte(`{"Id":1}`)).
+			AddRow(2, []byte(`{"Id":2}`)).
+			AddRow(3, []byte(`{"Id":3}`)))
+	mock.ExpectRollback()
+
+	stop := errors.New("stop")
+	visited := 0
+	err := store.ForEach([]byte("endpoints"), func(k, v []byte) error {
+		visited++
+		if visited == 2 {
+			return stop
+		}
+
+		return nil
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 2, visited)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_ForEachMissingBucket(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "stacks", false)
+	mock.ExpectCommit()
+
+	err := store.ForEach([]byte("stacks"), func(k, v []byte) error {
+		t.Error("fn must not be called for a missing bucket")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_MigrateLegacyBuckets(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass($1) IS NOT NULL")).
+		WithArgs(LegacyBucketsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT bucket_name, key, value FROM portainer_buckets")).
+		WillReturnRows(sqlmock.NewRows([]string{"bucket_name", "key", "value"}).
+			AddRow("endpoints", conn.ConvertToKey(1), []byte(`{"Id":1}`)).
+			AddRow("endpoints", conn.ConvertToKey(2), []byte(`{"Id":2}`)).
+			AddRow("settings", []byte("1"), []byte(`{"LogoURL":""}`)))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS endpoints")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "endpoints")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO endpoints (id, data) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING")).
+		WithArgs(1, []byte(`{"Id":1}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO endpoints (id, data) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING")).
+		WithArgs(2, []byte(`{"Id":2}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS settings")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "settings")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO settings (id, data) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING")).
+		WithArgs(1, []byte(`{"LogoURL":""}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE portainer_buckets")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	assert.NoError(t, conn.MigrateLegacyBuckets())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_MigrateLegacyBuckets_StringKeysAndRawValues(t *testing.T) {
+	const (
+		registryQuery = "SELECT key_type FROM bucket_registry WHERE bucket_name = $1"
+		columnQuery   = "SELECT data_type FROM information_schema.columns"
+		insert        = "INSERT INTO %s (id, data) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING"
+	)
+
+	conn, mock := newMockConnection(t)
+
+	// the version bucket has text keys by default, edge_jobs gets them from its composite key
+	// and the value of users was encrypted before the envelopes
+	encrypted := []byte{0x8f, 0x01, 0xfe, 0x42, 0x00, 0x99}
+	version, edgeJob, user := &capturedArg{}, &capturedArg{}, &capturedArg{}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT to_regclass($1) IS NOT NULL")).
+		WithArgs(LegacyBucketsTable).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT bucket_name, key, value FROM portainer_buckets")).
+		WillReturnRows(sqlmock.NewRows([]string{"bucket_name", "key", "value"}).
+			AddRow("version", []byte("VERSION"), []byte("2.21.0")).
+			AddRow("edge_jobs", conn.ConvertToKey(1), []byte(`{"Id":1}`)).
+			AddRow("edge_jobs", []byte("5.edge.async"), []byte(`{"Id":5}`)).
+			AddRow("users", conn.ConvertToKey(1), encrypted))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS version (id TEXT PRIMARY KEY")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "version")
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(insert, "version"))).WithArgs("VERSION", version).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS bucket_registry")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(registryQuery)).WithArgs("edge_jobs").WillReturnRows(sqlmock.NewRows([]string{"key_type"}))
+	mock.ExpectQuery(regexp.QuoteMeta(columnQuery)).WithArgs("edge_jobs").WillReturnRows(sqlmock.NewRows([]string{"data_type"}))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS edge_jobs (id TEXT PRIMARY KEY")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "edge_jobs")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO bucket_registry")).WithArgs("edge_jobs", KeyTypeText).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(insert, "edge_jobs"))).WithArgs("1", []byte(`{"Id":1}`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(insert, "edge_jobs"))).WithArgs("5.edge.async", edgeJob).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "users")
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(insert, "users"))).WithArgs(1, user).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE portainer_buckets")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.MigrateLegacyBuckets())
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, KeyTypeText, conn.keyType("edge_jobs"))
+
+	// the raw string is read back through its envelope document
+	var s string
+	require.NoError(t, conn.decodeObject("version", []byte("VERSION"), version.value.([]byte), &s))
+	assert.Equal(t, "2.21.0", s)
+
+	assert.Equal(t, []byte(`{"Id":5}`), edgeJob.value)
+
+	// the encrypted value is carried over as it is, it needs the key to be read
+	envelope, ok := unwrapEnvelope(user.value.([]byte))
+	require.True(t, ok)
+	flags, payload, ok := parseEnvelope(envelope)
+	require.True(t, ok)
+	assert.Equal(t, envelopeEncrypted, flags)
+	assert.Equal(t, encrypted, payload)
+
+	var object map[string]any
+	assert.ErrorIs(t, conn.decodeObject("users", conn.ConvertToKey(1), user.value.([]byte), &object), ErrHaveEncryptedWithNoKey)
+}
+
+func Test_legacyBucketValue_EncryptedStore(t *testing.T) {
+	conn, _ := newMockConnection(t)
+	conn.EncryptionKey = secretToEncryptionKey(passphrase)
+	conn.SetEncrypted(true)
+
+	legacy, err := encrypt([]byte(`{"Username":"admin"}`), conn.EncryptionKey)
+	require.NoError(t, err)
+
+	// the data column is BYTEA, every value is stored as an envelope
+	for _, value := range [][]byte{[]byte(`{"Username":"admin"}`), legacy} {
+		data, err := conn.legacyBucketValue(value)
+		require.NoError(t, err)
+
+		_, _, ok := parseEnvelope(data)
+		require.True(t, ok)
+
+		var user map[string]any
+		require.NoError(t, conn.decodeObject("users", conn.ConvertToKey(1), data, &user))
+		assert.Equal(t, "admin", user["Username"])
+	}
+
+	data, err := conn.legacyBucketValue([]byte("2.21.0"))
+	require.NoError(t, err)
+
+	var s string
+	require.NoError(t, conn.decodeObject("version", []byte("VERSION"), data, &s))
+	assert.Equal(t, "2.21.0", s)
+}
+
+func Test_PostgresStore_TextKeys(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+	conn.keyTypes.Store("edge_jobs", KeyTypeText)
+
+	envelope := append(envelopeHeader(envelopeRawString), "raw"...)
+	document, err := wrapEnvelope(envelope)
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "edge_jobs", true)
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO edge_jobs (id, data)")).
+		WithArgs("5.edge.async", []byte(`{"Id":5}`)).
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM edge_jobs WHERE id = $1")).
+		WithArgs("5.edge.async").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Id":5}`)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM edge_jobs WHERE id = $1")).
+		WithArgs("raw").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(document))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, data FROM edge_jobs ORDER BY id COLLATE "C"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).
+			AddRow("5.edge.async", []byte(`{"Id":5}`)).
+			AddRow("raw", document))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM edge_jobs WHERE id = $1")).
+		WithArgs("5.edge.async").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = store.Update(func(tx *PostgresTx) error {
+		b := tx.Bucket([]byte("edge_jobs"))
+
+		require.NoError(t, b.Put([]byte("5.edge.async"), []byte(`{"Id":5}`)))
+		assert.Equal(t, []byte(`{"Id":5}`), b.Get([]byte("5.edge.async")))
+
+		// the values carried over in an envelope document are returned as their envelope
+		assert.Equal(t, envelope, b.Get([]byte("raw")))
+
+		pairs, err := b.GetAllKeyValues()
+		require.NoError(t, err)
+		assert.Equal(t, [][2][]byte{
+			{[]byte("5.edge.async"), []byte(`{"Id":5}`)},
+			{[]byte("raw"), envelope},
+		}, pairs)
+
+		return b.Delete([]byte("5.edge.async"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_KeyToID(t *testing.T) {
+	conn := DbConnection{}
+
+	for _, tc := range []struct {
+		key      []byte
+		expected int
+	}{
+		{key: conn.ConvertToKey(0), expected: 0},
+		{key: conn.ConvertToKey(42), expected: 42},
+		{key: []byte("42"), expected: 42},
+		{key: []byte("12345678"), expected: 12345678},
+	} {
+		id, err := keyToID(tc.key)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, id)
+	}
+
+	_, err := keyToID([]byte("edge.async"))
+	assert.Error(t, err)
+}
+
+func Test_PostgresBucket_NextSequence(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "webhooks", true)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE SEQUENCE IF NOT EXISTS seq_webhooks")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT nextval($1)")).WithArgs("seq_webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT nextval($1)")).WithArgs("seq_webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(2))
+	mock.ExpectCommit()
+
+	err := store.Update(func(tx *PostgresTx) error {
+		b := tx.Bucket([]byte("webhooks"))
+
+		// the sequence is only created once
+		for _, expected := range []uint64{1, 2} {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, expected, id)
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresBucket_NextSequenceReadOnly(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "webhooks", true)
+	mock.ExpectCommit()
+
+	err := store.View(func(tx *PostgresTx) error {
+		_, err := tx.Bucket([]byte("webhooks")).NextSequence()
+		assert.ErrorIs(t, err, ErrTxReadOnly)
+
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresBucket_NextSequence_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "sequence_test")
+	t.Cleanup(func() {
+		conn.Exec("DROP SEQUENCE IF EXISTS seq_sequence_test")
+	})
+	store := &PostgresStore{conn: conn}
+
+	err := store.Update(func(tx *PostgresTx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("sequence_test"))
+		return err
+	})
+	require.NoError(t, err)
+
+	const goroutines, calls = 10, 10
+
+	var wg sync.WaitGroup
+	results := make([][]uint64, goroutines)
+	for i := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range calls {
+				err := store.Update(func(tx *PostgresTx) error {
+					id, err := tx.Bucket([]byte("sequence_test")).NextSequence()
+					results[i] = append(results[i], id)
+					return err
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var all []uint64
+	for _, values := range results {
+		assert.True(t, slices.IsSorted(values), "the values of a goroutine must increase")
+		all = append(all, values...)
+	}
+
+	slices.Sort(all)
+	require.Len(t, all, goroutines*calls)
+	for i, id := range all {
+		assert.Equal(t, uint64(i+1), id)
+	}
+}
+
+func Test_PostgresStore_DeleteBucket(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+	conn.sequences.Store("seq_endpoints", struct{}{})
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS endpoints")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "endpoints")
+	for id := 1; id <= 3; id++ {
+		mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO endpoints")).WithArgs(id, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+	}
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM endpoints")).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta("DROP SEQUENCE IF EXISTS seq_endpoints")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM endpoints ORDER BY id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	for id := 1; id <= 3; id++ {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM endpoints WHERE id = $1")).WithArgs(id).
+			WillReturnError(sql.ErrNoRows)
+	}
+	mock.ExpectCommit()
+
+	err := store.Update(func(tx *PostgresTx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("endpoints"))
+		if err != nil {
+			return err
+		}
+
+		for id := 1; id <= 3; id++ {
+			if err := b.Put(conn.ConvertToKey(id), []byte(`{}`)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.DeleteBucket([]byte("endpoints")))
+
+	_, ok := conn.sequences.Load("seq_endpoints")
+	assert.False(t, ok)
+
+	err = store.ForEach([]byte("endpoints"), func(k, v []byte) error {
+		t.Error("the bucket must be empty")
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = store.View(func(tx *PostgresTx) error {
+		b := tx.Bucket([]byte("endpoints"))
+		for id := 1; id <= 3; id++ {
+			assert.Nil(t, b.Get(conn.ConvertToKey(id)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_DeleteMissingBucket(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "stacks", false)
+	mock.ExpectRollback()
+
+	err := store.DeleteBucket([]byte("stacks"))
+	assert.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_DropBucketTable(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DROP TABLE IF EXISTS endpoints")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DROP SEQUENCE IF EXISTS seq_endpoints")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", false)
+	mock.ExpectCommit()
+
+	require.NoError(t, store.DropBucketTable([]byte("endpoints")))
+
+	err := store.View(func(tx *PostgresTx) error {
+		assert.Nil(t, tx.Bucket([]byte("endpoints")))
+		assert.ErrorIs(t, tx.DropBucketTable([]byte("endpoints")), ErrTxReadOnly)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Error(t, store.DropBucketTable([]byte("invalid name")))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_DeleteBucket_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "delete_bucket_test")
+	store := &PostgresStore{conn: conn}
+
+	err := store.Update(func(tx *PostgresTx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("delete_bucket_test"))
+		if err != nil {
+			return err
+		}
+
+		for id := 1; id <= 5; id++ {
+			if err := b.Put(conn.ConvertToKey(id), []byte(`{"Id":1}`)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.DeleteBucket([]byte("delete_bucket_test")))
+
+	visited := 0
+	require.NoError(t, store.ForEach([]byte("delete_bucket_test"), func(k, v []byte) error {
+		visited++
+		return nil
+	}))
+	assert.Zero(t, visited)
+
+	err = store.View(func(tx *PostgresTx) error {
+		for id := 1; id <= 5; id++ {
+			assert.Nil(t, tx.Bucket([]byte("delete_bucket_test")).Get(conn.ConvertToKey(id)))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.DropBucketTable([]byte("delete_bucket_test")))
+	err = store.View(func(tx *PostgresTx) error {
+		assert.Nil(t, tx.Bucket([]byte("delete_bucket_test")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func Test_PostgresStore_Stats(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT table_name")).
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("endpoints").AddRow("stacks"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) AS count, COALESCE(SUM(octet_length(id::text) + pg_column_size(data)), 0) AS size_bytes")).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "size_bytes"}).AddRow(3, 42))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) AS count, .+ FROM stacks`).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "size_bytes"}).AddRow(0, 0))
+	mock.ExpectCommit()
+
+	stats, err := store.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]BucketStats{
+		"endpoints": {Count: 3, SizeBytes: 42},
+		"stacks":    {},
+	}, stats)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresStore_Stats_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "stats_small", "stats_large")
+	store := &PostgresStore{conn: conn}
+
+	// the keys are stored as integers, "1" to "9" is a byte once formatted, every row is
+	// the same size
+	value := []byte(`"abcd"`)
+	counts := map[string]int{"stats_small": 2, "stats_large": 7}
+
+	err := store.Update(func(tx *PostgresTx) error {
+		for bucket, count := range counts {
+			b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+
+			for id := 1; id <= count; id++ {
+				if err := b.Put(conn.ConvertToKey(id), value); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	stats, err := store.Stats(context.Background())
+	require.NoError(t, err)
+
+	for bucket, count := range counts {
+		assert.Equal(t, int64(count), stats[bucket].Count, bucket)
+	}
+
+	rowSize := stats["stats_small"].SizeBytes / 2
+	assert.Positive(t, rowSize)
+	assert.Equal(t, 7*rowSize, stats["stats_large"].SizeBytes)
+}
+
+func Test_PostgresStoreConfig_Validate(t *testing.T) {
+	valid := PostgresStoreConfig{Host: "db.local", Port: "5432", DBName: "portainer", User: "portainer"}
+	require.NoError(t, valid.Validate())
+
+	for name, mutate := range map[string]func(*PostgresStoreConfig){
+		"missing host":      func(cfg *PostgresStoreConfig) { cfg.Host = "" },
+		"missing database":  func(cfg *PostgresStoreConfig) { cfg.DBName = "" },
+		"non-numeric port":  func(cfg *PostgresStoreConfig) { cfg.Port = "postgres" },
+		"port out of range": func(cfg *PostgresStoreConfig) { cfg.Port = "65536" },
+		"zero port":         func(cfg *PostgresStoreConfig) { cfg.Port = "0" },
+		"negative timeout":  func(cfg *PostgresStoreConfig) { cfg.ConnectTimeout = -time.Second },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			mutate(&cfg)
+
+			assert.ErrorIs(t, cfg.Validate(), ErrInvalidConfig)
+
+			_, err := NewPostgresStore(cfg)
+			assert.ErrorIs(t, err, ErrInvalidConfig)
+		})
+	}
+
+	t.Run("default port", func(t *testing.T) {
+		cfg := valid
+		cfg.Port = ""
+
+		assert.NoError(t, cfg.Validate())
+	})
+}
+
+func Test_PostgresStoreConfig_DSN(t *testing.T) {
+	cfg := PostgresStoreConfig{
+		Host:           "db.local",
+		Port:           "5433",
+		DBName:         "portainer",
+		User:           "portainer",
+		Password:       "p@ss word",
+		ConnectTimeout: 1500 * time.Millisecond,
+	}
+	assert.Equal(t, `host=db.local port=5433 dbname=portainer user=portainer password='p@ss word' sslmode=disable connect_timeout=2`, cfg.DSN())
+
+	cfg = PostgresStoreConfig{Host: "db.local", DBName: "portainer", SSLMode: "verify-full"}
+	assert.Equal(t, `host=db.local dbname=portainer sslmode=verify-full`, cfg.DSN())
+}
+
+func Test_PostgresBucket_GetAll(t *testing.T) {
+	store, mock := newMockStore(t)
+	conn := store.conn
+
+	rows := func() *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "data"})
+		for id := 1; id <= 5; id++ {
+			rows.AddRow(id, []byte(fmt.Sprintf(`{"Id":%d}`, id)))
+		}
+
+		return rows
+	}
+
+	mock.ExpectBegin()
+	expectBucketExists(mock, "endpoints", true)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM endpoints ORDER BY id")).WillReturnRows(rows())
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM endpoints ORDER BY id")).WillReturnRows(rows())
+	expectBucketExists(mock, "stacks", true)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM stacks ORDER BY id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM stacks ORDER BY id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}))
+	mock.ExpectCommit()
+
+	err := store.View(func(tx *PostgresTx) error {
+		b := tx.Bucket([]byte("endpoints"))
+
+		values, err := b.GetAll()
+		require.NoError(t, err)
+
+		pairs, err := b.GetAllKeyValues()
+		require.NoError(t, err)
+
+		require.Len(t, values, 5)
+		require.Len(t, pairs, 5)
+		for i, pair := range pairs {
+			assert.Equal(t, conn.ConvertToKey(i+1), pair[0])
+			assert.Equal(t, values[i], pair[1])
+			assert.Equal(t, fmt.Sprintf(`{"Id":%d}`, i+1), string(values[i]))
+		}
+
+		empty := tx.Bucket([]byte("stacks"))
+
+		values, err = empty.GetAll()
+		require.NoError(t, err)
+		assert.NotNil(t, values)
+		assert.Empty(t, values)
+
+		pairs, err = empty.GetAllKeyValues()
+		require.NoError(t, err)
+		assert.NotNil(t, pairs)
+		assert.Empty(t, pairs)
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_PostgresBucket_GetAll_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "get_all_test")
+	store := &PostgresStore{conn: conn}
+
+	// inserted out of order, read back in the order of the keys
+	ids := []int{3, 1, 300, 2, 20}
+	err := store.Update(func(tx *PostgresTx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("get_all_test"))
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := b.Put(conn.ConvertToKey(id), []byte(fmt.Sprintf(`{"Id": %d}`, id))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = store.View(func(tx *PostgresTx) error {
+		b := tx.Bucket([]byte("get_all_test"))
+
+		values, err := b.GetAll()
+		require.NoError(t, err)
+
+		pairs, err := b.GetAllKeyValues()
+		require.NoError(t, err)
+
+		sorted := slices.Clone(ids)
+		slices.Sort(sorted)
+
+		require.Len(t, pairs, len(sorted))
+		for i, id := range sorted {
+			assert.Equal(t, conn.ConvertToKey(id), pairs[i][0])
+			assert.Equal(t, values[i], pairs[i][1])
+			assert.JSONEq(t, fmt.Sprintf(`{"Id": %d}`, id), string(values[i]))
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+}
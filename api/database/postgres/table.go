@@ -0,0 +1,230 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// identifierPattern matches the unquoted identifiers accepted for bucket tables
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// jsonPathElementPattern matches the object keys and array indexes accepted in an index path
+var jsonPathElementPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// namespacePattern matches the schemas and table prefixes, they are lowercase as PostgreSQL
+// folds the unquoted identifiers to lowercase
+var namespacePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// WithSchema stores the tables in schema rather than in public, Open creates it when missing
+// and makes it the search_path of every connection
+func WithSchema(schema string) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.schema = schema
+	}
+}
+
+// WithTablePrefix prepends prefix to the name of every table, so that the tables of Portainer
+// can live alongside the tables of other applications. The buckets keep their name.
+func WithTablePrefix(prefix string) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.tablePrefix = prefix
+	}
+}
+
+// validateNamespace checks the schema and the table prefix of the connection
+func (connection *DbConnection) validateNamespace() error {
+	if connection.schema != "" && !namespacePattern.MatchString(connection.schema) {
+		return fmt.Errorf("invalid schema %q", connection.schema)
+	}
+
+	if connection.tablePrefix != "" && !namespacePattern.MatchString(connection.tablePrefix) {
+		return fmt.Errorf("invalid table prefix %q", connection.tablePrefix)
+	}
+
+	return nil
+}
+
+// table returns the name of the table of a bucket
+func (connection *DbConnection) table(bucketName string) string {
+	return connection.tablePrefix + bucketName
+}
+
+// bucketOf returns the bucket of a table, ok is false for the tables outside of the prefix
+func (connection *DbConnection) bucketOf(table string) (bucketName string, ok bool) {
+	bucketName, ok = strings.CutPrefix(table, connection.tablePrefix)
+
+	return bucketName, ok && bucketName != ""
+}
+
+// searchPathConnectionString returns dsn with the schema of the connection as search_path
+func (connection *DbConnection) searchPathConnectionString(dsn string) string {
+	if connection.schema == "" {
+		return dsn
+	}
+
+	return withRuntimeParameters(dsn, map[string]string{"search_path": connection.schema})
+}
+
+// ColumnDef describes an extra column added to a bucket table
+type ColumnDef struct {
+	Name        string
+	Type        string
+	Constraints string
+}
+
+// validateTableName makes sure a table name can be safely interpolated into a query
+func validateTableName(name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidTableName, name)
+	}
+
+	return nil
+}
+
+// bucketTableQuery returns the statement creating the table of a bucket with keys of the given
+// type and the extra columns, unless it exists. It is shared by EnsureTableExists and
+// SetServiceName.
+func (connection *DbConnection) bucketTableQuery(name string, keyType KeyType, columns []ColumnDef) (string, error) {
+	table := connection.table(name)
+	if err := validateTableName(table); err != nil {
+		return "", err
+	}
+
+	definitions := []string{
+		keyType.idColumn(),
+		"data " + connection.dataColumnType() + " NOT NULL",
+		versionColumn,
+		createdAtColumn,
+		updatedAtColumn,
+	}
+
+	for _, column := range columns {
+		if err := validateTableName(column.Name); err != nil {
+			return "", fmt.Errorf("invalid column for table %s: %w", name, err)
+		}
+
+		definitions = append(definitions, strings.TrimSpace(fmt.Sprintf("%s %s %s", column.Name, column.Type, column.Constraints)))
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(definitions, ", ")), nil
+}
+
+// EnsureTableExists creates the bucket table and its extra columns if it does not exist yet.
+// It runs outside of any transaction and is safe to call repeatedly.
+func (connection *DbConnection) EnsureTableExists(ctx context.Context, name string, columns []ColumnDef) (err error) {
+	ctx, end := connection.startSpan(ctx, "EnsureTableExists", name)
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	return connection.createTable(ctx, connection.DB, name, columns)
+}
+
+// createTable creates the table of a bucket and its extra columns unless it exists, the
+// statements are run by execer so that a transaction can roll the creation back
+func (connection *DbConnection) createTable(ctx context.Context, execer sqlx.ExecerContext, name string, columns []ColumnDef) error {
+	query, err := connection.bucketTableQuery(name, connection.keyType(name), columns)
+	if err != nil {
+		return err
+	}
+
+	if _, err := execer.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create table %s: %w", connection.table(name), err)
+	}
+
+	if err := connection.addTimestampColumns(ctx, execer, name); err != nil {
+		return err
+	}
+
+	if connection.auditTriggers {
+		if err := connection.installAuditTrigger(ctx, execer, name); err != nil {
+			return err
+		}
+	}
+
+	if connection.changeTracking {
+		return connection.installChangeTrigger(ctx, execer, name)
+	}
+
+	return nil
+}
+
+// EnsureJsonIndex creates an index on the value found at path in the data column of a bucket,
+// or a GIN index on the whole data column when path is empty. Nothing is done when an index
+// with the same name already exists, the table prefix applies to the name of the index. It
+// returns ErrEncryptedStore on an encrypted store.
+func (connection *DbConnection) EnsureJsonIndex(bucketName string, name string, path []string, unique bool) (err error) {
+	_, end := connection.startSpan(connection.ctx, "EnsureJsonIndex", bucketName)
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return ErrNoConnection
+	}
+
+	if connection.IsEncryptedStore() {
+		return fmt.Errorf("%w: cannot index encrypted objects", ErrEncryptedStore)
+	}
+
+	table := connection.table(bucketName)
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	// the index names share the namespace of the tables
+	index := connection.table(name)
+	if !identifierPattern.MatchString(name) || !identifierPattern.MatchString(index) {
+		return fmt.Errorf("invalid index name %q", name)
+	}
+
+	for _, element := range path {
+		if !jsonPathElementPattern.MatchString(element) {
+			return fmt.Errorf("invalid element %q in the path of index %s", element, name)
+		}
+	}
+
+	if len(path) == 0 && unique {
+		return fmt.Errorf("index %s: a GIN index cannot be unique", name)
+	}
+
+	// Unquoted identifiers are stored in lowercase
+	var exists bool
+	err = connection.GetContext(connection.ctx, &exists, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_indexes
+			WHERE schemaname = current_schema() AND indexname = $1
+		)`, strings.ToLower(index))
+	if err != nil {
+		return fmt.Errorf("failed to look up index %s: %w", name, err)
+	}
+
+	if exists {
+		return nil
+	}
+
+	var query string
+	if len(path) == 0 {
+		query = fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (data)", index, table)
+	} else {
+		kind := "INDEX"
+		if unique {
+			kind = "UNIQUE INDEX"
+		}
+
+		query = fmt.Sprintf("CREATE %s IF NOT EXISTS %s ON %s ((data #>> '{%s}'))", kind, index, table, strings.Join(path, ","))
+	}
+
+	if _, err := connection.ExecContext(connection.ctx, query); err != nil {
+		return fmt.Errorf("failed to create index %s on %s: %w", index, table, err)
+	}
+
+	log.Debug().Str("component", "postgres").Str("bucket", bucketName).Str("index", name).Msg("JSON index created")
+
+	return nil
+}
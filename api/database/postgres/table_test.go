@@ -0,0 +1,270 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EnsureTableExists(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	createQuery := "CREATE TABLE IF NOT EXISTS columns_test (id INTEGER PRIMARY KEY, data JSONB NOT NULL, " +
+		versionColumn + ", " + createdAtColumn + ", " + updatedAtColumn
+
+	mock.ExpectExec(regexp.QuoteMeta(createQuery + ", archived_at TIMESTAMPTZ NOT NULL DEFAULT now())")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "columns_test")
+
+	// SetServiceName creates the same table inside the transaction, the timestamp columns are
+	// known to exist
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(createQuery + ")")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	columns := []ColumnDef{{Name: "archived_at", Type: "TIMESTAMPTZ", Constraints: "NOT NULL DEFAULT now()"}}
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "columns_test", columns))
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.SetServiceName("columns_test")
+	}))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	err := conn.EnsureTableExists(context.Background(), "columns_test", []ColumnDef{{Name: "archived_at; DROP TABLE users", Type: "TEXT"}})
+	assert.ErrorIs(t, err, ErrInvalidTableName)
+}
+
+func Test_EnsureTableExists_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "columns_test")
+
+	columns := []ColumnDef{{Name: "archived_at", Type: "TIMESTAMPTZ", Constraints: "NOT NULL DEFAULT now()"}}
+	for range 2 {
+		require.NoError(t, conn.EnsureTableExists(context.Background(), "columns_test", columns))
+	}
+
+	var found []struct {
+		Name     string `db:"column_name"`
+		DataType string `db:"data_type"`
+		Nullable string `db:"is_nullable"`
+	}
+	err := conn.Select(&found, `
+		SELECT column_name, data_type, is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'columns_test'
+		ORDER BY ordinal_position
+	`)
+	require.NoError(t, err)
+
+	require.Len(t, found, 6)
+	assert.Equal(t, "id", found[0].Name)
+	assert.Equal(t, "integer", found[0].DataType)
+	assert.Equal(t, "data", found[1].Name)
+	assert.Equal(t, "jsonb", found[1].DataType)
+	assert.Equal(t, "version", found[2].Name)
+	assert.Equal(t, "created_at", found[3].Name)
+	assert.Equal(t, "updated_at", found[4].Name)
+	assert.Equal(t, "archived_at", found[5].Name)
+	assert.Equal(t, "timestamp with time zone", found[5].DataType)
+	assert.Equal(t, "NO", found[5].Nullable)
+}
+
+func Test_EnsureJsonIndex(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("stacks_endpoint_idx").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS stacks_endpoint_idx ON stacks ((data #>> '{EndpointId}'))")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("users_username_idx").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE UNIQUE INDEX IF NOT EXISTS users_username_idx ON users ((data #>> '{Profile,Username}'))")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("endpoints_data_idx").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS endpoints_data_idx ON endpoints USING GIN (data)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// the index already exists
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("stacks_endpoint_idx").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	require.NoError(t, conn.EnsureJsonIndex("stacks", "stacks_endpoint_idx", []string{"EndpointId"}, false))
+	require.NoError(t, conn.EnsureJsonIndex("users", "users_username_idx", []string{"Profile", "Username"}, true))
+	require.NoError(t, conn.EnsureJsonIndex("endpoints", "endpoints_data_idx", nil, false))
+	require.NoError(t, conn.EnsureJsonIndex("stacks", "stacks_endpoint_idx", []string{"EndpointId"}, false))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_EnsureJsonIndex_Rejected(t *testing.T) {
+	conn, _ := newMockConnection(t)
+
+	assert.ErrorIs(t, conn.EnsureJsonIndex("stacks; DROP TABLE users", "idx", []string{"Name"}, false), ErrInvalidTableName)
+	assert.Error(t, conn.EnsureJsonIndex("stacks", "idx; DROP TABLE users", []string{"Name"}, false))
+	assert.Error(t, conn.EnsureJsonIndex("stacks", "idx", []string{"Name}'))); DROP TABLE users; --"}, false))
+	assert.Error(t, conn.EnsureJsonIndex("stacks", "idx", nil, true))
+
+	conn.EncryptionKey = []byte("secret")
+	conn.SetEncrypted(true)
+	assert.ErrorIs(t, conn.EnsureJsonIndex("stacks", "idx", []string{"Name"}, false), ErrEncryptedStore)
+}
+
+func Test_EnsureJsonIndex_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "index_test")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "index_test", nil))
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, conn.EnsureJsonIndex("index_test", "index_test_name_idx", []string{"Name"}, true))
+		require.NoError(t, conn.EnsureJsonIndex("index_test", "index_test_data_idx", nil, false))
+	}
+
+	var definitions []string
+	require.NoError(t, conn.Select(&definitions, "SELECT indexdef FROM pg_indexes WHERE tablename = 'index_test' AND indexname LIKE 'index_test_%_idx' ORDER BY indexname"))
+	require.Len(t, definitions, 2)
+	assert.Contains(t, definitions[0], "USING gin (data)")
+	assert.Contains(t, definitions[1], "CREATE UNIQUE INDEX")
+
+	require.NoError(t, conn.CreateObjectWithId("index_test", 1, map[string]any{"Name": "local"}))
+	assert.Error(t, conn.CreateObjectWithId("index_test", 2, map[string]any{"Name": "local"}))
+}
+
+func Test_TablePrefix(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	conn.tablePrefix = "pt_"
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS pt_endpoints")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTimestampColumns(mock, "pt_endpoints")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO pt_endpoints (id, data) VALUES ($1, $2)")).WithArgs(1, []byte(`{"Id":1}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM pt_endpoints WHERE id = $1")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Id":1}`)))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE pt_endpoints SET data = $1, version = version + 1, updated_at = now() WHERE id = $2")).WithArgs([]byte(`{"Id":2}`), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM pt_endpoints")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", []byte(`{"Id":2}`)))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM pt_endpoints WHERE id = $1")).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		require.NoError(t, tx.SetServiceName("endpoints"))
+		require.NoError(t, tx.CreateObjectWithId("endpoints", 1, map[string]int{"Id": 1}))
+
+		var endpoint map[string]int
+		require.NoError(t, tx.GetObject("endpoints", []byte("1"), &endpoint))
+		assert.Equal(t, 1, endpoint["Id"])
+
+		require.NoError(t, tx.UpdateObject("endpoints", []byte("1"), map[string]int{"Id": 2}))
+
+		var endpoints []map[string]int
+		require.NoError(t, tx.GetAll("endpoints", &map[string]int{}, func(o any) (any, error) {
+			endpoints = append(endpoints, *o.(*map[string]int))
+			return &map[string]int{}, nil
+		}))
+		assert.Equal(t, []map[string]int{{"Id": 2}}, endpoints)
+
+		return tx.DeleteObject("endpoints", []byte("1"))
+	})
+	require.NoError(t, err)
+
+	// the buckets keep their name, the tables outside of the prefix are ignored
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT table_name")).
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("endpoints").AddRow("pt_endpoints").AddRow("pt_stacks"))
+
+	buckets, err := conn.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"endpoints", "stacks"}, buckets)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_validateNamespace(t *testing.T) {
+	for _, conn := range []*DbConnection{
+		{},
+		{schema: "portainer", tablePrefix: "pt_"},
+		{schema: "_shared2"},
+	} {
+		assert.NoError(t, conn.validateNamespace())
+	}
+
+	for _, conn := range []*DbConnection{
+		{schema: "Portainer"},
+		{schema: "shared; DROP SCHEMA public"},
+		{tablePrefix: "pt-"},
+		{tablePrefix: "1pt_"},
+	} {
+		assert.Error(t, conn.validateNamespace(), "schema %q, prefix %q", conn.schema, conn.tablePrefix)
+	}
+
+	// the combined names are validated
+	conn := &DbConnection{tablePrefix: strings.Repeat("p", 60), connectionState: &connectionState{}}
+	assert.ErrorIs(t, conn.EnsureTableExists(context.Background(), "endpoints", nil), ErrNoConnection)
+	conn.DB = &sqlx.DB{}
+	assert.ErrorIs(t, conn.EnsureTableExists(context.Background(), "endpoints", nil), ErrInvalidTableName)
+}
+
+func Test_searchPathConnectionString(t *testing.T) {
+	conn := &DbConnection{}
+	assert.Equal(t, "host=localhost", conn.searchPathConnectionString("host=localhost"))
+
+	conn.schema = "portainer"
+	assert.Equal(t, "host=localhost search_path=portainer", conn.searchPathConnectionString("host=localhost"))
+	assert.Equal(t, "postgres://localhost/portainer?search_path=portainer", conn.searchPathConnectionString("postgres://localhost/portainer"))
+}
+
+func Test_SchemaAndTablePrefix_RealDatabase(t *testing.T) {
+	const schema = "portainer_shared_test"
+
+	conn := newTestConnection(t, WithSchema(schema), WithTablePrefix("pt_"))
+	t.Cleanup(func() {
+		if _, err := conn.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE"); err != nil {
+			t.Errorf("failed to drop schema %s: %v", schema, err)
+		}
+	})
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("endpoints"); err != nil {
+			return err
+		}
+
+		return tx.CreateObject("endpoints", func(id uint64) (int, any) {
+			return int(id), map[string]int{"Id": int(id)}
+		})
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, conn.UpdateObject("endpoints", []byte("1"), map[string]int{"Id": 1, "GroupId": 2}))
+
+	var endpoint map[string]int
+	require.NoError(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+	assert.Equal(t, map[string]int{"Id": 1, "GroupId": 2}, endpoint)
+
+	nextID, err := conn.GetNextIdentifierErr("endpoints")
+	require.NoError(t, err)
+	assert.Equal(t, 2, nextID)
+
+	var tables []string
+	require.NoError(t, conn.Select(&tables, "SELECT table_name FROM information_schema.tables WHERE table_schema = $1", schema))
+	assert.Equal(t, []string{"pt_endpoints"}, tables)
+
+	buckets, err := conn.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"endpoints"}, buckets)
+
+	metadata, err := conn.BackupMetadata()
+	require.NoError(t, err)
+	assert.Contains(t, metadata, "endpoints")
+
+	require.NoError(t, conn.DeleteObject("endpoints", []byte("1")))
+	assert.Error(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+}
@@ -0,0 +1,58 @@
+package postgres
+
+import (
+	"sync/atomic"
+)
+
+// TableStats counts the object operations issued against a table
+type TableStats struct {
+	Reads   uint64
+	Writes  uint64
+	Deletes uint64
+}
+
+// tableCounters holds the live counters of a table
+type tableCounters struct {
+	reads   atomic.Uint64
+	writes  atomic.Uint64
+	deletes atomic.Uint64
+}
+
+// counters returns the counters of a table, creating them on first use
+func (connection *DbConnection) counters(tableName string) *tableCounters {
+	if counters, ok := connection.tableStats.Load(tableName); ok {
+		return counters.(*tableCounters)
+	}
+
+	counters, _ := connection.tableStats.LoadOrStore(tableName, &tableCounters{})
+
+	return counters.(*tableCounters)
+}
+
+// TableStats returns a snapshot of the operation counters of a table
+func (connection *DbConnection) TableStats(tableName string) TableStats {
+	counters, ok := connection.tableStats.Load(tableName)
+	if !ok {
+		return TableStats{}
+	}
+
+	c := counters.(*tableCounters)
+
+	return TableStats{
+		Reads:   c.reads.Load(),
+		Writes:  c.writes.Load(),
+		Deletes: c.deletes.Load(),
+	}
+}
+
+// ResetTableStats zeroes the operation counters of every table
+func (connection *DbConnection) ResetTableStats() {
+	connection.tableStats.Range(func(_, counters any) bool {
+		c := counters.(*tableCounters)
+		c.reads.Store(0)
+		c.writes.Store(0)
+		c.deletes.Store(0)
+
+		return true
+	})
+}
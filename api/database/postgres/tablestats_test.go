@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TableStats(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	object := []byte(`{"Name":"local"}`)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(object))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, data FROM endpoints").WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("1", object).AddRow("2", object))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM endpoints").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var endpoint map[string]any
+	require.NoError(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+	require.NoError(t, conn.GetAll("endpoints", &endpoint, func(o any) (any, error) { return o, nil }))
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.CreateObjectWithId("endpoints", 2, endpoint); err != nil {
+			return err
+		}
+
+		if err := tx.UpdateObject("endpoints", []byte("1"), endpoint); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteObject("endpoints", []byte("2")); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithStringId("users", []byte("3"), endpoint)
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, TableStats{Reads: 2, Writes: 2, Deletes: 1}, conn.TableStats("endpoints"))
+	assert.Equal(t, TableStats{Writes: 1}, conn.TableStats("users"))
+	assert.Equal(t, TableStats{}, conn.TableStats("settings"))
+
+	conn.ResetTableStats()
+	assert.Equal(t, TableStats{}, conn.TableStats("endpoints"))
+	assert.Equal(t, TableStats{}, conn.TableStats("users"))
+}
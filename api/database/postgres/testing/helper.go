@@ -0,0 +1,79 @@
+//go:build integration
+
+// Package pgtest starts the ephemeral PostgreSQL servers of the integration tests, it is built
+// with the integration tag only and needs a Docker daemon. It is not named after its directory
+// so that it does not shadow the testing package of the standard library.
+package pgtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/portainer/portainer/api/database/postgres"
+	"github.com/testcontainers/testcontainers-go"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	// Image is the PostgreSQL image the test servers are started from
+	Image = "postgres:16-alpine"
+
+	database = "portainer"
+	user     = "portainer"
+	password = "portainer"
+
+	startupTimeout = time.Minute
+)
+
+// NewTestConnection starts a PostgreSQL container and returns a connection opened to it, Open
+// creating the schema of the store. The container is terminated and the connection closed once
+// the test is over. The test is skipped when no Docker daemon is available.
+func NewTestConnection(t *testing.T, opts ...postgres.ConnectionOption) *postgres.DbConnection {
+	t.Helper()
+
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	ctx := context.Background()
+
+	// the server restarts once the initialization scripts are run, it is ready the second time
+	container, err := tcpostgres.RunContainer(ctx,
+		testcontainers.WithImage(Image),
+		tcpostgres.WithDatabase(database),
+		tcpostgres.WithUsername(user),
+		tcpostgres.WithPassword(password),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(startupTimeout),
+		),
+	)
+	if err != nil {
+		t.Fatalf("failed to start the PostgreSQL container: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := container.Terminate(context.Background()); err != nil {
+			t.Errorf("failed to terminate the PostgreSQL container: %v", err)
+		}
+	})
+
+	dsn, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatalf("failed to get the connection string of the PostgreSQL container: %v", err)
+	}
+
+	conn, err := postgres.NewConnection(dsn, nil, opts...)
+	if err != nil {
+		t.Fatalf("failed to open database connection: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := conn.Close(); err != nil {
+			t.Errorf("failed to close the PostgreSQL database: %v", err)
+		}
+	})
+
+	return conn
+}
@@ -0,0 +1,41 @@
+package postgres
+
+import (
+	"net"
+	"testing"
+)
+
+// NewTestConnection starts an embedded PostgreSQL server for the test and returns a connection
+// to it. The server and its data directory are removed once the test is over.
+func NewTestConnection(t *testing.T, opts ...ConnectionOption) *DbConnection {
+	t.Helper()
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatalf("failed to find a free port for the embedded PostgreSQL server: %v", err)
+	}
+
+	conn, err := NewEmbeddedConnection(t.TempDir(), port, nil, opts...)
+	if err != nil {
+		t.Fatalf("failed to open the embedded PostgreSQL database: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := conn.Close(); err != nil {
+			t.Errorf("failed to close the embedded PostgreSQL database: %v", err)
+		}
+	})
+
+	return conn
+}
+
+// freePort returns a port that no process listens on
+func freePort() (uint32, error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return uint32(listener.Addr().(*net.TCPAddr).Port), nil
+}
@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// DefaultStatementTimeout is the longest time a statement may run before it is canceled
+	DefaultStatementTimeout = 30 * time.Second
+
+	// DefaultLockTimeout is the longest time a statement may wait for a lock
+	DefaultLockTimeout = 10 * time.Second
+)
+
+// SQLSTATE codes of the statements canceled by statement_timeout and lock_timeout
+const (
+	sqlStateQueryCanceled    = "57014"
+	sqlStateLockNotAvailable = "55P03"
+)
+
+// ErrQueryTimeout is returned when a statement is canceled by the statement or lock timeout
+var ErrQueryTimeout = errors.New("the database query timed out")
+
+// WithStatementTimeout sets the statement_timeout of every connection of the pool, 0 disables it
+func WithStatementTimeout(timeout time.Duration) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.statementTimeout = timeout
+	}
+}
+
+// WithLockTimeout sets the lock_timeout of every connection of the pool, 0 disables it
+func WithLockTimeout(timeout time.Duration) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.lockTimeout = timeout
+	}
+}
+
+// timeoutConnectionString returns dsn with the timeouts of the connection as runtime
+// parameters, so that they apply to every connection opened by the pool. The parameters
+// already set in dsn take precedence.
+func (connection *DbConnection) timeoutConnectionString(dsn string) string {
+	return withRuntimeParameters(dsn, map[string]string{
+		"statement_timeout": strconv.FormatInt(connection.statementTimeout.Milliseconds(), 10),
+		"lock_timeout":      strconv.FormatInt(connection.lockTimeout.Milliseconds(), 10),
+	})
+}
+
+// withRuntimeParameters adds the parameters missing from a URL or keyword/value connection string
+func withRuntimeParameters(dsn string, params map[string]string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+
+		query := u.Query()
+		for key, value := range params {
+			if !query.Has(key) {
+				query.Set(key, value)
+			}
+		}
+		u.RawQuery = query.Encode()
+
+		return u.String()
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(key) + `\s*=`).MatchString(dsn) {
+			continue
+		}
+
+		dsn = strings.TrimSpace(dsn + " " + key + "=" + params[key])
+	}
+
+	return dsn
+}
+
+// timeoutError translates the errors caused by the statement or lock timeout into ErrQueryTimeout
+func timeoutError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	// query_canceled is also raised when the statement is canceled by the client
+	if pqErr.Code == sqlStateLockNotAvailable ||
+		(pqErr.Code == sqlStateQueryCanceled && strings.Contains(pqErr.Message, "statement timeout")) {
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+
+	return err
+}
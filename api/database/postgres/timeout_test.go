@@ -0,0 +1,105 @@
+package postgres
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_timeoutConnectionString(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		expected string
+	}{
+		{
+			"postgres://portainer@localhost:5432/portainer?sslmode=disable",
+			"postgres://portainer@localhost:5432/portainer?lock_timeout=10000&sslmode=disable&statement_timeout=30000",
+		},
+		{
+			"postgres://localhost/portainer?statement_timeout=0",
+			"postgres://localhost/portainer?lock_timeout=10000&statement_timeout=0",
+		},
+		{
+			"host=localhost dbname=portainer",
+			"host=localhost dbname=portainer lock_timeout=10000 statement_timeout=30000",
+		},
+		{
+			"host=localhost lock_timeout = 500",
+			"host=localhost lock_timeout = 500 statement_timeout=30000",
+		},
+		{"", "lock_timeout=10000 statement_timeout=30000"},
+	}
+
+	for _, tc := range tests {
+		conn := &DbConnection{
+			ConnectionString: tc.dsn,
+			statementTimeout: DefaultStatementTimeout,
+			lockTimeout:      DefaultLockTimeout,
+		}
+		assert.Equal(t, tc.expected, conn.timeoutConnectionString(conn.ConnectionString), tc.dsn)
+	}
+
+	conn := &DbConnection{ConnectionString: "host=localhost"}
+	WithStatementTimeout(0)(conn)
+	WithLockTimeout(time.Second)(conn)
+	assert.Equal(t, "host=localhost lock_timeout=1000 statement_timeout=0", conn.timeoutConnectionString(conn.ConnectionString))
+}
+
+func Test_timeoutError(t *testing.T) {
+	statementTimeout := &pq.Error{Code: sqlStateQueryCanceled, Message: "canceling statement due to statement timeout"}
+	assert.ErrorIs(t, timeoutError(statementTimeout), ErrQueryTimeout)
+	assert.ErrorIs(t, timeoutError(statementTimeout), statementTimeout)
+
+	lockTimeout := &pq.Error{Code: sqlStateLockNotAvailable, Message: "canceling statement due to lock timeout"}
+	assert.ErrorIs(t, timeoutError(lockTimeout), ErrQueryTimeout)
+
+	canceled := &pq.Error{Code: sqlStateQueryCanceled, Message: "canceling statement due to user request"}
+	assert.NotErrorIs(t, timeoutError(canceled), ErrQueryTimeout)
+
+	other := errors.New("unexpected")
+	assert.Equal(t, other, timeoutError(other))
+	assert.NoError(t, timeoutError(nil))
+}
+
+func Test_UpdateTxWithOptions_Timeouts(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET TRANSACTION READ ONLY; SET LOCAL statement_timeout = 1500; SET LOCAL lock_timeout = 200")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT data FROM endpoints").
+		WillReturnError(&pq.Error{Code: sqlStateQueryCanceled, Message: "canceling statement due to statement timeout"})
+	mock.ExpectRollback()
+
+	opts := TxOptions{ReadOnly: true, StatementTimeout: 1500 * time.Millisecond, LockTimeout: 200 * time.Millisecond}
+	err := conn.UpdateTxWithOptions(opts, func(tx portainer.Transaction) error {
+		var endpoint map[string]any
+		return tx.GetObject("endpoints", []byte("1"), &endpoint)
+	})
+	require.ErrorIs(t, err, ErrQueryTimeout)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_StatementTimeout_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t, WithStatementTimeout(50*time.Millisecond))
+
+	err := conn.ViewTx(func(tx portainer.Transaction) error {
+		_, err := tx.(*DbTransaction).tx.Exec("SELECT pg_sleep(1)")
+		return err
+	})
+	require.ErrorIs(t, err, ErrQueryTimeout)
+
+	// the override of the transaction takes precedence
+	err = conn.UpdateTxWithOptions(TxOptions{StatementTimeout: 5 * time.Second}, func(tx portainer.Transaction) error {
+		_, err := tx.(*DbTransaction).tx.Exec("SELECT pg_sleep(0.1)")
+		return err
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,113 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+)
+
+// createdAtColumn and updatedAtColumn are the definitions of the columns holding when the
+// objects of a bucket were created and last updated
+const (
+	createdAtColumn = "created_at TIMESTAMPTZ NOT NULL DEFAULT now()"
+	updatedAtColumn = "updated_at TIMESTAMPTZ NOT NULL DEFAULT now()"
+)
+
+// ObjectMetadata holds when an object was created and last updated
+type ObjectMetadata struct {
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// addTimestampColumns adds the timestamp columns to the table of a bucket created before them,
+// the existing objects get the time of the upgrade. The table is only altered the first time
+// the connection uses the bucket.
+func (connection *DbConnection) addTimestampColumns(ctx context.Context, e sqlx.ExecerContext, bucketName string) error {
+	if _, ok := connection.timestamped.Load(bucketName); ok {
+		return nil
+	}
+
+	query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s, ADD COLUMN IF NOT EXISTS %s", connection.table(bucketName), createdAtColumn, updatedAtColumn)
+	if _, err := e.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to add the timestamp columns to bucket %s: %w", bucketName, err)
+	}
+
+	connection.timestamped.Store(bucketName, true)
+
+	return nil
+}
+
+// GetObjectMetadata returns when the object stored at key was created and last updated
+func (tx *DbTransaction) GetObjectMetadata(bucketName string, key []byte) (metadata ObjectMetadata, err error) {
+	ctx, end := tx.startSpan("GetObjectMetadata", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return metadata, err
+	}
+
+	query := fmt.Sprintf("SELECT created_at, updated_at FROM %s WHERE id = $1", tx.conn.table(bucketName))
+	if err := tx.tx.GetContext(ctx, &metadata, query, id); err == sql.ErrNoRows {
+		return metadata, fmt.Errorf("%w (bucket=%s, key=%s)", dserrors.ErrObjectNotFound, bucketName, changeKey(key))
+	} else if err != nil {
+		return metadata, err
+	}
+
+	return metadata, nil
+}
+
+// GetAllModifiedSince retrieves the objects of a table updated after since, in the order of
+// their keys, see GetAll
+func (tx *DbTransaction) GetAllModifiedSince(bucketName string, since time.Time, obj any, appendFn func(o any) (any, error)) (err error) {
+	ctx, end := tx.startSpan("GetAllModifiedSince", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	query := fmt.Sprintf("SELECT id, data FROM %s WHERE updated_at > $1 ORDER BY id", tx.conn.table(bucketName))
+	rows, err := tx.tx.QueryContext(ctx, query, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var jsonData []byte
+		if err := rows.Scan(&id, &jsonData); err != nil {
+			return err
+		}
+
+		if err := tx.unmarshal(bucketName, []byte(id), jsonData, obj); err != nil {
+			return err
+		}
+
+		if obj, err = appendFn(obj); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetObjectMetadata returns when the object stored at key was created and last updated
+func (connection *DbConnection) GetObjectMetadata(bucketName string, key []byte) (metadata ObjectMetadata, err error) {
+	err = connection.tracedViewTx("GetObjectMetadata", bucketName, func(tx *DbTransaction) error {
+		metadata, err = tx.GetObjectMetadata(bucketName, key)
+		return err
+	})
+
+	return metadata, err
+}
+
+// GetAllModifiedSince retrieves the objects of a table updated after since, see GetAll
+func (connection *DbConnection) GetAllModifiedSince(bucketName string, since time.Time, obj any, appendFn func(o any) (any, error)) error {
+	return connection.tracedViewTx("GetAllModifiedSince", bucketName, func(tx *DbTransaction) error {
+		return tx.GetAllModifiedSince(bucketName, since, obj, appendFn)
+	})
+}
@@ -0,0 +1,133 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TimestampColumns_AddedOnce(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS endpoints")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS " + createdAtColumn + ", ADD COLUMN IF NOT EXISTS " + updatedAtColumn)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS endpoints")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.SetServiceName("endpoints"); err != nil {
+			return err
+		}
+
+		return tx.SetServiceName("endpoints")
+	}))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_GetObjectMetadata(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	query := regexp.QuoteMeta("SELECT created_at, updated_at FROM endpoints WHERE id = $1")
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	updatedAt := time.Date(2024, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at"}).AddRow(createdAt, updatedAt))
+	mock.ExpectCommit()
+
+	metadata, err := conn.GetObjectMetadata("endpoints", conn.ConvertToKey(1))
+	require.NoError(t, err)
+	assert.Equal(t, ObjectMetadata{CreatedAt: createdAt, UpdatedAt: updatedAt}, metadata)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"created_at", "updated_at"}))
+	mock.ExpectRollback()
+
+	_, err = conn.GetObjectMetadata("endpoints", []byte("2"))
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_GetAllModifiedSince(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, data FROM endpoints WHERE updated_at > $1 ORDER BY id")).WithArgs(since).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "data"}).AddRow("2", []byte(`{"Name":"remote"}`)))
+	mock.ExpectCommit()
+
+	var endpoint map[string]any
+	var names []any
+	require.NoError(t, conn.GetAllModifiedSince("endpoints", since, &endpoint, func(o any) (any, error) {
+		names = append(names, (*o.(*map[string]any))["Name"])
+		return o, nil
+	}))
+	assert.Equal(t, []any{"remote"}, names)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Timestamps_RealDatabase(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "timestamps_test")
+
+	// a table created before the timestamps gets them the first time its bucket is used
+	_, err := conn.Exec("CREATE TABLE timestamps_test (id INTEGER PRIMARY KEY, data JSONB NOT NULL, " + versionColumn + ")")
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO timestamps_test (id, data) VALUES (1, '{"Name":"local"}')`)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetServiceName("timestamps_test"))
+	require.NoError(t, conn.CreateObjectWithId("timestamps_test", 2, map[string]string{"Name": "remote"}))
+
+	before, err := conn.GetObjectMetadata("timestamps_test", []byte("1"))
+	require.NoError(t, err)
+	assert.False(t, before.CreatedAt.IsZero())
+
+	// now() is the start time of the transaction, the update runs in a later one
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	require.NoError(t, conn.UpdateObject("timestamps_test", []byte("1"), map[string]string{"Name": "primary"}))
+
+	after, err := conn.GetObjectMetadata("timestamps_test", []byte("1"))
+	require.NoError(t, err)
+	assert.True(t, after.CreatedAt.Equal(before.CreatedAt))
+	assert.True(t, after.UpdatedAt.After(before.UpdatedAt))
+
+	var object map[string]string
+	var modified []string
+	require.NoError(t, conn.GetAllModifiedSince("timestamps_test", since, &object, func(o any) (any, error) {
+		modified = append(modified, (*o.(*map[string]string))["Name"])
+		return o, nil
+	}))
+	assert.Equal(t, []string{"primary"}, modified)
+
+	// the timestamps survive an export and import
+	var buf bytes.Buffer
+	require.NoError(t, conn.ExportTables(context.Background(), []string{"timestamps_test"}, &buf, ExportFormatJSON))
+
+	_, err = conn.Exec("DROP TABLE timestamps_test")
+	require.NoError(t, err)
+	conn.timestamped.Delete("timestamps_test")
+
+	require.NoError(t, conn.ImportFromJSON(context.Background(), &buf, ImportOptions{}))
+
+	imported, err := conn.GetObjectMetadata("timestamps_test", []byte("1"))
+	require.NoError(t, err)
+	assert.True(t, imported.CreatedAt.Equal(after.CreatedAt))
+	assert.True(t, imported.UpdatedAt.Equal(after.UpdatedAt))
+}
@@ -0,0 +1,192 @@
+package postgres
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// sslRequestCode is the code of the SSLRequest message asking the server to switch to TLS
+const sslRequestCode = 80877103
+
+// LoadTLSConfigFromPEM returns a TLS configuration trusting the PEM encoded CA certificates
+// and, when they are given, presenting the PEM encoded client certificate and key, so that the
+// certificates can be read from a secret store rather than from files. The host name of the
+// server is verified against its certificate.
+func LoadTLSConfigFromPEM(caCert, clientCert, clientKey []byte) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(caCert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no CA certificate found in the PEM data")
+		}
+
+		config.RootCAs = pool
+	}
+
+	if len(clientCert) > 0 != (len(clientKey) > 0) {
+		return nil, errors.New("the client certificate and the client key must be given together")
+	}
+
+	if len(clientCert) > 0 {
+		certificate, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// SetTLSConfig makes the connections to the server use TLS with the given configuration and
+// sets sslmode=verify-full in the connection string. lib/pq can only read the certificates
+// from files, the connections are encrypted by the connection instead: it negotiates TLS with
+// the server before handing the connection to lib/pq. The host name of the server is verified
+// unless cfg sets ServerName or InsecureSkipVerify. It must be called before Open.
+func (connection *DbConnection) SetTLSConfig(cfg *tls.Config) error {
+	if cfg == nil {
+		return errors.New("the TLS configuration is nil")
+	}
+
+	if connection.DB != nil {
+		return errors.New("the TLS configuration cannot be changed once the connection is open")
+	}
+
+	dsn, err := withDSNParameter(connection.ConnectionString, "sslmode", "verify-full")
+	if err != nil {
+		return err
+	}
+
+	connection.ConnectionString = dsn
+	connection.tlsConfig = cfg.Clone()
+
+	return nil
+}
+
+// withDSNParameter sets a parameter of a URL or keyword/value connection string, replacing
+// its value when it is already set
+func withDSNParameter(dsn, key, value string) (string, error) {
+	if isURLDSN(dsn) {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", errors.New("the connection URL cannot be parsed")
+		}
+
+		query := u.Query()
+		query.Set(key, value)
+		u.RawQuery = query.Encode()
+
+		return u.String(), nil
+	}
+
+	params, err := parseKeywordDSN(dsn)
+	if err != nil {
+		return "", errors.New("the connection string cannot be parsed")
+	}
+
+	found := false
+	for i := range params {
+		if params[i].key == key {
+			params[i].value = value
+			found = true
+		}
+	}
+
+	if !found {
+		params = append(params, dsnParam{key: key, value: value})
+	}
+
+	return formatKeywordDSN(params), nil
+}
+
+// tlsDialer opens the connections of lib/pq and switches them to TLS, lib/pq is told not to
+// negotiate TLS itself
+type tlsDialer struct {
+	dialer net.Dialer
+	config *tls.Config
+}
+
+func (d *tlsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *tlsDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *tlsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// like libpq, the unix domain sockets are not encrypted
+	if network == "unix" {
+		return conn, nil
+	}
+
+	tlsConn, err := d.startTLS(ctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// startTLS sends an SSLRequest to the server and performs the TLS handshake once it accepts
+func (d *tlsDialer) startTLS(ctx context.Context, conn net.Conn, address string) (*tls.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], sslRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to request TLS: %w", err)
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("failed to request TLS: %w", err)
+	}
+
+	if response[0] != 'S' {
+		return nil, errors.New("the server does not support TLS")
+	}
+
+	config := d.config
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", address, err)
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,260 @@
+package postgres
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a certificate and its key, PEM encoded
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCertificate generates a certificate signed by parent, it is self-signed when parent is nil
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newTestPKI generates a CA along with a server certificate for 127.0.0.1 and a client certificate
+func newTestPKI(t *testing.T) (ca, server, client *testCertificate) {
+	t.Helper()
+
+	ca = newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "portainer test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	server = newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "postgres"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+
+	client = newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "portainer"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	return ca, server, client
+}
+
+// startTLSServer accepts one connection, answers its SSLRequest like PostgreSQL and performs a
+// TLS handshake requiring a client certificate signed by the CA. It sends the common name of
+// the client certificate, or the error of the handshake.
+func startTLSServer(t *testing.T, ca, server *testCertificate) (string, <-chan any) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	certificate, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	require.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	result := make(chan any, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			result <- err
+			return
+		}
+
+		if binary.BigEndian.Uint32(request[4:]) != sslRequestCode {
+			result <- io.ErrUnexpectedEOF
+			conn.Write([]byte{'N'})
+			return
+		}
+
+		if _, err := conn.Write([]byte{'S'}); err != nil {
+			result <- err
+			return
+		}
+
+		tlsConn := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			result <- err
+			return
+		}
+
+		result <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}()
+
+	return listener.Addr().String(), result
+}
+
+func Test_LoadTLSConfigFromPEM(t *testing.T) {
+	ca, _, client := newTestPKI(t)
+
+	config, err := LoadTLSConfigFromPEM(ca.certPEM, client.certPEM, client.keyPEM)
+	require.NoError(t, err)
+	assert.NotNil(t, config.RootCAs)
+	assert.Len(t, config.Certificates, 1)
+	assert.Empty(t, config.ServerName)
+	assert.False(t, config.InsecureSkipVerify)
+
+	config, err = LoadTLSConfigFromPEM(ca.certPEM, nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, config.Certificates)
+
+	_, err = LoadTLSConfigFromPEM([]byte("not a certificate"), nil, nil)
+	require.Error(t, err)
+
+	_, err = LoadTLSConfigFromPEM(ca.certPEM, client.certPEM, nil)
+	require.Error(t, err)
+
+	_, err = LoadTLSConfigFromPEM(ca.certPEM, client.certPEM, ca.keyPEM)
+	require.Error(t, err)
+}
+
+func Test_tlsDialer_MutualTLS(t *testing.T) {
+	ca, server, client := newTestPKI(t)
+
+	t.Run("client certificate", func(t *testing.T) {
+		address, result := startTLSServer(t, ca, server)
+
+		config, err := LoadTLSConfigFromPEM(ca.certPEM, client.certPEM, client.keyPEM)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		conn, err := (&tlsDialer{config: config}).DialContext(ctx, "tcp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.IsType(t, &tls.Conn{}, conn)
+		assert.Equal(t, "portainer", <-result)
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		address, result := startTLSServer(t, ca, server)
+
+		config, err := LoadTLSConfigFromPEM(ca.certPEM, nil, nil)
+		require.NoError(t, err)
+
+		conn, err := (&tlsDialer{config: config}).Dial("tcp", address)
+		if err == nil {
+			// with TLS 1.3 the client learns the server rejected it on its first read
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		require.Error(t, err)
+		_, rejected := (<-result).(error)
+		assert.True(t, rejected)
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		address, _ := startTLSServer(t, ca, server)
+
+		otherCA, _, _ := newTestPKI(t)
+		config, err := LoadTLSConfigFromPEM(otherCA.certPEM, client.certPEM, client.keyPEM)
+		require.NoError(t, err)
+
+		_, err = (&tlsDialer{config: config}).DialTimeout("tcp", address, 10*time.Second)
+		require.Error(t, err)
+	})
+}
+
+func Test_SetTLSConfig(t *testing.T) {
+	ca, server, client := newTestPKI(t)
+
+	config, err := LoadTLSConfigFromPEM(ca.certPEM, client.certPEM, client.keyPEM)
+	require.NoError(t, err)
+
+	for dsn, expected := range map[string]string{
+		"host=localhost dbname=portainer":                        "host=localhost dbname=portainer sslmode=verify-full",
+		"host=localhost sslmode=disable dbname=portainer":        "host=localhost sslmode=verify-full dbname=portainer",
+		"postgres://portainer@localhost/portainer":               "postgres://portainer@localhost/portainer?sslmode=verify-full",
+		"postgres://portainer@localhost/portainer?sslmode=allow": "postgres://portainer@localhost/portainer?sslmode=verify-full",
+	} {
+		conn := &DbConnection{ConnectionString: dsn}
+		require.NoError(t, conn.SetTLSConfig(config), dsn)
+		assert.Equal(t, expected, conn.ConnectionString)
+	}
+
+	t.Run("refused once open", func(t *testing.T) {
+		conn, _ := newMockConnection(t)
+		require.Error(t, conn.SetTLSConfig(config))
+	})
+
+	t.Run("connections use TLS", func(t *testing.T) {
+		address, result := startTLSServer(t, ca, server)
+		host, port, err := net.SplitHostPort(address)
+		require.NoError(t, err)
+
+		conn := &DbConnection{ConnectionString: "host=" + host + " port=" + port + " user=portainer dbname=portainer connect_timeout=10"}
+		require.NoError(t, conn.SetTLSConfig(config))
+
+		db, _, err := conn.openPool(conn.ConnectionString)
+		require.NoError(t, err)
+		defer db.Close()
+
+		// the test server closes the connection after the handshake
+		require.Error(t, db.Ping())
+		assert.Equal(t, "portainer", <-result)
+	})
+}
@@ -0,0 +1,67 @@
+package postgres
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// noopTracer is used until a tracer is injected with WithTracer
+var noopTracer = noop.NewTracerProvider().Tracer("")
+
+// WithTracer traces the database operations with tracer
+func WithTracer(tracer trace.Tracer) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.tracer = tracer
+	}
+}
+
+// startSpan starts the span of a database operation as a child of the span found in ctx.
+// The returned function ends the span and records err when it is not nil.
+func (connection *DbConnection) startSpan(ctx context.Context, operation, table string) (context.Context, func(err error)) {
+	tracer := connection.tracer
+	if tracer == nil {
+		tracer = noopTracer
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	attributes := []attribute.KeyValue{
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", operation),
+	}
+	if table != "" {
+		attributes = append(attributes, attribute.String("db.table", table))
+	}
+
+	ctx, span := tracer.Start(ctx, "postgres."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}
+}
+
+// startSpan starts the span of an operation made inside the transaction
+func (tx *DbTransaction) startSpan(operation, table string) (context.Context, func(err error)) {
+	return tx.conn.startSpan(tx.context(), operation, table)
+}
+
+// context returns the context of the UpdateTx or ViewTx call running the transaction, it
+// falls back to the context of the connection for the transactions created without one
+func (tx *DbTransaction) context() context.Context {
+	if tx.ctx != nil {
+		return tx.ctx
+	}
+
+	return tx.conn.ctx
+}
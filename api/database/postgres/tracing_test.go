@@ -0,0 +1,156 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// newTracedMockConnection returns a mock connection whose spans are exported to memory
+func newTracedMockConnection(t *testing.T) (*DbConnection, sqlmock.Sqlmock, *tracetest.InMemoryExporter) {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+	})
+
+	conn, mock := newMockConnection(t)
+	WithTracer(provider.Tracer("test"))(conn)
+
+	return conn, mock, exporter
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.AsString()
+		}
+	}
+
+	return ""
+}
+
+func Test_Tracing_NoopTracer(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithTracer(noop.NewTracerProvider().Tracer("test"))(conn)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT data FROM endpoints").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"local"}`)))
+	mock.ExpectCommit()
+
+	var endpoint map[string]any
+	require.NoError(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+	assert.Equal(t, "local", endpoint["Name"])
+
+	// without any tracer
+	conn.tracer = nil
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM endpoints").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.DeleteObject("endpoints", []byte("1")))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Tracing_Spans(t *testing.T) {
+	conn, mock, exporter := newTracedMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT data FROM endpoints").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{"Name":"local"}`)))
+	mock.ExpectCommit()
+
+	var endpoint map[string]any
+	require.NoError(t, conn.GetObject("endpoints", []byte("1"), &endpoint))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	// the operation of the transaction ends first
+	txSpan, connSpan := spans[0], spans[1]
+	for _, span := range spans {
+		assert.Equal(t, "postgres.GetObject", span.Name)
+		assert.Equal(t, "postgresql", spanAttribute(span, "db.system"))
+		assert.Equal(t, "GetObject", spanAttribute(span, "db.operation"))
+		assert.Equal(t, "endpoints", spanAttribute(span, "db.table"))
+		assert.Equal(t, codes.Unset, span.Status.Code)
+	}
+	assert.Equal(t, connSpan.SpanContext.SpanID(), txSpan.Parent.SpanID())
+
+	exporter.Reset()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM users").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM teams").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.DeleteObject("users", []byte("2")); err != nil {
+			return err
+		}
+
+		return tx.DeleteObject("teams", []byte("3"))
+	})
+	require.NoError(t, err)
+
+	spans = exporter.GetSpans()
+	require.Len(t, spans, 3)
+	assert.Equal(t, []string{"postgres.DeleteObject", "postgres.DeleteObject", "postgres.UpdateTx"},
+		[]string{spans[0].Name, spans[1].Name, spans[2].Name})
+	assert.Equal(t, "users", spanAttribute(spans[0], "db.table"))
+	assert.Equal(t, "teams", spanAttribute(spans[1], "db.table"))
+	assert.Empty(t, spanAttribute(spans[2], "db.table"))
+	assert.Equal(t, spans[2].SpanContext.SpanID(), spans[0].Parent.SpanID())
+	assert.Equal(t, spans[2].SpanContext.SpanID(), spans[1].Parent.SpanID())
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Tracing_RecordsErrors(t *testing.T) {
+	conn, mock, exporter := newTracedMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT data FROM endpoints").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	mock.ExpectRollback()
+
+	var endpoint map[string]any
+	err := conn.GetObject("endpoints", []byte("1"), &endpoint)
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	for _, span := range spans {
+		assert.Equal(t, "postgres.GetObject", span.Name)
+		assert.Equal(t, codes.Error, span.Status.Code)
+		assert.Equal(t, err.Error(), span.Status.Description)
+
+		require.Len(t, span.Events, 1)
+		assert.Equal(t, "exception", span.Events[0].Name)
+	}
+
+	exporter.Reset()
+
+	require.Error(t, conn.EnsureJsonIndex("stacks", "idx; DROP TABLE stacks", []string{"Name"}, false))
+
+	spans = exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "postgres.EnsureJsonIndex", spans[0].Name)
+	assert.Equal(t, "stacks", spanAttribute(spans[0], "db.table"))
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+}
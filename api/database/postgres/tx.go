@@ -1,68 +1,503 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	dserrors "github.com/portainer/portainer/api/dataservices/errors"
-
-	"github.com/rs/zerolog/log"
 )
 
 type DbTransaction struct {
 	conn *DbConnection
 	tx   *sqlx.Tx
+	ctx  context.Context
+
+	// db is the pool of the transaction, the primary or the read replica
+	db *sqlx.DB
+
+	// readOnly is set for the transactions of ViewTx and the read-only transactions, the writes
+	// are rejected in them
+	readOnly bool
+
+	// changes are notified when the transaction is committed
+	changes []ChangeEvent
+
+	// invalidations are the objects removed from the cache by the transaction, they are removed
+	// again once it commits
+	invalidations []ChangeEvent
+
+	// savepoints counts the savepoints created by the nested transactional calls, it names them
+	savepoints int
+
+	// cursors counts the cursors declared by ForEach, it names them
+	cursors int
+
+	// beforeCommit are the functions registered by BeforeCommit
+	beforeCommit []func() error
+
+	// ChangedBy is the author of the changes of the transaction recorded in AuditLogTable, see
+	// WithActor
+	ChangedBy string
+
+	// closed is set once the transaction is committed or rolled back
+	closed atomic.Bool
+
+	// watched is the entry of the transaction in the watchdog, removed by release
+	watched *openTx
 }
 
-func (tx *DbTransaction) SetServiceName(bucketName string) error {
-	// In PostgreSQL, this would typically involve creating a table if it doesn't exist
-	createTableQuery := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id SERIAL PRIMARY KEY,
-			data JSONB NOT NULL
-		)`, bucketName)
-	_, err := tx.tx.Exec(createTableQuery)
-	return err
+// RawTx returns the underlying transaction for the SQL which the portainer.Transaction interface
+// cannot express, such as COPY FROM, temporary tables or advisory locks. It returns
+// ErrTransactionClosed once the transaction is committed or rolled back.
+//
+// The statements run on it bypass the validation of the table names, the encryption of the data
+// column and the change notifications, use it only when the methods of DbTransaction are not enough.
+func (tx *DbTransaction) RawTx() (*sqlx.Tx, error) {
+	if tx.closed.Load() {
+		return nil, ErrTransactionClosed
+	}
+
+	return tx.tx, nil
+}
+
+// BeforeCommit registers fn to run in the transaction right before it commits, in the order of
+// registration. The transaction is rolled back when fn fails.
+func (tx *DbTransaction) BeforeCommit(fn func() error) {
+	tx.beforeCommit = append(tx.beforeCommit, fn)
+}
+
+// marshal encodes an object for the data column, it is encrypted and bound to its key on an
+// encrypted store
+func (tx *DbTransaction) marshal(bucketName string, key []byte, object any) ([]byte, error) {
+	if tx.conn.IsEncryptedStore() {
+		return tx.conn.MarshalObjectForKey(bucketName, key, object)
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil || !tx.conn.shouldCompress(len(data)) {
+		return data, err
+	}
+
+	// the JSONB column cannot hold the compressed payload, it is stored in an envelope document
+	compressed, err := compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapEnvelope(append(envelopeHeader(envelopeCompressed), compressed...))
+}
+
+// unmarshal decodes the data column of the object stored at key
+func (tx *DbTransaction) unmarshal(bucketName string, key []byte, data []byte, object any) error {
+	return tx.conn.decodeObject(bucketName, key, data, object)
+}
+
+// SetServiceName creates the table of a bucket unless it exists, with the key type found in
+// the bucket registry or integer keys, see SetServiceNameWithKeyType
+func (tx *DbTransaction) SetServiceName(bucketName string) (err error) {
+	ctx, end := tx.startSpan("SetServiceName", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	return tx.createBucketTable(ctx, bucketName, tx.conn.keyType(bucketName))
+}
+
+// createBucketTable creates the table of a bucket with keys of the given type, unless it exists
+func (tx *DbTransaction) createBucketTable(ctx context.Context, bucketName string, keyType KeyType) error {
+	createTableQuery, err := tx.conn.bucketTableQuery(bucketName, keyType, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.tx.ExecContext(ctx, createTableQuery); err != nil {
+		return err
+	}
+
+	if err := tx.conn.addTimestampColumns(ctx, tx.tx, bucketName); err != nil {
+		return err
+	}
+
+	if tx.conn.IsEncryptedStore() {
+		if err := tx.encryptBucket(ctx, bucketName); err != nil {
+			return err
+		}
+	}
+
+	if tx.conn.auditTriggers {
+		if err := tx.conn.installAuditTrigger(ctx, tx.tx, bucketName); err != nil {
+			return err
+		}
+	}
+
+	if !tx.conn.changeTracking {
+		return nil
+	}
+
+	return tx.conn.installChangeTrigger(ctx, tx.tx, bucketName)
+}
+
+func (tx *DbTransaction) GetObject(bucketName string, key []byte, object any) (err error) {
+	data, err := tx.getObjectData(bucketName, key)
+	if err != nil {
+		return err
+	}
+
+	return tx.unmarshal(bucketName, key, data, object)
 }
 
-func (tx *DbTransaction) GetObject(bucketName string, key []byte, object any) error {
-	query := fmt.Sprintf("SELECT data FROM %s WHERE id = $1", bucketName)
-	
+// getObjectData returns the data column of the object stored at key
+func (tx *DbTransaction) getObjectData(bucketName string, key []byte) (_ []byte, err error) {
+	ctx, end := tx.startSpan("GetObject", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT data FROM %s WHERE id = $1", tx.conn.table(bucketName))
+
 	var jsonData []byte
-	err := tx.tx.Get(&jsonData, query, string(key))
+	err = tx.getStmt(ctx, bucketName, stmtSelect, &jsonData, query, id)
 	if err == sql.ErrNoRows {
-		return fmt.Errorf("%w (bucket=%s, key=%s)", dserrors.ErrObjectNotFound, bucketName, string(key))
+		return nil, fmt.Errorf("%w (bucket=%s, key=%s)", dserrors.ErrObjectNotFound, bucketName, string(key))
 	} else if err != nil {
+		return nil, err
+	}
+
+	return jsonData, nil
+}
+
+func (tx *DbTransaction) UpdateObject(bucketName string, key []byte, object any) (err error) {
+	ctx, end := tx.startSpan("UpdateObject", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	data, err := tx.marshal(bucketName, key, object)
+	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(jsonData, object)
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET data = $1, %s WHERE id = $2", tx.conn.table(bucketName), bumpVersion)
+	if _, err = tx.execStmt(ctx, bucketName, stmtUpdate, query, data, id); err != nil {
+		return err
+	}
+
+	tx.recordChange(bucketName, changeKey(key))
+
+	return tx.audit(ctx, bucketName, changeKey(key), AuditOperationUpdate)
 }
 
-func (tx *DbTransaction) UpdateObject(bucketName string, key []byte, object any) error {
-	data, err := json.Marshal(object)
+// UpdateObjectFunc locks the row of the key until the end of the transaction, unmarshals it
+// into object and writes object back once updateFn has modified it
+func (tx *DbTransaction) UpdateObjectFunc(bucketName string, key []byte, object any, updateFn func()) (err error) {
+	ctx, end := tx.startSpan("UpdateObjectFunc", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	id, err := tx.keyArg(bucketName, key)
 	if err != nil {
 		return err
 	}
 
-	query := fmt.Sprintf("UPDATE %s SET data = $1 WHERE id = $2", bucketName)
-	_, err = tx.tx.Exec(query, data, string(key))
-	return err
+	query := fmt.Sprintf("SELECT data FROM %s WHERE id = $1 FOR UPDATE", tx.conn.table(bucketName))
+
+	var jsonData []byte
+	err = tx.tx.GetContext(ctx, &jsonData, query, id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w (bucket=%s, key=%v)", dserrors.ErrObjectNotFound, bucketName, id)
+	} else if err != nil {
+		return err
+	}
+
+	if err := tx.unmarshal(bucketName, key, jsonData, object); err != nil {
+		return err
+	}
+
+	updateFn()
+
+	data, err := tx.marshal(bucketName, key, object)
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET data = $1, %s WHERE id = $2", tx.conn.table(bucketName), bumpVersion)
+	if _, err = tx.execStmt(ctx, bucketName, stmtUpdate, query, data, id); err != nil {
+		return err
+	}
+
+	tx.recordChange(bucketName, fmt.Sprint(id))
+
+	return tx.audit(ctx, bucketName, fmt.Sprint(id), AuditOperationUpdate)
 }
 
-func (tx *DbTransaction) DeleteObject(bucketName string, key []byte) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", bucketName)
-	_, err := tx.tx.Exec(query, string(key))
+// UpdateObjectField sets the field of an object found at path to value in a single statement,
+// without reading the object. The missing objects along the path are created. It returns
+// ErrEncryptedStore on an encrypted store and ErrCompressedStore when compression is enabled,
+// where the caller has to update the whole object.
+func (tx *DbTransaction) UpdateObjectField(bucketName string, key []byte, path []string, value any) (err error) {
+	ctx, end := tx.startSpan("UpdateObjectField", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	if tx.conn.IsEncryptedStore() {
+		return fmt.Errorf("%w: cannot update a single field of an encrypted object", ErrEncryptedStore)
+	}
+
+	if tx.conn.compression {
+		return fmt.Errorf("%w: cannot update a single field of a compressed object", ErrCompressedStore)
+	}
+
+	if len(path) == 0 {
+		return errors.New("the path of the field to update is empty")
+	}
+
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	// jsonb_set only creates the last element of the path, the parents are created first
+	args := []any{data, id}
+	expr := "data"
+	for i := 1; i <= len(path); i++ {
+		args = append(args, pq.Array(path[:i]))
+		n := len(args)
+
+		if i < len(path) {
+			expr = fmt.Sprintf("jsonb_set(%s, $%d::text[], COALESCE(data #> $%d::text[], '{}'::jsonb), true)", expr, n, n)
+		} else {
+			expr = fmt.Sprintf("jsonb_set(%s, $%d::text[], $1::jsonb, true)", expr, n)
+		}
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET data = %s, %s WHERE id = $2", tx.conn.table(bucketName), expr, bumpVersion)
+	result, err := tx.tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return fmt.Errorf("%w (bucket=%s, key=%v)", dserrors.ErrObjectNotFound, bucketName, id)
+	}
+
+	tx.recordChange(bucketName, fmt.Sprint(id))
+
+	return tx.audit(ctx, bucketName, fmt.Sprint(id), AuditOperationUpdate)
+}
+
+// PatchObject merges patch into the top-level fields of an object in a single statement,
+// without reading the object, so that the concurrent updates of other fields are not lost. The
+// fields of patch replace the stored ones, the fields set to nil are removed and the other
+// fields are kept. It returns ErrEncryptedStore on an encrypted store and ErrCompressedStore
+// when compression is enabled.
+func (tx *DbTransaction) PatchObject(bucketName string, key []byte, patch map[string]any) (err error) {
+	ctx, end := tx.startSpan("PatchObject", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	if tx.conn.IsEncryptedStore() {
+		return fmt.Errorf("%w: cannot patch an encrypted object", ErrEncryptedStore)
+	}
+
+	if tx.conn.compression {
+		return fmt.Errorf("%w: cannot patch a compressed object", ErrCompressedStore)
+	}
+
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return err
+	}
+
+	// the JSONB concatenation keeps the null values, the fields set to nil are removed instead
+	fields := make(map[string]any, len(patch))
+	removed := pq.StringArray{}
+	for field, value := range patch {
+		if value == nil {
+			removed = append(removed, field)
+		} else {
+			fields[field] = value
+		}
+	}
+	slices.Sort(removed)
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET data = (data || $1::jsonb) - $3::text[], %s WHERE id = $2", tx.conn.table(bucketName), bumpVersion)
+	result, err := tx.tx.ExecContext(ctx, query, data, id, removed)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return fmt.Errorf("%w (bucket=%s, key=%v)", dserrors.ErrObjectNotFound, bucketName, id)
+	}
+
+	tx.recordChange(bucketName, fmt.Sprint(id))
+
+	return tx.audit(ctx, bucketName, fmt.Sprint(id), AuditOperationUpdate)
+}
+
+func (tx *DbTransaction) DeleteObject(bucketName string, key []byte) (err error) {
+	ctx, end := tx.startSpan("DeleteObject", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).deletes.Add(1)
+
+	id, err := tx.keyArg(bucketName, key)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", tx.conn.table(bucketName))
+	if _, err = tx.execStmt(ctx, bucketName, stmtDelete, query, id); err != nil {
+		return err
+	}
+
+	tx.recordChange(bucketName, changeKey(key))
+
+	if err := tx.recordDeletions(ctx, bucketName, changeKey(key)); err != nil {
+		return err
+	}
+
+	return tx.audit(ctx, bucketName, changeKey(key), AuditOperationDelete)
+}
+
+// DeleteObjects removes the objects stored at keys in a single statement and returns how many
+// were removed, the keys that do not exist are ignored. The keys are given in the encoding of
+// DeleteObject: decimal or ConvertToKey for the integer ids, the raw id for the string ids.
+func (tx *DbTransaction) DeleteObjects(bucketName string, keys [][]byte) (deleted int, err error) {
+	ctx, end := tx.startSpan("DeleteObjects", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return 0, ErrTxReadOnly
+	}
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	tx.conn.counters(bucketName).deletes.Add(1)
+
+	// the type of the array is inferred from the id column, so that it matches integer and text ids
+	ids := make(pq.StringArray, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, changeKey(key))
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = ANY($1) RETURNING id::text", tx.conn.table(bucketName))
+	rows, err := tx.tx.QueryContext(ctx, query, ids)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var deletedIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return len(deletedIDs), err
+		}
+
+		tx.recordChange(bucketName, id)
+		deletedIDs = append(deletedIDs, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return len(deletedIDs), err
+	}
+
+	// the audit entries are inserted once the rows are read, the connection runs one statement at a time
+	rows.Close()
+	if err := tx.recordDeletions(ctx, bucketName, deletedIDs...); err != nil {
+		return len(deletedIDs), err
+	}
+
+	for _, id := range deletedIDs {
+		if err := tx.audit(ctx, bucketName, id, AuditOperationDelete); err != nil {
+			return len(deletedIDs), err
+		}
+	}
+
+	return len(deletedIDs), nil
+}
+
+// Truncate removes every object of a bucket and restarts its id sequence, so that the next
+// object created gets the identifier 1. No change is notified for the removed objects.
+func (tx *DbTransaction) Truncate(bucketName string) (err error) {
+	ctx, end := tx.startSpan("Truncate", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+
+	tx.conn.counters(bucketName).deletes.Add(1)
+	tx.invalidateCache(bucketName, "")
+
+	_, err = tx.tx.ExecContext(ctx, fmt.Sprintf("TRUNCATE TABLE %s RESTART IDENTITY", tx.conn.table(bucketName)))
+
 	return err
 }
 
-func (tx *DbTransaction) DeleteAllObjects(bucketName string, obj any, matchingFn func(o any) (id int, ok bool)) error {
+func (tx *DbTransaction) DeleteAllObjects(bucketName string, obj any, matchingFn func(o any) (id int, ok bool)) (err error) {
+	ctx, end := tx.startSpan("DeleteAllObjects", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).deletes.Add(1)
+
 	// Retrieve all objects
-	query := fmt.Sprintf("SELECT id, data FROM %s", bucketName)
-	rows, err := tx.tx.Query(query)
+	query := fmt.Sprintf("SELECT id, data FROM %s", tx.conn.table(bucketName))
+	rows, err := tx.tx.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -85,7 +520,7 @@ func (tx *DbTransaction) DeleteAllObjects(bucketName string, obj any, matchingFn
 
 		// Unmarshal the object
 		tempObj := reflect.New(objType).Elem()
-		if err := json.Unmarshal(jsonData, tempObj.Addr().Interface()); err != nil {
+		if err := tx.unmarshal(bucketName, []byte(id), jsonData, tempObj.Addr().Interface()); err != nil {
 			return err
 		}
 
@@ -97,89 +532,225 @@ func (tx *DbTransaction) DeleteAllObjects(bucketName string, obj any, matchingFn
 
 	// Delete matching objects
 	for _, id := range idsToDelete {
-		deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE id = $1", bucketName)
-		_, err := tx.tx.Exec(deleteQuery, id)
+		deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE id = $1", tx.conn.table(bucketName))
+		_, err := tx.tx.ExecContext(ctx, deleteQuery, id)
 		if err != nil {
 			return err
 		}
+
+		tx.recordChange(bucketName, strconv.Itoa(id))
+
+		if err := tx.recordDeletions(ctx, bucketName, strconv.Itoa(id)); err != nil {
+			return err
+		}
+
+		if err := tx.audit(ctx, bucketName, strconv.Itoa(id), AuditOperationDelete); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// GetNextIdentifier returns the next available identifier of a bucket. It returns 0 when the
+// identifier cannot be obtained, the failure is only logged.
+//
+// Deprecated: 0 is not a valid identifier, use GetNextIdentifierErr, which reports the failure.
 func (tx *DbTransaction) GetNextIdentifier(bucketName string) int {
-	var nextID int
-	query := fmt.Sprintf("SELECT COALESCE(MAX(id), 0) + 1 FROM %s", bucketName)
-	err := tx.tx.Get(&nextID, query)
+	nextID, err := tx.GetNextIdentifierErr(bucketName)
 	if err != nil {
-		log.Error().Err(err).Str("bucket", bucketName).Msg("failed to get the next identifier")
+		ctxLogger(tx.ctx).Error().Str("component", "postgres").Err(err).Str("bucket", bucketName).Msg("failed to get the next identifier")
 		return 0
 	}
+
 	return nextID
 }
 
-func (tx *DbTransaction) CreateObject(bucketName string, fn func(uint64) (int, any)) error {
-	// Get the next sequence number
-	var seqID uint64
-	query := fmt.Sprintf("SELECT COALESCE(MAX(id), 0) + 1 FROM %s", bucketName)
-	err := tx.tx.Get(&seqID, query)
+// GetNextIdentifierErr returns the next available identifier of a bucket
+func (tx *DbTransaction) GetNextIdentifierErr(bucketName string) (nextID int, err error) {
+	ctx, end := tx.startSpan("GetNextIdentifier", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if err := tx.checkIntegerKeys(bucketName); err != nil {
+		return 0, err
+	}
+
+	sequence, err := tx.ensureSequenceForTable(ctx, bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	// the sequence skips the identifiers taken by the objects created with an explicit one
+	query := fmt.Sprintf("SELECT setval('%[1]s', GREATEST(nextval('%[1]s'), (SELECT COALESCE(MAX(id), 0) + 1 FROM %[2]s)))", sequence, tx.conn.table(bucketName))
+	if err := tx.tx.GetContext(ctx, &nextID, query); err != nil {
+		return 0, fmt.Errorf("failed to get the next identifier of bucket %s: %w", bucketName, err)
+	}
+
+	return nextID, nil
+}
+
+// ensureSequenceForTable creates the sequence of the identifiers of a bucket unless it exists
+// and returns its name. The sequence is owned by the id column, so that it is dropped along with
+// the table and restarted by TRUNCATE ... RESTART IDENTITY.
+func (tx *DbTransaction) ensureSequenceForTable(ctx context.Context, bucketName string) (string, error) {
+	table := tx.conn.table(bucketName)
+	sequence := idSequence(table)
+	if _, ok := tx.conn.sequences.Load(sequence); ok {
+		return sequence, nil
+	}
+
+	var exists bool
+	if err := tx.tx.GetContext(ctx, &exists, "SELECT to_regclass($1) IS NOT NULL", sequence); err != nil {
+		return "", fmt.Errorf("failed to look up the sequence %s: %w", sequence, err)
+	}
+
+	// a sequence created by the transaction is not cached, the transaction may still roll back
+	if exists {
+		tx.conn.sequences.Store(sequence, struct{}{})
+		return sequence, nil
+	}
+
+	// the concurrent creations of the sequence are serialized like the ones of the tables
+	if _, err := tx.tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", BucketsLockKey); err != nil {
+		return "", fmt.Errorf("failed to lock the bucket tables: %w", err)
+	}
+
+	query := fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s OWNED BY %s.id", sequence, table)
+	if _, err := tx.tx.ExecContext(ctx, query); err != nil {
+		return "", fmt.Errorf("failed to create the sequence %s: %w", sequence, err)
+	}
+
+	return sequence, nil
+}
+
+// CreateObject inserts the object returned by fn for the next sequence value. It returns
+// ErrAlreadyExists when the identifier returned by fn is taken, which happens when a concurrent
+// transaction created an object meanwhile. The insertion is not retried with the next sequence
+// value: the failure aborts the PostgreSQL transaction and fn may have derived the object from
+// the identifier, the caller has to run the whole transaction again.
+func (tx *DbTransaction) CreateObject(bucketName string, fn func(uint64) (int, any)) (err error) {
+	ctx, end := tx.startSpan("CreateObject", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+
+	if err := tx.checkIntegerKeys(bucketName); err != nil {
+		return err
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	// Get the next sequence number, the object is never created with a made-up identifier
+	seqID, err := tx.GetNextIdentifierErr(bucketName)
 	if err != nil {
 		return err
 	}
 
 	// Generate the object
-	id, obj := fn(seqID)
+	id, obj := fn(uint64(seqID))
 
 	// Marshall the object
-	data, err := json.Marshal(obj)
+	data, err := tx.marshal(bucketName, []byte(strconv.Itoa(id)), obj)
 	if err != nil {
 		return err
 	}
 
 	// Insert the object
-	insertQuery := fmt.Sprintf("INSERT INTO %s (id, data) VALUES ($1, $2)", bucketName)
-	_, err = tx.tx.Exec(insertQuery, id, data)
-	return err
+	insertQuery := fmt.Sprintf("INSERT INTO %s (id, data) VALUES ($1, $2)", tx.conn.table(bucketName))
+	if _, err = tx.execStmt(ctx, bucketName, stmtInsert, insertQuery, id, data); isUniqueViolation(err) {
+		return fmt.Errorf("%w (bucket=%s, key=%d): %w", dserrors.ErrAlreadyExists, bucketName, id, err)
+	} else if err != nil {
+		return err
+	}
+
+	tx.recordChange(bucketName, strconv.Itoa(id))
+
+	return tx.audit(ctx, bucketName, strconv.Itoa(id), AuditOperationCreate)
 }
 
-func (tx *DbTransaction) CreateObjectWithId(bucketName string, id int, obj any) error {
-	data, err := json.Marshal(obj)
+func (tx *DbTransaction) CreateObjectWithId(bucketName string, id int, obj any) (err error) {
+	ctx, end := tx.startSpan("CreateObjectWithId", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+
+	if err := tx.checkIntegerKeys(bucketName); err != nil {
+		return err
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	data, err := tx.marshal(bucketName, []byte(strconv.Itoa(id)), obj)
 	if err != nil {
 		return err
 	}
 
-	query := fmt.Sprintf("INSERT INTO %s (id, data) VALUES ($1, $2)", bucketName)
-	_, err = tx.tx.Exec(query, id, data)
-	return err
+	query := fmt.Sprintf("INSERT INTO %s (id, data) VALUES ($1, $2)", tx.conn.table(bucketName))
+	if _, err = tx.execStmt(ctx, bucketName, stmtInsert, query, id, data); isUniqueViolation(err) {
+		return fmt.Errorf("%w (bucket=%s, key=%d): %w", dserrors.ErrAlreadyExists, bucketName, id, err)
+	} else if err != nil {
+		return err
+	}
+
+	tx.recordChange(bucketName, strconv.Itoa(id))
+
+	return tx.audit(ctx, bucketName, strconv.Itoa(id), AuditOperationCreate)
 }
 
-func (tx *DbTransaction) CreateObjectWithStringId(bucketName string, id []byte, obj any) error {
-	data, err := json.Marshal(obj)
+func (tx *DbTransaction) CreateObjectWithStringId(bucketName string, id []byte, obj any) (err error) {
+	ctx, end := tx.startSpan("CreateObjectWithStringId", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+
+	if tx.readOnly {
+		return ErrTxReadOnly
+	}
+	tx.conn.counters(bucketName).writes.Add(1)
+
+	idArg, err := tx.keyArg(bucketName, id)
 	if err != nil {
 		return err
 	}
 
-	query := fmt.Sprintf("INSERT INTO %s (id, data) VALUES ($1, $2)", bucketName)
-	_, err = tx.tx.Exec(query, string(id), data)
-	return err
+	data, err := tx.marshal(bucketName, id, obj)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (id, data) VALUES ($1, $2)", tx.conn.table(bucketName))
+	if _, err = tx.execStmt(ctx, bucketName, stmtInsert, query, idArg, data); isUniqueViolation(err) {
+		return fmt.Errorf("%w (bucket=%s, key=%s): %w", dserrors.ErrAlreadyExists, bucketName, string(id), err)
+	} else if err != nil {
+		return err
+	}
+
+	tx.recordChange(bucketName, string(id))
+
+	return tx.audit(ctx, bucketName, string(id), AuditOperationCreate)
 }
 
-func (tx *DbTransaction) GetAll(bucketName string, obj any, appendFn func(o any) (any, error)) error {
-	query := fmt.Sprintf("SELECT data FROM %s", bucketName)
-	rows, err := tx.tx.Query(query)
+func (tx *DbTransaction) GetAll(bucketName string, obj any, appendFn func(o any) (any, error)) (err error) {
+	ctx, end := tx.startSpan("GetAll", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	query := fmt.Sprintf("SELECT id, data FROM %s ORDER BY id", tx.conn.table(bucketName))
+	rows, err := tx.tx.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
+		var id string
 		var jsonData []byte
-		if err := rows.Scan(&jsonData); err != nil {
+		if err := rows.Scan(&id, &jsonData); err != nil {
 			return err
 		}
 
 		// Unmarshal the object
-		err := json.Unmarshal(jsonData, obj)
+		err := tx.unmarshal(bucketName, []byte(id), jsonData, obj)
 		if err != nil {
 			return err
 		}
@@ -194,22 +765,27 @@ func (tx *DbTransaction) GetAll(bucketName string, obj any, appendFn func(o any)
 	return nil
 }
 
-func (tx *DbTransaction) GetAllWithKeyPrefix(bucketName string, keyPrefix []byte, obj any, appendFn func(o any) (any, error)) error {
-	query := fmt.Sprintf("SELECT data FROM %s WHERE id LIKE $1", bucketName)
-	rows, err := tx.tx.Query(query, string(keyPrefix)+"%")
+func (tx *DbTransaction) GetAllWithKeyPrefix(bucketName string, keyPrefix []byte, obj any, appendFn func(o any) (any, error)) (err error) {
+	ctx, end := tx.startSpan("GetAllWithKeyPrefix", bucketName)
+	defer func() { err = translateError(err); end(err) }()
+	tx.conn.counters(bucketName).reads.Add(1)
+
+	query := fmt.Sprintf("SELECT id, data FROM %s WHERE %s ORDER BY id", tx.conn.table(bucketName), tx.keyPrefixCondition(bucketName))
+	rows, err := tx.tx.QueryContext(ctx, query, likePrefix(keyPrefix))
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
+		var id string
 		var jsonData []byte
-		if err := rows.Scan(&jsonData); err != nil {
+		if err := rows.Scan(&id, &jsonData); err != nil {
 			return err
 		}
 
 		// Unmarshal the object
-		err := json.Unmarshal(jsonData, obj)
+		err := tx.unmarshal(bucketName, []byte(id), jsonData, obj)
 		if err != nil {
 			return err
 		}
@@ -222,4 +798,4 @@ func (tx *DbTransaction) GetAllWithKeyPrefix(bucketName string, keyPrefix []byte
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// recentTxDurations is the number of transaction durations kept for diagnostics
+const recentTxDurations = 100
+
+// durationRing keeps the last recentTxDurations durations
+type durationRing struct {
+	mu     sync.Mutex
+	values [recentTxDurations]time.Duration
+	next   int
+	count  int
+}
+
+func (r *durationRing) add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[r.next] = d
+	r.next = (r.next + 1) % len(r.values)
+	if r.count < len(r.values) {
+		r.count++
+	}
+}
+
+// list returns the durations from the oldest to the most recent
+func (r *durationRing) list() []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	durations := make([]time.Duration, 0, r.count)
+	start := (r.next - r.count + len(r.values)) % len(r.values)
+	for i := 0; i < r.count; i++ {
+		durations = append(durations, r.values[(start+i)%len(r.values)])
+	}
+
+	return durations
+}
+
+// SetTransactionDurationThresholds logs the transactions running for longer than warn as
+// warnings and the ones running for longer than critical as errors, 0 disables a threshold
+func (connection *DbConnection) SetTransactionDurationThresholds(warn, critical time.Duration) {
+	connection.txWarnThreshold.Store(int64(warn))
+	connection.txCriticalThreshold.Store(int64(critical))
+}
+
+// RecentTransactionDurations returns the durations of the last 100 transactions, from the
+// oldest to the most recent
+func (connection *DbConnection) RecentTransactionDurations() []time.Duration {
+	return connection.txDurations.list()
+}
+
+// observeTxDuration records the duration of a transaction since start and logs it when
+// it exceeds a threshold
+func (connection *DbConnection) observeTxDuration(ctx context.Context, operation, table string, start time.Time) {
+	duration := time.Since(start)
+	connection.txDurations.add(duration)
+
+	var level zerolog.Level
+	var threshold time.Duration
+	if critical := time.Duration(connection.txCriticalThreshold.Load()); critical > 0 && duration >= critical {
+		level, threshold = zerolog.ErrorLevel, critical
+	} else if warn := time.Duration(connection.txWarnThreshold.Load()); warn > 0 && duration >= warn {
+		level, threshold = zerolog.WarnLevel, warn
+	} else {
+		return
+	}
+
+	ctxLogger(ctx).WithLevel(level).
+		Str("component", "postgres").
+		Str("operation", operation).
+		Str("table", table).
+		Dur("duration", duration).
+		Dur("threshold", threshold).
+		Msg("long running transaction")
+}
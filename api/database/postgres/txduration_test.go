@@ -0,0 +1,86 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// longTransactionLogs returns the levels of the long running transaction entries written to buf
+func longTransactionLogs(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+
+	var levels []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["message"] == "long running transaction" {
+			levels = append(levels, entry["level"].(string))
+		}
+	}
+
+	return levels
+}
+
+func Test_TransactionDurationThresholds(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	buf := captureLogs(t)
+
+	sleep := func(tx portainer.Transaction) error {
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	}
+
+	for i := 0; i < 4; i++ {
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+	}
+
+	// no thresholds
+	require.NoError(t, conn.UpdateTx(sleep))
+	assert.Empty(t, longTransactionLogs(t, buf))
+
+	conn.SetTransactionDurationThresholds(10*time.Millisecond, time.Minute)
+	require.NoError(t, conn.UpdateTx(sleep))
+	assert.Equal(t, []string{"warn"}, longTransactionLogs(t, buf))
+
+	conn.SetTransactionDurationThresholds(10*time.Millisecond, 20*time.Millisecond)
+	require.NoError(t, conn.ViewTx(sleep))
+	assert.Equal(t, []string{"warn", "error"}, longTransactionLogs(t, buf))
+
+	conn.SetTransactionDurationThresholds(time.Minute, 0)
+	require.NoError(t, conn.ViewTx(sleep))
+	assert.Len(t, longTransactionLogs(t, buf), 2)
+
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	durations := conn.RecentTransactionDurations()
+	require.Len(t, durations, 4)
+	for _, d := range durations {
+		assert.GreaterOrEqual(t, d, 30*time.Millisecond)
+	}
+}
+
+func Test_durationRing(t *testing.T) {
+	var r durationRing
+	assert.Empty(t, r.list())
+
+	for i := 1; i <= recentTxDurations+5; i++ {
+		r.add(time.Duration(i))
+	}
+
+	durations := r.list()
+	require.Len(t, durations, recentTxDurations)
+	assert.Equal(t, time.Duration(6), durations[0])
+	assert.Equal(t, time.Duration(recentTxDurations+5), durations[recentTxDurations-1])
+}
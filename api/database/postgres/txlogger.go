@@ -0,0 +1,47 @@
+package postgres
+
+import (
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+)
+
+// TxOption configures a transaction of UpdateTxWith and ViewTxWith
+type TxOption func(*txConfig)
+
+type txConfig struct {
+	logger *zerolog.Logger
+}
+
+// WithTxLogger makes the transaction log with l instead of the global logger, so that its
+// entries can be told apart from the ones of the concurrent transactions, for example by a
+// correlation ID added to l
+func WithTxLogger(l zerolog.Logger) TxOption {
+	return func(config *txConfig) {
+		config.logger = &l
+	}
+}
+
+// withTxOptions returns the connection making its transactions with opts
+func (connection *DbConnection) withTxOptions(opts []TxOption) *DbConnection {
+	var config txConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	if config.logger == nil {
+		return connection
+	}
+
+	return connection.WithContext(config.logger.WithContext(connection.ctx))
+}
+
+// UpdateTxWith is UpdateTx configured by opts. UpdateTx keeps the signature of
+// portainer.Connection.
+func (connection *DbConnection) UpdateTxWith(fn func(portainer.Transaction) error, opts ...TxOption) error {
+	return connection.withTxOptions(opts).UpdateTx(fn)
+}
+
+// ViewTxWith is ViewTx configured by opts
+func (connection *DbConnection) ViewTxWith(fn func(portainer.Transaction) error, opts ...TxOption) error {
+	return connection.withTxOptions(opts).ViewTx(fn)
+}
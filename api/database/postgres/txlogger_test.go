@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UpdateTxWith_TxLogger(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	global := captureLogs(t)
+
+	// the statements of the two transactions are interleaved
+	mock.MatchExpectationsInOrder(false)
+
+	failure := errors.New("connection reset")
+	for _, table := range []string{"users", "teams"} {
+		mock.ExpectBegin()
+		expectNextIdentifier(mock, table).WillReturnError(failure)
+		mock.ExpectCommit()
+	}
+
+	buffers := map[string]*bytes.Buffer{"users": {}, "teams": {}}
+
+	var wg sync.WaitGroup
+	for table, buf := range buffers {
+		logger := zerolog.New(buf).With().Str("correlation_id", table).Logger()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := conn.UpdateTxWith(func(tx portainer.Transaction) error {
+				tx.GetNextIdentifier(table)
+				return nil
+			}, WithTxLogger(logger))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	for table, buf := range buffers {
+		entries := logEntries(t, buf)
+
+		messages := make([]any, 0, len(entries))
+		for _, entry := range entries {
+			assert.Equal(t, table, entry["correlation_id"], entry["message"])
+			messages = append(messages, entry["message"])
+		}
+
+		assert.Equal(t, []any{"transaction started", "failed to get the next identifier", "transaction ended"}, messages)
+	}
+
+	assert.Empty(t, global.String(), "the transactions logged with the global logger")
+}
+
+func Test_ViewTxWith_TxLogger(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	global := captureLogs(t)
+
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).With().Str("correlation_id", "view").Logger()
+
+	require.NoError(t, conn.ViewTxWith(func(tx portainer.Transaction) error {
+		return nil
+	}, WithTxLogger(logger)))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	entries := logEntries(t, &buf)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, "view", entry["correlation_id"])
+		assert.Equal(t, "ViewTx", entry["operation"])
+	}
+
+	assert.Empty(t, global.String())
+}
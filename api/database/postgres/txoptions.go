@@ -0,0 +1,69 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TxOptions configures the isolation level, access mode and timeouts of a transaction
+type TxOptions struct {
+	// Isolation is the isolation level, sql.LevelDefault keeps the server default (READ COMMITTED)
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+
+	// StatementTimeout and LockTimeout override the timeouts of the connection for the
+	// statements of the transaction, 0 keeps the timeouts of the connection
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+}
+
+// isolationLevels maps the isolation levels supported by PostgreSQL to their SQL name
+var isolationLevels = map[sql.IsolationLevel]string{
+	sql.LevelReadUncommitted: "READ UNCOMMITTED",
+	sql.LevelReadCommitted:   "READ COMMITTED",
+	sql.LevelRepeatableRead:  "REPEATABLE READ",
+	sql.LevelSerializable:    "SERIALIZABLE",
+}
+
+// WithTxOptions sets the transaction options used by UpdateTx and ViewTx
+func WithTxOptions(opts TxOptions) ConnectionOption {
+	return func(connection *DbConnection) {
+		connection.txOptions = opts
+	}
+}
+
+// statement returns the SET TRANSACTION and SET LOCAL statements applying the options,
+// it is empty when the options are the defaults
+func (opts TxOptions) statement() (string, error) {
+	var modes []string
+
+	if opts.Isolation != sql.LevelDefault {
+		level, ok := isolationLevels[opts.Isolation]
+		if !ok {
+			return "", fmt.Errorf("unsupported isolation level %s", opts.Isolation)
+		}
+
+		modes = append(modes, "ISOLATION LEVEL "+level)
+	}
+
+	if opts.ReadOnly {
+		modes = append(modes, "READ ONLY")
+	}
+
+	var statements []string
+	if len(modes) > 0 {
+		statements = append(statements, "SET TRANSACTION "+strings.Join(modes, ", "))
+	}
+
+	if opts.StatementTimeout > 0 {
+		statements = append(statements, fmt.Sprintf("SET LOCAL statement_timeout = %d", opts.StatementTimeout.Milliseconds()))
+	}
+
+	if opts.LockTimeout > 0 {
+		statements = append(statements, fmt.Sprintf("SET LOCAL lock_timeout = %d", opts.LockTimeout.Milliseconds()))
+	}
+
+	return strings.Join(statements, "; "), nil
+}
@@ -0,0 +1,109 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TxOptions_statement(t *testing.T) {
+	tests := []struct {
+		opts     TxOptions
+		expected string
+	}{
+		{TxOptions{}, ""},
+		{TxOptions{Isolation: sql.LevelRepeatableRead}, "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ"},
+		{TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true}, "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY"},
+		{TxOptions{ReadOnly: true}, "SET TRANSACTION READ ONLY"},
+	}
+
+	for _, tc := range tests {
+		statement, err := tc.opts.statement()
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, statement)
+	}
+
+	_, err := TxOptions{Isolation: sql.LevelLinearizable}.statement()
+	assert.Error(t, err)
+}
+
+func Test_UpdateTxWithOptions(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL SERIALIZABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM endpoints WHERE id = $1")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := conn.UpdateTxWithOptions(TxOptions{Isolation: sql.LevelSerializable}, func(tx portainer.Transaction) error {
+		return tx.DeleteObject("endpoints", []byte("1"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateTx_UsesDefaultTxOptions(t *testing.T) {
+	conn, mock := newMockConnection(t)
+	WithTxOptions(TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})(conn)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	require.NoError(t, conn.UpdateTx(func(tx portainer.Transaction) error { return nil }))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_UpdateTxWithOptions_Serializable(t *testing.T) {
+	conn := newTestConnection(t)
+	dropTestTables(t, conn, "serializable_test")
+
+	require.NoError(t, conn.EnsureTableExists(context.Background(), "serializable_test", nil))
+
+	// Each transaction reads the table before inserting the next identifier, which
+	// conflicts with the other transaction under SERIALIZABLE
+	var ready sync.WaitGroup
+	ready.Add(2)
+
+	insert := func() func(portainer.Transaction) error {
+		var once sync.Once
+
+		return func(tx portainer.Transaction) error {
+			id := tx.GetNextIdentifier("serializable_test")
+
+			once.Do(func() {
+				ready.Done()
+				ready.Wait()
+			})
+
+			return tx.CreateObjectWithId("serializable_test", id, map[string]any{"ID": id})
+		}
+	}
+
+	opts := TxOptions{Isolation: sql.LevelSerializable}
+	errs := make(chan error, 2)
+	go func() { errs <- conn.UpdateTxWithOptions(opts, insert()) }()
+	go func() { errs <- conn.UpdateTxWithOptions(opts, insert()) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+		case <-time.After(30 * time.Second):
+			t.Fatal("the transactions did not complete")
+		}
+	}
+
+	var ids []int
+	require.NoError(t, conn.Select(&ids, "SELECT id FROM serializable_test ORDER BY id"))
+	assert.Equal(t, []int{1, 2}, ids)
+	assert.NotZero(t, conn.TxRetries())
+}
@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/portainer/portainer/api/database/models"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+)
+
+const (
+	// versionBucket holds the Portainer version under versionKey, its keys are text
+	versionBucket = "version"
+	versionKey    = "VERSION"
+)
+
+// tableExists returns whether the table of a bucket exists in the schema of the connection
+func (connection *DbConnection) tableExists(ctx context.Context, q sqlx.QueryerContext, bucketName string) (bool, error) {
+	var exists bool
+	query := `
+		SELECT EXISTS (
+			SELECT FROM information_schema.tables
+			WHERE table_schema = current_schema()
+			AND table_name = $1
+		);`
+	err := sqlx.GetContext(ctx, q, &exists, query, connection.table(bucketName))
+
+	return exists, err
+}
+
+// IsNew returns true when the database was never initialized by Portainer, that is when it holds
+// neither a bucket nor the metadata marking an encrypted or an unencrypted store
+func (connection *DbConnection) IsNew() (isNew bool, err error) {
+	ctx, end := connection.startSpan(connection.ctx, "IsNew", "")
+	defer func() { end(err) }()
+
+	if connection.DB == nil {
+		return false, ErrNoConnection
+	}
+
+	buckets, err := connection.listBuckets(ctx, connection.DB)
+	if err != nil {
+		return false, err
+	}
+
+	if len(buckets) > 0 {
+		return false, nil
+	}
+
+	for _, marker := range []string{UnencryptedMetadataTable, EncryptedMetadataTable} {
+		exists, err := connection.tableExists(ctx, connection.DB, marker)
+		if err != nil {
+			return false, fmt.Errorf("failed to check %s table: %w", marker, err)
+		}
+
+		if exists {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// GetVersion reads the Portainer version from the version bucket, it returns
+// dserrors.ErrObjectNotFound when no version was stored yet
+func (connection *DbConnection) GetVersion() (version *models.Version, err error) {
+	err = connection.tracedViewTx("GetVersion", versionBucket, func(tx *DbTransaction) error {
+		version, err = tx.version()
+		return err
+	})
+
+	return version, err
+}
+
+// StoreVersion writes the Portainer version to the version bucket, which is created with text
+// keys when it does not exist yet
+func (connection *DbConnection) StoreVersion(version *models.Version) error {
+	return connection.tracedTx("StoreVersion", versionBucket, connection.txOptions, func(tx *DbTransaction) error {
+		return tx.storeVersion(version)
+	})
+}
+
+// version reads the Portainer version within the transaction, the schema migrations reach it
+// and storeVersion through asDbTransaction
+func (tx *DbTransaction) version() (*models.Version, error) {
+	ctx, end := tx.startSpan("GetVersion", versionBucket)
+	exists, err := tx.conn.tableExists(ctx, tx.tx, versionBucket)
+	end(err)
+
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("%w (bucket=%s, key=%s)", dserrors.ErrObjectNotFound, versionBucket, versionKey)
+	}
+
+	var version models.Version
+	if err := tx.GetObject(versionBucket, []byte(versionKey), &version); err != nil {
+		return nil, err
+	}
+
+	return &version, nil
+}
+
+// storeVersion writes version to the version bucket within the transaction
+func (tx *DbTransaction) storeVersion(version *models.Version) error {
+	if err := tx.SetServiceNameWithKeyType(versionBucket, KeyTypeText); err != nil {
+		return err
+	}
+
+	_, err := tx.version()
+	if errors.Is(err, dserrors.ErrObjectNotFound) {
+		return tx.CreateObjectWithStringId(versionBucket, []byte(versionKey), version)
+	} else if err != nil {
+		return err
+	}
+
+	return tx.UpdateObject(versionBucket, []byte(versionKey), version)
+}
@@ -0,0 +1,126 @@
+package postgres
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/portainer/portainer/api/database/models"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func expectTableExists(mock sqlmock.Sqlmock, table string, exists bool) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS")).WithArgs(table).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+}
+
+func Test_IsNew(t *testing.T) {
+	t.Run("fresh database", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		expectManagedTables(mock)
+		expectTableExists(mock, UnencryptedMetadataTable, false)
+		expectTableExists(mock, EncryptedMetadataTable, false)
+
+		isNew, err := conn.IsNew()
+		require.NoError(t, err)
+		assert.True(t, isNew)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("database with buckets", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		expectManagedTables(mock, "endpoints", "version")
+
+		isNew, err := conn.IsNew()
+		require.NoError(t, err)
+		assert.False(t, isNew)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("database with a metadata marker", func(t *testing.T) {
+		conn, mock := newMockConnection(t)
+
+		expectManagedTables(mock)
+		expectTableExists(mock, UnencryptedMetadataTable, false)
+		expectTableExists(mock, EncryptedMetadataTable, true)
+
+		isNew, err := conn.IsNew()
+		require.NoError(t, err)
+		assert.False(t, isNew)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no connection", func(t *testing.T) {
+		_, err := (&DbConnection{}).IsNew()
+		require.ErrorIs(t, err, ErrNoConnection)
+	})
+}
+
+func Test_GetVersion_NotFound(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	expectTableExists(mock, versionBucket, false)
+	mock.ExpectRollback()
+
+	_, err := conn.GetVersion()
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_Version_RealDatabase(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		name := "unencrypted"
+		if encrypted {
+			name = "encrypted"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			schema := "portainer_version_test_" + name
+
+			conn := newTestConnection(t, WithSchema(schema))
+			t.Cleanup(func() {
+				if _, err := conn.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE"); err != nil {
+					t.Errorf("failed to drop schema %s: %v", schema, err)
+				}
+			})
+
+			if encrypted {
+				conn.EncryptionKey = secretToEncryptionKey("version-passphrase")
+			}
+
+			isNew, err := conn.IsNew()
+			require.NoError(t, err)
+			assert.True(t, isNew)
+
+			_, err = conn.GetVersion()
+			require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+
+			version := &models.Version{SchemaVersion: "2.21.0", Edition: 1, InstanceID: "instance"}
+			require.NoError(t, conn.StoreVersion(version))
+
+			got, err := conn.GetVersion()
+			require.NoError(t, err)
+			assert.Equal(t, version, got)
+
+			version.SchemaVersion = "2.22.0"
+			require.NoError(t, conn.StoreVersion(version))
+
+			got, err = conn.GetVersion()
+			require.NoError(t, err)
+			assert.Equal(t, "2.22.0", got.SchemaVersion)
+
+			isNew, err = conn.IsNew()
+			require.NoError(t, err)
+			assert.False(t, isNew)
+
+			needed, err := conn.NeedsEncryptionMigration()
+			require.NoError(t, err)
+			assert.False(t, needed)
+		})
+	}
+}
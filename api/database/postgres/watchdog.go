@@ -0,0 +1,232 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrTransactionAborted is returned by the transactions rolled back by the watchdog once they
+// were open for longer than the hard limit set by SetTransactionHardLimit
+var ErrTransactionAborted = errors.New("the transaction was open for too long and was aborted")
+
+const (
+	minWatchdogInterval = 5 * time.Millisecond
+	maxWatchdogInterval = time.Second
+)
+
+// packageDir is the directory of the package, its frames are skipped to find the caller of a
+// transaction
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+
+	return filepath.Dir(file)
+}()
+
+// ActiveTransaction describes a transaction in progress
+type ActiveTransaction struct {
+	ID uint64
+	// Caller is the function outside of the package which began the transaction, with its
+	// file and line
+	Caller    string
+	StartedAt time.Time
+	Duration  time.Duration
+}
+
+// openTx is the entry of a transaction in the watchdog
+type openTx struct {
+	ctx       context.Context
+	id        uint64
+	caller    string
+	startedAt time.Time
+	cancel    context.CancelCauseFunc
+
+	warned  atomic.Bool
+	logged  atomic.Bool
+	aborted atomic.Bool
+}
+
+// SetTransactionHardLimit makes the watchdog abort the transactions open for longer than
+// limit: their context is canceled, which rolls them back, and they fail with
+// ErrTransactionAborted. 0 disables the limit.
+func (connection *DbConnection) SetTransactionHardLimit(limit time.Duration) {
+	connection.txHardLimit.Store(int64(limit))
+}
+
+// ActiveTransactions returns the transactions in progress, from the oldest to the most recent
+func (connection *DbConnection) ActiveTransactions() []ActiveTransaction {
+	var active []ActiveTransaction
+	connection.openTxs.Range(func(_, value any) bool {
+		open := value.(*openTx)
+		active = append(active, ActiveTransaction{
+			ID:        open.id,
+			Caller:    open.caller,
+			StartedAt: open.startedAt,
+			Duration:  time.Since(open.startedAt),
+		})
+
+		return true
+	})
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].StartedAt.Before(active[j].StartedAt)
+	})
+
+	return active
+}
+
+// registerTx adds a transaction carried by ctx to the watchdog, which is started when it is not
+// running. cancel aborts the transaction.
+func (connection *DbConnection) registerTx(ctx context.Context, cancel context.CancelCauseFunc) *openTx {
+	open := &openTx{
+		ctx:       ctx,
+		id:        connection.nextTxID.Add(1),
+		caller:    txCaller(),
+		startedAt: time.Now(),
+		cancel:    cancel,
+	}
+	connection.openTxs.Store(open.id, open)
+
+	if connection.watchdogRunning.CompareAndSwap(false, true) {
+		go connection.watchTransactions()
+	}
+
+	return open
+}
+
+// release removes the transaction from the watchdog once it is over
+func (tx *DbTransaction) release() {
+	if tx.watched == nil {
+		return
+	}
+
+	tx.conn.openTxs.Delete(tx.watched.id)
+	tx.watched.cancel(nil)
+}
+
+// txCaller returns the first function outside of the package in the call stack
+func txCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+
+	for {
+		frame, more := frames.Next()
+		if filepath.Dir(frame.File) != packageDir || strings.HasSuffix(frame.File, "_test.go") {
+			return fmt.Sprintf("%s (%s:%d)", frame.Function, filepath.Base(frame.File), frame.Line)
+		}
+
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// watchdogInterval returns the interval between two checks of the transactions in progress,
+// a fraction of the shortest threshold
+func (connection *DbConnection) watchdogInterval() time.Duration {
+	interval := maxWatchdogInterval
+	for _, threshold := range []int64{
+		connection.txWarnThreshold.Load(),
+		connection.txCriticalThreshold.Load(),
+		connection.txHardLimit.Load(),
+	} {
+		if threshold > 0 {
+			interval = min(interval, time.Duration(threshold)/4)
+		}
+	}
+
+	return max(interval, minWatchdogInterval)
+}
+
+// watchTransactions checks the transactions in progress until there is none left
+func (connection *DbConnection) watchTransactions() {
+	for {
+		time.Sleep(connection.watchdogInterval())
+
+		if connection.checkTransactions() > 0 {
+			continue
+		}
+
+		// a transaction registered while stopping starts its own watchdog unless this one is still running
+		connection.watchdogRunning.Store(false)
+		if connection.countTransactions() == 0 || !connection.watchdogRunning.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// countTransactions returns the number of transactions in progress
+func (connection *DbConnection) countTransactions() int {
+	count := 0
+	connection.openTxs.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+
+	return count
+}
+
+// checkTransactions logs the transactions in progress past the duration thresholds and aborts
+// the ones past the hard limit, it returns the number of transactions in progress
+func (connection *DbConnection) checkTransactions() int {
+	warn := time.Duration(connection.txWarnThreshold.Load())
+	critical := time.Duration(connection.txCriticalThreshold.Load())
+	hardLimit := time.Duration(connection.txHardLimit.Load())
+
+	count := 0
+	connection.openTxs.Range(func(_, value any) bool {
+		count++
+
+		open := value.(*openTx)
+		duration := time.Since(open.startedAt)
+
+		if warn > 0 && duration >= warn && open.warned.CompareAndSwap(false, true) {
+			open.log(zerolog.WarnLevel, duration, warn, "transaction still open")
+		}
+
+		if critical > 0 && duration >= critical && open.logged.CompareAndSwap(false, true) {
+			open.log(zerolog.ErrorLevel, duration, critical, "transaction still open")
+		}
+
+		if hardLimit > 0 && duration >= hardLimit && open.aborted.CompareAndSwap(false, true) {
+			open.log(zerolog.ErrorLevel, duration, hardLimit, "aborting the transaction open for too long")
+			open.cancel(fmt.Errorf("%w: it was open for more than %s", ErrTransactionAborted, hardLimit))
+		}
+
+		return true
+	})
+
+	return count
+}
+
+func (open *openTx) log(level zerolog.Level, duration, threshold time.Duration, msg string) {
+	ctxLogger(open.ctx).WithLevel(level).
+		Str("component", "postgres").
+		Uint64("transaction", open.id).
+		Str("caller", open.caller).
+		Dur("duration", duration).
+		Dur("threshold", threshold).
+		Msg(msg)
+}
+
+// abortedError wraps err into the cause of the cancellation of the context of a transaction
+// aborted by the watchdog
+func abortedError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrTransactionAborted) {
+		return err
+	}
+
+	if cause := context.Cause(ctx); errors.Is(cause, ErrTransactionAborted) {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+
+	return err
+}
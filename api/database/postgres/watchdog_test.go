@@ -0,0 +1,189 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	portainer "github.com/portainer/portainer/api"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logChannel is a log writer sending the decoded entries to a channel, the watchdog logs from
+// its own goroutine
+type logChannel chan map[string]any
+
+func (entries logChannel) Write(p []byte) (int, error) {
+	var entry map[string]any
+	if err := json.Unmarshal(p, &entry); err != nil {
+		return 0, err
+	}
+
+	entries <- entry
+
+	return len(p), nil
+}
+
+// watchdogLogs returns the entries logged during the test
+func watchdogLogs(t *testing.T) logChannel {
+	t.Helper()
+
+	entries := make(logChannel, 100)
+	logger := log.Logger
+	log.Logger = zerolog.New(entries)
+	t.Cleanup(func() {
+		log.Logger = logger
+	})
+
+	return entries
+}
+
+// nextLog returns the next entry with msg, it fails the test when it is not logged within a second
+func nextLog(t *testing.T, entries logChannel, msg string) map[string]any {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case entry := <-entries:
+			if entry["message"] == msg {
+				return entry
+			}
+		case <-timeout:
+			t.Fatalf("%q was not logged", msg)
+		}
+	}
+}
+
+func Test_Watchdog_LogsLongTransaction(t *testing.T) {
+	entries := watchdogLogs(t)
+
+	conn, mock := newMockConnection(t)
+	conn.SetTransactionDurationThresholds(20*time.Millisecond, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM slow_bucket WHERE id = $1")).WithArgs(1).
+		WillDelayFor(200 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{}`)))
+	mock.ExpectCommit()
+
+	errs := make(chan error, 1)
+	go func() {
+		var object map[string]any
+		errs <- conn.GetObject("slow_bucket", conn.ConvertToKey(1), &object)
+	}()
+
+	entry := nextLog(t, entries, "transaction still open")
+	assert.Equal(t, "warn", entry["level"])
+	assert.Contains(t, entry["caller"], "Test_Watchdog_LogsLongTransaction")
+
+	require.NoError(t, <-errs)
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, conn.ActiveTransactions())
+}
+
+func Test_Watchdog_HardLimitAbortsTransaction(t *testing.T) {
+	entries := watchdogLogs(t)
+
+	conn, mock := newMockConnection(t)
+	conn.SetTransactionHardLimit(50 * time.Millisecond)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM slow_bucket WHERE id = $1")).WithArgs(1).
+		WillDelayFor(time.Minute).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte(`{}`)))
+	mock.ExpectRollback()
+
+	start := time.Now()
+
+	var object map[string]any
+	err := conn.GetObject("slow_bucket", conn.ConvertToKey(1), &object)
+	require.ErrorIs(t, err, ErrTransactionAborted)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	nextLog(t, entries, "aborting the transaction open for too long")
+
+	// database/sql rolls the transaction back in the background once its context is canceled
+	require.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, conn.ActiveTransactions())
+}
+
+func Test_Watchdog_HardLimitAbortsManualTransaction(t *testing.T) {
+	watchdogLogs(t)
+
+	conn, mock := newMockConnection(t)
+	conn.SetTransactionHardLimit(20 * time.Millisecond)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	_, commit, _, err := conn.BeginTransaction(context.Background(), TxOptions{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, time.Second, 10*time.Millisecond)
+
+	require.ErrorIs(t, commit(), ErrTransactionAborted)
+	assert.Empty(t, conn.ActiveTransactions())
+}
+
+func Test_ActiveTransactions(t *testing.T) {
+	watchdogLogs(t)
+
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	mock.ExpectRollback()
+
+	var rollbacks []RollbackFn
+	for range 2 {
+		_, _, rollback, err := conn.BeginTransaction(context.Background(), TxOptions{})
+		require.NoError(t, err)
+
+		rollbacks = append(rollbacks, rollback)
+	}
+
+	active := conn.ActiveTransactions()
+	require.Len(t, active, 2)
+	assert.Less(t, active[0].ID, active[1].ID)
+	assert.False(t, active[1].StartedAt.Before(active[0].StartedAt))
+
+	for _, tx := range active {
+		assert.True(t, strings.HasPrefix(tx.Caller, "github.com/portainer/portainer/api/database/postgres.Test_ActiveTransactions"), tx.Caller)
+		assert.Contains(t, tx.Caller, "watchdog_test.go")
+	}
+
+	for _, rollback := range rollbacks {
+		require.NoError(t, rollback())
+	}
+
+	assert.Empty(t, conn.ActiveTransactions())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_ActiveTransactions_ReleasedOnPanic(t *testing.T) {
+	conn, mock := newMockConnection(t)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	assert.Panics(t, func() {
+		conn.UpdateTx(func(tx portainer.Transaction) error {
+			panic("boom")
+		})
+	})
+
+	assert.Empty(t, conn.ActiveTransactions())
+}
@@ -0,0 +1,311 @@
+// Package conformance holds the test suite that every implementation of portainer.Connection
+// must pass, so that the database backends behave alike.
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	portainer "github.com/portainer/portainer/api"
+	"github.com/portainer/portainer/api/database/models"
+	"github.com/portainer/portainer/api/dataservices"
+	dserrors "github.com/portainer/portainer/api/dataservices/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// ObjectsBucket holds the objects with integer keys used by the suite
+	ObjectsBucket = "conformance_objects"
+	// SequenceBucket holds the objects created concurrently by the suite
+	SequenceBucket = "conformance_sequence"
+	// StringKeysBucket holds the objects with string keys used by the suite, the backends which
+	// need the key type of a bucket to be declared must declare it before RunConnectionTests
+	StringKeysBucket = "conformance_string_keys"
+
+	versionBucket = "version"
+	versionKey    = "VERSION"
+
+	concurrentCreations = 10
+)
+
+type object struct {
+	ID   int      `json:"Id"`
+	Name string   `json:"Name"`
+	Tags []string `json:"Tags,omitempty"`
+}
+
+// RunConnectionTests runs the conformance suite against an open connection. The buckets of the
+// suite are emptied before use, the version bucket is overwritten.
+func RunConnectionTests(t *testing.T, conn portainer.Connection) {
+	t.Helper()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		for _, bucket := range []string{ObjectsBucket, SequenceBucket, StringKeysBucket, versionBucket} {
+			if err := tx.SetServiceName(bucket); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Run("CRUD", func(t *testing.T) { testCRUD(t, conn) })
+	t.Run("GetAll allocates a fresh object for each row", func(t *testing.T) { testGetAll(t, conn) })
+	t.Run("GetAllWithKeyPrefix", func(t *testing.T) { testKeyPrefix(t, conn) })
+	t.Run("not found", func(t *testing.T) { testNotFound(t, conn) })
+	t.Run("duplicate keys", func(t *testing.T) { testDuplicateKeys(t, conn) })
+	t.Run("read-only views", func(t *testing.T) { testReadOnlyView(t, conn) })
+	t.Run("concurrent sequence", func(t *testing.T) { testConcurrentSequence(t, conn) })
+	t.Run("version bucket", func(t *testing.T) { testVersionBucket(t, conn) })
+}
+
+// emptyBucket removes the objects with integer keys of a bucket
+func emptyBucket(t *testing.T, conn portainer.Connection, bucket string) {
+	t.Helper()
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.DeleteAllObjects(bucket, object{}, func(o any) (int, bool) {
+			return o.(object).ID, true
+		})
+	})
+	require.NoError(t, err)
+}
+
+func testCRUD(t *testing.T, conn portainer.Connection) {
+	emptyBucket(t, conn, ObjectsBucket)
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		return tx.CreateObjectWithId(ObjectsBucket, 1, object{ID: 1, Name: "created"})
+	})
+	require.NoError(t, err)
+
+	var got object
+	require.NoError(t, conn.GetObject(ObjectsBucket, conn.ConvertToKey(1), &got))
+	assert.Equal(t, object{ID: 1, Name: "created"}, got)
+
+	require.NoError(t, conn.UpdateObject(ObjectsBucket, conn.ConvertToKey(1), object{ID: 1, Name: "updated"}))
+	require.NoError(t, conn.GetObject(ObjectsBucket, conn.ConvertToKey(1), &got))
+	assert.Equal(t, "updated", got.Name)
+
+	err = conn.UpdateObjectFunc(ObjectsBucket, conn.ConvertToKey(1), &got, func() {
+		got.Tags = []string{"func"}
+	})
+	require.NoError(t, err)
+
+	var updated object
+	require.NoError(t, conn.GetObject(ObjectsBucket, conn.ConvertToKey(1), &updated))
+	assert.Equal(t, []string{"func"}, updated.Tags)
+
+	require.NoError(t, conn.DeleteObject(ObjectsBucket, conn.ConvertToKey(1)))
+	err = conn.GetObject(ObjectsBucket, conn.ConvertToKey(1), &got)
+	assert.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+}
+
+func testGetAll(t *testing.T, conn portainer.Connection) {
+	emptyBucket(t, conn, ObjectsBucket)
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.CreateObjectWithId(ObjectsBucket, 1, object{ID: 1, Name: "first", Tags: []string{"tagged"}}); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithId(ObjectsBucket, 2, object{ID: 2, Name: "second"})
+	})
+	require.NoError(t, err)
+
+	var objects []object
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetAll(ObjectsBucket, &object{}, dataservices.AppendFn(&objects))
+	})
+	require.NoError(t, err)
+
+	// the fields of the first object must not leak into the second one, the objects come in key order
+	assert.Equal(t, []object{
+		{ID: 1, Name: "first", Tags: []string{"tagged"}},
+		{ID: 2, Name: "second"},
+	}, objects)
+
+	var first object
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetAll(ObjectsBucket, &object{}, dataservices.FirstFn(&first, func(o object) bool { return true }))
+	})
+	require.ErrorIs(t, err, dataservices.ErrStop)
+	assert.Equal(t, 1, first.ID)
+}
+
+func testKeyPrefix(t *testing.T, conn portainer.Connection) {
+	keys := []string{"5.edge.async", "5.edge.sync", "50.edge.async", "6.edge.async"}
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		for i, key := range keys {
+			if err := tx.DeleteObject(StringKeysBucket, []byte(key)); err != nil {
+				return err
+			}
+
+			if err := tx.CreateObjectWithStringId(StringKeysBucket, []byte(key), object{ID: i, Name: key}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	var objects []object
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetAllWithKeyPrefix(StringKeysBucket, []byte("5.edge."), &object{}, dataservices.AppendFn(&objects))
+	})
+	require.NoError(t, err)
+
+	names := make([]string, 0, len(objects))
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+	assert.Equal(t, []string{"5.edge.async", "5.edge.sync"}, names)
+
+	objects = nil
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetAllWithKeyPrefix(StringKeysBucket, []byte("7."), &object{}, dataservices.AppendFn(&objects))
+	})
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func testNotFound(t *testing.T, conn portainer.Connection) {
+	emptyBucket(t, conn, ObjectsBucket)
+
+	var got object
+	err := conn.GetObject(ObjectsBucket, conn.ConvertToKey(404), &got)
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+	assert.True(t, dataservices.IsErrObjectNotFound(err))
+
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetObject(StringKeysBucket, []byte("missing"), &got)
+	})
+	require.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+
+	// deleting a missing object is not an error
+	require.NoError(t, conn.DeleteObject(ObjectsBucket, conn.ConvertToKey(404)))
+}
+
+func testDuplicateKeys(t *testing.T, conn portainer.Connection) {
+	emptyBucket(t, conn, ObjectsBucket)
+
+	create := func(name string) error {
+		return conn.UpdateTx(func(tx portainer.Transaction) error {
+			return tx.CreateObjectWithId(ObjectsBucket, 1, object{ID: 1, Name: name})
+		})
+	}
+
+	require.NoError(t, create("original"))
+
+	err := create("duplicate")
+	require.ErrorIs(t, err, dserrors.ErrAlreadyExists)
+	assert.True(t, dataservices.IsErrAlreadyExists(err))
+
+	// the failed creation leaves the original object untouched
+	var got object
+	require.NoError(t, conn.GetObject(ObjectsBucket, conn.ConvertToKey(1), &got))
+	assert.Equal(t, "original", got.Name)
+}
+
+func testReadOnlyView(t *testing.T, conn portainer.Connection) {
+	emptyBucket(t, conn, ObjectsBucket)
+
+	writes := map[string]func(tx portainer.Transaction) error{
+		"CreateObjectWithId": func(tx portainer.Transaction) error {
+			return tx.CreateObjectWithId(ObjectsBucket, 1, object{ID: 1})
+		},
+		"UpdateObject": func(tx portainer.Transaction) error {
+			return tx.UpdateObject(ObjectsBucket, conn.ConvertToKey(1), object{ID: 1})
+		},
+		"DeleteObject": func(tx portainer.Transaction) error {
+			return tx.DeleteObject(ObjectsBucket, conn.ConvertToKey(1))
+		},
+	}
+
+	for name, write := range writes {
+		err := conn.ViewTx(write)
+		assert.Error(t, err, "%s must be rejected in a read-only view", name)
+	}
+
+	var got object
+	err := conn.GetObject(ObjectsBucket, conn.ConvertToKey(1), &got)
+	assert.ErrorIs(t, err, dserrors.ErrObjectNotFound)
+}
+
+func testConcurrentSequence(t *testing.T, conn portainer.Connection) {
+	emptyBucket(t, conn, SequenceBucket)
+
+	var mu sync.Mutex
+	ids := make(map[int]bool)
+	errs := make([]error, concurrentCreations)
+
+	var wg sync.WaitGroup
+	for i := range concurrentCreations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			errs[i] = conn.UpdateTx(func(tx portainer.Transaction) error {
+				return tx.CreateObject(SequenceBucket, func(id uint64) (int, any) {
+					mu.Lock()
+					ids[int(id)] = true
+					mu.Unlock()
+
+					return int(id), object{ID: int(id)}
+				})
+			})
+		}()
+	}
+	wg.Wait()
+
+	require.NoError(t, errors.Join(errs...))
+	assert.Len(t, ids, concurrentCreations, "the identifiers must be unique")
+
+	var objects []object
+	err := conn.ViewTx(func(tx portainer.Transaction) error {
+		return tx.GetAll(SequenceBucket, &object{}, dataservices.AppendFn(&objects))
+	})
+	require.NoError(t, err)
+	assert.Len(t, objects, concurrentCreations)
+
+	next := 0
+	err = conn.ViewTx(func(tx portainer.Transaction) error {
+		next = tx.GetNextIdentifier(SequenceBucket)
+		return nil
+	})
+	require.NoError(t, err)
+
+	for id := range ids {
+		assert.Greater(t, next, id, "the next identifier must come after the existing ones")
+	}
+}
+
+func testVersionBucket(t *testing.T, conn portainer.Connection) {
+	version := &models.Version{SchemaVersion: "2.21.0", Edition: int(portainer.PortainerCE), InstanceID: "conformance"}
+
+	err := conn.UpdateTx(func(tx portainer.Transaction) error {
+		if err := tx.DeleteObject(versionBucket, []byte(versionKey)); err != nil {
+			return err
+		}
+
+		return tx.CreateObjectWithStringId(versionBucket, []byte(versionKey), version)
+	})
+	require.NoError(t, err)
+
+	var got models.Version
+	require.NoError(t, conn.GetObject(versionBucket, []byte(versionKey), &got))
+	assert.Equal(t, *version, got)
+
+	version.SchemaVersion = "2.22.0"
+	version.MigratorCount = 3
+	require.NoError(t, conn.UpdateObject(versionBucket, []byte(versionKey), version))
+
+	require.NoError(t, conn.GetObject(versionBucket, []byte(versionKey), &got))
+	assert.Equal(t, *version, got)
+}
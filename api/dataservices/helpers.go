@@ -16,6 +16,14 @@ func IsErrObjectNotFound(e error) bool {
 	return errors.Is(e, perrors.ErrObjectNotFound)
 }
 
+func IsErrAlreadyExists(e error) bool {
+	return errors.Is(e, perrors.ErrAlreadyExists)
+}
+
+func IsErrDatabaseUnavailable(e error) bool {
+	return errors.Is(e, perrors.ErrDatabaseUnavailable)
+}
+
 // AppendFn appends elements to the given collection slice
 func AppendFn[T any](collection *[]T) func(obj any) (any, error) {
 	return func(obj any) (any, error) {